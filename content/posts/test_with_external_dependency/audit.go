@@ -0,0 +1,334 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditCollection is the collection of the users database WithAuditing writes
+// the audit trail to.
+const AuditCollection = "user_audit"
+
+var (
+	ErrAuditing          = errors.New("error writing audit entry")
+	ErrListingAuditTrail = errors.New("error listing audit entries")
+)
+
+// AuditCaller is the part of *mongo.Collection the audit trail is written and
+// read with.
+type AuditCaller interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+		*mongo.InsertOneResult, error)
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+}
+
+var _ AuditCaller = (*mongo.Collection)(nil)
+
+type actorKey struct{}
+
+// WithActor returns ctx telling that actor, such as the ID of the signed-in
+// user or the name of a job, makes the mutations called with it. The audit
+// entries of the mutations record it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor, or an empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditEntry records a mutation of a user, as written by a repo given
+// WithAuditing.
+type AuditEntry struct {
+	ID primitive.ObjectID
+	// Operation is the repo method which made the mutation, such as
+	// "UpdateUser".
+	Operation string
+	UserID    primitive.ObjectID
+	// Actor is the one given to the context of the mutation with WithActor,
+	// empty if none was.
+	Actor string
+	// Tenant is the one the mutation was made under, empty if none was.
+	Tenant    string
+	Timestamp time.Time
+	// Changes lists the fields the mutation changed, in the order of
+	// auditedFields. It is empty for deletes.
+	Changes []FieldChange
+}
+
+// FieldChange is the change of a field of a user. Old is empty for a field the
+// user didn't have, New for one it lost. The values of the password are never
+// recorded, nor the ones of the email when emails are encrypted: only the
+// field tells it changed.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// auditedFields are the fields of the users whose changes are recorded. The
+// version and updated_at change on every update and tell nothing more.
+var auditedFields = []string{"name", "email", "password", "role", "deleted_at", "expires_at", "email_verified"}
+
+// auditDocument is how an AuditEntry is stored.
+type auditDocument struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Operation string             `bson:"operation"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Actor     string             `bson:"actor,omitempty"`
+	Tenant    string             `bson:"tenant,omitempty"`
+	Timestamp time.Time          `bson:"timestamp"`
+	Changes   []auditChange      `bson:"changes,omitempty"`
+}
+
+type auditChange struct {
+	Field string `bson:"field"`
+	Old   string `bson:"old,omitempty"`
+	New   string `bson:"new,omitempty"`
+}
+
+// auditSnapshot is a user as read before a mutation, for the audit entry to
+// tell what the mutation changed.
+type auditSnapshot struct {
+	user *User
+	// skip is set when the user couldn't be read, the mutation isn't audited
+	// then.
+	skip bool
+}
+
+// snapshot reads the user matching filter before a mutation. The user is nil
+// when there is none, as before a create. A failure to read it is handled as
+// a failure to audit.
+func (m *MongoRepo) snapshot(ctx context.Context, op string, filter bson.M) (auditSnapshot, error) {
+	if m.auditLog == nil {
+		return auditSnapshot{}, nil
+	}
+
+	user, err := m.auditedUser(ctx, filter)
+	if err != nil {
+		return auditSnapshot{skip: true}, m.auditFailed(ctx, op, primitive.NilObjectID, err)
+	}
+
+	return auditSnapshot{user: user}, nil
+}
+
+// audit records the mutation op made on the user matching filter, which was
+// before as read by snapshot. The user is read again to tell what changed, so
+// a concurrent write between the reads shows in the entry too.
+func (m *MongoRepo) audit(ctx context.Context, op string, filter bson.M, before auditSnapshot) error {
+	if m.auditLog == nil || before.skip {
+		return nil
+	}
+
+	after, err := m.auditedUser(ctx, filter)
+	if err != nil {
+		return m.auditFailed(ctx, op, primitive.NilObjectID, err)
+	}
+
+	return m.writeAudit(ctx, op, before.user, after)
+}
+
+// writeAudit records the mutation op which changed a user from before to
+// after. before is nil for a create, after for a delete.
+func (m *MongoRepo) writeAudit(ctx context.Context, op string, before, after *User) error {
+	if m.auditLog == nil {
+		return nil
+	}
+
+	doc := auditDocument{
+		ID:        primitive.NewObjectID(),
+		Operation: op,
+		Actor:     ActorFromContext(ctx),
+		Tenant:    TenantFromContext(ctx),
+		Timestamp: m.timestamp(),
+	}
+
+	switch {
+	case after != nil:
+		doc.UserID = after.ID
+	case before != nil:
+		doc.UserID = before.ID
+	default:
+		// Deleted or changed by someone else before it was read again.
+		return m.auditFailed(ctx, op, primitive.NilObjectID, errors.New("user not found"))
+	}
+
+	if after != nil {
+		doc.Changes = m.auditChanges(before, after)
+	}
+
+	_, err := m.auditLog.InsertOne(ctx, &doc)
+	if err != nil {
+		return m.auditFailed(ctx, op, doc.UserID, err)
+	}
+
+	return nil
+}
+
+// auditedUser returns the user matching filter, on its ID or email, with its
+// password hash, or nil when there is none.
+func (m *MongoRepo) auditedUser(ctx context.Context, filter bson.M) (*User, error) {
+	var doc userDocument
+
+	_, byEmail := filter["email"]
+
+	err := m.mongoCaller.FindOne(ctx, filter, options.FindOne().SetCollation(m.emailCollation(byEmail))).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.decode(&doc)
+}
+
+// auditChanges lists the auditedFields which differ between before, nil for a
+// new user, and after.
+func (m *MongoRepo) auditChanges(before, after *User) []auditChange {
+	if before == nil {
+		before = &User{}
+	}
+
+	var changes []auditChange
+
+	for _, field := range auditedFields {
+		old, updated := auditValue(before, field), auditValue(after, field)
+		if old == updated {
+			continue
+		}
+
+		if field == "password" || (field == "email" && m.fields != nil) {
+			old, updated = "", ""
+		}
+
+		changes = append(changes, auditChange{Field: field, Old: old, New: updated})
+	}
+
+	return changes
+}
+
+func auditValue(user *User, field string) string {
+	switch field {
+	case "name":
+		return user.Name
+	case "email":
+		return user.Email
+	case "password":
+		return user.Password
+	case "role":
+		return user.Role
+	case "deleted_at":
+		return auditTime(user.DeletedAt)
+	case "expires_at":
+		return auditTime(user.ExpiresAt)
+	case "email_verified":
+		if user.EmailVerified {
+			return "true"
+		}
+
+		return ""
+	default:
+		return ""
+	}
+}
+
+func auditTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// auditFailed handles the failure to audit the mutation op of the user id: it
+// is logged and counted, and returned wrapping ErrAuditing if the repo was
+// given StrictAuditing, though the mutation is applied.
+func (m *MongoRepo) auditFailed(ctx context.Context, op string, id primitive.ObjectID, err error) error {
+	if m.metrics != nil {
+		m.metrics.auditFailures.WithLabelValues(op).Inc()
+	}
+
+	if m.strictAudit {
+		return fmt.Errorf("%w: %s of %s: %w", ErrAuditing, op, id.Hex(), err)
+	}
+
+	if m.logger != nil {
+		m.logger.LogAttrs(ctx, slog.LevelWarn, "writing audit entry failed",
+			slog.String("op", op),
+			slog.String("user_id", id.Hex()),
+			slog.String("error", redact(err.Error())))
+	}
+
+	return nil
+}
+
+// ListAuditEntries returns up to limit audit entries of the user with this id,
+// the most recent first, recorded under the tenant of ctx. The limit is bounded
+// as in ListUsers. It fails with ErrListingAuditTrail when the repo wasn't
+// given WithAuditing.
+func (m *MongoRepo) ListAuditEntries(ctx context.Context, id primitive.ObjectID, limit int64) (
+	_ []AuditEntry, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "ListAuditEntries", id)
+	defer m.end(ctx, &call, &err)
+
+	if m.auditLog == nil {
+		return nil, fmt.Errorf("%w: auditing is not enabled", ErrListingAuditTrail)
+	}
+
+	cursor, err := m.auditLog.Find(ctx, tenantFilter(ctx, bson.M{"user_id": id}), options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(m.pageLimit(limit)))
+	if err != nil {
+		return nil, driverError(ErrListingAuditTrail, err)
+	}
+
+	var docs []auditDocument
+
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, driverError(ErrListingAuditTrail, err)
+	}
+
+	entries := make([]AuditEntry, 0, len(docs))
+	for _, doc := range docs {
+		entries = append(entries, auditEntry(doc))
+	}
+
+	return entries, nil
+}
+
+func auditEntry(doc auditDocument) AuditEntry {
+	entry := AuditEntry{
+		ID:        doc.ID,
+		Operation: doc.Operation,
+		UserID:    doc.UserID,
+		Actor:     doc.Actor,
+		Tenant:    doc.Tenant,
+		Timestamp: doc.Timestamp,
+	}
+
+	for _, change := range doc.Changes {
+		entry.Changes = append(entry.Changes, FieldChange(change))
+	}
+
+	return entry
+}
@@ -0,0 +1,368 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultCacheTTL       = 5 * time.Minute
+	defaultCacheKeyPrefix = "user:"
+)
+
+// emailChanger is implemented by the repositories able to change the email of
+// a user on its own, such as MongoRepo.
+type emailChanger interface {
+	ChangeUserEmail(ctx context.Context, id primitive.ObjectID, newEmail string) (*User, error)
+}
+
+// CachedUserRepository is a UserRepository caching the users found by
+// GetUserByID and GetUserByEmail in Redis, in front of the repository it
+// wraps. Each user found is cached under its ID and its email, without its
+// password, and dropped from the cache when updated or deleted through this
+// repository. The users of the tenant set with WithTenant are cached apart
+// from the ones of the other tenants.
+//
+// Redis is only an optimization: when it fails, the calls go to the wrapped
+// repository and Stats counts them as degraded. Reads asking for passwords,
+// soft-deleted users or a read preference always skip the cache.
+type CachedUserRepository struct {
+	repo   UserRepository
+	client redis.UniversalClient
+	ttl    time.Duration
+	prefix string
+
+	hits     atomic.Int64
+	misses   atomic.Int64
+	degraded atomic.Int64
+}
+
+var _ UserRepository = (*CachedUserRepository)(nil)
+
+// CacheOption configures NewCachedUserRepository.
+type CacheOption func(*CachedUserRepository)
+
+// WithCacheTTL sets how long users stay cached, five minutes by default. A
+// provisional user is never cached past its expiry.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(r *CachedUserRepository) {
+		r.ttl = ttl
+	}
+}
+
+// WithCacheKeyPrefix sets what the cache keys start with, "user:" by default,
+// for instance to keep apart the users of two repositories sharing a Redis.
+func WithCacheKeyPrefix(prefix string) CacheOption {
+	return func(r *CachedUserRepository) {
+		r.prefix = prefix
+	}
+}
+
+// NewCachedUserRepository returns repo behind a cache kept in client.
+func NewCachedUserRepository(repo UserRepository, client redis.UniversalClient, opts ...CacheOption) *CachedUserRepository {
+	r := &CachedUserRepository{
+		repo:   repo,
+		client: client,
+		ttl:    defaultCacheTTL,
+		prefix: defaultCacheKeyPrefix,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// CacheStats counts the cached lookups by outcome.
+type CacheStats struct {
+	// Hits were answered from the cache, and Misses by the wrapped repository
+	// as the user wasn't cached.
+	Hits   int64
+	Misses int64
+	// Degraded counts the Redis calls which failed.
+	Degraded int64
+}
+
+// Stats returns the counts of the lookups made so far.
+func (r *CachedUserRepository) Stats() CacheStats {
+	return CacheStats{
+		Hits:     r.hits.Load(),
+		Misses:   r.misses.Load(),
+		Degraded: r.degraded.Load(),
+	}
+}
+
+// cachedUser is how a user is stored in the cache, without its password.
+type cachedUser struct {
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Email     string             `json:"email"`
+	Role      string             `json:"role"`
+	Version   int64              `json:"version"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	ExpiresAt *time.Time         `json:"expires_at,omitempty"`
+	// EmailVerified is false for the users cached before it existed, which
+	// CachedUserRepository can't tell from unverified ones.
+	EmailVerified bool `json:"email_verified,omitempty"`
+}
+
+func (r *CachedUserRepository) CreateUser(ctx context.Context, user *User, opts ...WriteOption) (*User, error) {
+	return r.repo.CreateUser(ctx, user, opts...)
+}
+
+func (r *CachedUserRepository) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	if !cacheable(opts) {
+		return r.repo.GetUserByID(ctx, id, opts...)
+	}
+
+	user, ok := r.lookup(ctx, r.idKey(ctx, id))
+	if ok {
+		return user, nil
+	}
+
+	user, err := r.repo.GetUserByID(ctx, id, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store(ctx, user)
+
+	return user, nil
+}
+
+func (r *CachedUserRepository) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (
+	*User, error,
+) {
+	normalized, err := NormalizeEmail(email)
+	if err != nil || !cacheable(opts) {
+		return r.repo.GetUserByEmail(ctx, email, opts...)
+	}
+
+	user, ok := r.lookup(ctx, r.emailKey(ctx, normalized))
+	if ok {
+		return user, nil
+	}
+
+	user, err = r.repo.GetUserByEmail(ctx, email, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store(ctx, user)
+
+	return user, nil
+}
+
+// UpdateUser updates user in the wrapped repository, then drops it from the
+// cache under its ID, its previous email and its new one.
+func (r *CachedUserRepository) UpdateUser(ctx context.Context, user *User, opts ...WriteOption) error {
+	previous := r.cachedEmail(ctx, user.ID)
+
+	err := r.repo.UpdateUser(ctx, user, opts...)
+
+	email, _ := NormalizeEmail(user.Email)
+	r.invalidate(ctx, user.ID, previous, email)
+
+	return err
+}
+
+// DeleteUser deletes the user from the wrapped repository and the cache.
+func (r *CachedUserRepository) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	previous := r.cachedEmail(ctx, id)
+
+	err := r.repo.DeleteUser(ctx, id)
+
+	r.invalidate(ctx, id, previous)
+
+	return err
+}
+
+// ChangeUserEmail changes the email of the user in the wrapped repository,
+// which must have a ChangeUserEmail method like MongoRepo does, then drops
+// the user from the cache under its ID and both emails.
+func (r *CachedUserRepository) ChangeUserEmail(ctx context.Context, id primitive.ObjectID, newEmail string) (
+	*User, error,
+) {
+	changer, ok := r.repo.(emailChanger)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T can't change emails", errors.ErrUnsupported, r.repo)
+	}
+
+	previous := r.cachedEmail(ctx, id)
+
+	user, err := changer.ChangeUserEmail(ctx, id, newEmail)
+
+	email, _ := NormalizeEmail(newEmail)
+	r.invalidate(ctx, id, previous, email)
+
+	return user, err
+}
+
+func (r *CachedUserRepository) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) (
+	[]*User, error,
+) {
+	return r.repo.ListUsers(ctx, limit, offset, opts...)
+}
+
+func (r *CachedUserRepository) ListUsersAfter(
+	ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption,
+) ([]*User, primitive.ObjectID, error) {
+	return r.repo.ListUsersAfter(ctx, afterID, limit, opts...)
+}
+
+// cacheable reports whether a read made with opts can be answered from the
+// cache, which holds neither passwords nor soft-deleted users.
+func cacheable(opts []ReadOption) bool {
+	readOpts := newReadOptions(opts)
+
+	return !readOpts.withPassword && !readOpts.includeDeleted && !readOpts.verifiedOnly && readOpts.readPreference == nil
+}
+
+func (r *CachedUserRepository) idKey(ctx context.Context, id primitive.ObjectID) string {
+	return r.tenantPrefix(ctx) + "id:" + id.Hex()
+}
+
+func (r *CachedUserRepository) emailKey(ctx context.Context, email string) string {
+	return r.tenantPrefix(ctx) + "email:" + email
+}
+
+// tenantPrefix returns what the keys of the users of the tenant of ctx start
+// with, for the same email under two tenants to be cached apart. The tenant
+// is quoted since the IDs a TenantResolver accepts may contain ':'.
+func (r *CachedUserRepository) tenantPrefix(ctx context.Context) string {
+	tenantID := TenantFromContext(ctx)
+	if tenantID == "" {
+		return r.prefix
+	}
+
+	return r.prefix + "tenant:" + strconv.Quote(tenantID) + ":"
+}
+
+// lookup returns the user cached under key, if any.
+func (r *CachedUserRepository) lookup(ctx context.Context, key string) (*User, bool) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		r.misses.Add(1)
+		return nil, false
+	}
+
+	if err != nil {
+		r.degraded.Add(1)
+		return nil, false
+	}
+
+	var cached cachedUser
+
+	err = json.Unmarshal(data, &cached)
+	if err != nil {
+		r.degraded.Add(1)
+		return nil, false
+	}
+
+	r.hits.Add(1)
+
+	return &User{
+		ID:        cached.ID,
+		Name:      cached.Name,
+		Email:     cached.Email,
+		Role:      cached.Role,
+		Version:   cached.Version,
+		CreatedAt: cached.CreatedAt,
+		UpdatedAt: cached.UpdatedAt,
+		ExpiresAt: cached.ExpiresAt,
+
+		EmailVerified: cached.EmailVerified,
+	}, true
+}
+
+// cachedEmail returns the email of the user cached under id, or "" if it
+// isn't cached.
+func (r *CachedUserRepository) cachedEmail(ctx context.Context, id primitive.ObjectID) string {
+	data, err := r.client.Get(ctx, r.idKey(ctx, id)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			r.degraded.Add(1)
+		}
+
+		return ""
+	}
+
+	var cached cachedUser
+
+	_ = json.Unmarshal(data, &cached)
+
+	return cached.Email
+}
+
+// store caches user under its ID and its email. Both keys are written
+// together, so that the ID key tells the email key to drop.
+func (r *CachedUserRepository) store(ctx context.Context, user *User) {
+	if user.DeletedAt != nil {
+		return
+	}
+
+	ttl := r.ttl
+	if user.ExpiresAt != nil {
+		left := time.Until(*user.ExpiresAt)
+		if left <= 0 {
+			return
+		}
+
+		if left < ttl {
+			ttl = left
+		}
+	}
+
+	data, err := json.Marshal(cachedUser{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		Role:      user.Role,
+		Version:   user.Version,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		ExpiresAt: user.ExpiresAt,
+
+		EmailVerified: user.EmailVerified,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, key := range []string{r.idKey(ctx, user.ID), r.emailKey(ctx, user.Email)} {
+		err = r.client.Set(ctx, key, data, ttl).Err()
+		if err != nil {
+			r.degraded.Add(1)
+			return
+		}
+	}
+}
+
+// invalidate drops the user with this id from the cache, under its ID and
+// the non-empty emails.
+func (r *CachedUserRepository) invalidate(ctx context.Context, id primitive.ObjectID, emails ...string) {
+	keys := []string{r.idKey(ctx, id)}
+
+	for _, email := range emails {
+		if email != "" {
+			keys = append(keys, r.emailKey(ctx, email))
+		}
+	}
+
+	err := r.client.Del(ctx, keys...).Err()
+	if err != nil {
+		r.degraded.Add(1)
+	}
+}
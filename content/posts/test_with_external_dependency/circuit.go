@@ -0,0 +1,276 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned by CircuitBreakerRepo in place of the calls it
+// didn't make. It also matches ErrTemporarilyUnavailable.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitState is the state of a CircuitBreakerRepo.
+type CircuitState string
+
+const (
+	// CircuitClosed means calls go to the wrapped repository.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen means calls fail right away with ErrCircuitOpen until the
+	// cooldown ends.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen means a probe call was let through after the cooldown,
+	// and the others fail with ErrCircuitOpen until it returns.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreakerRepo is a UserRepository which stops calling the repository
+// it wraps while it is failing, so that callers don't each wait for the
+// database to time out. After threshold consecutive calls failed with an
+// infrastructure failure, as told by IsRetryable, the circuit opens and calls
+// fail with ErrCircuitOpen. Once the cooldown has passed, the next call probes
+// the repository: the circuit closes if it gets an answer, and opens for
+// another cooldown otherwise.
+//
+// Timeouts of the wrapped repository, such as the one set with
+// WithOperationTimeout, count as failures too. Answers such as ErrUserNotFound
+// or a validation failure mean the repository works and don't, and calls
+// ending with their context don't count either way.
+type CircuitBreakerRepo struct {
+	repo          UserRepository
+	threshold     int
+	cooldown      time.Duration
+	onStateChange func(from, to CircuitState)
+
+	// clock is swapped by tests to end cooldowns without waiting.
+	clock Clock
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+var _ UserRepository = (*CircuitBreakerRepo)(nil)
+
+// CircuitBreakerOption configures NewCircuitBreakerRepo.
+type CircuitBreakerOption func(*CircuitBreakerRepo)
+
+// WithCircuitThreshold sets the consecutive failures opening the circuit, 5
+// by default.
+func WithCircuitThreshold(failures int) CircuitBreakerOption {
+	return func(b *CircuitBreakerRepo) {
+		b.threshold = failures
+	}
+}
+
+// WithCircuitCooldown sets how long the circuit stays open before a probe, 30
+// seconds by default.
+func WithCircuitCooldown(cooldown time.Duration) CircuitBreakerOption {
+	return func(b *CircuitBreakerRepo) {
+		b.cooldown = cooldown
+	}
+}
+
+// OnCircuitStateChange has fn called on each change of state, for instance to
+// count the openings in a metric. fn is called with the breaker locked, it
+// must return quickly and not call the repository.
+func OnCircuitStateChange(fn func(from, to CircuitState)) CircuitBreakerOption {
+	return func(b *CircuitBreakerRepo) {
+		b.onStateChange = fn
+	}
+}
+
+// NewCircuitBreakerRepo returns repo behind a closed circuit breaker.
+func NewCircuitBreakerRepo(repo UserRepository, opts ...CircuitBreakerOption) *CircuitBreakerRepo {
+	b := &CircuitBreakerRepo{
+		repo:      repo,
+		threshold: defaultCircuitThreshold,
+		cooldown:  defaultCircuitCooldown,
+		clock:     systemClock{},
+		state:     CircuitClosed,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.threshold < 1 {
+		b.threshold = 1
+	}
+
+	return b
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreakerRepo) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *CircuitBreakerRepo) CreateUser(ctx context.Context, user *User, opts ...WriteOption) (*User, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := b.repo.CreateUser(ctx, user, opts...)
+	b.record(ctx, probe, err)
+
+	return created, err
+}
+
+func (b *CircuitBreakerRepo) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := b.repo.GetUserByID(ctx, id, opts...)
+	b.record(ctx, probe, err)
+
+	return user, err
+}
+
+func (b *CircuitBreakerRepo) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (
+	*User, error,
+) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := b.repo.GetUserByEmail(ctx, email, opts...)
+	b.record(ctx, probe, err)
+
+	return user, err
+}
+
+func (b *CircuitBreakerRepo) UpdateUser(ctx context.Context, user *User, opts ...WriteOption) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = b.repo.UpdateUser(ctx, user, opts...)
+	b.record(ctx, probe, err)
+
+	return err
+}
+
+func (b *CircuitBreakerRepo) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = b.repo.DeleteUser(ctx, id)
+	b.record(ctx, probe, err)
+
+	return err
+}
+
+func (b *CircuitBreakerRepo) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) (
+	[]*User, error,
+) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := b.repo.ListUsers(ctx, limit, offset, opts...)
+	b.record(ctx, probe, err)
+
+	return users, err
+}
+
+func (b *CircuitBreakerRepo) ListUsersAfter(
+	ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption,
+) ([]*User, primitive.ObjectID, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, primitive.NilObjectID, err
+	}
+
+	users, next, err := b.repo.ListUsersAfter(ctx, afterID, limit, opts...)
+	b.record(ctx, probe, err)
+
+	return users, next, err
+}
+
+// allow tells whether a call may be made, and whether it is the probe of a
+// half-open circuit.
+func (b *CircuitBreakerRepo) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitClosed:
+		return false, nil
+	case CircuitOpen:
+		remaining := b.cooldown - b.clock.Now().Sub(b.openedAt)
+		if remaining > 0 {
+			return false, fmt.Errorf("%w: %w: probing again in %s", ErrCircuitOpen, ErrTemporarilyUnavailable, remaining)
+		}
+
+		b.setState(CircuitHalfOpen)
+
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: %w: probe in progress", ErrCircuitOpen, ErrTemporarilyUnavailable)
+	}
+}
+
+// record counts the outcome of a call made with ctx, allowed by allow.
+func (b *CircuitBreakerRepo) record(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The caller gave up, which tells nothing about the repository. A probe
+		// is left for the next call to make.
+		if probe {
+			b.setState(CircuitOpen)
+		}
+	case IsRetryable(err), errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrOperationTimeout):
+		b.failures++
+
+		if probe || (b.state == CircuitClosed && b.failures >= b.threshold) {
+			b.openedAt = b.clock.Now()
+			b.setState(CircuitOpen)
+		}
+	default:
+		b.failures = 0
+
+		if probe {
+			b.setState(CircuitClosed)
+		}
+	}
+}
+
+func (b *CircuitBreakerRepo) setState(state CircuitState) {
+	from := b.state
+	if from == state {
+		return
+	}
+
+	b.state = state
+
+	if b.onStateChange != nil {
+		b.onStateChange(from, state)
+	}
+}
@@ -0,0 +1,90 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// callerCloner is implemented by the callers, other than the driver ones, that
+// can run operations with other collection options, such as a write concern
+// or a read preference.
+type callerCloner interface {
+	Clone(opts ...*options.CollectionOptions) (MongoCaller, error)
+}
+
+// writeCaller returns the caller to write with given opts.
+func (m *MongoRepo) writeCaller(opts []WriteOption) (MongoCaller, error) {
+	writeOpts := newWriteOptions(opts)
+	if writeOpts.writeConcern == nil {
+		return m.mongoCaller, nil
+	}
+
+	return cloneCaller(m.mongoCaller, options.Collection().SetWriteConcern(writeOpts.writeConcern))
+}
+
+// documents returns the Repository storing the users with caller, one
+// returned by writeCaller or readCaller.
+func (m *MongoRepo) documents(caller MongoCaller) *Repository[*userDocument] {
+	return NewRepositoryFromCollection[*userDocument](caller, m.collection)
+}
+
+// readCaller returns the caller to read with given readOpts.
+func (m *MongoRepo) readCaller(readOpts readOptions) (MongoCaller, error) {
+	rp := readOpts.readPreference
+	if rp == nil {
+		return m.mongoCaller, nil
+	}
+
+	// Only this preference can be known to match the repo one without
+	// comparing tag sets.
+	if rp.Mode() == readpref.PrimaryMode && m.readPref != nil && m.readPref.Mode() == readpref.PrimaryMode {
+		return m.mongoCaller, nil
+	}
+
+	return cloneCaller(m.mongoCaller, options.Collection().SetReadPreference(rp))
+}
+
+func cloneCaller(caller MongoCaller, opts *options.CollectionOptions) (MongoCaller, error) {
+	switch c := caller.(type) {
+	case *mongo.Collection:
+		return c.Clone(opts)
+	case *reconnectingCaller:
+		inner, err := cloneCaller(c.caller, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return &reconnectingCaller{caller: inner, state: c.state}, nil
+	case *retryingCaller:
+		inner, err := cloneCaller(c.caller, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		retrying := *c
+		retrying.caller = inner
+
+		return &retrying, nil
+	case callerCloner:
+		return c.Clone(opts)
+	default:
+		return nil, fmt.Errorf("%w: %T can't change its collection options", ErrInvalidOption, caller)
+	}
+}
+
+// isWriteConcernError reports whether err carries a write concern error, in
+// which case the write itself may have succeeded.
+func isWriteConcernError(err error) bool {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError != nil {
+		return true
+	}
+
+	var bulkErr mongo.BulkWriteException
+
+	return errors.As(err, &bulkErr) && bulkErr.WriteConcernError != nil
+}
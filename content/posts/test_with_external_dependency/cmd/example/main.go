@@ -4,25 +4,22 @@ import (
 	"context"
 	"fmt"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	users "github.com/tclaudel/blog-tclaudel/content/posts/test_with_external_dependency"
 )
 
 func main() {
 	ctx := context.Background()
 
-	repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017")
+	repo, err := users.NewMongoRepo(ctx, "mongodb://localhost:27017")
 	if err != nil {
 		panic(err)
 	}
 
-	user := &User{
-		ID:       primitive.NewObjectID(),
+	user, err := repo.CreateUser(ctx, &users.User{
 		Name:     "John",
 		Email:    "john@example.com",
 		Password: "password",
-	}
-
-	err = repo.CreateUser(ctx, user)
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,308 @@
+// Command usersctl manages the users of a Mongo database from the command
+// line, through the repo of this module.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	users "github.com/tclaudel/blog-tclaudel/content/posts/test_with_external_dependency"
+)
+
+// Exit codes of usersctl.
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitNotFound = 2
+)
+
+const (
+	defaultUsersctlURI     = "mongodb://localhost:27017"
+	defaultUsersctlTimeout = 10 * time.Second
+)
+
+const usersctlUsage = `usage: usersctl [--uri URI] [--timeout DURATION] COMMAND [FLAGS]
+
+Commands:
+  create --name NAME --email EMAIL --password PASSWORD [--role ROLE]
+  get    --id ID | --email EMAIL
+  list   [--limit N] [--after TOKEN]
+  delete --id ID
+
+The URI defaults to $MONGO_URI, then to ` + defaultUsersctlURI + `. The page
+tokens of list are signed with $PAGE_TOKEN_KEY, the WithPageTokenKey of the
+services on the database for their tokens to be usable here, or else with a
+key derived from the URI.
+`
+
+// errUsage is returned for a command line usersctl can't run.
+var errUsage = errors.New("usage error")
+
+// pageRepository is the repository usersctl runs on, listing by page tokens.
+type pageRepository interface {
+	users.UserRepository
+	ListUsersPage(ctx context.Context, pageToken string, limit int64, opts ...users.ReadOption) (
+		[]*users.User, string, error,
+	)
+}
+
+func main() {
+	os.Exit(usersctl(context.Background(), os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
+
+// usersctl connects to the Mongo named by --uri or the MONGO_URI variable
+// given by getenv, runs the command of args on it and returns the exit code.
+func usersctl(ctx context.Context, args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("usersctl", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	uri := flags.String("uri", getenv("MONGO_URI"), "")
+	timeout := flags.Duration("timeout", defaultUsersctlTimeout, "")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return usersctlFailed(stderr, fmt.Errorf("%w: %s", errUsage, err))
+	}
+
+	if flags.NArg() == 0 {
+		return usersctlFailed(stderr, fmt.Errorf("%w: no command", errUsage))
+	}
+
+	if *uri == "" {
+		*uri = defaultUsersctlURI
+	}
+
+	repo, err := users.NewMongoRepo(ctx, *uri, users.WithConnectTimeout(*timeout),
+		users.WithPageTokenKey(pageTokenKey(getenv, *uri)))
+	if err != nil {
+		return usersctlFailed(stderr, err)
+	}
+
+	defer func() {
+		_ = repo.Close(context.Background())
+	}()
+
+	return runUsersctl(ctx, repo, flags.Args(), stdout, stderr)
+}
+
+// pageTokenKey returns the key of the page tokens: PAGE_TOKEN_KEY, or the
+// SHA-256 of uri for the runs on a database to read the tokens of each other
+// without one.
+func pageTokenKey(getenv func(string) string, uri string) []byte {
+	if key := getenv("PAGE_TOKEN_KEY"); key != "" {
+		return []byte(key)
+	}
+
+	sum := sha256.Sum256([]byte(uri))
+
+	return sum[:]
+}
+
+// runUsersctl runs the usersctl command of args, such as
+// ["get", "--id", "..."], on repo. It prints what the command returns as
+// JSON to stdout and its failure to stderr, and returns the exit code:
+// exitNotFound when the user doesn't exist, exitError on any other failure.
+func runUsersctl(ctx context.Context, repo pageRepository, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return usersctlFailed(stderr, fmt.Errorf("%w: no command", errUsage))
+	}
+
+	commands := map[string]func(context.Context, pageRepository, *flag.FlagSet, []string) (any, error){
+		"create": usersctlCreate,
+		"get":    usersctlGet,
+		"list":   usersctlList,
+		"delete": usersctlDelete,
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		return usersctlFailed(stderr, fmt.Errorf("%w: unknown command %q", errUsage, args[0]))
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	result, err := command(ctx, repo, flags, args[1:])
+	if err != nil {
+		return usersctlFailed(stderr, err)
+	}
+
+	if result != nil {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+
+		err = encoder.Encode(result)
+		if err != nil {
+			return usersctlFailed(stderr, err)
+		}
+	}
+
+	return exitOK
+}
+
+func usersctlCreate(ctx context.Context, repo pageRepository, flags *flag.FlagSet, args []string) (any, error) {
+	name := flags.String("name", "", "")
+	email := flags.String("email", "", "")
+	password := flags.String("password", "", "")
+	role := flags.String("role", "", "")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := repo.CreateUser(ctx, &users.User{Name: *name, Email: *email, Password: *password, Role: *role})
+	if err != nil {
+		return nil, err
+	}
+
+	return newUserOutput(user), nil
+}
+
+func usersctlGet(ctx context.Context, repo pageRepository, flags *flag.FlagSet, args []string) (any, error) {
+	id := flags.String("id", "", "")
+	email := flags.String("email", "", "")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *users.User
+
+	switch {
+	case *id != "" && *email != "":
+		return nil, fmt.Errorf("%w: --id and --email are exclusive", errUsage)
+	case *id != "":
+		objectID, err := users.ParseUserID(*id)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = repo.GetUserByID(ctx, objectID)
+		if err != nil {
+			return nil, err
+		}
+	case *email != "":
+		user, err = repo.GetUserByEmail(ctx, *email)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: --id or --email is required", errUsage)
+	}
+
+	return newUserOutput(user), nil
+}
+
+// userOutput is a user as printed, never with its password.
+type userOutput struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newUserOutput(user *users.User) userOutput {
+	return userOutput{
+		ID:        user.ID.Hex(),
+		Name:      user.Name,
+		Email:     user.Email,
+		Role:      user.Role,
+		Version:   user.Version,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		ExpiresAt: user.ExpiresAt,
+	}
+}
+
+// usersctlListOutput is what list prints. Next is the page token to pass as
+// --after for the next page, empty on the last one.
+type usersctlListOutput struct {
+	Users []userOutput `json:"users"`
+	Next  string       `json:"next,omitempty"`
+}
+
+func usersctlList(ctx context.Context, repo pageRepository, flags *flag.FlagSet, args []string) (any, error) {
+	limit := flags.Int64("limit", 0, "")
+	after := flags.String("after", "", "")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return nil, err
+	}
+
+	page, next, err := repo.ListUsersPage(ctx, *after, *limit)
+	if err != nil {
+		return nil, err
+	}
+
+	output := usersctlListOutput{Users: make([]userOutput, 0, len(page)), Next: next}
+	for _, user := range page {
+		output.Users = append(output.Users, newUserOutput(user))
+	}
+
+	return output, nil
+}
+
+func usersctlDelete(ctx context.Context, repo pageRepository, flags *flag.FlagSet, args []string) (any, error) {
+	id := flags.String("id", "", "")
+
+	err := parseCommandFlags(flags, args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *id == "" {
+		return nil, fmt.Errorf("%w: --id is required", errUsage)
+	}
+
+	objectID, err := users.ParseUserID(*id)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, repo.DeleteUser(ctx, objectID)
+}
+
+// parseCommandFlags parses the flags of a command, which takes no
+// arguments.
+func parseCommandFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%w: unexpected argument %q", errUsage, flags.Arg(0))
+	}
+
+	return nil
+}
+
+// usersctlFailed prints err to stderr, with the usage on usage errors, and
+// returns the exit code matching it.
+func usersctlFailed(stderr io.Writer, err error) int {
+	_, _ = fmt.Fprintf(stderr, "usersctl: %s\n", err)
+
+	if errors.Is(err, errUsage) {
+		_, _ = io.WriteString(stderr, usersctlUsage)
+	}
+
+	if users.IsNotFound(err) {
+		return exitNotFound
+	}
+
+	return exitError
+}
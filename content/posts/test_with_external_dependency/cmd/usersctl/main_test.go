@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	users "github.com/tclaudel/blog-tclaudel/content/posts/test_with_external_dependency"
+)
+
+// newRepo returns an empty repo on a MockMongo with a unique email index.
+func newRepo(t *testing.T) *users.MongoRepo {
+	t.Helper()
+
+	return users.NewMockMongo(users.WithUniqueEmail())
+}
+
+// runUsersctlT runs usersctl with args on repo and returns its exit code and
+// outputs.
+func runUsersctlT(t *testing.T, repo pageRepository, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+
+	code := runUsersctl(context.Background(), repo, args, &stdout, &stderr)
+
+	return code, stdout.String(), stderr.String()
+}
+
+func TestUsersctl(t *testing.T) {
+	repo := newRepo(t)
+
+	code, stdout, stderr := runUsersctlT(t, repo,
+		"create", "--name", "John", "--email", "John@example.com", "--password", "password", "--role", users.RoleAdmin)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.NotContains(t, stdout, "password")
+
+	var created userOutput
+
+	err := json.Unmarshal([]byte(stdout), &created)
+	if err != nil {
+		t.Fatalf("error decoding output %q: %s", stdout, err)
+	}
+
+	assert.Equal(t, "john@example.com", created.Email)
+	assert.Equal(t, users.RoleAdmin, created.Role)
+
+	for _, args := range [][]string{{"get", "--id", created.ID}, {"get", "--email", "JOHN@example.com"}} {
+		code, stdout, stderr = runUsersctlT(t, repo, args...)
+		assert.Equal(t, exitOK, code, stderr)
+
+		var got userOutput
+
+		err = json.Unmarshal([]byte(stdout), &got)
+		if err != nil {
+			t.Fatalf("error decoding output %q: %s", stdout, err)
+		}
+
+		assert.Equal(t, created, got)
+	}
+
+	for _, name := range []string{"Jane", "Jack"} {
+		code, _, stderr = runUsersctlT(t, repo,
+			"create", "--name", name, "--email", name+"@example.com", "--password", "password")
+		assert.Equal(t, exitOK, code, stderr)
+	}
+
+	var page usersctlListOutput
+
+	code, stdout, stderr = runUsersctlT(t, repo, "list", "--limit", "2")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.NotContains(t, stdout, "password")
+
+	err = json.Unmarshal([]byte(stdout), &page)
+	if err != nil {
+		t.Fatalf("error decoding output %q: %s", stdout, err)
+	}
+
+	assert.Len(t, page.Users, 2)
+	assert.NotEmpty(t, page.Next)
+
+	code, stdout, stderr = runUsersctlT(t, repo, "list", "--limit", "2", "--after", page.Next)
+	assert.Equal(t, exitOK, code, stderr)
+
+	page = usersctlListOutput{}
+
+	err = json.Unmarshal([]byte(stdout), &page)
+	if err != nil {
+		t.Fatalf("error decoding output %q: %s", stdout, err)
+	}
+
+	assert.Len(t, page.Users, 1)
+	assert.Empty(t, page.Next)
+
+	code, stdout, stderr = runUsersctlT(t, repo, "delete", "--id", created.ID)
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Empty(t, stdout)
+
+	code, stdout, stderr = runUsersctlT(t, repo, "get", "--id", created.ID)
+	assert.Equal(t, exitNotFound, code)
+	assert.Empty(t, stdout)
+	assert.Contains(t, stderr, users.ErrUserNotFound.Error())
+}
+
+func TestUsersctl_Errors(t *testing.T) {
+	repo := newRepo(t)
+
+	code, _, stderr := runUsersctlT(t, repo, "create", "--name", "John", "--email", "john@example.com", "--password", "password")
+	assert.Equal(t, exitOK, code, stderr)
+
+	missing := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name  string
+		args  []string
+		code  int
+		usage bool
+	}{
+		{"NoCommand", nil, exitError, true},
+		{"UnknownCommand", []string{"promote"}, exitError, true},
+		{"UnknownFlag", []string{"list", "--all"}, exitError, true},
+		{"ExtraArgument", []string{"delete", "--id", missing, "now"}, exitError, true},
+		{"CreateDuplicate", []string{
+			"create", "--name", "John", "--email", "john@example.com", "--password", "password",
+		}, exitError, false},
+		{"CreateInvalid", []string{"create", "--name", "John"}, exitError, false},
+		{"GetNothing", []string{"get"}, exitError, true},
+		{"GetBoth", []string{"get", "--id", missing, "--email", "john@example.com"}, exitError, true},
+		{"GetMissingID", []string{"get", "--id", missing}, exitNotFound, false},
+		{"GetMissingEmail", []string{"get", "--email", "jane@example.com"}, exitNotFound, false},
+		{"GetMalformedID", []string{"get", "--id", "not-hex"}, exitError, false},
+		{"ListMalformedAfter", []string{"list", "--after", "not-a-token"}, exitError, false},
+		{"ListIDAfter", []string{"list", "--after", missing}, exitError, false},
+		{"DeleteWithoutID", []string{"delete"}, exitError, true},
+		{"DeleteMissing", []string{"delete", "--id", missing}, exitNotFound, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, stdout, stderr := runUsersctlT(t, repo, test.args...)
+			assert.Equal(t, test.code, code, stderr)
+			assert.Empty(t, stdout)
+			assert.True(t, strings.HasPrefix(stderr, "usersctl: "), stderr)
+			assert.Equal(t, test.usage, strings.Contains(stderr, "usage: usersctl"), stderr)
+		})
+	}
+}
+
+func TestUsersctl_Connect(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	getenv := func(key string) string {
+		if key == "MONGO_URI" {
+			return "not-a-uri"
+		}
+
+		return ""
+	}
+
+	code := usersctl(context.Background(), []string{"--timeout", "10ms", "list"}, getenv, &stdout, &stderr)
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr.String(), users.ErrConnectingToMongoDatabase.Error())
+
+	stderr.Reset()
+
+	code = usersctl(context.Background(), []string{"--timeout", "soon", "list"}, getenv, &stdout, &stderr)
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr.String(), "usage: usersctl")
+	assert.Empty(t, stdout.String())
+}
+
+func TestPageTokenKey(t *testing.T) {
+	noEnv := func(string) string { return "" }
+
+	key := pageTokenKey(noEnv, "mongodb://localhost:27017")
+	assert.Len(t, key, 32)
+	assert.Equal(t, key, pageTokenKey(noEnv, "mongodb://localhost:27017"), "runs on a database share the key")
+	assert.NotEqual(t, key, pageTokenKey(noEnv, "mongodb://other:27017"))
+
+	getenv := func(name string) string {
+		if name == "PAGE_TOKEN_KEY" {
+			return "0123456789abcdef"
+		}
+
+		return ""
+	}
+
+	assert.Equal(t, []byte("0123456789abcdef"), pageTokenKey(getenv, "mongodb://localhost:27017"))
+}
@@ -0,0 +1,349 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RunRepositoryContractTests checks the behavior every UserRepository must
+// have, one subtest per behavior. newRepo returns an empty repository, with
+// emails already uniquely indexed, and is called once per subtest.
+func RunRepositoryContractTests(t *testing.T, newRepo func(t *testing.T) UserRepository) {
+	t.Helper()
+
+	create := func(t *testing.T, repo UserRepository, name string) *User {
+		t.Helper()
+
+		user, err := repo.CreateUser(context.Background(), &User{
+			Name:     name,
+			Email:    name + "@example.com",
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		return user
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		repo := newRepo(t)
+
+		user, err := repo.CreateUser(context.Background(), &User{
+			Name:     "John",
+			Email:    " John@Example.com",
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.False(t, user.ID.IsZero())
+		assert.Equal(t, "john@example.com", user.Email)
+		assert.NotEqual(t, "password", user.Password)
+		assert.Equal(t, RoleMember, user.Role)
+		assert.Equal(t, int64(1), user.Version)
+		assert.False(t, user.CreatedAt.IsZero())
+		assert.Equal(t, user.CreatedAt, user.UpdatedAt)
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		repo := newRepo(t)
+		create(t, repo, "john")
+
+		_, err := repo.CreateUser(context.Background(), &User{
+			Name:     "Johnny",
+			Email:    "JOHN@example.com",
+			Password: "password",
+		})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	})
+
+	t.Run("GetByID", func(t *testing.T) {
+		repo := newRepo(t)
+		user := create(t, repo, "john")
+
+		got, err := repo.GetUserByID(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, user.ID, got.ID)
+		assert.Equal(t, user.Email, got.Email)
+		assert.Equal(t, user.CreatedAt, got.CreatedAt)
+		assert.Empty(t, got.Password)
+
+		got, err = repo.GetUserByID(context.Background(), user.ID, WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, user.Password, got.Password)
+	})
+
+	t.Run("GetByEmail", func(t *testing.T) {
+		repo := newRepo(t)
+		user := create(t, repo, "john")
+
+		got, err := repo.GetUserByEmail(context.Background(), "John@Example.com")
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, user.ID, got.ID)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		_, err := repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = repo.GetUserByEmail(ctx, "nobody@example.com")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		err = repo.UpdateUser(ctx, &User{
+			ID:       primitive.NewObjectID(),
+			Name:     "John",
+			Email:    "john@example.com",
+			Password: "password",
+			Version:  1,
+		})
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		err = repo.DeleteUser(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		user := create(t, repo, "john")
+
+		got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		got.Name = "Johnny"
+
+		err = repo.UpdateUser(ctx, got)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		assert.Equal(t, int64(2), got.Version)
+
+		got, err = repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "Johnny", got.Name)
+		assert.Equal(t, int64(2), got.Version)
+		assert.Equal(t, user.CreatedAt, got.CreatedAt)
+	})
+
+	t.Run("VersionConflict", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		user := create(t, repo, "john")
+
+		first, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		second, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		first.Name = "Johnny"
+
+		err = repo.UpdateUser(ctx, first)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		second.Name = "Jack"
+
+		err = repo.UpdateUser(ctx, second)
+		assert.ErrorIs(t, err, ErrVersionConflict)
+
+		got, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "Johnny", got.Name)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		user := create(t, repo, "john")
+
+		err := repo.DeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+
+		_, err = repo.GetUserByID(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		err = repo.DeleteUser(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("Copies", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		user := create(t, repo, "john")
+		user.Name = "Johnny"
+
+		got, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "john", got.Name)
+
+		got.Name = "Jack"
+
+		again, err := repo.GetUserByEmail(ctx, "john@example.com")
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "john", again.Name)
+
+		users, err := repo.ListUsers(ctx, 10, 0)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		users[0].Name = "Jack"
+
+		again, err = repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "john", again.Name)
+	})
+
+	t.Run("ListOrdering", func(t *testing.T) {
+		repo := newRepo(t)
+
+		want := make([]primitive.ObjectID, 0, 3)
+		for i := 0; i < 3; i++ {
+			want = append(want, create(t, repo, fmt.Sprintf("john%d", i)).ID)
+		}
+
+		users, err := repo.ListUsers(context.Background(), 10, 0)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		assert.Equal(t, want, userIDs(users))
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		want := make([]primitive.ObjectID, 0, 5)
+		for i := 0; i < 5; i++ {
+			want = append(want, create(t, repo, fmt.Sprintf("john%d", i)).ID)
+		}
+
+		var byOffset []primitive.ObjectID
+
+		for offset := int64(0); offset < 6; offset += 2 {
+			page, err := repo.ListUsers(ctx, 2, offset)
+			if err != nil {
+				t.Fatalf("error listing users: %s", err)
+			}
+
+			byOffset = append(byOffset, userIDs(page)...)
+		}
+
+		assert.Equal(t, want, byOffset)
+
+		var (
+			byCursor []primitive.ObjectID
+			after    primitive.ObjectID
+		)
+
+		for {
+			page, next, err := repo.ListUsersAfter(ctx, after, 2)
+			if err != nil {
+				t.Fatalf("error listing users: %s", err)
+			}
+
+			byCursor = append(byCursor, userIDs(page)...)
+
+			if next.IsZero() {
+				break
+			}
+
+			after = next
+		}
+
+		assert.Equal(t, want, byCursor)
+	})
+}
+
+func userIDs(users []*User) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	return ids
+}
+
+func TestMockMongo_Contract(t *testing.T) {
+	RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+		repo := NewMockMongo()
+
+		err := repo.EnsureIndexes(context.Background())
+		if err != nil {
+			t.Fatalf("error ensuring indexes: %s", err)
+		}
+
+		return repo
+	})
+}
+
+func TestInMemoryUserRepository_Contract(t *testing.T) {
+	RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+		return newInMemoryRepo(t)
+	})
+}
+
+func TestSQLiteRepo_Contract(t *testing.T) {
+	RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+		return newSQLiteRepo(t, filepath.Join(t.TempDir(), "users.db"))
+	})
+}
+
+func TestSQLiteRepo_ContractInMemory(t *testing.T) {
+	RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+		return newSQLiteRepo(t, ":memory:")
+	})
+}
+
+func TestFileRepo_Contract(t *testing.T) {
+	RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+		return newFileRepo(t, filepath.Join(t.TempDir(), "users.json"))
+	})
+}
@@ -0,0 +1,102 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// userDocument is how a User is stored in Mongo. It is only used by MongoRepo
+// and its mock: the rest of the code works with User.
+type userDocument struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Name string             `bson:"name,omitempty"`
+	// Email is encrypted with WithFieldEncryption, and EmailHash then set to
+	// look it up.
+	Email     string `bson:"email,omitempty"`
+	EmailHash string `bson:"email_hash,omitempty"`
+	Password  string `bson:"password,omitempty"`
+	Role      string `bson:"role,omitempty"`
+	Version   int64  `bson:"version,omitempty"`
+	// CreatedAt and UpdatedAt are absent from documents written before they
+	// existed.
+	CreatedAt time.Time  `bson:"created_at,omitempty"`
+	UpdatedAt time.Time  `bson:"updated_at,omitempty"`
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty"`
+	// EmailVerified is absent until the email is verified.
+	EmailVerified bool `bson:"email_verified,omitempty"`
+	// IdempotencyKey is only set on users created with CreateUserIdempotent.
+	IdempotencyKey       string     `bson:"idempotency_key,omitempty"`
+	IdempotencyExpiresAt *time.Time `bson:"idempotency_expires_at,omitempty"`
+}
+
+func (d *userDocument) GetID() primitive.ObjectID {
+	return d.ID
+}
+
+func (d *userDocument) SetID(id primitive.ObjectID) {
+	d.ID = id
+}
+
+// toDocument maps user to what is written to Mongo. Emails are stored
+// lowercased and times in UTC at millisecond precision, which is all a bson
+// date keeps, so that reading the document back gives the same values.
+func toDocument(user *User) *userDocument {
+	return &userDocument{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     strings.ToLower(strings.TrimSpace(user.Email)),
+		Password:  user.Password,
+		Role:      user.Role,
+		Version:   user.Version,
+		CreatedAt: storedTime(user.CreatedAt),
+		UpdatedAt: storedTime(user.UpdatedAt),
+		DeletedAt: storedTimePtr(user.DeletedAt),
+		ExpiresAt: storedTimePtr(user.ExpiresAt),
+
+		EmailVerified:        user.EmailVerified,
+		IdempotencyKey:       user.idempotencyKey,
+		IdempotencyExpiresAt: storedTimePtr(user.idempotencyExpiresAt),
+	}
+}
+
+// fromDocument maps a document read from Mongo back to a User.
+func fromDocument(doc *userDocument) *User {
+	return &User{
+		ID:        doc.ID,
+		Name:      doc.Name,
+		Email:     doc.Email,
+		Password:  doc.Password,
+		Role:      doc.Role,
+		Version:   doc.Version,
+		CreatedAt: storedTime(doc.CreatedAt),
+		UpdatedAt: storedTime(doc.UpdatedAt),
+		DeletedAt: storedTimePtr(doc.DeletedAt),
+		ExpiresAt: storedTimePtr(doc.ExpiresAt),
+
+		EmailVerified:        doc.EmailVerified,
+		idempotencyKey:       doc.IdempotencyKey,
+		idempotencyExpiresAt: storedTimePtr(doc.IdempotencyExpiresAt),
+	}
+}
+
+// storedTime keeps the zero time as is so omitempty still drops it.
+func storedTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Time{}
+	}
+
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+func storedTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	stored := storedTime(*t)
+
+	return &stored
+}
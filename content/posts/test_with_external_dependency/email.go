@@ -0,0 +1,42 @@
+package users
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// caseInsensitiveCollation is the collation of WithEmailCollation: at strength
+// 2, strings compare ignoring case but not accents.
+var caseInsensitiveCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// NormalizeEmail returns the canonical form of email that the repo stores and
+// queries: surrounding whitespace trimmed and both the local part and domain
+// lowercased. It returns an error wrapping ErrInvalidEmail when email is not a
+// bare address such as john@example.com.
+func NormalizeEmail(email string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	if normalized == "" {
+		return "", fmt.Errorf("%w: email is empty", ErrInvalidEmail)
+	}
+
+	address, err := mail.ParseAddress(normalized)
+	if err != nil || address.Address != normalized {
+		return "", fmt.Errorf("%w: %q", ErrInvalidEmail, email)
+	}
+
+	return normalized, nil
+}
+
+// emailCollation returns the collation of a query, which matches on email if
+// byEmail: the one set by WithEmailCollation, or nil for the default one. The
+// hashes of encrypted emails are of their normalized form and need none.
+func (m *MongoRepo) emailCollation(byEmail bool) *options.Collation {
+	if !byEmail || m.fields != nil {
+		return nil
+	}
+
+	return m.collation
+}
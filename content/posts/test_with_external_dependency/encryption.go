@@ -0,0 +1,237 @@
+package users
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// encryptedPrefix starts the encrypted values, followed by the ID of their
+// key and the base64 of their nonce and ciphertext:
+//
+//	enc1:<key ID>:<base64>
+const encryptedPrefix = "enc1:"
+
+const minEmailHashKeyLength = 16
+
+// ErrCorruptField is returned when a stored field can't be decrypted, as it
+// was altered or encrypted with a key the repo wasn't given.
+var ErrCorruptField = errors.New("corrupt field")
+
+// fieldEncryption encrypts the email of the users a repo stores, with
+// AES-GCM, and keys their email_hash.
+type fieldEncryption struct {
+	current   cipher.AEAD
+	currentID string
+	// aeads has every key by ID, the current one included.
+	aeads   map[string]cipher.AEAD
+	hashKey []byte
+}
+
+// newFieldEncryption returns the encryption of the emails with key, which
+// can also decrypt the values encrypted with previousKeys. The email hashes
+// are keyed by hashKey, or a key derived from key when nil.
+func newFieldEncryption(key []byte, previousKeys [][]byte, hashKey []byte) (*fieldEncryption, error) {
+	e := &fieldEncryption{aeads: make(map[string]cipher.AEAD, len(previousKeys)+1)}
+
+	for i, k := range append([][]byte{key}, previousKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("%w: encryption key %d: %s", ErrInvalidOption, i, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: encryption key %d: %s", ErrInvalidOption, i, err)
+		}
+
+		id := encryptionKeyID(k)
+		if _, ok := e.aeads[id]; ok {
+			return nil, fmt.Errorf("%w: encryption key %d is given twice", ErrInvalidOption, i)
+		}
+
+		e.aeads[id] = aead
+
+		if i == 0 {
+			e.current, e.currentID = aead, id
+		}
+	}
+
+	switch {
+	case hashKey == nil:
+		e.hashKey = deriveKey(key, "email_hash")
+	case len(hashKey) < minEmailHashKeyLength:
+		return nil, fmt.Errorf("%w: email hash key is shorter than %d bytes", ErrInvalidOption, minEmailHashKeyLength)
+	default:
+		e.hashKey = hashKey
+	}
+
+	return e, nil
+}
+
+// encryptionKeyID identifies key in the values it encrypted without telling
+// anything about it.
+func encryptionKeyID(key []byte) string {
+	return hex.EncodeToString(deriveKey(key, "key_id")[:4])
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+
+	return mac.Sum(nil)
+}
+
+// encrypt returns value of the field encrypted with a random nonce. The field
+// is authenticated along, so the value can't be moved to another field.
+func (e *fieldEncryption) encrypt(field, value string) string {
+	nonce := make([]byte, e.current.NonceSize())
+	_, _ = rand.Read(nonce)
+
+	sealed := e.current.Seal(nonce, nonce, []byte(value), []byte(field))
+
+	return encryptedPrefix + e.currentID + ":" + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// decrypt returns the plain value of the field encrypted by encrypt, with the
+// current key or a previous one.
+func (e *fieldEncryption) decrypt(field, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return "", errors.New("value is not encrypted")
+	}
+
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("value has no key ID")
+	}
+
+	aead, ok := e.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("unknown key %s", id)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("value is malformed")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", errors.New("value fails authentication")
+	}
+
+	return string(plain), nil
+}
+
+// emailHash returns the email_hash of email, which is the same for every
+// spelling toDocument stores the same way.
+func (e *fieldEncryption) emailHash(email string) string {
+	mac := hmac.New(sha256.New, e.hashKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encrypted returns doc as written to Mongo: itself without field encryption,
+// otherwise a copy with its email encrypted and hashed.
+func (m *MongoRepo) encrypted(doc *userDocument) *userDocument {
+	if m.fields == nil || doc.Email == "" {
+		return doc
+	}
+
+	encrypted := *doc
+	encrypted.EmailHash = m.fields.emailHash(doc.Email)
+	encrypted.Email = m.fields.encrypt("email", doc.Email)
+
+	return &encrypted
+}
+
+// decode is fromDocument for the documents read from Mongo, whose fields it
+// decrypts. A field which can't be is reported as ErrCorruptField.
+func (m *MongoRepo) decode(doc *userDocument) (*User, error) {
+	user := fromDocument(doc)
+	if m.fields == nil || doc.Email == "" {
+		return user, nil
+	}
+
+	email, err := m.fields.decrypt("email", doc.Email)
+	if err != nil {
+		return nil, fmt.Errorf("%w: email of user %s: %s", ErrCorruptField, doc.ID.Hex(), err)
+	}
+
+	user.Email = email
+
+	return user, nil
+}
+
+// decodeUsers reads every document left in cursor as users.
+func (m *MongoRepo) decodeUsers(ctx context.Context, cursor *mongo.Cursor) ([]*User, error) {
+	var docs []*userDocument
+
+	err := cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.decodeAll(docs)
+}
+
+// decodeAll is decode for every document of docs.
+func (m *MongoRepo) decodeAll(docs []*userDocument) ([]*User, error) {
+	users := make([]*User, 0, len(docs))
+
+	for _, doc := range docs {
+		user, err := m.decode(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// emailFilter matches the user having email, already normalized.
+func (m *MongoRepo) emailFilter(email string) bson.M {
+	if m.fields == nil {
+		return bson.M{"email": email}
+	}
+
+	return bson.M{"email_hash": m.fields.emailHash(email)}
+}
+
+// emailFields are the fields to $set to give a user email, already
+// normalized.
+func (m *MongoRepo) emailFields(email string) bson.M {
+	if m.fields == nil {
+		return bson.M{"email": email}
+	}
+
+	return bson.M{"email": m.fields.encrypt("email", email), "email_hash": m.fields.emailHash(email)}
+}
+
+// userFilter is filter.toBSON, matching emails on their hash when they are
+// encrypted.
+func (m *MongoRepo) userFilter(filter UserFilter) bson.M {
+	query := filter.toBSON()
+
+	if m.fields != nil && filter.Email != "" {
+		delete(query, "email")
+		query["email_hash"] = m.fields.emailHash(filter.Email)
+	}
+
+	return query
+}
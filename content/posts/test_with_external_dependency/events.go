@@ -0,0 +1,164 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxCollection is the collection of the database NewOutboxSink writes the
+// events to.
+const OutboxCollection = "user_events"
+
+var ErrPublishingEvent = errors.New("error publishing user event")
+
+// EventType tells what happened to a user.
+type EventType string
+
+const (
+	EventUserCreated EventType = "created"
+	EventUserUpdated EventType = "updated"
+	EventUserDeleted EventType = "deleted"
+)
+
+// UserEvent is published by a repo given WithEventSink after each mutation
+// which succeeded. Email is the email of the user when the mutation knew it,
+// which deletes and updates leaving the email alone don't. UserID is zero for
+// an UpsertUser updating the user having the email, whose ID it doesn't read.
+type UserEvent struct {
+	Type      EventType
+	UserID    primitive.ObjectID
+	Email     string
+	Timestamp time.Time
+}
+
+// EventSink receives the events of a repo, in the order of the mutations.
+// Publish is called by the method making the mutation, before it returns.
+type EventSink interface {
+	Publish(ctx context.Context, event UserEvent) error
+}
+
+// ChannelSink is an EventSink sending the events on a channel, for tests.
+type ChannelSink struct {
+	events chan UserEvent
+}
+
+var _ EventSink = (*ChannelSink)(nil)
+
+// NewChannelSink returns a ChannelSink buffering size events. Once the buffer
+// is full Publish waits for Events to be read, or its context to be done.
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{events: make(chan UserEvent, size)}
+}
+
+func (s *ChannelSink) Publish(ctx context.Context, event UserEvent) error {
+	select {
+	case s.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Events returns the channel the events are sent on.
+func (s *ChannelSink) Events() <-chan UserEvent {
+	return s.events
+}
+
+// OutboxInserter is the part of *mongo.Collection used by OutboxSink.
+type OutboxInserter interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+		*mongo.InsertOneResult, error)
+}
+
+// OutboxSink is an EventSink storing the events in a Mongo collection, the
+// outbox, from which a relay delivers them to the other services. The events
+// are stored by the call making the mutation, so none is lost when the relay
+// or their consumers are down. Each gets an ObjectID from the time it was
+// published, for the relay to read them in order.
+type OutboxSink struct {
+	events OutboxInserter
+}
+
+var _ EventSink = (*OutboxSink)(nil)
+
+// outboxEvent is how an event is stored in the outbox.
+type outboxEvent struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Type      EventType          `bson:"type"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Email     string             `bson:"email,omitempty"`
+	Timestamp time.Time          `bson:"timestamp"`
+}
+
+// NewOutboxSink returns an OutboxSink on the OutboxCollection of db, usually
+// the database of the users.
+func NewOutboxSink(db *mongo.Database) *OutboxSink {
+	return NewOutboxSinkFromCollection(db.Collection(OutboxCollection))
+}
+
+// NewOutboxSinkFromCollection returns an OutboxSink inserting the events in
+// events, typically a *mongo.Collection.
+func NewOutboxSinkFromCollection(events OutboxInserter) *OutboxSink {
+	return &OutboxSink{events: events}
+}
+
+func (s *OutboxSink) Publish(ctx context.Context, event UserEvent) error {
+	_, err := s.events.InsertOne(ctx, &outboxEvent{
+		ID:        primitive.NewObjectIDFromTimestamp(event.Timestamp),
+		Type:      event.Type,
+		UserID:    event.UserID,
+		Email:     event.Email,
+		Timestamp: event.Timestamp,
+	})
+
+	return err
+}
+
+// publishAudited is publish for a mutation whose audit returned auditErr. The
+// event is published whatever auditErr, as the mutation is applied, and
+// auditErr is returned first.
+func (m *MongoRepo) publishAudited(
+	ctx context.Context, auditErr error, eventType EventType, id primitive.ObjectID, email string,
+) error {
+	err := m.publish(ctx, eventType, id, email)
+	if auditErr != nil {
+		return auditErr
+	}
+
+	return err
+}
+
+// publish sends the event of a mutation which succeeded to the sink of the
+// repo, if any. A failure is logged and ignored unless the repo was given
+// RequireEventDelivery, in which case it is returned though the mutation is
+// applied.
+func (m *MongoRepo) publish(ctx context.Context, eventType EventType, id primitive.ObjectID, email string) error {
+	if m.events == nil {
+		return nil
+	}
+
+	err := m.events.Publish(ctx, UserEvent{Type: eventType, UserID: id, Email: email, Timestamp: m.timestamp()})
+	if err == nil {
+		return nil
+	}
+
+	if m.requireDelivery {
+		return fmt.Errorf("%w: %s event of %s: %w", ErrPublishingEvent, eventType, id.Hex(), err)
+	}
+
+	if m.logger != nil {
+		m.logger.LogAttrs(ctx, slog.LevelWarn, "publishing user event failed",
+			slog.String("type", string(eventType)),
+			slog.String("user_id", id.Hex()),
+			slog.String("error", redact(err.Error())))
+	}
+
+	return nil
+}
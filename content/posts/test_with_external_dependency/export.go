@@ -0,0 +1,302 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxImportLineSize bounds the lines ImportUsersJSON reads, far above what a
+// user takes.
+const maxImportLineSize = 1 << 20
+
+var ErrMalformedJSON = errors.New("malformed json")
+
+// userRecord is the JSON form of a user written by ExportUsers and read back
+// by ImportUsersJSON, also the one FileRepo stores. Password holds the bcrypt
+// hash, or is left out.
+type userRecord struct {
+	ID            primitive.ObjectID `json:"id"`
+	Name          string             `json:"name"`
+	Email         string             `json:"email"`
+	Password      string             `json:"password,omitempty"`
+	Role          string             `json:"role"`
+	Version       int64              `json:"version"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+	DeletedAt     *time.Time         `json:"deleted_at,omitempty"`
+	ExpiresAt     *time.Time         `json:"expires_at,omitempty"`
+	EmailVerified bool               `json:"email_verified,omitempty"`
+}
+
+func newUserRecord(user *User) userRecord {
+	return userRecord{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		Password:      user.Password,
+		Role:          user.Role,
+		Version:       user.Version,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		DeletedAt:     user.DeletedAt,
+		ExpiresAt:     user.ExpiresAt,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+func (r userRecord) user() *User {
+	return &User{
+		ID:            r.ID,
+		Name:          r.Name,
+		Email:         r.Email,
+		Password:      r.Password,
+		Role:          r.Role,
+		Version:       r.Version,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+		DeletedAt:     r.DeletedAt,
+		ExpiresAt:     r.ExpiresAt,
+		EmailVerified: r.EmailVerified,
+	}
+}
+
+// ExportOptions tunes ExportUsers.
+type ExportOptions struct {
+	// BatchSize is the number of users read per round trip, 50 when zero or
+	// negative.
+	BatchSize int64
+	// IncludeSecrets exports the password hashes, which ImportUsersJSON
+	// needs to restore the users. Leave it unset for exports read by people.
+	IncludeSecrets bool
+}
+
+// ExportUsers writes every user, soft-deleted ones included, to w as
+// newline-delimited JSON, one user per line in ID order, and returns how many
+// it wrote. Users are read with IterateUsers, by batches of opts.BatchSize,
+// and written as they come, so the collection is never held in memory, and
+// ctx is checked between users. Passwords are left out unless
+// opts.IncludeSecrets is set.
+//
+// Users created or deleted during the export may or may not be in it, the
+// others are exactly once.
+func (m *MongoRepo) ExportUsers(ctx context.Context, w io.Writer, opts ExportOptions) (int64, error) {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultPageSize
+	}
+
+	if batchSize > maxPageSize {
+		batchSize = maxPageSize
+	}
+
+	readOpts := []ReadOption{IncludeDeleted(), WithBatchSize(int32(batchSize))}
+	if opts.IncludeSecrets {
+		readOpts = append(readOpts, WithPassword())
+	}
+
+	users, err := m.IterateUsers(ctx, UserFilter{}, readOpts...)
+	if err != nil {
+		return 0, err
+	}
+	defer users.Close()
+
+	encoder := json.NewEncoder(w)
+
+	var exported int64
+
+	for {
+		user, err := users.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return exported, nil
+		}
+
+		if err != nil {
+			return exported, err
+		}
+
+		// Encode ends each record with a newline.
+		err = encoder.Encode(newUserRecord(user))
+		if err != nil {
+			return exported, fmt.Errorf("writing user %s: %w", user.ID.Hex(), err)
+		}
+
+		exported++
+	}
+}
+
+// ConflictPolicy tells ImportUsersJSON what to do with a user whose ID is
+// already stored.
+type ConflictPolicy int
+
+const (
+	// ConflictSkip keeps the stored user and reports the imported one as
+	// skipped.
+	ConflictSkip ConflictPolicy = iota
+	// ConflictUpsert replaces the stored user with the imported one.
+	ConflictUpsert
+)
+
+// JSONImportOptions tunes ImportUsersJSON.
+type JSONImportOptions struct {
+	OnConflict ConflictPolicy
+}
+
+// ImportUsersJSON stores the users of the newline-delimited JSON read from r,
+// as written by ExportUsers with IncludeSecrets, as they are: with their ID,
+// password hash, version and timestamps. Users whose ID is already stored
+// are skipped or replaced as opts.OnConflict says, and users whose email
+// belongs to another stored user are skipped. The returned ImportReport
+// counts the created, replaced, skipped and invalid users, with an entry in
+// Errors per skipped or invalid one; users exported without their password,
+// or with a password which isn't a bcrypt hash, are invalid.
+//
+// A line which isn't JSON stops the import with an *ImportRowError matching
+// ErrMalformedJSON, and a write failure with one carrying it. Either way the
+// users stored so far stay and the report counts them.
+func (m *MongoRepo) ImportUsersJSON(ctx context.Context, r io.Reader, opts JSONImportOptions) (
+	_ ImportReport, err error,
+) {
+	if m.closed.Load() {
+		return ImportReport{}, ErrRepoClosed
+	}
+
+	ctx, call := m.begin(ctx, "ImportUsersJSON", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	var report ImportReport
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxImportLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+
+		var record userRecord
+
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return report, &ImportRowError{Line: line, Err: fmt.Errorf("%w: %s", ErrMalformedJSON, err)}
+		}
+
+		user := record.user()
+
+		err = validateRecord(user)
+		if err != nil {
+			report.Invalid++
+			report.Errors = append(report.Errors, &ImportRowError{Line: line, Err: err})
+
+			continue
+		}
+
+		err = m.importRecord(ctx, user, opts.OnConflict, &report)
+		if err != nil {
+			var rowErr *ImportRowError
+			if !errors.As(err, &rowErr) {
+				return report, &ImportRowError{Line: line, Err: err}
+			}
+
+			rowErr.Line = line
+			report.SkippedDuplicates++
+			report.Errors = append(report.Errors, rowErr)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return report, fmt.Errorf("%w: %s", ErrMalformedJSON, err)
+	}
+
+	return report, nil
+}
+
+// validateRecord checks user, read by ImportUsersJSON, can be stored as is,
+// its password being a bcrypt hash and never a plaintext one.
+func validateRecord(user *User) error {
+	if user.ID.IsZero() {
+		return fmt.Errorf("%w: id is zero", ErrInvalidUserID)
+	}
+
+	err := user.Validate()
+	if err != nil {
+		return err
+	}
+
+	if !isPasswordHash(user.Password) {
+		return fmt.Errorf("%w: password isn't a bcrypt hash", ErrInvalidUser)
+	}
+
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+
+	user.Email = email
+
+	return nil
+}
+
+// importRecord stores user as is, counting it in report. A conflict the
+// import goes on after is returned as an *ImportRowError, without its line.
+func (m *MongoRepo) importRecord(ctx context.Context, user *User, policy ConflictPolicy, report *ImportReport) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	doc := toDocument(user)
+
+	_, err := m.mongoCaller.InsertOne(ctx, m.encrypted(doc))
+	if err == nil {
+		report.Created++
+		return m.publishAudited(ctx, m.writeAudit(ctx, "ImportUsersJSON", nil, user),
+			EventUserCreated, doc.ID, doc.Email)
+	}
+
+	if !mongo.IsDuplicateKeyError(err) {
+		return translateWriteError(ErrInsertingUser, err)
+	}
+
+	conflict := alreadyExistsError(doc.ID, doc.Email, err)
+
+	// Only a user having the same ID is replaced, one having the email
+	// under another ID is another user.
+	if policy != ConflictUpsert || !strings.Contains(err.Error(), "index: _id_") {
+		return &ImportRowError{Err: conflict}
+	}
+
+	before, err := m.snapshot(ctx, "ImportUsersJSON", bson.M{"_id": doc.ID})
+	if err != nil {
+		return err
+	}
+
+	result, err := m.mongoCaller.ReplaceOne(ctx, bson.M{"_id": doc.ID}, m.encrypted(doc))
+	if mongo.IsDuplicateKeyError(err) {
+		return &ImportRowError{Err: alreadyExistsError(doc.ID, doc.Email, err)}
+	}
+
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	if result.MatchedCount == 0 {
+		// Deleted since the insert failed.
+		return &ImportRowError{Err: fmt.Errorf("%w: %s", ErrUserNotFound, doc.ID.Hex())}
+	}
+
+	report.Updated++
+
+	return m.publishAudited(ctx, m.audit(ctx, "ImportUsersJSON", bson.M{"_id": doc.ID}, before),
+		EventUserUpdated, doc.ID, doc.Email)
+}
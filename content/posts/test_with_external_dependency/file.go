@@ -0,0 +1,303 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrOpeningFileStore = errors.New("error opening file store")
+	ErrCorruptStore     = errors.New("corrupt store")
+)
+
+// CorruptStoreError is returned by NewFileRepo when the file doesn't hold a
+// valid store. It matches ErrCorruptStore with errors.Is.
+type CorruptStoreError struct {
+	Path string
+	// Offset is how many bytes of the file were read when parsing failed,
+	// and Line and Column, counted from one, the position of the last of
+	// them, which is where the problem is. All three are zero when the file
+	// parsed but holds users that can't be stored together, such as two with
+	// the same email.
+	Offset int64
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *CorruptStoreError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s %s: %s", ErrCorruptStore, e.Path, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s at line %d, column %d: %s", ErrCorruptStore, e.Path, e.Line, e.Column, e.Err)
+}
+
+func (e *CorruptStoreError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptStoreError) Is(target error) bool {
+	return target == ErrCorruptStore
+}
+
+// FileRepo is a UserRepository keeping its users in a JSON file, for the
+// runnable examples and fixtures which need users to outlive the process
+// without a database. The users are held in memory, following the rules of
+// InMemoryUserRepository, and the whole file is rewritten after every
+// change: first to a temporary file next to it, then renamed over it, so the
+// file always holds either the users before the change or after it.
+//
+// It is safe for concurrent use within a process, but two FileRepos on the
+// same file overwrite each other's changes.
+type FileRepo struct {
+	// mu makes each change and the write of its result one step, so the
+	// writes land in the order of the changes.
+	mu   sync.Mutex
+	path string
+	mem  *InMemoryUserRepository
+}
+
+var _ UserRepository = (*FileRepo)(nil)
+
+// fileStore is the content of the file, where users are stored with their
+// password hash.
+type fileStore struct {
+	Users []userRecord `json:"users"`
+}
+
+// NewFileRepo loads the users stored in the file at path. A missing file is
+// an empty store, created on the first change. Of opts, only WithBcryptCost,
+// WithClock and WithIDGenerator apply, the others are about the database and
+// ignored.
+func NewFileRepo(path string, opts ...Option) (*FileRepo, error) {
+	mem, err := NewInMemoryUserRepository(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrOpeningFileStore, err)
+	}
+
+	if err == nil {
+		users, err := decodeFileStore(path, data)
+		if err != nil {
+			return nil, err
+		}
+
+		mem.replace(users)
+	}
+
+	return &FileRepo{path: path, mem: mem}, nil
+}
+
+// decodeFileStore returns the users of the file at path holding data.
+func decodeFileStore(path string, data []byte) ([]*User, error) {
+	var store fileStore
+
+	err := json.Unmarshal(data, &store)
+	if err != nil {
+		corrupt := &CorruptStoreError{Path: path, Err: err}
+
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+
+		switch {
+		case errors.As(err, &syntaxErr):
+			corrupt.Offset = syntaxErr.Offset
+		case errors.As(err, &typeErr):
+			corrupt.Offset = typeErr.Offset
+		default:
+			return nil, corrupt
+		}
+
+		corrupt.Line, corrupt.Column = position(data, corrupt.Offset)
+
+		return nil, corrupt
+	}
+
+	users := make([]*User, 0, len(store.Users))
+	ids := make(map[primitive.ObjectID]struct{}, len(store.Users))
+	emails := make(map[string]struct{}, len(store.Users))
+
+	for i, stored := range store.Users {
+		_, idTaken := ids[stored.ID]
+		_, emailTaken := emails[stored.Email]
+
+		problem := ""
+
+		switch {
+		case stored.ID.IsZero():
+			problem = "zero id"
+		case idTaken:
+			problem = "duplicate id " + stored.ID.Hex()
+		case stored.Email == "":
+			problem = "empty email"
+		case emailTaken:
+			problem = "duplicate email " + stored.Email
+		}
+
+		if problem != "" {
+			return nil, &CorruptStoreError{Path: path, Err: fmt.Errorf("user %d: %s", i, problem)}
+		}
+
+		ids[stored.ID] = struct{}{}
+		emails[stored.Email] = struct{}{}
+
+		users = append(users, stored.user())
+	}
+
+	return users, nil
+}
+
+// position returns the line and column of the last of the first offset bytes
+// of data.
+func position(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	if offset <= 0 {
+		return 1, 1
+	}
+
+	before := data[:offset-1]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+
+	return line, column
+}
+
+// CreateUser stores user like InMemoryUserRepository.CreateUser does, then
+// writes the file. user is only updated in place once the file is written,
+// so a failed call can be retried with it.
+func (r *FileRepo) CreateUser(ctx context.Context, user *User, opts ...WriteOption) (*User, error) {
+	created := copyUser(user)
+
+	err := r.change(ErrInsertingUser, func() error {
+		_, err := r.mem.CreateUser(ctx, created, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	*user = *created
+
+	return user, nil
+}
+
+func (r *FileRepo) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (*User, error) {
+	return r.mem.GetUserByID(ctx, id, opts...)
+}
+
+func (r *FileRepo) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (*User, error) {
+	return r.mem.GetUserByEmail(ctx, email, opts...)
+}
+
+// UpdateUser replaces the user like InMemoryUserRepository.UpdateUser does,
+// then writes the file. user.Version only changes once the file is written.
+func (r *FileRepo) UpdateUser(ctx context.Context, user *User, opts ...WriteOption) error {
+	updated := copyUser(user)
+
+	err := r.change(ErrUpdatingUser, func() error {
+		return r.mem.UpdateUser(ctx, updated, opts...)
+	})
+	if err != nil {
+		return err
+	}
+
+	*user = *updated
+
+	return nil
+}
+
+// DeleteUser removes the user for good, then writes the file.
+func (r *FileRepo) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	return r.change(ErrDeletingUser, func() error {
+		return r.mem.DeleteUser(ctx, id)
+	})
+}
+
+func (r *FileRepo) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) ([]*User, error) {
+	return r.mem.ListUsers(ctx, limit, offset, opts...)
+}
+
+func (r *FileRepo) ListUsersAfter(
+	ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption,
+) ([]*User, primitive.ObjectID, error) {
+	return r.mem.ListUsersAfter(ctx, afterID, limit, opts...)
+}
+
+// change applies apply to the users in memory and writes the result to the
+// file. When the write fails, the users in memory are put back as they were
+// and the error matches sentinel.
+func (r *FileRepo) change(sentinel error, apply func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := r.mem.snapshot()
+
+	err := apply()
+	if err != nil {
+		return err
+	}
+
+	err = r.write(r.mem.snapshot())
+	if err != nil {
+		r.mem.replace(before)
+		return driverError(sentinel, err)
+	}
+
+	return nil
+}
+
+// write replaces the file with one holding users.
+func (r *FileRepo) write(users []*User) error {
+	store := fileStore{Users: make([]userRecord, 0, len(users))}
+
+	for _, user := range users {
+		store.Users = append(store.Users, newUserRecord(user))
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is in the same directory so the rename doesn't
+	// cross file systems, which would make it a copy.
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tmp.Name(), r.path)
+}
@@ -0,0 +1,53 @@
+package users
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UserFilter selects users on the fields that are set. Zero-value fields don't
+// constrain the query, so an empty filter matches every user. CreatedAfter
+// and CreatedBefore bound CreatedAt, which the users stored without one never
+// match.
+type UserFilter struct {
+	Name          string
+	Email         string
+	Role          string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// AllowAll lets DeleteUsersMatching run with an otherwise empty filter.
+	AllowAll bool
+}
+
+func (f UserFilter) toBSON() bson.M {
+	filter := bson.M{}
+
+	if f.Name != "" {
+		filter["name"] = f.Name
+	}
+
+	if f.Email != "" {
+		filter["email"] = f.Email
+	}
+
+	if f.Role != "" {
+		filter["role"] = f.Role
+	}
+
+	created := bson.M{}
+
+	if !f.CreatedAfter.IsZero() {
+		created["$gt"] = f.CreatedAfter
+	}
+
+	if !f.CreatedBefore.IsZero() {
+		created["$lt"] = f.CreatedBefore
+	}
+
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+
+	return filter
+}
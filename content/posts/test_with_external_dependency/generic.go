@@ -0,0 +1,232 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInsertingDocument     = errors.New("error inserting document")
+	ErrFindingDocument       = errors.New("error finding document")
+	ErrReplacingDocument     = errors.New("error replacing document")
+	ErrDeletingDocument      = errors.New("error deleting document")
+	ErrListingDocuments      = errors.New("error listing documents")
+	ErrDocumentNotFound      = errors.New("document not found")
+	ErrDocumentAlreadyExists = errors.New("document already exists")
+)
+
+// Entity is a document Repository stores, a pointer to a struct whose _id is
+// read and set with GetID and SetID:
+//
+//	type Post struct {
+//		ID    primitive.ObjectID `bson:"_id"`
+//		Title string             `bson:"title"`
+//	}
+//
+//	func (p *Post) GetID() primitive.ObjectID   { return p.ID }
+//	func (p *Post) SetID(id primitive.ObjectID) { p.ID = id }
+type Entity interface {
+	GetID() primitive.ObjectID
+	SetID(id primitive.ObjectID)
+}
+
+// DocumentCaller is the part of MongoCaller Repository is built on.
+type DocumentCaller interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+		*mongo.InsertOneResult, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (
+		*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+var _ DocumentCaller = (*mongo.Collection)(nil)
+
+// Repository stores the documents of type T in a collection, by ID. It is the
+// part of MongoRepo which doesn't depend on users, for the other types of an
+// application to reuse: MongoRepo stores its documents through a
+// Repository[*userDocument] and adds what users need on top, such as the
+// lookups by email and the hashing of passwords.
+type Repository[T Entity] struct {
+	caller DocumentCaller
+	// collection is the name reported in errors.
+	collection string
+}
+
+// NewRepository returns the Repository of the documents of the named
+// collection of db.
+func NewRepository[T Entity](db *mongo.Database, collection string) *Repository[T] {
+	return NewRepositoryFromCollection[T](db.Collection(collection), collection)
+}
+
+// NewRepositoryFromCollection returns the Repository of the documents read and
+// written with caller, such as a *mongo.Collection or a MockCollection, whose
+// name is collection.
+func NewRepositoryFromCollection[T Entity](caller DocumentCaller, collection string) *Repository[T] {
+	return &Repository[T]{caller: caller, collection: collection}
+}
+
+// Insert stores doc, after giving it a new ID if it has none. A document with
+// the same ID, or colliding on a unique index, makes it fail with
+// ErrDocumentAlreadyExists.
+func (r *Repository[T]) Insert(ctx context.Context, doc T) error {
+	err := r.insert(ctx, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s %s", ErrDocumentAlreadyExists, r.collection, doc.GetID().Hex())
+	}
+
+	if err != nil {
+		return translateWriteError(ErrInsertingDocument, err)
+	}
+
+	return nil
+}
+
+// FindByID returns the document with this id, or fails with
+// ErrDocumentNotFound.
+func (r *Repository[T]) FindByID(ctx context.Context, id primitive.ObjectID) (T, error) {
+	doc, err := r.findOne(ctx, bson.M{"_id": id})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return doc, fmt.Errorf("%w: %s %s", ErrDocumentNotFound, r.collection, id.Hex())
+	}
+
+	if err != nil {
+		return doc, driverError(ErrFindingDocument, err)
+	}
+
+	return doc, nil
+}
+
+// Replace overwrites the stored document having the ID of doc with doc, or
+// fails with ErrDocumentNotFound when there is none.
+func (r *Repository[T]) Replace(ctx context.Context, doc T) error {
+	matched, err := r.replace(ctx, bson.M{"_id": doc.GetID()}, doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s %s", ErrDocumentAlreadyExists, r.collection, doc.GetID().Hex())
+	}
+
+	if err != nil {
+		return translateWriteError(ErrReplacingDocument, err)
+	}
+
+	if !matched {
+		return fmt.Errorf("%w: %s %s", ErrDocumentNotFound, r.collection, doc.GetID().Hex())
+	}
+
+	return nil
+}
+
+// Delete removes the document with this id, or fails with ErrDocumentNotFound
+// when there is none.
+func (r *Repository[T]) Delete(ctx context.Context, id primitive.ObjectID) error {
+	deleted, err := r.delete(ctx, bson.M{"_id": id})
+	if err != nil {
+		return translateWriteError(ErrDeletingDocument, err)
+	}
+
+	if !deleted {
+		return fmt.Errorf("%w: %s %s", ErrDocumentNotFound, r.collection, id.Hex())
+	}
+
+	return nil
+}
+
+// List returns a page of documents ordered by ID. The limit is bounded as in
+// MongoRepo.ListUsers.
+func (r *Repository[T]) List(ctx context.Context, limit, offset int64) ([]T, error) {
+	if limit < 1 {
+		limit = defaultPageSize
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	docs, err := r.find(ctx, bson.M{}, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit).
+		SetSkip(offset))
+	if err != nil {
+		return nil, driverError(ErrListingDocuments, err)
+	}
+
+	return docs, nil
+}
+
+// The methods below return the errors of the driver as they are, for
+// MongoRepo to report them as user errors.
+
+func (r *Repository[T]) insert(ctx context.Context, doc T) error {
+	if doc.GetID().IsZero() {
+		doc.SetID(primitive.NewObjectID())
+	}
+
+	_, err := r.caller.InsertOne(ctx, doc)
+
+	return err
+}
+
+// findOne returns the first document matching filter, failing with
+// mongo.ErrNoDocuments when there is none.
+func (r *Repository[T]) findOne(ctx context.Context, filter bson.M, opts ...*options.FindOneOptions) (T, error) {
+	var doc T
+
+	err := r.caller.FindOne(ctx, filter, opts...).Decode(&doc)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return doc, nil
+}
+
+func (r *Repository[T]) find(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := r.caller.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []T{}
+
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+// replace overwrites the document matching filter with doc, and tells whether
+// there was one.
+func (r *Repository[T]) replace(ctx context.Context, filter bson.M, doc T, opts ...*options.ReplaceOptions) (
+	bool, error,
+) {
+	result, err := r.caller.ReplaceOne(ctx, filter, doc, opts...)
+	if err != nil {
+		return false, err
+	}
+
+	return result.MatchedCount > 0, nil
+}
+
+// delete removes the document matching filter, and tells whether there was
+// one.
+func (r *Repository[T]) delete(ctx context.Context, filter bson.M) (bool, error) {
+	result, err := r.caller.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
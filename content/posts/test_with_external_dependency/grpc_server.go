@@ -0,0 +1,116 @@
+package users
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative user.proto
+
+// UserServer is the UserService of user.proto, serving the users of a
+// UserRepository. Register it on a grpc.Server with
+// RegisterUserServiceServer.
+type UserServer struct {
+	UnimplementedUserServiceServer
+
+	repo UserRepository
+}
+
+// NewUserServer returns a UserServer on repo.
+func NewUserServer(repo UserRepository) *UserServer {
+	return &UserServer{repo: repo}
+}
+
+func (s *UserServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
+	user, err := s.repo.CreateUser(ctx, &User{
+		Name:     req.GetName(),
+		Email:    req.GetEmail(),
+		Password: req.GetPassword(),
+		Role:     req.GetRole(),
+	})
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+
+	return &CreateUserResponse{User: userInfo(user)}, nil
+}
+
+func (s *UserServer) GetUser(ctx context.Context, req *GetUserRequest) (*GetUserResponse, error) {
+	id, err := requestUserID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+
+	return &GetUserResponse{User: userInfo(user)}, nil
+}
+
+func (s *UserServer) DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error) {
+	id, err := requestUserID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.repo.DeleteUser(ctx, id)
+	if err != nil {
+		return nil, grpcStatus(err)
+	}
+
+	return &DeleteUserResponse{}, nil
+}
+
+// requestUserID returns the ObjectID of the hex id, or an INVALID_ARGUMENT
+// status.
+func requestUserID(id string) (primitive.ObjectID, error) {
+	objectID, err := ParseUserID(id)
+	if err != nil {
+		return primitive.NilObjectID, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return objectID, nil
+}
+
+// userInfo returns user as sent to clients, which leaves its password out.
+func userInfo(user *User) *UserInfo {
+	return &UserInfo{
+		Id:      user.ID.Hex(),
+		Name:    user.Name,
+		Email:   user.Email,
+		Role:    user.Role,
+		Version: user.Version,
+	}
+}
+
+// grpcStatus returns the status a repository error is reported with. The
+// errors the client can't act on are reported as INTERNAL without their
+// message, which could tell about the database.
+func grpcStatus(err error) error {
+	var code codes.Code
+
+	switch {
+	case errors.Is(err, ErrUserAlreadyExists), errors.Is(err, ErrEmailAlreadyTaken):
+		code = codes.AlreadyExists
+	case IsNotFound(err):
+		code = codes.NotFound
+	case errors.Is(err, ErrInvalidUser), errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrInvalidUserID):
+		code = codes.InvalidArgument
+	case errors.Is(err, ErrOperationTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, ErrOperationCanceled):
+		code = codes.Canceled
+	case errors.Is(err, ErrTemporarilyUnavailable):
+		code = codes.Unavailable
+	default:
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	return status.Error(code, redact(err.Error()))
+}
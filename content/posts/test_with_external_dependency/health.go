@@ -0,0 +1,67 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds the ping made by Health, which is meant to be cheap.
+const healthTimeout = 2 * time.Second
+
+// HealthDetails describes the outcome of a health check.
+type HealthDetails struct {
+	// Latency is how long the server took to answer the ping.
+	Latency time.Duration
+	// Address lists the hosts the repo connects to.
+	Address string
+}
+
+// Health returns nil when the server answers a ping within a couple of seconds
+// and ErrConnectingToMongoDatabase otherwise.
+func (m *MongoRepo) Health(ctx context.Context) error {
+	_, err := m.HealthDetails(ctx)
+
+	return err
+}
+
+// HealthDetails is Health also reporting the ping latency and the server
+// address, for diagnostics. They are filled in even when the check fails.
+func (m *MongoRepo) HealthDetails(ctx context.Context) (HealthDetails, error) {
+	details := HealthDetails{Address: m.address}
+
+	if m.closed.Load() {
+		return details, ErrRepoClosed
+	}
+
+	if m.client == nil {
+		return details, fmt.Errorf("%w: no client to ping", ErrConnectingToMongoDatabase)
+	}
+
+	start := time.Now()
+	err := ping(ctx, m.client, healthTimeout)
+	details.Latency = time.Since(start)
+
+	if err != nil {
+		return details, fmt.Errorf("%w: %s", ErrConnectingToMongoDatabase, err)
+	}
+
+	return details, nil
+}
+
+// ReadyzHandler answers readiness probes, typically mounted on /readyz: 200
+// when repo is healthy and 503 otherwise.
+//
+//	http.Handle("/readyz", ReadyzHandler(repo))
+func ReadyzHandler(repo *MongoRepo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := repo.Health(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+}
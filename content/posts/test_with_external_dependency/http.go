@@ -0,0 +1,309 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxRequestBodySize bounds the bodies UserHandler reads, far above what a
+// user takes.
+const maxRequestBodySize = 64 << 10
+
+// NewUserHandler returns the HTTP handler of the users of repo, speaking
+// JSON:
+//
+//	POST   /users             creates a user, answering 201 with its Location
+//	GET    /users?email=...   returns the user having the email
+//	GET    /users             lists users, paginated with limit and page_token
+//	GET    /users/{id}        returns the user having the ID
+//	DELETE /users/{id}        deletes the user, answering 204
+//
+// A listing answers the next_page_token to pass as page_token for the next
+// page, none on the last one. The tokens are the ones of the PageTokens of
+// repo when it has any, as MongoRepo does, of a random key otherwise. The
+// offset parameter is still served, without tokens, for the clients of
+// before.
+//
+// Users are returned without their password. Failures are answered with an
+// errorResponse and the status matching the repository error, such as 404
+// for ErrUserNotFound.
+func NewUserHandler(repo UserRepository) http.Handler {
+	h := &userHandler{repo: repo, tokens: newRandomPageTokens()}
+
+	if source, ok := repo.(interface{ PageTokens() *PageTokens }); ok {
+		h.tokens = source.PageTokens()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /users", h.create)
+	mux.HandleFunc("GET /users", h.list)
+	mux.HandleFunc("GET /users/{id}", h.get)
+	mux.HandleFunc("DELETE /users/{id}", h.delete)
+
+	return mux
+}
+
+type userHandler struct {
+	repo   UserRepository
+	tokens *PageTokens
+}
+
+type createUserBody struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// userResponse is a user as answered by UserHandler, never with its
+// password.
+type userResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type listUsersResponse struct {
+	Users         []userResponse `json:"users"`
+	NextPageToken string         `json:"next_page_token,omitempty"`
+}
+
+// errorResponse is the body of every failed request.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	// Code tells the failures apart, e.g. "not_found".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (h *userHandler) create(w http.ResponseWriter, r *http.Request) {
+	var body createUserBody
+
+	err := decodeBody(w, r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := h.repo.CreateUser(r.Context(), &User{
+		Name:     body.Name,
+		Email:    body.Email,
+		Password: body.Password,
+		Role:     body.Role,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/users/"+user.ID.Hex())
+	writeJSON(w, http.StatusCreated, newUserResponse(user))
+}
+
+func (h *userHandler) get(w http.ResponseWriter, r *http.Request) {
+	id, err := pathUserID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := h.repo.GetUserByID(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+func (h *userHandler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Has("email") {
+		user, err := h.repo.GetUserByEmail(r.Context(), query.Get("email"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newUserResponse(user))
+
+		return
+	}
+
+	limit, err := queryInt(query.Get("limit"), "limit")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var (
+		users []*User
+		next  string
+	)
+
+	if query.Has("offset") {
+		var offset int64
+
+		offset, err = queryInt(query.Get("offset"), "offset")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		users, err = h.repo.ListUsers(r.Context(), limit, offset)
+	} else {
+		users, next, err = listUsersPage(r.Context(), h.repo, h.tokens, query.Get("page_token"), limit, nil)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := listUsersResponse{Users: make([]userResponse, 0, len(users)), NextPageToken: next}
+	for _, user := range users {
+		response.Users = append(response.Users, newUserResponse(user))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *userHandler) delete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathUserID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = h.repo.DeleteUser(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestError is a request UserHandler can't make sense of, answered with
+// status.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// decodeBody decodes the JSON body of r into v, refusing bodies over
+// maxRequestBodySize, unknown fields and trailing data.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &requestError{
+				status:  http.StatusRequestEntityTooLarge,
+				message: fmt.Sprintf("body larger than %d bytes", tooLarge.Limit),
+			}
+		}
+
+		return &requestError{status: http.StatusBadRequest, message: "invalid body: " + err.Error()}
+	}
+
+	if decoder.More() {
+		return &requestError{status: http.StatusBadRequest, message: "invalid body: data after the JSON object"}
+	}
+
+	return nil
+}
+
+// pathUserID returns the ObjectID in the {id} path parameter of r.
+func pathUserID(r *http.Request) (primitive.ObjectID, error) {
+	return ParseUserID(r.PathValue("id"))
+}
+
+// queryInt parses the query parameter name, zero when missing.
+func queryInt(value, name string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, &requestError{status: http.StatusBadRequest, message: fmt.Sprintf("invalid %s %q", name, value)}
+	}
+
+	return n, nil
+}
+
+func newUserResponse(user *User) userResponse {
+	return userResponse{
+		ID:        user.ID.Hex(),
+		Name:      user.Name,
+		Email:     user.Email,
+		Role:      user.Role,
+		Version:   user.Version,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		ExpiresAt: user.ExpiresAt,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers err with the status and code matching it. Like
+// grpcStatus, it hides the message of the errors the client can't act on.
+func writeError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+
+	status, code := http.StatusInternalServerError, "internal"
+
+	switch {
+	case errors.As(err, &reqErr):
+		status, code = reqErr.status, "invalid_request"
+	case errors.Is(err, ErrUserAlreadyExists), errors.Is(err, ErrEmailAlreadyTaken):
+		status, code = http.StatusConflict, "already_exists"
+	case IsNotFound(err):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, ErrInvalidUser), errors.Is(err, ErrInvalidEmail):
+		status, code = http.StatusBadRequest, "invalid_user"
+	case errors.Is(err, ErrInvalidUserID):
+		status, code = http.StatusBadRequest, "invalid_id"
+	case errors.Is(err, ErrInvalidPageToken):
+		status, code = http.StatusBadRequest, "invalid_page_token"
+	case errors.Is(err, ErrOperationTimeout):
+		status, code = http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, ErrTemporarilyUnavailable):
+		status, code = http.StatusServiceUnavailable, "unavailable"
+	}
+
+	message := redact(err.Error())
+	if status == http.StatusInternalServerError {
+		message = "internal error"
+	}
+
+	writeJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: message}})
+}
@@ -0,0 +1,132 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+	maxIdempotencyKeyLength  = 256
+)
+
+var ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+
+// errIdempotencyKeyTaken is matched by the ErrUserAlreadyExists of an insert
+// whose idempotency key another user holds.
+var errIdempotencyKeyTaken = errors.New("idempotency key taken")
+
+// CreateUserIdempotent is CreateUser made safe to retry: the user is stored
+// with idempotencyKey, and a call made with a key a user still holds returns
+// that user, unchanged, instead of inserting user. Keys are held for the TTL
+// set with WithIdempotencyKeyTTL, after which the key creates a new user.
+//
+// Keys are unique thanks to an index created by EnsureIndexes. They aren't
+// purged by a TTL index, which would delete the users: a key past its TTL is
+// released by the next call made with it.
+func (m *MongoRepo) CreateUserIdempotent(ctx context.Context, user *User, idempotencyKey string) (
+	_ *User, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	switch {
+	case user == nil:
+		return nil, fmt.Errorf("%w: user is nil", ErrInvalidUser)
+	case idempotencyKey == "":
+		return nil, fmt.Errorf("%w: key is empty", ErrInvalidIdempotencyKey)
+	case len(idempotencyKey) > maxIdempotencyKeyLength:
+		return nil, fmt.Errorf("%w: key is longer than %d bytes", ErrInvalidIdempotencyKey, maxIdempotencyKeyLength)
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "CreateUserIdempotent", user.ID)
+	defer m.end(ctx, &call, &err)
+
+	now := m.timestamp()
+
+	existing, err := m.userByIdempotencyKey(ctx, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != nil {
+		if existing.idempotencyExpiresAt == nil || existing.idempotencyExpiresAt.After(now) {
+			call.userID = existing.ID
+			return existing, nil
+		}
+
+		err = m.releaseIdempotencyKey(ctx, idempotencyKey, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := m.idempotencyKeyTTL
+	if ttl == 0 {
+		ttl = defaultIdempotencyKeyTTL
+	}
+
+	expiresAt := now.Add(ttl)
+	user.idempotencyKey = idempotencyKey
+	user.idempotencyExpiresAt = &expiresAt
+
+	created, err := m.CreateUser(ctx, user)
+	if !errors.Is(err, errIdempotencyKeyTaken) {
+		return created, err
+	}
+
+	// A concurrent call with the key inserted its user first.
+	existing, err = m.userByIdempotencyKey(ctx, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserAlreadyExists, errIdempotencyKeyTaken)
+	}
+
+	call.userID = existing.ID
+
+	return existing, nil
+}
+
+// userByIdempotencyKey returns the user holding key, expired or not, or nil
+// when there is none.
+func (m *MongoRepo) userByIdempotencyKey(ctx context.Context, key string) (*User, error) {
+	var doc userDocument
+
+	err := m.mongoCaller.FindOne(ctx, bson.M{"idempotency_key": key},
+		options.FindOne().SetProjection(bson.M{"password": 0})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	return m.decode(&doc)
+}
+
+// releaseIdempotencyKey removes key from the user holding it, provided it
+// expired by now.
+func (m *MongoRepo) releaseIdempotencyKey(ctx context.Context, key string, now time.Time) error {
+	_, err := m.mongoCaller.UpdateOne(ctx,
+		bson.M{"idempotency_key": key, "idempotency_expires_at": bson.M{"$lte": now}},
+		bson.M{"$unset": bson.M{"idempotency_key": "", "idempotency_expires_at": ""}},
+	)
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package users
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// IDGenerator makes the IDs of the users created without one. The repo uses
+// primitive.NewObjectID unless WithIDGenerator sets another generator.
+type IDGenerator interface {
+	NewID() primitive.ObjectID
+}
+
+type objectIDGenerator struct{}
+
+func (objectIDGenerator) NewID() primitive.ObjectID {
+	return primitive.NewObjectID()
+}
+
+// SequentialIDGenerator makes the IDs 000000000000000000000001,
+// 000000000000000000000002 and so on, so tests know the IDs of the users they
+// create and the order they sort in. The zero value is ready to use and safe
+// for concurrent use.
+type SequentialIDGenerator struct {
+	last atomic.Uint64
+}
+
+var _ IDGenerator = (*SequentialIDGenerator)(nil)
+
+func (g *SequentialIDGenerator) NewID() primitive.ObjectID {
+	var id primitive.ObjectID
+	binary.BigEndian.PutUint64(id[4:], g.last.Add(1))
+
+	return id
+}
+
+// ParseUserID returns the ID written in hex as s, such as a path parameter or
+// a flag, ignoring the spaces around it. Either case is accepted. A value
+// which isn't 24 hex characters makes it fail with an error wrapping
+// ErrInvalidUserID and quoting s, ready to be shown to the caller.
+func ParseUserID(s string) (primitive.ObjectID, error) {
+	trimmed := strings.TrimSpace(s)
+
+	switch {
+	case trimmed == "":
+		return primitive.NilObjectID, fmt.Errorf("%w: id is empty", ErrInvalidUserID)
+	case len(trimmed) != 2*len(primitive.NilObjectID):
+		return primitive.NilObjectID, fmt.Errorf("%w: %q is not %d hex characters",
+			ErrInvalidUserID, s, 2*len(primitive.NilObjectID))
+	}
+
+	var id primitive.ObjectID
+
+	_, err := hex.Decode(id[:], []byte(trimmed))
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %q is not hex", ErrInvalidUserID, s)
+	}
+
+	return id, nil
+}
+
+// MustParseUserID is ParseUserID for the IDs known to be valid, such as the
+// ones written in tests. It panics on an invalid one.
+func MustParseUserID(s string) primitive.ObjectID {
+	id, err := ParseUserID(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return id
+}
@@ -0,0 +1,263 @@
+package users
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultImportBatchSize is the number of users ImportUsersCSV inserts per
+// CreateUsers call when ImportOptions.BatchSize is unset.
+const defaultImportBatchSize = 100
+
+const utf8BOM = "\ufeff"
+
+var (
+	ErrMalformedCSV     = errors.New("malformed csv")
+	ErrInvalidCSVHeader = errors.New("invalid csv header")
+)
+
+// importColumns are the columns ImportUsersCSV requires, in any order.
+var importColumns = []string{"name", "email", "password"}
+
+// ImportOptions tunes ImportUsersCSV.
+type ImportOptions struct {
+	// BatchSize is the number of users inserted per round trip, 100 when
+	// zero or negative.
+	BatchSize int
+	// DryRun validates the rows without inserting any. Duplicates are then
+	// only found within the file, not against the stored users.
+	DryRun bool
+}
+
+// ImportReport tells what ImportUsersCSV or ImportUsersJSON did with the rows
+// it read. In a dry run Created counts the users which would have been
+// inserted.
+type ImportReport struct {
+	Created int
+	// Updated counts the stored users ImportUsersJSON replaced.
+	Updated           int
+	SkippedDuplicates int
+	Invalid           int
+	// Errors has an entry per skipped or invalid row, in file order.
+	Errors []*ImportRowError
+}
+
+// ImportRowError is what went wrong with the row starting on Line of the
+// file, counted from one with the header.
+type ImportRowError struct {
+	Line int
+	Err  error
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+// importRow is a valid row waiting to be inserted. A User is built from it
+// for every insert attempt, as CreateUsers replaces the password with its
+// hash.
+type importRow struct {
+	line                  int
+	name, email, password string
+}
+
+func (row importRow) user() *User {
+	return &User{Name: row.name, Email: row.email, Password: row.password}
+}
+
+// ImportUsersCSV inserts the users of the CSV read from r, whose header row
+// names the name, email and password columns in any order; other columns are
+// ignored and a byte order mark is skipped. Rows are validated and their
+// emails normalized as CreateUser does, then inserted by batches of
+// opts.BatchSize with CreateUsers.
+//
+// Invalid rows and rows whose email is already taken, earlier in the file or
+// by a stored user, are skipped and reported in the returned ImportReport.
+// Malformed CSV stops the import with an *ImportRowError matching
+// ErrMalformedCSV, and a batch the database refuses for another reason stops
+// it with an *ImportRowError carrying that failure and the line of the row
+// it failed on. Either way the users inserted so far stay and the report
+// counts them.
+func (m *MongoRepo) ImportUsersCSV(ctx context.Context, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	var report ImportReport
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	// Spreadsheets often start their exports with a byte order mark, which
+	// would otherwise end up in the first column name.
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		_, _ = buffered.Discard(len(utf8BOM))
+	}
+
+	reader := csv.NewReader(buffered)
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return report, fmt.Errorf("%w: empty file", ErrInvalidCSVHeader)
+	}
+
+	if err != nil {
+		return report, malformedCSVError(err)
+	}
+
+	columns, err := importHeader(header)
+	if err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]struct{})
+	batch := make([]importRow, 0, batchSize)
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return report, malformedCSVError(err)
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		row := importRow{
+			line:     line,
+			name:     strings.TrimSpace(record[columns["name"]]),
+			email:    strings.TrimSpace(record[columns["email"]]),
+			password: record[columns["password"]],
+		}
+
+		err = row.user().Validate()
+		if err == nil {
+			err = m.checkPassword(row.password)
+		}
+
+		if err == nil {
+			row.email, err = NormalizeEmail(row.email)
+		}
+
+		if err != nil {
+			report.Invalid++
+			report.Errors = append(report.Errors, &ImportRowError{Line: line, Err: err})
+
+			continue
+		}
+
+		if _, ok := seen[row.email]; ok {
+			report.SkippedDuplicates++
+			report.Errors = append(report.Errors, &ImportRowError{
+				Line: line,
+				Err:  fmt.Errorf("%w: email %s earlier in the file", ErrUserAlreadyExists, row.email),
+			})
+
+			continue
+		}
+
+		seen[row.email] = struct{}{}
+		batch = append(batch, row)
+
+		if len(batch) == batchSize {
+			err = m.importBatch(ctx, batch, opts.DryRun, &report)
+			if err != nil {
+				return report, err
+			}
+
+			batch = batch[:0]
+		}
+	}
+
+	return report, m.importBatch(ctx, batch, opts.DryRun, &report)
+}
+
+// importHeader returns the index of each of importColumns in header.
+func importHeader(header []string) (map[string]int, error) {
+	columns := make(map[string]int, len(header))
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate column %q", ErrInvalidCSVHeader, name)
+		}
+
+		columns[name] = i
+	}
+
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: missing column %q", ErrInvalidCSVHeader, name)
+		}
+	}
+
+	return columns, nil
+}
+
+// importBatch inserts rows and counts them in report. A row found to be a
+// duplicate of a stored user is skipped and the rows after it retried, since
+// the insert is ordered and stopped there.
+func (m *MongoRepo) importBatch(ctx context.Context, rows []importRow, dryRun bool, report *ImportReport) error {
+	if dryRun {
+		report.Created += len(rows)
+		return nil
+	}
+
+	for len(rows) > 0 {
+		users := make([]*User, 0, len(rows))
+		for _, row := range rows {
+			users = append(users, row.user())
+		}
+
+		_, err := m.CreateUsers(ctx, users)
+		if err == nil {
+			report.Created += len(rows)
+			return nil
+		}
+
+		var bulkErr *BulkInsertError
+		if !errors.As(err, &bulkErr) || len(bulkErr.FailedIndexes()) == 0 {
+			return &ImportRowError{Line: rows[0].line, Err: err}
+		}
+
+		failed := bulkErr.FailedIndexes()[0]
+		report.Created += bulkErr.Succeeded()
+
+		if !mongo.IsDuplicateKeyError(bulkErr.Err) {
+			return &ImportRowError{Line: rows[failed].line, Err: err}
+		}
+
+		report.SkippedDuplicates++
+		report.Errors = append(report.Errors, &ImportRowError{
+			Line: rows[failed].line,
+			Err:  fmt.Errorf("%w: email %s", ErrUserAlreadyExists, rows[failed].email),
+		})
+
+		rows = rows[failed+1:]
+	}
+
+	return nil
+}
+
+// malformedCSVError returns err, returned by the CSV reader, as an
+// *ImportRowError matching ErrMalformedCSV.
+func malformedCSVError(err error) error {
+	var parseErr *csv.ParseError
+	if !errors.As(err, &parseErr) {
+		return fmt.Errorf("%w: %s", ErrMalformedCSV, err)
+	}
+
+	return &ImportRowError{Line: parseErr.Line, Err: fmt.Errorf("%w: %s", ErrMalformedCSV, parseErr.Err)}
+}
@@ -0,0 +1,727 @@
+//go:build integration
+
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/testcontainers/testcontainers-go"
+	tcmongo "github.com/testcontainers/testcontainers-go/modules/mongodb"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The tests of this file run against a real server started in a container:
+//
+//	go test -tags integration -run TestIntegration .
+
+const (
+	integrationImage = "mongo:7"
+	postgresImage    = "postgres:16-alpine"
+)
+
+// startMongo starts a Mongo container, stopped when t ends, and returns its
+// URI. t is skipped when Docker isn't available.
+func startMongo(t *testing.T, opts ...testcontainers.ContainerCustomizer) string {
+	t.Helper()
+
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx := context.Background()
+
+	container, err := tcmongo.Run(ctx, integrationImage, opts...)
+	if err != nil {
+		t.Fatalf("error starting %s container: %s", integrationImage, err)
+	}
+
+	t.Cleanup(func() {
+		err := container.Terminate(context.Background())
+		if err != nil {
+			t.Errorf("error terminating container: %s", err)
+		}
+	})
+
+	uri, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatalf("error getting connection string: %s", err)
+	}
+
+	return uri
+}
+
+// newIntegrationRepo connects to the server at uri on a database of its own,
+// so that tests and CI jobs sharing a server don't see each other's users.
+func newIntegrationRepo(t *testing.T, uri string) *MongoRepo {
+	t.Helper()
+
+	ctx := context.Background()
+
+	repo, err := NewMongoRepo(ctx, uri, WithDatabase("blog_test_"+primitive.NewObjectID().Hex()), WithIndexCreation())
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		err := repo.Close(context.Background())
+		if err != nil {
+			t.Errorf("error closing repo: %s", err)
+		}
+	})
+
+	return repo
+}
+
+// startPostgres starts a Postgres container, stopped when t ends, and returns
+// its DSN. t is skipped when Docker isn't available.
+func startPostgres(t *testing.T) string {
+	t.Helper()
+
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	ctx := context.Background()
+
+	container, err := tcpostgres.Run(ctx, postgresImage,
+		tcpostgres.WithDatabase("blog"),
+		tcpostgres.BasicWaitStrategies(),
+	)
+	if err != nil {
+		t.Fatalf("error starting %s container: %s", postgresImage, err)
+	}
+
+	t.Cleanup(func() {
+		err := container.Terminate(context.Background())
+		if err != nil {
+			t.Errorf("error terminating container: %s", err)
+		}
+	})
+
+	dsn, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("error getting connection string: %s", err)
+	}
+
+	return dsn
+}
+
+// newPostgresIntegrationRepo connects to the database at dsn on a table of
+// its own, created by Migrate.
+func newPostgresIntegrationRepo(t *testing.T, dsn string) *PostgresRepo {
+	t.Helper()
+
+	ctx := context.Background()
+
+	repo, err := NewPostgresRepo(ctx, dsn, WithCollection("users_"+primitive.NewObjectID().Hex()), WithIndexCreation())
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		err := repo.Close(context.Background())
+		if err != nil {
+			t.Errorf("error closing repo: %s", err)
+		}
+	})
+
+	return repo
+}
+
+func TestIntegration_PostgresRepo(t *testing.T) {
+	dsn := startPostgres(t)
+
+	t.Run("Contract", func(t *testing.T) {
+		RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+			return newPostgresIntegrationRepo(t, dsn)
+		})
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		repo := newPostgresIntegrationRepo(t, dsn)
+
+		err := repo.Migrate(context.Background())
+		assert.NoError(t, err)
+	})
+
+	t.Run("DuplicateID", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newPostgresIntegrationRepo(t, dsn)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.CreateUser(ctx, &User{ID: user.ID, Name: "Jack", Email: "jack@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+		assert.ErrorContains(t, err, "id "+user.ID.Hex())
+	})
+
+	t.Run("SoftDeleted", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newPostgresIntegrationRepo(t, dsn)
+
+		deletedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+		user, err := repo.CreateUser(ctx, &User{
+			Name: "John", Email: "john@example.com", Password: "password", DeletedAt: &deletedAt,
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.GetUserByID(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		got, err := repo.GetUserByID(ctx, user.ID, IncludeDeleted())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, &deletedAt, got.DeletedAt)
+	})
+}
+
+// startMongoReplicaSet is startMongo for a single node replica set, which
+// change streams need.
+func startMongoReplicaSet(t *testing.T) string {
+	t.Helper()
+
+	// The node advertises the container hostname, unknown to the host.
+	return startMongo(t, tcmongo.WithReplicaSet("rs0")) + "/?directConnection=true"
+}
+
+func TestIntegration_WatchUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newIntegrationRepo(t, startMongoReplicaSet(t))
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes, err := repo.WatchUsers(watchCtx)
+	if err != nil {
+		t.Fatalf("error watching users: %s", err)
+	}
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	user.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	receive := func() UserChange {
+		t.Helper()
+
+		select {
+		case change := <-changes:
+			if change.Err != nil {
+				t.Fatalf("error watching users: %s", change.Err)
+			}
+
+			return change
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no change received")
+		}
+
+		return UserChange{}
+	}
+
+	created := receive()
+	assert.Equal(t, ChangeInsert, created.Operation)
+	assert.Equal(t, user.ID, created.UserID)
+	assert.Equal(t, "John", created.User.Name)
+	assert.Empty(t, created.User.Password, "password hashes must stay on the server")
+
+	replaced := receive()
+	assert.Equal(t, ChangeReplace, replaced.Operation)
+	assert.Equal(t, "Johnny", replaced.User.Name)
+
+	deleted := receive()
+	assert.Equal(t, ChangeDelete, deleted.Operation)
+	assert.Nil(t, deleted.User)
+
+	cancel()
+
+	// Resuming after the insert replays the changes which followed it.
+	resumeCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	resumed, err := repo.WatchUsersFrom(resumeCtx, created.ResumeToken)
+	if err != nil {
+		t.Fatalf("error resuming watch: %s", err)
+	}
+
+	changes = resumed
+
+	assert.Equal(t, ChangeReplace, receive().Operation)
+	assert.Equal(t, ChangeDelete, receive().Operation)
+}
+
+func TestIntegration_WithTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newIntegrationRepo(t, startMongoReplicaSet(t))
+
+	errProfile := errors.New("error creating profile")
+
+	err := repo.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			return err
+		}
+
+		return errProfile
+	})
+	assert.ErrorIs(t, err, errProfile)
+
+	// The insert was rolled back.
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	err = repo.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("error running transaction: %s", err)
+	}
+
+	_, err = repo.GetUserByEmail(ctx, "jane@example.com")
+	assert.NoError(t, err)
+}
+
+func TestIntegration_WithTransaction_Standalone(t *testing.T) {
+	repo := newIntegrationRepo(t, startMongo(t))
+
+	err := repo.WithTransaction(context.Background(), func(ctx context.Context) error {
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		return err
+	})
+	assert.ErrorIs(t, err, ErrTransactionsUnsupported)
+}
+
+func TestIntegration_CreateUserIdempotent(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newIntegrationRepo(t, startMongo(t))
+	clock := NewFakeClock(time.Now())
+	repo.clock = clock
+
+	first, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "key-1")
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	retried, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+	if err != nil {
+		t.Fatalf("error retrying user creation: %s", err)
+	}
+
+	assert.Equal(t, first.ID, retried.ID)
+
+	// Another user can't be given the key while it is held.
+	_, err = repo.CreateUser(ctx, &User{
+		Name: "Jane", Email: "jane@example.com", Password: "password", idempotencyKey: "key-1",
+	})
+	assert.ErrorIs(t, err, errIdempotencyKeyTaken)
+
+	clock.Advance(defaultIdempotencyKeyTTL)
+
+	second, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.NotEqual(t, first.ID, second.ID)
+}
+
+func TestIntegration_FieldEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newIntegrationRepo(t, startMongo(t))
+
+	fields, err := newFieldEncryption([]byte("0123456789abcdef0123456789abcdef"), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating field encryption: %s", err)
+	}
+
+	repo.fields = fields
+
+	err = repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	user, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	var raw bson.M
+
+	err = repo.mongoCaller.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&raw)
+	if err != nil {
+		t.Fatalf("error reading user: %s", err)
+	}
+
+	assert.NotEqual(t, "jane@example.com", raw["email"])
+	assert.NotEmpty(t, raw["email_hash"])
+
+	found, err := repo.GetUserByEmail(ctx, "Jane@Example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, user.ID, found.ID)
+		assert.Equal(t, "jane@example.com", found.Email)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Janet", Email: "jane@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+}
+
+func TestIntegration_UserStats(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newIntegrationRepo(t, startMongo(t))
+
+	stats, err := repo.UserStats(ctx)
+	if err != nil {
+		t.Fatalf("error computing stats of an empty collection: %s", err)
+	}
+
+	assert.Zero(t, stats.Total)
+	assert.Len(t, stats.Signups, 30)
+
+	now := time.Now().UTC()
+	clock := NewFakeClock(now.AddDate(0, 0, -3))
+	repo.clock = clock
+
+	for i, role := range []string{RoleAdmin, RoleMember, RoleMember} {
+		user, err := repo.CreateUser(ctx, &User{
+			Name:     fmt.Sprintf("User %d", i),
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+			Role:     role,
+		})
+		if err != nil {
+			t.Fatalf("error creating user %d: %s", i, err)
+		}
+
+		if i == 0 {
+			err = repo.SoftDeleteUser(ctx, user.ID)
+			if err != nil {
+				t.Fatalf("error soft-deleting user: %s", err)
+			}
+		}
+
+		clock.Set(now)
+	}
+
+	stats, err = repo.UserStats(ctx)
+	if err != nil {
+		t.Fatalf("error computing stats: %s", err)
+	}
+
+	assert.Equal(t, int64(3), stats.Total)
+	assert.Equal(t, int64(1), stats.SoftDeleted)
+	assert.Equal(t, map[string]int64{RoleAdmin: 1, RoleMember: 2}, stats.ByRole)
+	assert.Equal(t, int64(1), stats.Signups[26].Count)
+	assert.Equal(t, int64(2), stats.Signups[29].Count)
+}
+
+func TestIntegration_Tenants(t *testing.T) {
+	ctx := context.Background()
+
+	uri := startMongo(t)
+
+	repo, err := NewMongoRepo(ctx, uri, WithDatabase("blog_test_"+primitive.NewObjectID().Hex()),
+		WithTenantResolver(CollectionPerTenant("users")))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = repo.Close(context.Background())
+	})
+
+	for _, tenantID := range []string{"acme", "globex"} {
+		tenant := WithTenant(ctx, tenantID)
+
+		err = repo.EnsureTenantIndexes(ctx, tenantID)
+		if err != nil {
+			t.Fatalf("error ensuring indexes of %s: %s", tenantID, err)
+		}
+
+		_, err = repo.CreateUser(tenant, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user of %s: %s", tenantID, err)
+		}
+
+		_, err = repo.CreateUser(tenant, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+		users, err := repo.ListUsers(tenant, 10, 0)
+		if assert.NoError(t, err) {
+			assert.Len(t, users, 1)
+		}
+	}
+
+	_, err = repo.ListUsers(ctx, 10, 0)
+	assert.ErrorIs(t, err, ErrMissingTenant)
+}
+
+func TestIntegration_EmailCollation(t *testing.T) {
+	ctx := context.Background()
+
+	repo, err := NewMongoRepo(ctx, startMongo(t), WithDatabase("blog_test_"+primitive.NewObjectID().Hex()),
+		WithEmailCollation())
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = repo.Close(context.Background())
+	})
+
+	// Written before emails were normalized.
+	legacyID := primitive.NewObjectID()
+
+	_, err = repo.mongoCaller.InsertOne(ctx, bson.M{"_id": legacyID, "name": "John", "email": "John@Example.com"})
+	if err != nil {
+		t.Fatalf("error inserting user: %s", err)
+	}
+
+	err = repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error creating indexes: %s", err)
+	}
+
+	user, err := repo.GetUserByEmail(ctx, "john@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, legacyID, user.ID)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+}
+
+func TestIntegration_EmailVerification(t *testing.T) {
+	ctx := context.Background()
+
+	clock := NewFakeClock(time.Now())
+
+	repo, err := NewMongoRepo(ctx, startMongo(t), WithDatabase("blog_test_"+primitive.NewObjectID().Hex()),
+		WithClock(clock), WithVerificationTokenTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = repo.Close(context.Background())
+	})
+
+	users := SeedUsers(t, repo, 2)
+
+	token, err := repo.StartEmailVerification(ctx, users[0].ID)
+	if err != nil {
+		t.Fatalf("error starting verification: %s", err)
+	}
+
+	err = repo.ConfirmEmailVerification(ctx, token)
+	assert.NoError(t, err)
+
+	err = repo.ConfirmEmailVerification(ctx, token)
+	assert.ErrorIs(t, err, ErrTokenInvalid)
+
+	user, err := repo.GetUserByEmail(ctx, users[0].Email, VerifiedOnly())
+	if assert.NoError(t, err) {
+		assert.True(t, user.EmailVerified)
+	}
+
+	token, err = repo.StartEmailVerification(ctx, users[1].ID)
+	if err != nil {
+		t.Fatalf("error starting verification: %s", err)
+	}
+
+	clock.Advance(time.Hour)
+
+	err = repo.ConfirmEmailVerification(ctx, token)
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	_, err = repo.GetUserByEmail(ctx, users[1].Email, VerifiedOnly())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestIntegration_MongoRepo(t *testing.T) {
+	uri := startMongo(t)
+
+	t.Run("Contract", func(t *testing.T) {
+		RunRepositoryContractTests(t, func(t *testing.T) UserRepository {
+			return newIntegrationRepo(t, uri)
+		})
+	})
+
+	t.Run("CreateUser", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newIntegrationRepo(t, uri)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "John@Example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.False(t, user.ID.IsZero())
+		assert.Equal(t, "john@example.com", user.Email)
+		assert.NotEqual(t, "password", user.Password)
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newIntegrationRepo(t, uri)
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "JOHN@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	})
+
+	t.Run("GetUserByID", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newIntegrationRepo(t, uri)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		got, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, user.Name, got.Name)
+		assert.Equal(t, user.Email, got.Email)
+		assert.Equal(t, user.CreatedAt, got.CreatedAt)
+		assert.Empty(t, got.Password)
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("UpdateUser", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newIntegrationRepo(t, uri)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		user.Name = "Johnny"
+
+		err = repo.UpdateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		got, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "Johnny", got.Name)
+		assert.Equal(t, int64(2), got.Version)
+	})
+
+	t.Run("DeleteUser", func(t *testing.T) {
+		ctx := context.Background()
+		repo := newIntegrationRepo(t, uri)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		err = repo.DeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+
+		_, err = repo.GetUserByID(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		err = repo.DeleteUser(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+}
+
+func TestIntegration_Monitors(t *testing.T) {
+	uri := startMongo(t)
+	ctx := context.Background()
+
+	var (
+		mu       sync.Mutex
+		commands []string
+		pool     []string
+	)
+
+	repo, err := NewMongoRepo(ctx, uri,
+		WithDatabase("blog_test_"+primitive.NewObjectID().Hex()),
+		WithCommandMonitor(&event.CommandMonitor{
+			Succeeded: func(_ context.Context, evt *event.CommandSucceededEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				commands = append(commands, evt.CommandName)
+			},
+		}),
+		WithPoolMonitor(&event.PoolMonitor{
+			Event: func(evt *event.PoolEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				pool = append(pool, evt.Type)
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing repo: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Contains(t, commands, "ping")
+	assert.Contains(t, commands, "insert")
+	assert.Contains(t, pool, event.ConnectionCreated)
+	assert.Contains(t, pool, event.PoolClosedEvent)
+}
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrIteratorClosed is returned by the Next calls made after Close.
+var ErrIteratorClosed = errors.New("iterator closed")
+
+// UserIterator reads the users of a listing one at a time, as returned by
+// IterateUsers, so that only the current batch is held in memory. It isn't
+// safe for concurrent use.
+type UserIterator interface {
+	// Next returns the next user, or io.EOF once there is none left. Any
+	// other error, such as ctx ending, ends the iteration and is returned by
+	// the following calls too.
+	Next(ctx context.Context) (*User, error)
+	// Err returns the error which ended the iteration, nil while it goes on
+	// and once it reached io.EOF.
+	Err() error
+	// Close releases the cursor of the iteration. It must be called once done
+	// with the iterator, including after an error, and can be called more
+	// than once.
+	Close() error
+}
+
+// cursorIterator is the UserIterator of MongoRepo, reading a cursor.
+type cursorIterator struct {
+	repo   *MongoRepo
+	cursor *mongo.Cursor
+	err    error
+	done   bool
+	closed bool
+}
+
+var _ UserIterator = (*cursorIterator)(nil)
+
+// IterateUsers is FindUsers returning an iterator in place of the slice of
+// users, for the listings too large to hold in memory. The users are read in
+// batches of the size set by WithBatchSize, the server default otherwise, and
+// decoded as Next returns them.
+func (m *MongoRepo) IterateUsers(ctx context.Context, filter UserFilter, opts ...ReadOption) (
+	_ UserIterator, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "IterateUsers", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, err := readOpts.sort()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := caller.Find(ctx, readOpts.apply(m.userFilter(filter)), readOpts.findOptions().
+		SetSort(sort).
+		SetCollation(m.emailCollation(filter.Email != "")))
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	return &cursorIterator{repo: m, cursor: cursor}, nil
+}
+
+func (it *cursorIterator) Next(ctx context.Context) (*User, error) {
+	switch {
+	case it.err != nil:
+		return nil, it.err
+	case it.done:
+		return nil, io.EOF
+	case it.closed:
+		return nil, ErrIteratorClosed
+	}
+
+	// The cursor only notices ctx when it has to fetch the next batch.
+	err := contextError(ctx, ErrListingUsers)
+	if err != nil {
+		return nil, it.fail(err)
+	}
+
+	if !it.cursor.Next(ctx) {
+		err = it.cursor.Err()
+		if err != nil {
+			return nil, it.fail(driverError(ErrListingUsers, err))
+		}
+
+		it.done = true
+		_ = it.Close()
+
+		return nil, io.EOF
+	}
+
+	var doc userDocument
+
+	err = it.cursor.Decode(&doc)
+	if err != nil {
+		return nil, it.fail(driverError(ErrListingUsers, err))
+	}
+
+	user, err := it.repo.decode(&doc)
+	if err != nil {
+		return nil, it.fail(err)
+	}
+
+	return user, nil
+}
+
+// fail ends the iteration with err.
+func (it *cursorIterator) fail(err error) error {
+	it.err = err
+
+	return err
+}
+
+func (it *cursorIterator) Err() error {
+	return it.err
+}
+
+func (it *cursorIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+
+	// The ctx of the iteration may be over already, Close must still kill the
+	// cursor on the server.
+	ctx, cancel := it.repo.withTimeout(context.Background())
+	defer cancel()
+
+	err := it.cursor.Close(ctx)
+	if err != nil {
+		return driverError(ErrListingUsers, err)
+	}
+
+	return nil
+}
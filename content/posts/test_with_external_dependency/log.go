@@ -0,0 +1,12 @@
+package users
+
+import "regexp"
+
+// emailPattern matches what looks like an email in an error message.
+var emailPattern = regexp.MustCompile(`[^\s"'<>:,{}()]+@[^\s"'<>:,{}()]+`)
+
+// redact hides the emails an error message may quote, such as the one a
+// duplicate key error names, so that they don't end up in logs.
+func redact(message string) string {
+	return emailPattern.ReplaceAllString(message, "[redacted]")
+}
@@ -1,11 +1,56 @@
-package main
+package users
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func TestMongoRepo_CreateUser(t *testing.T) {
@@ -14,30 +59,10725 @@ func TestMongoRepo_CreateUser(t *testing.T) {
 	repo := NewMockMongo()
 
 	user := &User{
-		ID:       primitive.NewObjectID(),
 		Name:     "John",
 		Email:    "john@example.com",
 		Password: "password",
 	}
 
-	err := repo.CreateUser(ctx, user)
+	created, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.False(t, created.ID.IsZero())
+	assert.False(t, created.CreatedAt.IsZero())
+	assert.Equal(t, created.CreatedAt, created.UpdatedAt)
+	assert.Equal(t, user, created)
+
+	got, err := repo.GetUserByID(ctx, created.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created, got)
+}
+
+func TestMongoRepo_CreateUser_ExistingID(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	created, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
 	if err != nil {
 		t.Fatalf("error creating user: %s", err)
 	}
+
+	_, err = repo.CreateUser(ctx, &User{ID: created.ID, Name: "Jane", Email: "jane@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.ErrorContains(t, err, created.ID.Hex())
+
+	got, err := repo.GetUserByID(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, "John", got.Name)
 }
 
 func TestMongoRepo_CreateUserError(t *testing.T) {
 	ctx := context.Background()
 
 	repo := NewMockMongo()
+	repo.mongoCaller.(*MockMongo).FailWhen(FailOnEmail("broken@example.com", errors.New("boom")))
 
 	user := &User{
 		ID:       primitive.NewObjectID(),
 		Name:     "John",
-		Email:    emailWitchTriggersError,
+		Email:    "broken@example.com",
 		Password: "password",
 	}
 
-	err := repo.CreateUser(ctx, user)
+	_, err := repo.CreateUser(ctx, user)
 	assert.ErrorIs(t, err, ErrInsertingUser)
 }
+
+func TestMongoRepo_GetUserByID(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user, got)
+}
+
+func TestMongoRepo_GetUserByIDNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	id := primitive.NewObjectID()
+
+	_, err := repo.GetUserByID(ctx, id)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.NotErrorIs(t, err, mongo.ErrNoDocuments)
+	assert.Contains(t, err.Error(), id.Hex())
+}
+
+func TestMongoRepo_GetUserByIDDecodeError(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.GetUserByID(ctx, idWitchTriggersDecodeError)
+	assert.ErrorIs(t, err, ErrFindingUser)
+}
+
+func TestMongoRepo_GetUserByEmail(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	got, err := repo.GetUserByEmail(ctx, user.Email, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user, got)
+}
+
+func TestMongoRepo_GetUserByEmailNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestMongoRepo_GetUserByEmailEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.GetUserByEmail(ctx, "")
+	assert.ErrorIs(t, err, ErrInvalidEmail)
+}
+
+func TestMongoRepo_GetUserByEmailMultipleMatches(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	for _, name := range []string{"John", "Johnny"} {
+		_, err := repo.CreateUser(ctx, &User{
+			ID:       primitive.NewObjectID(),
+			Name:     name,
+			Email:    "john@example.com",
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	_, err := repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrMultipleUsersFound)
+}
+
+func TestMongoRepo_UpdateUser(t *testing.T) {
+	ctx := context.Background()
+
+	existing := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	tests := []struct {
+		name    string
+		user    *User
+		wantErr error
+	}{
+		{
+			name: "success",
+			user: &User{
+				ID:       existing.ID,
+				Name:     "Johnny",
+				Email:    existing.Email,
+				Password: existing.Password,
+				Version:  1,
+			},
+		},
+		{
+			name: "stale version",
+			user: &User{
+				ID:       existing.ID,
+				Name:     "Johnny",
+				Email:    existing.Email,
+				Password: existing.Password,
+				Version:  2,
+			},
+			wantErr: ErrVersionConflict,
+		},
+		{
+			name: "missing user",
+			user: &User{
+				ID:       primitive.NewObjectID(),
+				Name:     "Jane",
+				Email:    "jane@example.com",
+				Password: "password",
+			},
+			wantErr: ErrUserNotFound,
+		},
+		{
+			name: "zero id",
+			user: &User{
+				Name:  "Jane",
+				Email: "jane@example.com",
+			},
+			wantErr: ErrInvalidUserID,
+		},
+		{
+			name:    "nil user",
+			wantErr: ErrInvalidUser,
+		},
+		{
+			name: "driver error",
+			user: &User{
+				ID:       existing.ID,
+				Name:     "John",
+				Email:    "broken@example.com",
+				Password: "password",
+			},
+			wantErr: ErrUpdatingUser,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewMockMongo()
+			repo.mongoCaller.(*MockMongo).FailWhen(FailOnEmail("broken@example.com", errors.New("boom")))
+
+			_, err := repo.CreateUser(ctx, existing)
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+
+			err = repo.UpdateUser(ctx, tt.user)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("error updating user: %s", err)
+			}
+
+			got, err := repo.GetUserByID(ctx, tt.user.ID, WithPassword())
+			if err != nil {
+				t.Fatalf("error getting user: %s", err)
+			}
+
+			assert.Equal(t, tt.user, got)
+		})
+	}
+}
+
+func TestMongoRepo_DeleteUser(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestMongoRepo_DeleteUserError(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	err := repo.DeleteUser(ctx, idWitchTriggersError)
+	assert.ErrorIs(t, err, ErrDeletingUser)
+}
+
+func TestMongoRepo_ListUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	created := SeedUsers(t, repo, 5)
+
+	var listed []*User
+
+	for offset := int64(0); offset < 5; offset += 2 {
+		page, err := repo.ListUsers(ctx, 2, offset, WithPassword())
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		assert.LessOrEqual(t, len(page), 2)
+		listed = append(listed, page...)
+	}
+
+	assert.ElementsMatch(t, created, listed)
+}
+
+func TestMongoRepo_ListUsersOffsetOutOfRange(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	SeedUsers(t, repo, 1)
+
+	users, err := repo.ListUsers(ctx, 10, 10)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.NotNil(t, users)
+	assert.Empty(t, users)
+}
+
+func TestMongoRepo_ListUsersDefaultLimit(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.pageSize = 2
+	SeedUsers(t, repo, 3)
+
+	users, err := repo.ListUsers(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, users, 2)
+}
+
+func TestMongoRepo_CountUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	var ids []primitive.ObjectID
+
+	for i := 0; i < 3; i++ {
+		user := &User{
+			ID:       primitive.NewObjectID(),
+			Name:     fmt.Sprintf("John %d", i),
+			Email:    fmt.Sprintf("john%d@example.com", i),
+			Password: "password",
+		}
+
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		ids = append(ids, user.ID)
+	}
+
+	err := repo.DeleteUser(ctx, ids[0])
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMongoRepo_FindUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	// The IDs don't tell the creation time, CreatedAt does.
+	repo.ids = &SequentialIDGenerator{}
+
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(base)
+	repo.clock = clock
+
+	var created []*User
+
+	for i, name := range []string{"John", "Jane", "John"} {
+		clock.Set(base.Add(time.Duration(i) * time.Hour))
+
+		user := &User{
+			Name:     name,
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+		}
+
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		created = append(created, user)
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   []*User
+	}{
+		{
+			name:   "empty filter",
+			filter: UserFilter{},
+			want:   created,
+		},
+		{
+			name:   "unset fields don't constrain",
+			filter: UserFilter{Name: "John"},
+			want:   []*User{created[0], created[2]},
+		},
+		{
+			name:   "name and email",
+			filter: UserFilter{Name: "John", Email: "user2@example.com"},
+			want:   []*User{created[2]},
+		},
+		{
+			name:   "name and creation range",
+			filter: UserFilter{Name: "John", CreatedAfter: base.Add(30 * time.Minute), CreatedBefore: base.Add(3 * time.Hour)},
+			want:   []*User{created[2]},
+		},
+		{
+			name:   "no match",
+			filter: UserFilter{Name: "Jane", Email: "user0@example.com"},
+			want:   []*User{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := repo.FindUsers(ctx, tt.filter, WithPassword())
+			if err != nil {
+				t.Fatalf("error finding users: %s", err)
+			}
+
+			assert.Equal(t, tt.want, users)
+
+			count, err := repo.CountUsersMatching(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("error counting users: %s", err)
+			}
+
+			assert.Equal(t, int64(len(tt.want)), count)
+		})
+	}
+}
+
+func TestMongoRepo_UpsertUser(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	created, err := repo.UpsertUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	assert.True(t, created)
+	assert.False(t, user.ID.IsZero())
+
+	created, err = repo.UpsertUser(ctx, &User{
+		Name:     "Johnny",
+		Email:    "john@example.com",
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	assert.False(t, created)
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, "Johnny", got.Name)
+
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMongoRepo_UpsertUserWithID(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	id := primitive.NewObjectID()
+
+	created, err := repo.UpsertUser(ctx, &User{
+		ID:       id,
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	assert.True(t, created)
+
+	_, err = repo.GetUserByID(ctx, id)
+	assert.NoError(t, err)
+}
+
+func TestMongoRepo_UpsertUserExistingID(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	created, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.UpsertUser(ctx, &User{ID: created.ID, Name: "Jane", Email: "jane@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.ErrorContains(t, err, created.ID.Hex())
+}
+
+func TestMongoRepo_UpsertUserEmptyEmail(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.UpsertUser(ctx, &User{Name: "John"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	_, err = repo.UpsertUser(ctx, nil)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+}
+
+func TestMongoRepo_UpsertUserError(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.mongoCaller.(*MockMongo).FailWhen(FailOnEmail("broken@example.com", errors.New("boom")))
+
+	_, err := repo.UpsertUser(ctx, &User{Name: "John", Email: "broken@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUpdatingUser)
+}
+
+func TestMongoRepo_CreateUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	existingID := primitive.NewObjectID()
+
+	users := []*User{
+		{Name: "John", Email: "john@example.com", Password: "password"},
+		{ID: existingID, Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{Name: "Jack", Email: "jack@example.com", Password: "password"},
+	}
+
+	ids, err := repo.CreateUsers(ctx, users)
+	if err != nil {
+		t.Fatalf("error creating users: %s", err)
+	}
+
+	assert.Len(t, ids, len(users))
+	assert.Equal(t, existingID, ids[1])
+
+	for i, user := range users {
+		assert.Equal(t, ids[i], user.ID)
+
+		got, err := repo.GetUserByID(ctx, ids[i])
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, user.Email, got.Email)
+	}
+}
+
+func TestMongoRepo_CreateUsersInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.CreateUsers(ctx, []*User{
+		{Name: "John", Email: "john@example.com"},
+		{Name: "Jane"},
+	})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	assert.Zero(t, count)
+
+	t.Run("Retry", func(t *testing.T) {
+		users := []*User{
+			{Name: "John", Email: "John@Example.com", Password: "password"},
+			{Name: "Jane", Email: "jane@example.com", Password: "password"},
+			{Name: "Jack", Email: "jack@example.com"},
+		}
+
+		_, err := repo.CreateUsers(ctx, users)
+		assert.ErrorIs(t, err, ErrInvalidUser)
+
+		// The users before the invalid one are left as they were given.
+		assert.Equal(t, User{Name: "John", Email: "John@Example.com", Password: "password"}, *users[0])
+		assert.Equal(t, User{Name: "Jane", Email: "jane@example.com", Password: "password"}, *users[1])
+
+		users[2].Password = "password"
+
+		ids, err := repo.CreateUsers(ctx, users)
+		if err != nil {
+			t.Fatalf("error retrying: %s", err)
+		}
+
+		assert.Len(t, ids, 3)
+
+		for i, user := range users {
+			assert.Equal(t, ids[i], user.ID)
+			assert.Equal(t, int64(1), user.Version)
+			assert.True(t, isPasswordHash(user.Password))
+
+			ok, err := repo.VerifyPassword(ctx, user.Email, "password")
+			if err != nil {
+				t.Fatalf("error verifying password: %s", err)
+			}
+
+			assert.True(t, ok, "the password of %s is hashed once", user.Email)
+		}
+
+		assert.Equal(t, "john@example.com", users[0].Email)
+	})
+}
+
+func TestMongoRepo_CreateUsersPartialFailure(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.mongoCaller.(*MockMongo).FailWhen(FailOnEmail("broken@example.com", errors.New("boom")))
+
+	users := []*User{
+		{Name: "John", Email: "john@example.com", Password: "password"},
+		{Name: "Jane", Email: "broken@example.com", Password: "password"},
+		{Name: "Jack", Email: "jack@example.com", Password: "password"},
+	}
+
+	_, err := repo.CreateUsers(ctx, users)
+	assert.ErrorIs(t, err, ErrInsertingUser)
+
+	var bulkErr *BulkInsertError
+	if assert.ErrorAs(t, err, &bulkErr) {
+		assert.Equal(t, []int{1}, bulkErr.FailedIndexes())
+		assert.Equal(t, 1, bulkErr.Succeeded())
+	}
+
+	// Only the stored user is updated.
+	assert.False(t, users[0].ID.IsZero())
+	assert.True(t, isPasswordHash(users[0].Password))
+	assert.Equal(t, User{Name: "Jane", Email: "broken@example.com", Password: "password"}, *users[1])
+}
+
+func TestMongoRepo_CreateUsersBulkOptions(t *testing.T) {
+	ctx := context.Background()
+
+	// newBatch returns users whose second has the email of a stored user.
+	newBatch := func() []*User {
+		return []*User{
+			{Name: "John", Email: "john@example.com", Password: "password"},
+			{Name: "Taken", Email: "taken@example.com", Password: "password"},
+			{Name: "Jack", Email: "jack@example.com", Password: "password"},
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		opts      []BulkOptions
+		succeeded int
+		stored    []string
+	}{
+		{name: "Default", succeeded: 1, stored: []string{"taken@example.com", "john@example.com"}},
+		{name: "Ordered", opts: []BulkOptions{{Ordered: true}}, succeeded: 1,
+			stored: []string{"taken@example.com", "john@example.com"}},
+		{name: "Unordered", opts: []BulkOptions{{Ordered: false}}, succeeded: 2,
+			stored: []string{"taken@example.com", "john@example.com", "jack@example.com"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, mock := newImportRepo()
+
+			_, err := repo.CreateUser(ctx, &User{Name: "Taken", Email: "taken@example.com", Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+
+			sink := NewChannelSink(8)
+			repo.events = sink
+
+			users := newBatch()
+
+			_, err = repo.CreateUsers(ctx, users, tt.opts...)
+			assert.ErrorIs(t, err, ErrInsertingUser)
+
+			var bulkErr *BulkInsertError
+			if !errors.As(err, &bulkErr) {
+				t.Fatalf("expected a *BulkInsertError, got %T", err)
+			}
+
+			assert.Equal(t, []int{1}, bulkErr.FailedIndexes())
+			assert.Equal(t, tt.succeeded, bulkErr.Succeeded())
+			assert.ErrorIs(t, bulkErr.Errors()[1], ErrUserAlreadyExists)
+			assert.True(t, mongo.IsDuplicateKeyError(bulkErr))
+
+			var stored []string
+			for _, user := range mock.Users() {
+				stored = append(stored, user.Email)
+			}
+
+			assert.ElementsMatch(t, tt.stored, stored)
+
+			// Only the stored users are announced.
+			assert.Len(t, receivedEvents(sink), tt.succeeded)
+		})
+	}
+
+	t.Run("UnorderedFailures", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		mock.FailWhen(FailOnEmail("broken@example.com", errors.New("document failed validation")))
+
+		_, err := repo.CreateUsers(ctx, []*User{
+			{Name: "Broken", Email: "broken@example.com", Password: "password"},
+			{Name: "John", Email: "john@example.com", Password: "password"},
+			{Name: "Johnny", Email: "john@example.com", Password: "password"},
+			{Name: "Jack", Email: "jack@example.com", Password: "password"},
+		}, BulkOptions{})
+
+		var bulkErr *BulkInsertError
+		if !errors.As(err, &bulkErr) {
+			t.Fatalf("expected a *BulkInsertError, got %T", err)
+		}
+
+		assert.Equal(t, []int{0, 2}, bulkErr.FailedIndexes())
+		assert.Equal(t, 2, bulkErr.Succeeded())
+
+		errs := bulkErr.Errors()
+		assert.Len(t, errs, 2)
+		assert.NotErrorIs(t, errs[0], ErrUserAlreadyExists)
+		assert.ErrorIs(t, errs[2], ErrUserAlreadyExists)
+		assert.Len(t, mock.Users(), 2)
+	})
+}
+
+func TestMongoRepo_UpdateUserFields(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{
+		"name":  "Johnny",
+		"email": "johnny@example.com",
+	})
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, &User{
+		ID:        user.ID,
+		Name:      "Johnny",
+		Email:     "johnny@example.com",
+		Password:  user.Password,
+		Role:      RoleMember,
+		Version:   2,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: got.UpdatedAt,
+	}, got)
+}
+
+func TestMongoRepo_UpdateUserFieldsAtVersion(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.UpdateUserFieldsAtVersion(ctx, user.ID, 1, map[string]interface{}{"name": "Johnny"})
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	err = repo.UpdateUserFieldsAtVersion(ctx, user.ID, 1, map[string]interface{}{"name": "Jack"})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	err = repo.UpdateUserFieldsAtVersion(ctx, primitive.NewObjectID(), 1, map[string]interface{}{"name": "Jack"})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, "Johnny", got.Name)
+	assert.Equal(t, int64(2), got.Version)
+}
+
+func TestMongoRepo_UpdateUser_Concurrent(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	read, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	errs := make(chan error, 2)
+
+	var wg sync.WaitGroup
+
+	for _, name := range []string{"Johnny", "Jack"} {
+		copied := *read
+		copied.Name = name
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			errs <- repo.UpdateUser(ctx, &copied)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var succeeded, conflicted int
+
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrVersionConflict):
+			conflicted++
+		default:
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	assert.Equal(t, 1, succeeded)
+	assert.Equal(t, 1, conflicted)
+}
+
+func TestMongoRepo_UpdateUserFieldsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		id      primitive.ObjectID
+		fields  map[string]interface{}
+		wantErr error
+	}{
+		{
+			name:    "empty fields",
+			id:      user.ID,
+			fields:  map[string]interface{}{},
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "id field",
+			id:      user.ID,
+			fields:  map[string]interface{}{"_id": primitive.NewObjectID()},
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "unknown field",
+			id:      user.ID,
+			fields:  map[string]interface{}{"nmae": "Johnny"},
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "zero id",
+			fields:  map[string]interface{}{"name": "Johnny"},
+			wantErr: ErrInvalidUserID,
+		},
+		{
+			name:    "not found",
+			id:      primitive.NewObjectID(),
+			fields:  map[string]interface{}{"name": "Johnny"},
+			wantErr: ErrUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.UpdateUserFields(ctx, tt.id, tt.fields)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user, got)
+}
+
+func TestMongoRepo_SoftDeleteUser(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	users := []*User{
+		{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"},
+	}
+
+	for _, user := range users {
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	deleted := users[0]
+
+	err := repo.SoftDeleteUser(ctx, deleted.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, deleted.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	got, err := repo.GetUserByID(ctx, deleted.ID, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	if !assert.NotNil(t, got.DeletedAt) {
+		return
+	}
+
+	listed, err := repo.ListUsers(ctx, 10, 0, WithPassword())
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Equal(t, []*User{users[1]}, listed)
+
+	listed, err = repo.ListUsers(ctx, 10, 0, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, listed, 2)
+
+	found, err := repo.FindUsers(ctx, UserFilter{Name: "John"})
+	if err != nil {
+		t.Fatalf("error finding users: %s", err)
+	}
+
+	assert.Empty(t, found)
+
+	// Soft-deleting twice is a no-op that keeps the original timestamp.
+	err = repo.SoftDeleteUser(ctx, deleted.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user again: %s", err)
+	}
+
+	again, err := repo.GetUserByID(ctx, deleted.ID, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, got.DeletedAt, again.DeletedAt)
+
+	err = repo.RestoreUser(ctx, deleted.ID)
+	if err != nil {
+		t.Fatalf("error restoring user: %s", err)
+	}
+
+	restored, err := repo.GetUserByID(ctx, deleted.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Nil(t, restored.DeletedAt)
+}
+
+func TestMongoRepo_SoftDeleteUserNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	err := repo.SoftDeleteUser(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	err = repo.RestoreUser(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestMongoRepo_SoftDeleteUserVersion(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	repo.clock = clock
+	user := SeedUsers(t, repo, 1)[0]
+
+	stale := *user
+	stale.Name = "Stale"
+
+	clock.Advance(time.Minute)
+
+	err := repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	deleted, err := repo.GetUserByID(ctx, user.ID, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user.Version+1, deleted.Version)
+	assert.Equal(t, clock.Now(), deleted.UpdatedAt)
+
+	// An update read before the delete doesn't silently undo it.
+	err = repo.UpdateUser(ctx, &stale)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	// Soft-deleting again changes nothing.
+	err = repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user again: %s", err)
+	}
+
+	again, err := repo.GetUserByID(ctx, user.ID, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, deleted.Version, again.Version)
+}
+
+func TestMongoRepo_RestoreUserVersion(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	repo.clock = clock
+	user := SeedUsers(t, repo, 1)[0]
+
+	err := repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	stale, err := repo.GetUserByID(ctx, user.ID, IncludeDeleted(), WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	clock.Advance(time.Minute)
+
+	err = repo.RestoreUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error restoring user: %s", err)
+	}
+
+	restored, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, stale.Version+1, restored.Version)
+	assert.Equal(t, clock.Now(), restored.UpdatedAt)
+
+	// An update read before the restore doesn't delete the user again.
+	stale.Name = "Stale"
+
+	err = repo.UpdateUser(ctx, stale)
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	// Restoring a user which isn't deleted changes nothing.
+	err = repo.RestoreUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error restoring user again: %s", err)
+	}
+
+	again, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, restored.Version, again.Version)
+}
+
+func TestMongoRepo_UserExistsByEmail(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	exists, err := repo.UserExistsByEmail(ctx, "  John@Example.com ")
+	if err != nil {
+		t.Fatalf("error checking user: %s", err)
+	}
+
+	assert.True(t, exists)
+
+	exists, err = repo.UserExistsByEmail(ctx, "jane@example.com")
+	if err != nil {
+		t.Fatalf("error checking user: %s", err)
+	}
+
+	assert.False(t, exists)
+
+	// A soft-deleted user keeps its email reserved.
+	err = repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	exists, err = repo.UserExistsByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatalf("error checking user: %s", err)
+	}
+
+	assert.True(t, exists)
+
+	_, err = repo.UserExistsByEmail(ctx, " ")
+	assert.ErrorIs(t, err, ErrInvalidEmail)
+}
+
+func TestMongoRepo_SearchUsersByName(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	for i, name := range []string{"Johnny", "Jo.hn", "Jane", "John", "Joe"} {
+		_, err := repo.CreateUser(ctx, &User{
+			ID:       primitive.NewObjectID(),
+			Name:     name,
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	names := func(users []*User) []string {
+		names := make([]string, 0, len(users))
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		limit  int64
+		want   []string
+	}{
+		{name: "sorted by name", prefix: "Jo", limit: 10, want: []string{"Jo.hn", "Joe", "John", "Johnny"}},
+		{name: "capped at limit", prefix: "Jo", limit: 2, want: []string{"Jo.hn", "Joe"}},
+		{name: "metacharacters are literal", prefix: "Jo.", limit: 10, want: []string{"Jo.hn"}},
+		{name: "star matches nothing", prefix: "*", limit: 10, want: []string{}},
+		{name: "empty prefix matches all", prefix: "", limit: 10, want: []string{"Jane", "Jo.hn", "Joe", "John", "Johnny"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := repo.SearchUsersByName(ctx, tt.prefix, tt.limit)
+			if err != nil {
+				t.Fatalf("error searching users: %s", err)
+			}
+
+			assert.Equal(t, tt.want, names(users))
+		})
+	}
+}
+
+func TestMongoRepo_ListUsersAfter(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	want := SeedUsers(t, repo, 5)
+
+	var (
+		listed []*User
+		after  primitive.ObjectID
+		pages  int
+	)
+
+	for {
+		page, next, err := repo.ListUsersAfter(ctx, after, 2, WithPassword())
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		listed = append(listed, page...)
+		pages++
+
+		// A user created mid-scan doesn't shift the pages already read.
+		if pages == 1 {
+			late, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+
+			want = append(want, late)
+		}
+
+		if next.IsZero() {
+			break
+		}
+
+		after = next
+	}
+
+	assert.Equal(t, want, listed)
+	assert.Equal(t, 3, pages)
+}
+
+func TestMongoRepo_ListUsersAfterEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	users, next, err := repo.ListUsersAfter(ctx, primitive.NilObjectID, 10)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Empty(t, users)
+	assert.True(t, next.IsZero())
+}
+
+func TestMongoRepo_SortByCreatedAt(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	clock := NewFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	repo.clock = clock
+
+	// Created in the reverse order of their IDs, a millisecond apart, with a
+	// tie on the last two.
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	ids[0], ids[2] = ids[2], ids[0]
+
+	var created []*User
+
+	for i, id := range ids {
+		if i < 2 {
+			clock.Advance(time.Millisecond)
+		}
+
+		user, err := repo.CreateUser(ctx, &User{
+			ID:       id,
+			Name:     "John",
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		created = append(created, user)
+	}
+
+	users, err := repo.FindUsers(ctx, UserFilter{}, SortBy("created_at", false), WithPassword())
+	if err != nil {
+		t.Fatalf("error finding users: %s", err)
+	}
+
+	assert.Equal(t, []*User{created[0], created[2], created[1]}, users, "ties are broken by _id")
+
+	users, err = repo.FindUsers(ctx, UserFilter{CreatedAfter: created[0].CreatedAt}, WithPassword())
+	if err != nil {
+		t.Fatalf("error finding users: %s", err)
+	}
+
+	assert.Equal(t, []*User{created[2], created[1]}, users)
+}
+
+func TestMongoRepo_ListUsersSortBy(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	clock := NewFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	repo.clock = clock
+
+	var created []*User
+
+	for i, name := range []string{"John", "Alice", "John", "Bob"} {
+		clock.Advance(time.Millisecond)
+
+		user := &User{
+			ID:       primitive.NewObjectID(),
+			Name:     name,
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+		}
+
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		created = append(created, user)
+	}
+
+	tests := []struct {
+		name string
+		opt  ReadOption
+		want []*User
+	}{
+		{
+			name: "name ascending, ties by id",
+			opt:  SortBy("name", false),
+			want: []*User{created[1], created[3], created[0], created[2]},
+		},
+		{
+			name: "name descending, ties by id",
+			opt:  SortBy("name", true),
+			want: []*User{created[0], created[2], created[3], created[1]},
+		},
+		{
+			name: "created_at descending",
+			opt:  SortBy("created_at", true),
+			want: []*User{created[3], created[2], created[1], created[0]},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed, err := repo.ListUsers(ctx, 10, 0, tt.opt, WithPassword())
+			if err != nil {
+				t.Fatalf("error listing users: %s", err)
+			}
+
+			assert.Equal(t, tt.want, listed)
+
+			found, err := repo.FindUsers(ctx, UserFilter{}, tt.opt, WithPassword())
+			if err != nil {
+				t.Fatalf("error finding users: %s", err)
+			}
+
+			assert.Equal(t, tt.want, found)
+		})
+	}
+}
+
+func TestMongoRepo_ListUsersInvalidSortField(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.ListUsers(ctx, 10, 0, SortBy("password", false))
+	assert.ErrorIs(t, err, ErrInvalidSortField)
+
+	_, err = repo.FindUsers(ctx, UserFilter{}, SortBy("password", false))
+	assert.ErrorIs(t, err, ErrInvalidSortField)
+}
+
+func TestMongoRepo_GetUserByIDOmitsPassword(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Empty(t, got.Password)
+	assert.Equal(t, user.Email, got.Email)
+
+	got, err = repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user.Password, got.Password)
+
+	listed, err := repo.ListUsers(ctx, 10, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	for _, u := range listed {
+		assert.Empty(t, u.Password)
+	}
+}
+
+func TestMongoRepo_DeleteUsersMatching(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	for i, name := range []string{"John", "Jane", "John"} {
+		_, err := repo.CreateUser(ctx, &User{
+			ID:       primitive.NewObjectID(),
+			Name:     name,
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	_, err := repo.DeleteUsersMatching(ctx, UserFilter{})
+	assert.ErrorIs(t, err, ErrRefusingFullDelete)
+
+	deleted, err := repo.DeleteUsersMatching(ctx, UserFilter{Name: "John"})
+	if err != nil {
+		t.Fatalf("error deleting users: %s", err)
+	}
+
+	assert.Equal(t, int64(2), deleted)
+
+	deleted, err = repo.DeleteUsersMatching(ctx, UserFilter{Name: "Jack"})
+	if err != nil {
+		t.Fatalf("error deleting users: %s", err)
+	}
+
+	assert.Zero(t, deleted)
+
+	deleted, err = repo.DeleteUsersMatching(ctx, UserFilter{AllowAll: true})
+	if err != nil {
+		t.Fatalf("error deleting users: %s", err)
+	}
+
+	assert.Equal(t, int64(1), deleted)
+
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	assert.Zero(t, count)
+}
+
+func TestMongoRepo_GetUsersByIDs(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	var ids []primitive.ObjectID
+
+	for i := 0; i < 3; i++ {
+		user := &User{
+			ID:       primitive.NewObjectID(),
+			Name:     fmt.Sprintf("John %d", i),
+			Email:    fmt.Sprintf("john%d@example.com", i),
+			Password: "password",
+		}
+
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		ids = append(ids, user.ID)
+	}
+
+	missing := primitive.NewObjectID()
+
+	users, err := repo.GetUsersByIDs(ctx, []primitive.ObjectID{ids[0], ids[2], ids[0], missing})
+	if err != nil {
+		t.Fatalf("error getting users: %s", err)
+	}
+
+	assert.Len(t, users, 2)
+	assert.Equal(t, "John 0", users[ids[0]].Name)
+	assert.Equal(t, "John 2", users[ids[2]].Name)
+	assert.NotContains(t, users, missing)
+	assert.NotContains(t, users, ids[1])
+}
+
+func TestMongoRepo_GetUsersByIDsEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	// A nil caller proves the database is never reached.
+	repo := &MongoRepo{}
+
+	users, err := repo.GetUsersByIDs(ctx, nil)
+	if err != nil {
+		t.Fatalf("error getting users: %s", err)
+	}
+
+	assert.NotNil(t, users)
+	assert.Empty(t, users)
+}
+
+func TestMongoRepo_ChangeUserEmail(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo(WithUniqueEmail())
+
+	users := []*User{
+		{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"},
+	}
+
+	for _, user := range users {
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	updated, err := repo.ChangeUserEmail(ctx, users[0].ID, " Johnny@Example.com")
+	if err != nil {
+		t.Fatalf("error changing email: %s", err)
+	}
+
+	assert.Equal(t, "johnny@example.com", updated.Email)
+	assert.Equal(t, users[0].Name, updated.Name)
+	assert.Empty(t, updated.Password)
+
+	_, err = repo.ChangeUserEmail(ctx, users[0].ID, users[1].Email)
+	assert.ErrorIs(t, err, ErrEmailAlreadyTaken)
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.ErrorContains(t, err, users[1].Email)
+
+	// Keeping the current email is not a conflict.
+	_, err = repo.ChangeUserEmail(ctx, users[1].ID, users[1].Email)
+	assert.NoError(t, err)
+
+	_, err = repo.ChangeUserEmail(ctx, primitive.NewObjectID(), "jack@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, err = repo.ChangeUserEmail(ctx, users[0].ID, "not an email")
+	assert.ErrorIs(t, err, ErrInvalidEmail)
+
+	t.Run("WithoutUniqueIndex", func(t *testing.T) {
+		repo := NewMockMongo()
+		seeded := SeedUsers(t, repo, 2)
+
+		_, err := repo.ChangeUserEmail(ctx, seeded[0].ID, seeded[1].Email)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		repo := newEncryptedRepo(t, NewMockMongo(WithUniqueEmail()).mongoCaller.(*MockMongo), make([]byte, 32))
+		seeded := SeedUsers(t, repo, 2)
+
+		// The ciphertexts differ, the hashes collide.
+		_, err := repo.ChangeUserEmail(ctx, seeded[0].ID, seeded[1].Email)
+		assert.ErrorIs(t, err, ErrEmailAlreadyTaken)
+	})
+}
+
+func TestMongoRepo_DistinctEmails(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	users := []*User{
+		{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Johnny", Email: "john@example.com", Password: "password"},
+	}
+
+	for _, user := range users {
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	// Documents written without an email can't go through CreateUser.
+	nobody := userDocument{ID: primitive.NewObjectID(), Name: "Nobody"}
+	repo.mongoCaller.(*MockMongo).users[nobody.ID] = nobody
+
+	emails, err := repo.DistinctEmails(ctx)
+	if err != nil {
+		t.Fatalf("error listing emails: %s", err)
+	}
+
+	assert.Equal(t, []string{"jane@example.com", "john@example.com"}, emails)
+}
+
+func TestMongoRepo_Timestamps(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	repo.clock = clock
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	created := now
+
+	assert.Equal(t, created, user.CreatedAt)
+	assert.Equal(t, created, user.UpdatedAt)
+
+	clock.Advance(time.Hour)
+
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	got.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, got)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	got, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created, got.CreatedAt)
+	assert.Equal(t, clock.Now(), got.UpdatedAt)
+
+	clock.Advance(time.Hour)
+
+	err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"name": "John"})
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	got, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created, got.CreatedAt)
+	assert.Equal(t, clock.Now(), got.UpdatedAt)
+
+	clock.Advance(time.Hour)
+
+	_, err = repo.UpsertUser(ctx, &User{Name: "Johnny", Email: user.Email, Password: "password"})
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	got, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created, got.CreatedAt)
+	assert.Equal(t, clock.Now(), got.UpdatedAt)
+}
+
+func TestMongoRepo_UpsertUserSetsCreatedAt(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	repo.clock = clock
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	_, err := repo.UpsertUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, now, got.CreatedAt)
+	assert.Equal(t, clock.Now(), got.UpdatedAt)
+}
+
+func TestUserDocument_DecodeWithoutTimestamps(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	raw, err := bson.Marshal(bson.M{"_id": id, "name": "John", "email": "john@example.com"})
+	if err != nil {
+		t.Fatalf("error marshalling document: %s", err)
+	}
+
+	var doc userDocument
+
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		t.Fatalf("error decoding legacy document: %s", err)
+	}
+
+	assert.Equal(t, &User{ID: id, Name: "John", Email: "john@example.com"}, fromDocument(&doc))
+}
+
+func TestMongoRepo_EnsureIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	// Without the index duplicates go through.
+	_, err = repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "Johnny", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = repo.EnsureIndexes(ctx)
+		if err != nil {
+			t.Fatalf("error ensuring indexes: %s", err)
+		}
+	}
+
+	_, err = repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "Janet", Email: " Jane@Example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.ErrorContains(t, err, "jane@example.com")
+}
+
+func TestMongoRepo_UpdateUserHashesPassword(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.bcryptCost = bcrypt.MinCost
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	user.Password = "newsecret"
+
+	err = repo.UpdateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	stored := repo.mongoCaller.(*MockMongo).users[user.ID]
+
+	assert.Equal(t, stored.Password, user.Password)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("newsecret")))
+
+	ok, err := repo.VerifyPassword(ctx, user.Email, "newsecret")
+	if err != nil {
+		t.Fatalf("error verifying password: %s", err)
+	}
+
+	assert.True(t, ok)
+
+	// A hash read WithPassword is kept as is.
+	err = repo.UpdateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	assert.Equal(t, stored.Password, repo.mongoCaller.(*MockMongo).users[user.ID].Password)
+
+	policy := DefaultPasswordPolicy()
+	repo.passwordPolicy = &policy
+	user.Password = "newsecret"
+
+	err = repo.UpdateUser(ctx, user)
+	assert.ErrorIs(t, err, ErrWeakPassword)
+	assert.Equal(t, stored.Password, repo.mongoCaller.(*MockMongo).users[user.ID].Password)
+}
+
+func TestMongoRepo_CreateUserHashesPassword(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	stored := repo.mongoCaller.(*MockMongo).users[user.ID]
+
+	assert.NotEqual(t, "password", stored.Password)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("password")))
+
+	ok, err := repo.VerifyPassword(ctx, user.Email, "password")
+	if err != nil {
+		t.Fatalf("error verifying password: %s", err)
+	}
+
+	assert.True(t, ok)
+
+	ok, err = repo.VerifyPassword(ctx, user.Email, "wrong")
+	if err != nil {
+		t.Fatalf("error verifying password: %s", err)
+	}
+
+	assert.False(t, ok)
+
+	_, err = repo.VerifyPassword(ctx, "jane@example.com", "password")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestMongoRepo_CreateUserEmptyPassword(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	_, err := repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+}
+
+func TestUser_Validate(t *testing.T) {
+	valid := User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	tests := []struct {
+		name     string
+		mutate   func(u *User)
+		problems []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(u *User) {},
+		},
+		{
+			name:     "empty name",
+			mutate:   func(u *User) { u.Name = " " },
+			problems: []string{"name is empty"},
+		},
+		{
+			name:     "malformed email",
+			mutate:   func(u *User) { u.Email = "john.example.com" },
+			problems: []string{"email"},
+		},
+		{
+			name:     "short password",
+			mutate:   func(u *User) { u.Password = "short" },
+			problems: []string{"password must be at least 8 characters"},
+		},
+		{
+			name:     "long password",
+			mutate:   func(u *User) { u.Password = strings.Repeat("p", 73) },
+			problems: []string{"password must be at most 72 bytes"},
+		},
+		{
+			name:     "long name",
+			mutate:   func(u *User) { u.Name = strings.Repeat("John", 100) },
+			problems: []string{"name is longer than 256 bytes"},
+		},
+		{
+			name:     "name with a NUL byte",
+			mutate:   func(u *User) { u.Name = "John\x00" },
+			problems: []string{"name has invalid characters"},
+		},
+		{
+			name:     "everything",
+			mutate:   func(u *User) { *u = User{} },
+			problems: []string{"name is empty", "email", "password must be at least 8 characters"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := valid
+			tt.mutate(&user)
+
+			err := user.Validate()
+			if len(tt.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrInvalidUser)
+
+			for _, problem := range tt.problems {
+				assert.Contains(t, err.Error(), problem)
+			}
+		})
+	}
+}
+
+func TestMongoRepo_CreateUserInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	// A nil caller proves the database is never reached.
+	repo := &MongoRepo{}
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	_, err = repo.CreateUsers(ctx, []*User{{Name: "John", Email: "john@example.com"}})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	_, err = repo.UpsertUser(ctx, &User{Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	err = repo.UpdateUserFields(ctx, primitive.NewObjectID(), map[string]interface{}{"email": "john"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email   string
+		want    string
+		wantErr bool
+	}{
+		{email: "john@example.com", want: "john@example.com"},
+		{email: " John@Example.COM ", want: "john@example.com"},
+		{email: "", wantErr: true},
+		{email: "john", wantErr: true},
+		{email: "John <john@example.com>", wantErr: true},
+		{email: "john@@example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			got, err := NormalizeEmail(tt.email)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidEmail)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMongoRepo_CreateUserNormalizesEmail(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{
+		ID:       primitive.NewObjectID(),
+		Name:     "John",
+		Email:    "John@Example.COM ",
+		Password: "password",
+	}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Equal(t, "john@example.com", repo.mongoCaller.(*MockMongo).users[user.ID].Email)
+
+	got, err := repo.GetUserByEmail(ctx, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user.ID, got.ID)
+
+	_, err = repo.GetUserByEmail(ctx, " JOHN@example.com")
+	assert.NoError(t, err)
+
+	created, err := repo.UpsertUser(ctx, &User{Name: "Johnny", Email: "JOHN@EXAMPLE.COM", Password: "password"})
+	if err != nil {
+		t.Fatalf("error upserting user: %s", err)
+	}
+
+	assert.False(t, created)
+}
+
+func TestMongoRepo_ListUsersByRole(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	roles := []string{RoleAdmin, "", RoleMember, RoleAdmin, RoleGuest}
+
+	for i, role := range roles {
+		_, err := repo.CreateUser(ctx, &User{
+			ID:       primitive.NewObjectID(),
+			Name:     fmt.Sprintf("John %d", i),
+			Email:    fmt.Sprintf("john%d@example.com", i),
+			Password: "password",
+			Role:     role,
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	admins, err := repo.ListUsersByRole(ctx, RoleAdmin, 10, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	if assert.Len(t, admins, 2) {
+		assert.Equal(t, "John 0", admins[0].Name)
+		assert.Equal(t, "John 3", admins[1].Name)
+	}
+
+	members, err := repo.FindUsers(ctx, UserFilter{Role: RoleMember})
+	if err != nil {
+		t.Fatalf("error finding users: %s", err)
+	}
+
+	// Users created without a role default to member.
+	assert.Len(t, members, 2)
+
+	_, err = repo.ListUsersByRole(ctx, "root", 10, 0)
+	assert.ErrorIs(t, err, ErrInvalidRole)
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password", Role: "root"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+}
+
+func TestUserDocument_RoundTrip(t *testing.T) {
+	deletedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		user *User
+	}{
+		{
+			name: "every field",
+			user: &User{
+				ID:        primitive.NewObjectID(),
+				Name:      "John",
+				Email:     "john@example.com",
+				Password:  "hash",
+				Role:      RoleAdmin,
+				Version:   3,
+				CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				UpdatedAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+				DeletedAt: &deletedAt,
+				ExpiresAt: &deletedAt,
+			},
+		},
+		{
+			name: "zero values",
+			user: &User{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(toDocument(tt.user))
+			if err != nil {
+				t.Fatalf("error marshalling document: %s", err)
+			}
+
+			var doc userDocument
+
+			err = bson.Unmarshal(raw, &doc)
+			if err != nil {
+				t.Fatalf("error unmarshalling document: %s", err)
+			}
+
+			assert.Equal(t, tt.user, fromDocument(&doc))
+			assert.Equal(t, toDocument(tt.user), &doc)
+		})
+	}
+}
+
+func TestUserDocument_OmitsZeroValues(t *testing.T) {
+	raw, err := bson.Marshal(toDocument(&User{Name: "John"}))
+	if err != nil {
+		t.Fatalf("error marshalling document: %s", err)
+	}
+
+	var doc bson.M
+
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		t.Fatalf("error unmarshalling document: %s", err)
+	}
+
+	// A zero ObjectID must not be written so Mongo generates one.
+	assert.Equal(t, bson.M{"name": "John"}, doc)
+}
+
+func TestToDocument_Normalizes(t *testing.T) {
+	at := time.Date(2024, 1, 1, 13, 0, 0, 123456789, time.FixedZone("CET", 3600))
+
+	doc := toDocument(&User{Email: " John@Example.com ", CreatedAt: at})
+
+	assert.Equal(t, "john@example.com", doc.Email)
+	assert.Equal(t, time.Date(2024, 1, 1, 12, 0, 0, 123000000, time.UTC), doc.CreatedAt)
+}
+
+func TestMongoRepo_CreateProvisionalUser(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	repo.clock = clock
+
+	err := repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	err = repo.CreateProvisionalUser(ctx, user, time.Hour)
+	if err != nil {
+		t.Fatalf("error creating provisional user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	expiresAt := now.Add(time.Hour)
+	assert.Equal(t, &expiresAt, got.ExpiresAt)
+
+	clock.Advance(time.Hour)
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	err = repo.PromoteUser(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestMongoRepo_CreateProvisionalUser_InvalidTTL(t *testing.T) {
+	repo := &MongoRepo{}
+
+	err := repo.CreateProvisionalUser(context.Background(), &User{}, 0)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+}
+
+func TestMongoRepo_PromoteUser(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	repo.clock = clock
+
+	err := repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	err = repo.CreateProvisionalUser(ctx, user, time.Hour)
+	if err != nil {
+		t.Fatalf("error creating provisional user: %s", err)
+	}
+
+	clock.Advance(30 * time.Minute)
+
+	for i := 0; i < 2; i++ {
+		err = repo.PromoteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error promoting user: %s", err)
+		}
+	}
+
+	clock.Advance(24 * time.Hour)
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Nil(t, got.ExpiresAt)
+	assert.Equal(t, int64(2), got.Version)
+
+	err = repo.PromoteUser(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+// fakeConnect records the options NewMongoRepo connects with. mongo.Connect
+// doesn't dial, so the returned client works without a server.
+type fakeConnect struct {
+	opts []*options.ClientOptions
+}
+
+func (f *fakeConnect) option() Option {
+	return func(o *repoOptions) {
+		o.connect = func(ctx context.Context, opts ...*options.ClientOptions) (*mongo.Client, error) {
+			f.opts = opts
+			return mongo.Connect(ctx, opts...)
+		}
+	}
+}
+
+func TestNewMongoRepo_Defaults(t *testing.T) {
+	fake := &fakeConnect{}
+
+	repo, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017", fake.option(), WithSkipPing())
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	collection := repo.mongoCaller.(*reconnectingCaller).caller.(*mongo.Collection)
+	assert.Equal(t, "test", collection.Database().Name())
+	assert.Equal(t, "users", collection.Name())
+
+	if assert.Len(t, fake.opts, 1) {
+		assert.Nil(t, fake.opts[0].ConnectTimeout)
+	}
+}
+
+func TestNewMongoRepo_Options(t *testing.T) {
+	fake := &fakeConnect{}
+
+	repo, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017",
+		fake.option(),
+		WithSkipPing(),
+		WithDatabase("staging"),
+		WithCollection("accounts"),
+		WithConnectTimeout(3*time.Second),
+		WithClientOptions(options.Client().SetAppName("blog")),
+	)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	collection := repo.mongoCaller.(*reconnectingCaller).caller.(*mongo.Collection)
+	assert.Equal(t, "staging", collection.Database().Name())
+	assert.Equal(t, "accounts", collection.Name())
+
+	merged := options.MergeClientOptions(fake.opts...)
+	assert.Equal(t, "blog", *merged.AppName)
+	assert.Equal(t, 3*time.Second, *merged.ConnectTimeout)
+	assert.Equal(t, []string{"localhost:27017"}, merged.Hosts)
+}
+
+func TestNewMongoRepo_Monitors(t *testing.T) {
+	fake := &fakeConnect{}
+
+	commands := &event.CommandMonitor{}
+	pool := &event.PoolMonitor{Event: func(*event.PoolEvent) {}}
+
+	_, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017",
+		fake.option(),
+		WithSkipPing(),
+		WithClientOptions(options.Client().SetMonitor(&event.CommandMonitor{})),
+		WithCommandMonitor(commands),
+		WithPoolMonitor(pool),
+	)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	merged := options.MergeClientOptions(fake.opts...)
+	assert.Same(t, commands, merged.Monitor)
+	assert.Same(t, pool, merged.PoolMonitor)
+}
+
+func TestNewLoggingCommandMonitor(t *testing.T) {
+	ctx := context.Background()
+
+	handler := &recordingHandler{}
+	monitor := NewLoggingCommandMonitor(slog.New(handler))
+
+	command, err := bson.Marshal(bson.M{"insert": "users", "documents": bson.A{bson.M{"email": "john@example.com"}}})
+	if err != nil {
+		t.Fatalf("error marshaling command: %s", err)
+	}
+
+	finished := event.CommandFinishedEvent{
+		Duration:     3 * time.Millisecond,
+		CommandName:  "insert",
+		DatabaseName: "test",
+		RequestID:    42,
+		ConnectionID: "localhost:27017[-1]",
+	}
+
+	monitor.Started(ctx, &event.CommandStartedEvent{
+		Command:      command,
+		DatabaseName: "test",
+		CommandName:  "insert",
+		RequestID:    42,
+		ConnectionID: "localhost:27017[-1]",
+	})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finished, Reply: command})
+	monitor.Failed(ctx, &event.CommandFailedEvent{
+		CommandFinishedEvent: finished,
+		Failure:              `E11000 duplicate key error dup key: { email: "john@example.com" }`,
+	})
+
+	if len(handler.records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(handler.records))
+	}
+
+	started, succeeded, failed := handler.records[0], handler.records[1], handler.records[2]
+
+	assert.Equal(t, slog.LevelDebug, started.Level)
+	assert.Equal(t, "mongo command started", started.Message)
+	assert.Equal(t, map[string]string{
+		"command":       "insert",
+		"database":      "test",
+		"request_id":    "42",
+		"connection_id": "localhost:27017[-1]",
+	}, attrs(started))
+
+	assert.Equal(t, slog.LevelDebug, succeeded.Level)
+	assert.Equal(t, "mongo command succeeded", succeeded.Message)
+	assert.Equal(t, "3ms", attrs(succeeded)["duration"])
+
+	assert.Equal(t, slog.LevelWarn, failed.Level)
+	assert.Equal(t, "mongo command failed", failed.Message)
+	assert.Equal(t, "insert", attrs(failed)["command"])
+
+	for _, record := range handler.records {
+		for key, value := range attrs(record) {
+			assert.NotContains(t, value, "john@example.com", "%s of %q", key, record.Message)
+		}
+	}
+}
+
+func TestNewMongoRepo_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{name: "empty database", opt: WithDatabase("")},
+		{name: "empty collection", opt: WithCollection("")},
+		{name: "negative timeout", opt: WithConnectTimeout(-time.Second)},
+		{name: "zero ping timeout", opt: WithPingTimeout(0)},
+		{name: "negative slow operation threshold", opt: WithSlowOperationThreshold(-time.Second)},
+		{name: "negative idempotency key ttl", opt: WithIdempotencyKeyTTL(-time.Second)},
+		{name: "negative verification token ttl", opt: WithVerificationTokenTTL(-time.Second)},
+		{name: "negative password min length", opt: WithPasswordPolicy(PasswordPolicy{MinLength: -1})},
+		{name: "password max length over bcrypt", opt: WithPasswordPolicy(PasswordPolicy{MaxLength: 73})},
+		{name: "short encryption key", opt: WithFieldEncryption([]byte("short"))},
+		{name: "short previous encryption key", opt: WithFieldEncryption(make([]byte, 32), []byte("short"))},
+		{name: "repeated encryption key", opt: WithFieldEncryption(make([]byte, 32), make([]byte, 32))},
+		{name: "short email hash key", opt: func(o *repoOptions) {
+			WithFieldEncryption(make([]byte, 32))(o)
+			WithEmailHashKey([]byte("short"))(o)
+		}},
+		{name: "email hash key without encryption", opt: WithEmailHashKey(make([]byte, 32))},
+		{name: "password min length over max", opt: WithPasswordPolicy(PasswordPolicy{MinLength: 20, MaxLength: 12})},
+		{name: "short page token key", opt: WithPageTokenKey([]byte("short"))},
+		{name: "index creation with tenants", opt: func(o *repoOptions) {
+			WithTenantResolver(CollectionPerTenant("users"))(o)
+			WithIndexCreation()(o)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeConnect{}
+
+			_, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017", fake.option(), tt.opt)
+			assert.ErrorIs(t, err, ErrInvalidOption)
+			assert.Nil(t, fake.opts)
+		})
+	}
+}
+
+// closedPortURI returns a mongo URI on a local port nothing listens on.
+func closedPortURI(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	addr := listener.Addr().String()
+
+	err = listener.Close()
+	if err != nil {
+		t.Fatalf("error closing listener: %s", err)
+	}
+
+	return "mongodb://" + addr
+}
+
+func TestNewMongoRepo_Unreachable(t *testing.T) {
+	start := time.Now()
+
+	_, err := NewMongoRepo(context.Background(), closedPortURI(t), WithPingTimeout(200*time.Millisecond))
+	assert.ErrorIs(t, err, ErrConnectingToMongoDatabase)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestNewMongoRepo_SkipPing(t *testing.T) {
+	_, err := NewMongoRepo(context.Background(), closedPortURI(t), WithSkipPing())
+	assert.NoError(t, err)
+}
+
+func TestMongoRepo_Close(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = repo.Close(ctx)
+		if err != nil {
+			t.Fatalf("error closing repo: %s", err)
+		}
+	}
+
+	assert.Equal(t, 1, repo.mongoCaller.(*MockMongo).disconnects)
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrRepoClosed)
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrRepoClosed)
+
+	_, _, err = repo.ListUsersAfter(ctx, primitive.NilObjectID, 10)
+	assert.ErrorIs(t, err, ErrRepoClosed)
+
+	err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"name": "Johnny"})
+	assert.ErrorIs(t, err, ErrRepoClosed)
+}
+
+func TestMongoRepo_NotFound(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	id := primitive.NewObjectID()
+	missing := &User{ID: id, Name: "John", Email: "john@example.com", Password: "password", Version: 1}
+
+	tests := map[string]func() error{
+		"GetUserByID": func() error {
+			_, err := repo.GetUserByID(ctx, id)
+			return err
+		},
+		"GetUserByEmail": func() error {
+			_, err := repo.GetUserByEmail(ctx, "john@example.com")
+			return err
+		},
+		"VerifyPassword": func() error {
+			_, err := repo.VerifyPassword(ctx, "john@example.com", "password")
+			return err
+		},
+		"UpdateUser": func() error {
+			return repo.UpdateUser(ctx, missing)
+		},
+		"UpdateUserFields": func() error {
+			return repo.UpdateUserFields(ctx, id, map[string]interface{}{"name": "Johnny"})
+		},
+		"UpdateUserFieldsAtVersion": func() error {
+			return repo.UpdateUserFieldsAtVersion(ctx, id, 1, map[string]interface{}{"name": "Johnny"})
+		},
+		"ChangeUserEmail": func() error {
+			_, err := repo.ChangeUserEmail(ctx, id, "johnny@example.com")
+			return err
+		},
+		"DeleteUser": func() error {
+			return repo.DeleteUser(ctx, id)
+		},
+		"SoftDeleteUser": func() error {
+			return repo.SoftDeleteUser(ctx, id)
+		},
+		"RestoreUser": func() error {
+			return repo.RestoreUser(ctx, id)
+		},
+		"PromoteUser": func() error {
+			return repo.PromoteUser(ctx, id)
+		},
+	}
+
+	for name, call := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := call()
+			assert.ErrorIs(t, err, ErrUserNotFound)
+			assert.True(t, IsNotFound(err))
+			assert.NotErrorIs(t, err, mongo.ErrNoDocuments)
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	assert.True(t, IsNotFound(fmt.Errorf("wrapped: %w", ErrUserNotFound)))
+	assert.False(t, IsNotFound(mongo.ErrNoDocuments))
+	assert.False(t, IsNotFound(ErrFindingUser))
+	assert.False(t, IsNotFound(nil))
+}
+
+func TestMongoRepo_OperationError(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+	mock.transientFailures = 1
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrInsertingUser)
+	assert.NotErrorIs(t, err, ErrFindingUser)
+
+	var opErr *OperationError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected an OperationError, got %T: %s", err, err)
+	}
+
+	assert.Equal(t, "CreateUser", opErr.Op)
+	assert.Equal(t, "users", opErr.Collection)
+	assert.Greater(t, opErr.Took, time.Duration(0))
+	assert.Equal(t, transientError, opErr.Err)
+	assert.ErrorContains(t, err, "CreateUser on users")
+
+	var commandErr mongo.CommandError
+	assert.ErrorAs(t, err, &commandErr, "the driver error must stay reachable")
+
+	// The method that failed is reported, not the one calling it.
+	mock.transientFailures = 1
+
+	_, err = repo.VerifyPassword(ctx, "john@example.com", "password")
+	if assert.ErrorAs(t, err, &opErr) {
+		assert.Equal(t, "GetUserByEmail", opErr.Op)
+	}
+
+	assert.ErrorIs(t, err, ErrFindingUser)
+}
+
+func TestMongoRepo_OperationErrorNotForValidation(t *testing.T) {
+	repo := NewMockMongo()
+
+	_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "not an email", Password: "password"})
+	assert.Error(t, err)
+
+	var opErr *OperationError
+	assert.False(t, errors.As(err, &opErr))
+}
+
+func TestTranslateWriteError(t *testing.T) {
+	writeError := func(code int) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: code, Message: "write failed"}}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "object too large", err: writeError(10334), want: ErrDocumentTooLarge},
+		{name: "update too large", err: writeError(17419), want: ErrDocumentTooLarge},
+		{name: "batch too large", err: fmt.Errorf("insert: %w", driver.ErrDocumentTooLarge), want: ErrDocumentTooLarge},
+		{name: "unauthorized", err: mongo.CommandError{Code: 13, Name: "Unauthorized"}, want: ErrUnauthorized},
+		{name: "unauthorized write", err: writeError(13), want: ErrUnauthorized},
+		{name: "write concern failed", err: writeError(64), want: ErrWriteConcern},
+		{name: "unsatisfiable write concern", err: mongo.CommandError{Code: 100}, want: ErrWriteConcern},
+		{name: "write concern error", err: writeConcernError(), want: ErrWriteConcern},
+		{name: "unknown code", err: writeError(2), want: ErrUpdatingUser},
+		{name: "not a server error", err: errors.New("boom"), want: ErrUpdatingUser},
+		{name: "canceled", err: context.Canceled, want: ErrOperationCanceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := translateWriteError(ErrUpdatingUser, tt.err)
+			assert.ErrorIs(t, err, tt.want)
+
+			var opErr *OperationError
+			if assert.ErrorAs(t, err, &opErr) {
+				assert.Equal(t, tt.err, opErr.Err, "the driver error must stay wrapped")
+			}
+
+			if tt.want != ErrUpdatingUser {
+				assert.NotErrorIs(t, err, ErrUpdatingUser)
+			}
+		})
+	}
+}
+
+func TestMongoRepo_CreateUser_WriteErrors(t *testing.T) {
+	tests := map[int]error{
+		10334: ErrDocumentTooLarge,
+		13:    ErrUnauthorized,
+		64:    ErrWriteConcern,
+		2:     ErrInsertingUser,
+	}
+
+	for code, want := range tests {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			repo := NewMockMongo()
+			repo.mongoCaller.(*MockMongo).writeErr = mongo.WriteException{
+				WriteErrors: mongo.WriteErrors{{Code: code, Message: "write failed"}},
+			}
+
+			_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"})
+			assert.ErrorIs(t, err, want)
+
+			var writeErr mongo.WriteException
+			if assert.ErrorAs(t, err, &writeErr) {
+				assert.True(t, writeErr.HasErrorCode(code))
+			}
+
+			// Reads aren't affected.
+			_, err = repo.CountUsers(context.Background())
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMockMongo_Users(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	created, err := repo.CreateUser(ctx, &User{Name: "John", Email: "John@Example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	users := mock.Users()
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, created.ID, users[0].ID)
+		assert.Equal(t, "john@example.com", users[0].Email)
+		assert.NotEqual(t, "password", users[0].Password, "the password must be stored hashed")
+	}
+
+	// The users returned are copies.
+	users[0].Name = "Johnny"
+	assert.Equal(t, "John", mock.Users()[0].Name)
+}
+
+func TestMockMongo_Reset(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	err := repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			mock.Reset()
+
+			_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+
+			// The unique index outlives Reset.
+			_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+			assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+			assert.Len(t, mock.Users(), 1)
+			assert.Equal(t, 2, mock.calls)
+		})
+	}
+}
+
+func TestMockMongo_Filters(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	users := []*User{
+		{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{ID: primitive.NewObjectID(), Name: "Jack", Email: "jack@example.com", Password: "password"},
+	}
+
+	for _, user := range users {
+		_, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+	}
+
+	filters := map[string]struct {
+		filter bson.M
+		want   int64
+	}{
+		"_id":   {filter: bson.M{"_id": users[0].ID}, want: 1},
+		"email": {filter: bson.M{"email": "jane@example.com"}, want: 1},
+		"$in":   {filter: bson.M{"_id": bson.M{"$in": []primitive.ObjectID{users[0].ID, users[2].ID}}}, want: 2},
+		"none":  {filter: bson.M{"email": "nobody@example.com"}, want: 0},
+		"all":   {filter: bson.M{}, want: 3},
+	}
+
+	for name, tt := range filters {
+		t.Run(name, func(t *testing.T) {
+			count, err := mock.CountDocuments(ctx, tt.filter)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, count)
+
+			cursor, err := mock.Find(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("error finding: %s", err)
+			}
+
+			found, err := repo.decodeUsers(ctx, cursor)
+			assert.NoError(t, err)
+			assert.Len(t, found, int(tt.want))
+
+			err = mock.FindOne(ctx, tt.filter).Err()
+			if tt.want == 0 {
+				assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMockMongo_UnsupportedFilters(t *testing.T) {
+	ctx := context.Background()
+
+	mock := NewMockMongo().mongoCaller.(*MockMongo)
+
+	filters := map[string]interface{}{
+		"bson.D":           bson.D{{Key: "email", Value: "john@example.com"}},
+		"string":           `{"email": "john@example.com"}`,
+		"top level $or":    bson.M{"$or": bson.A{bson.M{"email": "a"}, bson.M{"email": "b"}}},
+		"unknown operator": bson.M{"email": bson.M{"$ne": "john@example.com"}},
+		"$in not an array": bson.M{"_id": bson.M{"$in": "john"}},
+	}
+
+	calls := map[string]func(filter interface{}) error{
+		"FindOne": func(filter interface{}) error {
+			return mock.FindOne(ctx, filter).Err()
+		},
+		"Find": func(filter interface{}) error {
+			_, err := mock.Find(ctx, filter)
+			return err
+		},
+		"UpdateOne": func(filter interface{}) error {
+			_, err := mock.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"name": "John"}})
+			return err
+		},
+		"FindOneAndUpdate": func(filter interface{}) error {
+			return mock.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"name": "John"}}).Err()
+		},
+		"ReplaceOne": func(filter interface{}) error {
+			_, err := mock.ReplaceOne(ctx, filter, &userDocument{Name: "John"})
+			return err
+		},
+		"DeleteOne": func(filter interface{}) error {
+			_, err := mock.DeleteOne(ctx, filter)
+			return err
+		},
+		"DeleteMany": func(filter interface{}) error {
+			_, err := mock.DeleteMany(ctx, filter)
+			return err
+		},
+		"CountDocuments": func(filter interface{}) error {
+			_, err := mock.CountDocuments(ctx, filter)
+			return err
+		},
+		"Distinct": func(filter interface{}) error {
+			_, err := mock.Distinct(ctx, "email", filter)
+			return err
+		},
+	}
+
+	for method, call := range calls {
+		for name, filter := range filters {
+			t.Run(method+"/"+name, func(t *testing.T) {
+				assert.ErrorIs(t, call(filter), errUnsupportedFilter)
+			})
+		}
+	}
+}
+
+func TestMockMongo_FailNext(t *testing.T) {
+	ctx := context.Background()
+
+	repo, mock, delays := newRetryingMock(3)
+	mock.FailNext("CountDocuments", transientError)
+	mock.FailNext("CountDocuments", transientError)
+
+	_, err := repo.CountUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, mock.calls)
+	assert.Len(t, *delays, 2)
+
+	_, err = repo.CountUsers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, mock.calls)
+}
+
+func TestMockMongo_FailAlways(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	tooLarge := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 10334, Message: "object to insert too large"}}}
+	mock.FailAlways("InsertOne", tooLarge)
+
+	for i := 0; i < 2; i++ {
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrDocumentTooLarge)
+	}
+
+	// Only InsertOne is broken.
+	_, err := repo.CountUsers(ctx)
+	assert.NoError(t, err)
+
+	mock.Reset()
+
+	_, err = repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	assert.NoError(t, err)
+}
+
+func TestMockMongo_FailAfterN(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+	mock.FailAfterN("InsertOne", 2, transientError)
+
+	for i, want := range []error{nil, nil, ErrInsertingUser, ErrInsertingUser} {
+		_, err := repo.CreateUser(ctx, &User{
+			Name:     "John",
+			Email:    fmt.Sprintf("john%d@example.com", i),
+			Password: "password",
+		})
+		if want == nil {
+			assert.NoError(t, err, "call %d", i)
+		} else {
+			assert.ErrorIs(t, err, want, "call %d", i)
+		}
+	}
+
+	assert.Len(t, mock.Users(), 2)
+}
+
+func TestMockMongo_LegacyTriggers(t *testing.T) {
+	ctx := context.Background()
+
+	mock := &MockMongo{users: make(map[primitive.ObjectID]userDocument)}
+	repo := NewMongoRepoFromCollection(mock)
+	repo.bcryptCost = bcrypt.MinCost
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: emailWitchTriggersError, Password: "password"})
+	assert.NoError(t, err, "the magic email only fails with legacyTriggers")
+
+	mock.legacyTriggers = true
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: emailWitchTriggersError, Password: "password"})
+	assert.ErrorIs(t, err, ErrInsertingUser)
+}
+
+func TestMockMongo_Calls(t *testing.T) {
+	repo := NewMockMongo()
+	repo.operationTimeout = time.Minute
+	mock := repo.mongoCaller.(*MockMongo)
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	_, err := repo.CreateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	// Changing the user afterwards doesn't alter what was recorded.
+	user.Name = "Johnny"
+
+	_, err = repo.GetUserByEmail(context.Background(), "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	calls := mock.Calls()
+	if assert.Len(t, calls, 2) {
+		assert.Equal(t, "InsertOne", calls[0].Method)
+		assert.Equal(t, "Find", calls[1].Method)
+		assert.False(t, calls[0].Deadline.IsZero(), "the operation timeout must reach the database")
+		assert.False(t, calls[1].At.Before(calls[0].At))
+	}
+
+	mock.AssertCalledWith(t, "InsertOne", func(call Call) bool {
+		doc := call.Args[0].(bson.M)
+		return doc["name"] == "John" && doc["email"] == "john@example.com"
+	})
+	mock.AssertCalledWith(t, "Find", func(call Call) bool {
+		return call.Args[0].(bson.M)["email"] == "john@example.com"
+	})
+
+	mock.Reset()
+	assert.Empty(t, mock.Calls())
+}
+
+func TestMockMongo_AssertCalledWith_NoMatch(t *testing.T) {
+	mock := NewMockMongo().mongoCaller.(*MockMongo)
+
+	reporter := &fakeReporter{}
+	matched := mock.AssertCalledWith(reporter, "InsertOne", func(Call) bool { return true })
+	assert.False(t, matched)
+	assert.Len(t, reporter.errors, 1)
+}
+
+// fakeReporter records the errors AssertCalledWith and SeedUsers report.
+type fakeReporter struct {
+	errors []string
+}
+
+func (r *fakeReporter) Helper() {}
+
+func (r *fakeReporter) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *fakeReporter) Fatalf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMongoRepo_CreateUsers_SingleInsertMany(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	users := []*User{
+		{Name: "John", Email: "john@example.com", Password: "password"},
+		{Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{Name: "Jack", Email: "jack@example.com", Password: "password"},
+	}
+
+	_, err := repo.CreateUsers(context.Background(), users)
+	if err != nil {
+		t.Fatalf("error creating users: %s", err)
+	}
+
+	assert.Empty(t, mock.CallsTo("InsertOne"))
+
+	inserts := mock.CallsTo("InsertMany")
+	if assert.Len(t, inserts, 1) {
+		assert.Len(t, inserts[0].Args[0], len(users))
+	}
+}
+
+func TestMockMongo_CallsConcurrently(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	const workers = 8
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := repo.CreateUser(context.Background(), &User{
+				Name:     "John",
+				Email:    fmt.Sprintf("john%d@example.com", i),
+				Password: "password",
+			})
+			assert.NoError(t, err)
+
+			_ = mock.Calls()
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Len(t, mock.CallsTo("InsertOne"), workers)
+}
+
+func TestMockMongo_ConcurrentCreateUser(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	const users = 100
+
+	ids := make(chan primitive.ObjectID, users)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			created, err := repo.CreateUser(context.Background(), &User{
+				Name:     "John",
+				Email:    fmt.Sprintf("john%d@example.com", i),
+				Password: "password",
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			ids <- created.ID
+
+			// Reads can go along the writes.
+			_ = mock.Users()
+		}(i)
+	}
+
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[primitive.ObjectID]bool, users)
+	for id := range ids {
+		assert.False(t, seen[id], "id %s inserted twice", id.Hex())
+		seen[id] = true
+	}
+
+	assert.Len(t, seen, users)
+	assert.Len(t, mock.Users(), users)
+	assert.Len(t, mock.CallsTo("InsertOne"), users)
+}
+
+func TestMockMongo_StoresCopies(t *testing.T) {
+	ctx := context.Background()
+
+	mock := NewMockMongo().mongoCaller.(*MockMongo)
+
+	deletedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	docDeletedAt := deletedAt
+	doc := &userDocument{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", DeletedAt: &docDeletedAt}
+
+	_, err := mock.InsertOne(ctx, doc)
+	if err != nil {
+		t.Fatalf("error inserting: %s", err)
+	}
+
+	doc.Name = "Johnny"
+	*doc.DeletedAt = deletedAt.Add(time.Hour)
+
+	users := mock.Users()
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "John", users[0].Name)
+		assert.Equal(t, deletedAt, *users[0].DeletedAt)
+
+		*users[0].DeletedAt = time.Time{}
+		assert.Equal(t, deletedAt, *mock.Users()[0].DeletedAt)
+	}
+}
+
+func TestMockMongo_SetLatency(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+	mock.SetLatency("InsertOne", 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrOperationTimeout)
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "the latency must end with the context")
+
+	// Other methods don't wait.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = repo.CountUsers(ctx)
+	assert.NoError(t, err)
+}
+
+func TestMockMongo_SetLatencyFunc(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+	mock.SetLatency("CountDocuments", time.Hour)
+
+	var methods []string
+
+	mock.SetLatencyFunc(func(method string) time.Duration {
+		methods = append(methods, method)
+		return time.Millisecond
+	})
+
+	_, err := repo.CountUsers(context.Background())
+	assert.NoError(t, err, "the latency func takes precedence")
+	assert.Equal(t, []string{"CountDocuments"}, methods)
+
+	mock.Reset()
+
+	_, err = repo.CountUsers(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, methods, 1, "Reset must drop the latency func")
+}
+
+func TestMockMongo_SetLatencyConcurrent(t *testing.T) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+	mock.SetLatency("CountDocuments", 100*time.Millisecond)
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+
+	for range 2 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, err := repo.CountUsers(context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Less(t, time.Since(start), 180*time.Millisecond, "concurrent calls must wait at the same time")
+
+	// The latency func runs without the lock of the mock.
+	mock.SetLatencyFunc(func(method string) time.Duration {
+		return time.Duration(len(mock.Calls())) * time.Millisecond
+	})
+
+	_, err := repo.CountUsers(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestMockMongo_FailWhen(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	locked := &User{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password"}
+	other := &User{ID: primitive.NewObjectID(), Name: "Jane", Email: "jane@example.com", Password: "password"}
+
+	errLocked := errors.New("document is locked")
+	mock.FailWhen(func(method string, doc interface{}) error {
+		if filter, ok := doc.(bson.M); ok && method == "UpdateOne" && filter["_id"] == locked.ID {
+			return errLocked
+		}
+
+		return nil
+	})
+
+	for _, user := range []*User{locked, other} {
+		_, err := repo.CreateUser(ctx, user)
+		assert.NoError(t, err, "inserts must go through")
+	}
+
+	err := repo.UpdateUserFields(ctx, locked.ID, map[string]interface{}{"name": "Johnny"})
+	assert.ErrorIs(t, err, ErrUpdatingUser)
+	assert.ErrorIs(t, err, errLocked)
+
+	err = repo.UpdateUserFields(ctx, other.ID, map[string]interface{}{"name": "Janet"})
+	assert.NoError(t, err)
+
+	mock.Reset()
+
+	_, err = repo.CreateUser(ctx, locked)
+	assert.NoError(t, err)
+
+	err = repo.UpdateUserFields(ctx, locked.ID, map[string]interface{}{"name": "Johnny"})
+	assert.NoError(t, err, "Reset must drop the predicates")
+}
+
+func TestFailOnEmail(t *testing.T) {
+	errBoom := errors.New("boom")
+	predicate := FailOnEmail("john@example.com", errBoom)
+
+	assert.Equal(t, errBoom, predicate("InsertOne", &userDocument{Email: "john@example.com"}))
+	assert.Equal(t, errBoom, predicate("Find", bson.M{"email": "john@example.com"}))
+	assert.NoError(t, predicate("InsertOne", &userDocument{Email: "jane@example.com"}))
+	assert.NoError(t, predicate("Find", bson.M{"_id": primitive.NewObjectID()}))
+}
+
+func TestMockMongo_WithUniqueEmail(t *testing.T) {
+	ctx := context.Background()
+
+	newRepo := func(t *testing.T) (*MongoRepo, *User) {
+		repo := NewMockMongo(WithUniqueEmail())
+
+		existing, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		return repo, existing
+	}
+
+	t.Run("CreateUser", func(t *testing.T) {
+		repo, _ := newRepo(t)
+
+		_, err := repo.CreateUser(ctx, &User{Name: "Johnny", Email: "John@Example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists, "emails differing by case collide once normalized")
+	})
+
+	t.Run("CreateUsers", func(t *testing.T) {
+		repo, _ := newRepo(t)
+
+		_, err := repo.CreateUsers(ctx, []*User{
+			{Name: "Jane", Email: "jane@example.com", Password: "password"},
+			{Name: "Johnny", Email: "john@example.com", Password: "password"},
+		})
+
+		var bulkErr *BulkInsertError
+		if assert.ErrorAs(t, err, &bulkErr) {
+			assert.Equal(t, []int{1}, bulkErr.FailedIndexes())
+			assert.True(t, mongo.IsDuplicateKeyError(bulkErr.Err))
+		}
+	})
+
+	t.Run("UpdateUser", func(t *testing.T) {
+		repo, existing := newRepo(t)
+
+		other, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		other.Email = existing.Email
+		err = repo.UpdateUser(ctx, other)
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+		assert.ErrorContains(t, err, existing.Email)
+
+		// Keeping its own email is no conflict.
+		got, err := repo.GetUserByID(ctx, existing.ID, WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		got.Name = "Johnny"
+		assert.NoError(t, repo.UpdateUser(ctx, got))
+	})
+
+	t.Run("UpdateUserFields", func(t *testing.T) {
+		repo, existing := newRepo(t)
+
+		other, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		err = repo.UpdateUserFields(ctx, other.ID, map[string]interface{}{"email": existing.Email})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+		err = repo.UpdateUserFields(ctx, existing.ID, map[string]interface{}{"email": existing.Email})
+		assert.NoError(t, err)
+	})
+
+	t.Run("case as stored", func(t *testing.T) {
+		mock := NewMockMongo(WithUniqueEmail()).mongoCaller.(*MockMongo)
+
+		_, err := mock.InsertOne(ctx, &userDocument{ID: primitive.NewObjectID(), Email: "john@example.com"})
+		assert.NoError(t, err)
+
+		// Without the repo normalizing, only exact matches collide.
+		_, err = mock.InsertOne(ctx, &userDocument{ID: primitive.NewObjectID(), Email: "John@example.com"})
+		assert.NoError(t, err)
+
+		_, err = mock.InsertOne(ctx, &userDocument{ID: primitive.NewObjectID(), Email: "john@example.com"})
+
+		var writeErr mongo.WriteException
+		if assert.ErrorAs(t, err, &writeErr) {
+			assert.True(t, writeErr.HasErrorCode(11000))
+		}
+	})
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	assert.Equal(t, start, clock.Now())
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Minute), clock.Now())
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			clock.Advance(time.Second)
+			clock.Now()
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, start.Add(10*time.Second), clock.Now())
+}
+
+func TestMongoRepo_WithClock(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer client.Disconnect(ctx)
+
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	repo, err := NewMongoRepoFromClient(client, WithClock(clock))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.Same(t, clock, repo.clock)
+	assert.Equal(t, clock.Now(), repo.connection.now())
+}
+
+func TestMongoRepo_ClockTimestamps(t *testing.T) {
+	ctx := context.Background()
+
+	created := time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC)
+	clock := NewFakeClock(created)
+
+	repo := NewMockMongo()
+	repo.clock = clock
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	_, err := repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	clock.Advance(90 * time.Minute)
+
+	err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"name": "Johnny"})
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created, got.CreatedAt)
+	assert.Equal(t, created.Add(90*time.Minute), got.UpdatedAt)
+}
+
+func TestMongoRepo_ClockOperationTook(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	repo := NewMockMongo()
+	repo.clock = clock
+	mock := repo.mongoCaller.(*MockMongo)
+
+	mock.FailWhen(func(method string, doc interface{}) error {
+		clock.Advance(3 * time.Second)
+		return errors.New("boom")
+	})
+
+	_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"})
+
+	var opErr *OperationError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected an OperationError, got %v", err)
+	}
+
+	assert.Equal(t, 3*time.Second, opErr.Took)
+}
+
+func TestSequentialIDGenerator(t *testing.T) {
+	var ids SequentialIDGenerator
+
+	first := ids.NewID()
+	second := ids.NewID()
+
+	assert.Equal(t, "000000000000000000000001", first.Hex())
+	assert.Equal(t, "000000000000000000000002", second.Hex())
+	assert.Negative(t, bytes.Compare(first[:], second[:]))
+}
+
+func TestMongoRepo_IDGenerator(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.ids = &SequentialIDGenerator{}
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Equal(t, "000000000000000000000001", user.ID.Hex())
+
+	kept := primitive.NewObjectID()
+
+	ids, err := repo.CreateUsers(ctx, []*User{
+		{Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{ID: kept, Name: "Jim", Email: "jim@example.com", Password: "password"},
+		{Name: "Joe", Email: "joe@example.com", Password: "password"},
+	})
+	if err != nil {
+		t.Fatalf("error creating users: %s", err)
+	}
+
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 ids, got %d", len(ids))
+	}
+
+	assert.Equal(t, "000000000000000000000002", ids[0].Hex())
+	assert.Equal(t, kept, ids[1])
+	assert.Equal(t, "000000000000000000000003", ids[2].Hex())
+
+	page, next, err := repo.ListUsersAfter(ctx, primitive.NilObjectID, 2)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	if len(page) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(page))
+	}
+
+	assert.Equal(t, "john@example.com", page[0].Email)
+	assert.Equal(t, "jane@example.com", page[1].Email)
+	assert.Equal(t, ids[0], next)
+}
+
+// trickyStrings seed the fuzz targets with inputs that once surprised us.
+var trickyStrings = []string{
+	"",
+	" ",
+	"john@example.com",
+	" John.Doe+newsletter@Example.COM ",
+	"john+@example.com",
+	"\"john doe\"@example.com",
+	"John <john@example.com>",
+	"john@@example.com",
+	"jöhn@exämple.com",
+	"\u05d9\u05d5\u05d7\u05e0\u05df@example.com",
+	"\u202ejohn@example.com",
+	"İstanbul@example.com",
+	"john\x00@example.com",
+	"\xff\xfe@example.com",
+	strings.Repeat("a", 1<<16) + "@example.com",
+}
+
+func FuzzNormalizeEmail(f *testing.F) {
+	for _, seed := range trickyStrings {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, email string) {
+		normalized, err := NormalizeEmail(email)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrInvalidEmail)
+			return
+		}
+
+		again, err := NormalizeEmail(normalized)
+		if err != nil {
+			t.Fatalf("normalized email %q is rejected: %s", normalized, err)
+		}
+
+		assert.Equal(t, normalized, again)
+	})
+}
+
+func FuzzUserValidate(f *testing.F) {
+	for _, seed := range trickyStrings {
+		f.Add(seed, seed, "password")
+	}
+
+	f.Add("John\x00", "john@example.com", "password")
+	f.Add(strings.Repeat("John", 1<<20), "john@example.com", "password")
+	f.Add("John", "john@example.com", strings.Repeat("p", maxPasswordLength+1))
+
+	f.Fuzz(func(t *testing.T, name, email, password string) {
+		user := &User{Name: name, Email: email, Password: password}
+
+		err := user.Validate()
+		if err != nil {
+			assert.ErrorIs(t, err, ErrInvalidUser)
+			return
+		}
+
+		_, err = NormalizeEmail(email)
+		assert.NoError(t, err)
+		assert.True(t, utf8.ValidString(name))
+		assert.LessOrEqual(t, len(name), maxNameLength)
+
+		repo := &MongoRepo{bcryptCost: bcrypt.MinCost}
+
+		_, err = repo.hashPassword(password)
+		assert.NoError(t, err)
+	})
+}
+
+func FuzzUserDocumentRoundTrip(f *testing.F) {
+	for _, seed := range trickyStrings {
+		f.Add([]byte("0123456789ab"), seed, seed, seed, RoleMember, int64(1), int64(0), int64(-1))
+	}
+
+	f.Add([]byte{}, "John", "john@example.com", "hash", "", int64(0), int64(1<<62), int64(1<<40))
+
+	f.Fuzz(func(t *testing.T, id []byte, name, email, password, role string, version, created, deleted int64) {
+		user := &User{
+			Name:      name,
+			Email:     email,
+			Password:  password,
+			Role:      role,
+			Version:   version,
+			CreatedAt: time.Unix(0, created),
+			UpdatedAt: time.Unix(0, created/2),
+		}
+		copy(user.ID[:], id)
+
+		if deleted >= 0 {
+			deletedAt := time.Unix(0, deleted)
+			user.DeletedAt = &deletedAt
+		}
+
+		data, err := bson.Marshal(toDocument(user))
+		if err != nil {
+			t.Fatalf("error marshaling user: %s", err)
+		}
+
+		var doc userDocument
+
+		err = bson.Unmarshal(data, &doc)
+		if err != nil {
+			t.Fatalf("error unmarshaling user: %s", err)
+		}
+
+		got := fromDocument(&doc)
+
+		assert.Equal(t, user.ID, got.ID)
+		assert.Equal(t, user.Name, got.Name)
+		assert.Equal(t, strings.ToLower(strings.TrimSpace(user.Email)), got.Email)
+		assert.Equal(t, user.Password, got.Password)
+		assert.Equal(t, user.Role, got.Role)
+		assert.Equal(t, user.Version, got.Version)
+		assert.Equal(t, storedTime(user.CreatedAt), got.CreatedAt)
+		assert.Equal(t, storedTime(user.UpdatedAt), got.UpdatedAt)
+		assert.Equal(t, storedTimePtr(user.DeletedAt), got.DeletedAt)
+		assert.Nil(t, got.ExpiresAt)
+	})
+}
+
+// seedMock stores n users directly in the mock behind repo, skipping the
+// password hashing CreateUser would do, and returns their IDs in order.
+func seedMock(repo *MongoRepo, n int) []primitive.ObjectID {
+	mock := repo.mongoCaller.(*MockMongo)
+	ids := &SequentialIDGenerator{}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	seeded := make([]primitive.ObjectID, 0, n)
+
+	for i := 0; i < n; i++ {
+		id := ids.NewID()
+		mock.users[id] = userDocument{
+			ID:        id,
+			Name:      fmt.Sprintf("John %d", i),
+			Email:     fmt.Sprintf("john%d@example.com", i),
+			Password:  "hash",
+			Role:      RoleMember,
+			Version:   1,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		seeded = append(seeded, id)
+	}
+
+	return seeded
+}
+
+func TestDocumentFields(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, doc := range []userDocument{
+		{},
+		{ID: primitive.NewObjectID(), Email: "john@example.com"},
+		{
+			ID:        primitive.NewObjectID(),
+			Name:      "John",
+			Email:     "john@example.com",
+			Password:  "hash",
+			Role:      RoleAdmin,
+			Version:   3,
+			CreatedAt: now,
+			UpdatedAt: now.Add(time.Hour),
+			DeletedAt: &now,
+			ExpiresAt: &time.Time{},
+		},
+	} {
+		want, err := bsonDocument(doc)
+		if err != nil {
+			t.Fatalf("error marshaling document: %s", err)
+		}
+
+		assert.Equal(t, want, documentFields(doc))
+	}
+}
+
+func BenchmarkMongoRepo_CreateUser(b *testing.B) {
+	ctx := context.Background()
+	repo := NewMockMongo()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := repo.CreateUser(ctx, &User{
+			Name:     "John",
+			Email:    fmt.Sprintf("john%d@example.com", i),
+			Password: "password",
+		})
+		if err != nil {
+			b.Fatalf("error creating user: %s", err)
+		}
+	}
+}
+
+func BenchmarkMongoRepo_CreateUsers(b *testing.B) {
+	ctx := context.Background()
+
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			repo := NewMockMongo()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				users := make([]*User, 0, size)
+				for j := 0; j < size; j++ {
+					users = append(users, &User{
+						Name:     "John",
+						Email:    fmt.Sprintf("john%d.%d@example.com", i, j),
+						Password: "password",
+					})
+				}
+
+				_, err := repo.CreateUsers(ctx, users)
+				if err != nil {
+					b.Fatalf("error creating users: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMongoRepo_GetUserByID(b *testing.B) {
+	ctx := context.Background()
+	repo := NewMockMongo()
+	ids := seedMock(repo, 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := repo.GetUserByID(ctx, ids[i%len(ids)])
+		if err != nil {
+			b.Fatalf("error getting user: %s", err)
+		}
+	}
+}
+
+func BenchmarkMongoRepo_ListUsers(b *testing.B) {
+	ctx := context.Background()
+	repo := NewMockMongo()
+	seedMock(repo, 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := repo.ListUsers(ctx, 50, int64(i%200)*50)
+		if err != nil {
+			b.Fatalf("error listing users: %s", err)
+		}
+	}
+}
+
+// TestMongoRepo_ConcurrentUse runs creates, updates, reads and deletes from
+// many goroutines on one repo, through the callers NewMongoRepo stacks. Run it
+// with -race.
+func TestMongoRepo_ConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	repo.connection = newConnectionState(mock, time.Minute)
+	repo.mongoCaller = newRetryingCaller(&reconnectingCaller{caller: mock, state: repo.connection}, 3, time.Millisecond)
+
+	const (
+		sharedUsers = 10
+		creators    = 20
+		updaters    = 20
+		updates     = 10
+	)
+
+	shared := make([]primitive.ObjectID, 0, sharedUsers)
+	for i := 0; i < sharedUsers; i++ {
+		user, err := repo.CreateUser(ctx, &User{
+			Name:     "John",
+			Email:    fmt.Sprintf("shared%d@example.com", i),
+			Password: "password",
+		})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		shared = append(shared, user.ID)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		created  atomic.Int64
+		deleted  atomic.Int64
+		versions [sharedUsers]atomic.Int64
+	)
+
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			user, err := repo.CreateUser(ctx, &User{
+				Name:     "Jane",
+				Email:    fmt.Sprintf("jane%d@example.com", i),
+				Password: "password",
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			created.Add(1)
+
+			if i%2 == 0 {
+				err = repo.DeleteUser(ctx, user.ID)
+				if assert.NoError(t, err) {
+					deleted.Add(1)
+				}
+			}
+		}(i)
+	}
+
+	for i := 0; i < updaters; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var seen [sharedUsers]int64
+
+			for j := 0; j < updates; j++ {
+				n := (i + j) % sharedUsers
+
+				err := repo.UpdateUserFields(ctx, shared[n], map[string]interface{}{"name": fmt.Sprintf("John %d", i)})
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				versions[n].Add(1)
+
+				got, err := repo.GetUserByID(ctx, shared[n])
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				// The update made above is visible, and versions never go back.
+				assert.Greater(t, got.Version, seen[n])
+				seen[n] = got.Version
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	count, err := repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	assert.Equal(t, sharedUsers+created.Load()-deleted.Load(), count)
+
+	for _, user := range mock.Users() {
+		assert.False(t, user.ID.IsZero())
+	}
+
+	for n, id := range shared {
+		got, err := repo.GetUserByID(ctx, id)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, 1+versions[n].Load(), got.Version)
+	}
+}
+
+// updateGolden makes TestUserDocument_Golden rewrite its golden files:
+//
+//	go test -run TestUserDocument_Golden -update .
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestUserDocument_Golden checks the documents written to Mongo keep their
+// shape, as canonical extended JSON. A change here breaks the documents
+// already stored: update the goldens only when that is intended.
+func TestUserDocument_Golden(t *testing.T) {
+	ids := &SequentialIDGenerator{}
+	clock := NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC))
+
+	minimal := &User{
+		ID:       ids.NewID(),
+		Name:     "John",
+		Email:    "john@example.com",
+		Password: "$2a$04$hash",
+	}
+
+	created := clock.Now()
+	clock.Advance(time.Hour)
+	updated := clock.Now()
+	clock.Advance(time.Hour)
+	deleted := clock.Now()
+	expires := created.Add(24 * time.Hour)
+
+	maximal := &User{
+		ID:        ids.NewID(),
+		Name:      "Jane",
+		Email:     "Jane@Example.com",
+		Password:  "$2a$04$hash",
+		Role:      RoleAdmin,
+		Version:   3,
+		CreatedAt: created,
+		UpdatedAt: updated,
+		DeletedAt: &deleted,
+		ExpiresAt: &expires,
+	}
+
+	for name, user := range map[string]*User{"minimal": minimal, "maximal": maximal} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := bson.MarshalExtJSON(toDocument(user), true, false)
+			if err != nil {
+				t.Fatalf("error marshaling user: %s", err)
+			}
+
+			var got bytes.Buffer
+
+			err = json.Indent(&got, raw, "", "  ")
+			if err != nil {
+				t.Fatalf("error indenting document: %s", err)
+			}
+
+			got.WriteString("\n")
+
+			path := filepath.Join("testdata", "user_"+name+".golden.json")
+
+			if *updateGolden {
+				err = os.WriteFile(path, got.Bytes(), 0o644)
+				if err != nil {
+					t.Fatalf("error writing golden file: %s", err)
+				}
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("error reading golden file: %s", err)
+			}
+
+			assert.Equal(t, string(want), got.String())
+		})
+	}
+}
+
+// TestUserDocument_Legacy decodes a document written before versions and
+// timestamps existed.
+func TestUserDocument_Legacy(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "user_legacy.json"))
+	if err != nil {
+		t.Fatalf("error reading document: %s", err)
+	}
+
+	var doc userDocument
+
+	err = bson.UnmarshalExtJSON(raw, true, &doc)
+	if err != nil {
+		t.Fatalf("error decoding document: %s", err)
+	}
+
+	user := fromDocument(&doc)
+
+	assert.Equal(t, "5f1d7e2c9a1b2c3d4e5f6a7b", user.ID.Hex())
+	assert.Equal(t, "John", user.Name)
+	assert.Equal(t, "john@example.com", user.Email)
+	assert.NotEmpty(t, user.Password)
+	assert.Empty(t, user.Role)
+	assert.Zero(t, user.Version)
+	assert.True(t, user.CreatedAt.IsZero())
+	assert.True(t, user.UpdatedAt.IsZero())
+	assert.Nil(t, user.DeletedAt)
+	assert.Nil(t, user.ExpiresAt)
+}
+
+func TestSeedUsers(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	users := SeedUsers(t, repo, 10, WithSeedRole(RoleGuest), WithSeedSoftDeleted(0.3),
+		WithSeedEmailDomain("example.org"))
+
+	if len(users) != 10 {
+		t.Fatalf("expected 10 users, got %d", len(users))
+	}
+
+	assert.Equal(t, "User 0001", users[0].Name)
+	assert.Equal(t, "user0010@example.org", users[9].Email)
+
+	var deleted int
+
+	for _, user := range users {
+		assert.False(t, user.ID.IsZero())
+		assert.Equal(t, RoleGuest, user.Role)
+
+		if user.DeletedAt != nil {
+			deleted++
+		}
+	}
+
+	assert.Equal(t, 3, deleted)
+
+	listed, err := repo.ListUsers(ctx, 100, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, listed, 7)
+
+	users = SeedUsers(t, NewMockMongo(), 2)
+	assert.Equal(t, "user0002@example.test", users[1].Email)
+	assert.Equal(t, RoleMember, users[1].Role)
+	assert.Nil(t, users[1].DeletedAt)
+
+	closed := NewMockMongo()
+	_ = closed.Close(ctx)
+
+	reporter := &fakeReporter{}
+	SeedUsers(reporter, closed, 1)
+
+	if assert.Len(t, reporter.errors, 1) {
+		assert.Contains(t, reporter.errors[0], "error seeding users")
+	}
+}
+
+// recordingHandler is a slog.Handler keeping the records it handles.
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, record.Clone())
+
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// attrs returns the attributes of record by key.
+func attrs(record slog.Record) map[string]string {
+	values := map[string]string{}
+
+	record.Attrs(func(attr slog.Attr) bool {
+		values[attr.Key] = attr.Value.String()
+		return true
+	})
+
+	return values
+}
+
+func TestMongoRepo_Logger(t *testing.T) {
+	ctx := context.Background()
+
+	handler := &recordingHandler{}
+
+	repo := NewMockMongo()
+	repo.logger = slog.New(handler)
+
+	const (
+		email    = "john@example.com"
+		password = "supersecret"
+	)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: email, Password: password})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: email, Password: password})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	_, err = repo.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	records := handler.records
+	if len(records) != 8 {
+		t.Fatalf("expected 8 records, got %d", len(records))
+	}
+
+	assert.Equal(t, slog.LevelDebug, records[0].Level)
+	assert.Equal(t, map[string]string{"op": "CreateUser"}, attrs(records[0]))
+
+	created := attrs(records[1])
+	assert.Equal(t, slog.LevelInfo, records[1].Level)
+	assert.Equal(t, "CreateUser", created["op"])
+	assert.Equal(t, user.ID.Hex(), created["user_id"])
+	assert.Contains(t, created, "duration")
+
+	failed := attrs(records[5])
+	assert.Equal(t, slog.LevelError, records[5].Level)
+	assert.Equal(t, "CreateUser", failed["op"])
+	assert.Contains(t, failed["error"], "user already exists")
+
+	for _, record := range records {
+		for key, value := range attrs(record) {
+			assert.NotContains(t, value, email, key)
+			assert.NotContains(t, value, password, key)
+		}
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	logger := slog.New(&recordingHandler{})
+
+	repo, err := NewMongoRepoFromClient(client, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.Same(t, logger, repo.logger)
+	assert.Nil(t, NewMockMongo().logger)
+}
+
+func TestRedact(t *testing.T) {
+	message := `user already exists: email john@example.com: E11000 dup key: { email: "JOHN@example.com" }`
+
+	assert.Equal(t, `user already exists: email [redacted]: E11000 dup key: { email: "[redacted]" }`, redact(message))
+}
+
+func TestMongoRepo_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	repo := NewMockMongo()
+	repo.tracer = provider.Tracer(tracerName)
+	mock := repo.mongoCaller.(*MockMongo)
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	mock.FailNext("FindOne", errors.New("boom"))
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.Error(t, err)
+
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	insert, find := spans[0], spans[1]
+
+	assert.Equal(t, "mongo.users.insert", insert.Name)
+	assert.Equal(t, trace.SpanKindClient, insert.SpanKind)
+	assert.Equal(t, codes.Unset, insert.Status.Code)
+	assert.Contains(t, insert.Attributes, attribute.String("db.system", "mongodb"))
+	assert.Contains(t, insert.Attributes, attribute.String("db.operation", "insert"))
+	assert.Contains(t, insert.Attributes, attribute.String("db.mongodb.collection", "users"))
+
+	assert.Equal(t, "mongo.users.find", find.Name)
+	assert.Equal(t, codes.Error, find.Status.Code)
+	assert.Contains(t, find.Status.Description, "boom")
+	assert.Len(t, find.Events, 1)
+
+	for _, span := range spans[:2] {
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID())
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	}
+}
+
+func TestMongoRepo_TracingPanic(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	repo := NewMockMongo()
+	repo.tracer = provider.Tracer(tracerName)
+	mock := repo.mongoCaller.(*MockMongo)
+
+	mock.FailWhen(func(string, interface{}) error {
+		panic("boom")
+	})
+
+	assert.Panics(t, func() {
+		_, _ = repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"})
+	})
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, "mongo.users.insert", spans[0].Name)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+	}
+}
+
+func TestWithTracerProvider(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	repo, err := NewMongoRepoFromClient(client, WithTracerProvider(sdktrace.NewTracerProvider()))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.NotNil(t, repo.tracer)
+	assert.Nil(t, NewMockMongo().tracer)
+}
+
+// scrapeMetrics gathers registry into the value of each series, keyed like
+// user_repo_operations_total{op="CreateUser",status="ok"}. Histograms give
+// their sample count, under their name suffixed with _count.
+func scrapeMetrics(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	series := make(map[string]float64)
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+
+			name, value := family.GetName(), metric.GetCounter().GetValue()
+			if family.GetType() == dto.MetricType_HISTOGRAM {
+				name, value = name+"_count", float64(metric.GetHistogram().GetSampleCount())
+			}
+
+			series[name+"{"+strings.Join(labels, ",")+"}"] = value
+		}
+	}
+
+	return series
+}
+
+func TestMongoRepo_Metrics(t *testing.T) {
+	ctx := context.Background()
+
+	registry := prometheus.NewRegistry()
+
+	metrics, err := newRepoMetrics(registry)
+	if err != nil {
+		t.Fatalf("error registering metrics: %s", err)
+	}
+
+	repo := NewMockMongo()
+	repo.metrics = metrics
+	mock := repo.mongoCaller.(*MockMongo)
+
+	err = repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	mock.FailNext("FindOne", errors.New("boom"))
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.Error(t, err)
+
+	err = repo.UpdateUserFieldsAtVersion(ctx, user.ID, 1, map[string]interface{}{"name": "Johnny"})
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	err = repo.UpdateUserFieldsAtVersion(ctx, user.ID, 1, map[string]interface{}{"name": "Jack"})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+
+	assert.Equal(t, map[string]float64{
+		`user_repo_operations_total{op="EnsureIndexes",status="ok"}`:                   1,
+		`user_repo_operations_total{op="CreateUser",status="ok"}`:                      1,
+		`user_repo_operations_total{op="CreateUser",status="conflict"}`:                1,
+		`user_repo_operations_total{op="GetUserByID",status="ok"}`:                     1,
+		`user_repo_operations_total{op="GetUserByID",status="not_found"}`:              1,
+		`user_repo_operations_total{op="GetUserByID",status="error"}`:                  1,
+		`user_repo_operations_total{op="UpdateUserFieldsAtVersion",status="ok"}`:       1,
+		`user_repo_operations_total{op="UpdateUserFieldsAtVersion",status="conflict"}`: 1,
+		`user_repo_operation_duration_seconds_count{op="EnsureIndexes"}`:               1,
+		`user_repo_operation_duration_seconds_count{op="CreateUser"}`:                  2,
+		`user_repo_operation_duration_seconds_count{op="GetUserByID"}`:                 3,
+		`user_repo_operation_duration_seconds_count{op="UpdateUserFieldsAtVersion"}`:   2,
+	}, scrapeMetrics(t, registry))
+}
+
+func TestOperationStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "ok"},
+		{ErrUserNotFound, "not_found"},
+		{&OperationError{Err: errors.New("no documents"), sentinel: ErrUserNotFound}, "not_found"},
+		{fmt.Errorf("%w: email john@example.com", ErrUserAlreadyExists), "conflict"},
+		{fmt.Errorf("%w: %w", ErrEmailAlreadyTaken, ErrUserAlreadyExists), "conflict"},
+		{ErrVersionConflict, "conflict"},
+		{ErrRepoClosed, "error"},
+		{&OperationError{Err: errors.New("boom"), sentinel: ErrFindingUser}, "error"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, operationStatus(tt.err), "%v", tt.err)
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	registry := prometheus.NewRegistry()
+
+	first, err := NewMongoRepoFromClient(client, WithMetrics(registry))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	second, err := NewMongoRepoFromClient(client, WithMetrics(registry), WithCollection("admins"))
+	if err != nil {
+		t.Fatalf("error creating second repo on the same registry: %s", err)
+	}
+
+	assert.Same(t, first.metrics.operations, second.metrics.operations)
+	assert.Same(t, first.metrics.duration, second.metrics.duration)
+
+	repo, err := NewMongoRepoFromClient(client)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.Nil(t, repo.metrics)
+
+	other := prometheus.NewRegistry()
+	other.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repo_operations_total",
+		Help: "Something else.",
+	}, []string{"method"}))
+
+	_, err = NewMongoRepoFromClient(client, WithMetrics(other))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+func TestMongoRepo_SlowOperations(t *testing.T) {
+	ctx := context.Background()
+
+	handler := &recordingHandler{}
+	registry := prometheus.NewRegistry()
+
+	metrics, err := newRepoMetrics(registry)
+	if err != nil {
+		t.Fatalf("error registering metrics: %s", err)
+	}
+
+	repo := NewMockMongo()
+	repo.logger = slog.New(handler)
+	repo.metrics = metrics
+	repo.slowThreshold = 100 * time.Millisecond
+	mock := repo.mongoCaller.(*MockMongo)
+
+	mock.SetLatency("FindOne", 200*time.Millisecond)
+
+	_, err = repo.CountUsers(ctx)
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	var warnings []slog.Record
+	for _, record := range handler.records {
+		if record.Level == slog.LevelWarn {
+			warnings = append(warnings, record)
+		}
+	}
+
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %d", len(warnings))
+	}
+
+	warning := attrs(warnings[0])
+	assert.Equal(t, "slow mongo operation", warnings[0].Message)
+	assert.Equal(t, "GetUserByID", warning["op"])
+	assert.Equal(t, "false", warning["success"])
+
+	took, err := time.ParseDuration(warning["duration"])
+	if err != nil {
+		t.Fatalf("error parsing duration: %s", err)
+	}
+
+	assert.GreaterOrEqual(t, took, 200*time.Millisecond)
+
+	series := scrapeMetrics(t, registry)
+	assert.Equal(t, float64(1), series[`user_repo_slow_operations_total{op="GetUserByID"}`])
+	assert.NotContains(t, series, `user_repo_slow_operations_total{op="CountUsers"}`)
+}
+
+func TestMongoRepo_SlowOperationsDisabled(t *testing.T) {
+	handler := &recordingHandler{}
+
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	repo := NewMockMongo()
+	repo.logger = slog.New(handler)
+	repo.clock = clock
+	mock := repo.mongoCaller.(*MockMongo)
+
+	mock.SetLatencyFunc(func(string) time.Duration {
+		clock.Advance(time.Hour)
+		return 0
+	})
+
+	_, err := repo.CountUsers(context.Background())
+	if err != nil {
+		t.Fatalf("error counting users: %s", err)
+	}
+
+	for _, record := range handler.records {
+		assert.NotEqual(t, slog.LevelWarn, record.Level)
+	}
+}
+
+func newInMemoryRepo(t *testing.T, opts ...Option) *InMemoryUserRepository {
+	t.Helper()
+
+	repo, err := NewInMemoryUserRepository(append([]Option{WithBcryptCost(bcrypt.MinCost)}, opts...)...)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	return repo
+}
+
+func TestInMemoryUserRepository(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+
+	repo := newInMemoryRepo(t, WithClock(clock), WithIDGenerator(&SequentialIDGenerator{}))
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "John@Example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Equal(t, "000000000000000000000001", user.ID.Hex())
+	assert.Equal(t, now, user.CreatedAt)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("password")))
+
+	_, err = repo.CreateUser(ctx, &User{ID: user.ID, Name: "Jack", Email: "jack@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	_, err = repo.CreateUser(ctx, &User{Name: "", Email: "jack@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	clock.Advance(time.Minute)
+
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	got.Email = "johnny@example.com"
+
+	err = repo.UpdateUser(ctx, got)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	assert.Equal(t, now.Add(time.Minute), got.UpdatedAt)
+
+	// The old email is free again, the new one is taken.
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	jack, err := repo.CreateUser(ctx, &User{Name: "Jack", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	jack.Email = "johnny@example.com"
+
+	err = repo.UpdateUser(ctx, jack)
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	err = repo.UpdateUser(ctx, &User{Name: "John", Email: "john@example.com"})
+	assert.ErrorIs(t, err, ErrInvalidUserID)
+
+	_, err = repo.ListUsers(ctx, 10, 0, SortBy("password", false))
+	assert.ErrorIs(t, err, ErrInvalidSortField)
+
+	users, err := repo.ListUsers(ctx, 10, 0, SortBy("name", true))
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Equal(t, []primitive.ObjectID{user.ID, jack.ID}, userIDs(users))
+
+	users, err = repo.ListUsers(ctx, 10, 5)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Empty(t, users)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = repo.GetUserByID(canceled, user.ID)
+	assert.ErrorIs(t, err, ErrOperationCanceled)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestInMemoryUserRepository_Hidden(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+
+	repo := newInMemoryRepo(t, WithClock(clock))
+
+	deletedAt := now
+	expiresAt := now.Add(time.Hour)
+
+	deleted, err := repo.CreateUser(ctx, &User{
+		Name: "John", Email: "john@example.com", Password: "password", DeletedAt: &deletedAt,
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	provisional, err := repo.CreateUser(ctx, &User{
+		Name: "Jack", Email: "jack@example.com", Password: "password", ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, deleted.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	got, err := repo.GetUserByEmail(ctx, deleted.Email, IncludeDeleted())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, deleted.ID, got.ID)
+
+	// A soft-deleted user keeps its email.
+	_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	users, err := repo.ListUsers(ctx, 10, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Equal(t, []primitive.ObjectID{provisional.ID}, userIDs(users))
+
+	clock.Advance(time.Hour)
+
+	_, err = repo.GetUserByID(ctx, provisional.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// An expired user frees its email.
+	_, err = repo.CreateUser(ctx, &User{Name: "Jack", Email: "jack@example.com", Password: "password"})
+	assert.NoError(t, err)
+}
+
+func TestInMemoryUserRepository_ConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newInMemoryRepo(t)
+
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int64
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				// Every goroutine races for the same emails.
+				user, err := repo.CreateUser(ctx, &User{
+					Name:     "John",
+					Email:    fmt.Sprintf("john%d@example.com", j),
+					Password: "password",
+				})
+				if err == nil {
+					created.Add(1)
+
+					user.Name = fmt.Sprintf("John %d", i)
+					_ = repo.UpdateUser(ctx, user)
+				} else if !errors.Is(err, ErrUserAlreadyExists) {
+					t.Errorf("error creating user: %s", err)
+				}
+
+				_, _ = repo.ListUsers(ctx, 5, 0)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int64(10), created.Load())
+
+	users, err := repo.ListUsers(ctx, 100, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, users, 10)
+}
+
+func TestNewInMemoryUserRepository_InvalidOptions(t *testing.T) {
+	_, err := NewInMemoryUserRepository(WithClock(nil))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// stateError is a driver error carrying a SQLSTATE, like *pgconn.PgError.
+type stateError struct {
+	code    string
+	message string
+}
+
+func (e *stateError) Error() string { return e.message }
+
+func (e *stateError) SQLState() string { return e.code }
+
+func TestPostgresRepo_WriteError(t *testing.T) {
+	repo, err := NewPostgresRepoFromDB(nil)
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	id := primitive.NewObjectID()
+
+	err = repo.writeError(ErrInsertingUser, id, "john@example.com", &stateError{
+		code:    codeUniqueViolation,
+		message: `duplicate key value violates unique constraint "users_email_key"`,
+	})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.EqualError(t, err, "user already exists: email john@example.com")
+
+	err = repo.writeError(ErrInsertingUser, id, "john@example.com", fmt.Errorf("insert: %w", &stateError{
+		code:    codeUniqueViolation,
+		message: `duplicate key value violates unique constraint "users_pkey"`,
+	}))
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.EqualError(t, err, "user already exists: id "+id.Hex())
+
+	err = repo.writeError(ErrUpdatingUser, id, "john@example.com", &stateError{code: "23502", message: "not null"})
+	assert.ErrorIs(t, err, ErrUpdatingUser)
+	assert.NotErrorIs(t, err, ErrUserAlreadyExists)
+
+	err = repo.writeError(ErrUpdatingUser, id, "john@example.com", context.DeadlineExceeded)
+	assert.ErrorIs(t, err, ErrOperationTimeout)
+}
+
+func TestSQLOrder(t *testing.T) {
+	tests := []struct {
+		opts []ReadOption
+		want string
+	}{
+		{nil, "id"},
+		{[]ReadOption{SortBy("_id", true)}, "id DESC"},
+		{[]ReadOption{SortBy("created_at", false)}, "created_at ASC, id"},
+		{[]ReadOption{SortBy("name", false)}, "name ASC, id"},
+		{[]ReadOption{SortBy("email", true)}, "email DESC, id"},
+	}
+
+	for _, tt := range tests {
+		got, err := sqlOrder(newReadOptions(tt.opts))
+		if err != nil {
+			t.Fatalf("error ordering: %s", err)
+		}
+
+		assert.Equal(t, tt.want, got)
+	}
+
+	_, err := sqlOrder(newReadOptions([]ReadOption{SortBy("password", false)}))
+	assert.ErrorIs(t, err, ErrInvalidSortField)
+}
+
+func TestNewPostgresRepoFromDB(t *testing.T) {
+	repo, err := NewPostgresRepoFromDB(nil, WithCollection(`my "users"`))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.Equal(t, `"my ""users"""`, repo.table)
+
+	err = repo.Close(context.Background())
+	assert.NoError(t, err)
+
+	_, err = repo.GetUserByID(context.Background(), primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrRepoClosed)
+
+	_, err = NewPostgresRepoFromDB(nil, WithCollection(""))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// newSQLiteRepo opens the SQLite database at path, closed when t ends.
+func newSQLiteRepo(t *testing.T, path string, opts ...Option) *SQLiteRepo {
+	t.Helper()
+
+	repo, err := NewSQLiteRepo(context.Background(), path, append([]Option{WithBcryptCost(bcrypt.MinCost)}, opts...)...)
+	if err != nil {
+		t.Fatalf("error opening repo: %s", err)
+	}
+
+	t.Cleanup(func() {
+		err := repo.Close(context.Background())
+		if err != nil {
+			t.Errorf("error closing repo: %s", err)
+		}
+	})
+
+	return repo
+}
+
+func TestSQLiteRepo_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	repo, err := NewSQLiteRepo(ctx, path, WithBcryptCost(bcrypt.MinCost))
+	if err != nil {
+		t.Fatalf("error opening repo: %s", err)
+	}
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing repo: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrRepoClosed)
+
+	reopened := newSQLiteRepo(t, path)
+
+	got, err := reopened.GetUserByEmail(ctx, "john@example.com", WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user, got)
+}
+
+func TestSQLiteRepo_ConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	// Two repos don't share their connections, so their writes contend for
+	// the database lock.
+	repos := []*SQLiteRepo{newSQLiteRepo(t, path), newSQLiteRepo(t, path)}
+
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int64
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(repo *SQLiteRepo, i int) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				_, err := repo.CreateUser(ctx, &User{
+					Name:     "John",
+					Email:    fmt.Sprintf("john%d.%d@example.com", i, j),
+					Password: "password",
+				})
+
+				switch {
+				case err == nil:
+					created.Add(1)
+				case errors.Is(err, ErrTemporarilyUnavailable):
+					assert.True(t, IsRetryable(err))
+				default:
+					t.Errorf("error creating user: %s", err)
+				}
+			}
+		}(repos[i%2], i)
+	}
+
+	wg.Wait()
+
+	users, err := repos[0].ListUsers(ctx, maxPageSize, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, users, int(created.Load()))
+}
+
+// codeError is a driver error carrying a SQLite result code, like
+// *sqlite.Error.
+type codeError struct {
+	code    int
+	message string
+}
+
+func (e *codeError) Error() string { return e.message }
+
+func (e *codeError) Code() int { return e.code }
+
+func TestSQLiteRepo_Errors(t *testing.T) {
+	repo := &SQLiteRepo{}
+	id := primitive.NewObjectID()
+
+	err := repo.writeError(ErrInsertingUser, id, "john@example.com", &codeError{
+		code:    sqliteConstraintUnique,
+		message: "UNIQUE constraint failed: users.email",
+	})
+	assert.EqualError(t, err, "user already exists: email john@example.com")
+
+	err = repo.writeError(ErrInsertingUser, id, "john@example.com", &codeError{
+		code:    sqliteConstraintPrimaryKey,
+		message: "UNIQUE constraint failed: users.id",
+	})
+	assert.EqualError(t, err, "user already exists: id "+id.Hex())
+
+	// SQLITE_BUSY_SNAPSHOT, an extended code of SQLITE_BUSY.
+	err = repo.writeError(ErrInsertingUser, id, "john@example.com", &codeError{code: 517, message: "database is locked"})
+	assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+	assert.ErrorIs(t, err, ErrInsertingUser)
+	assert.True(t, IsRetryable(err))
+
+	err = repo.translate(ErrFindingUser, &codeError{code: 11, message: "database disk image is malformed"})
+	assert.ErrorIs(t, err, ErrFindingUser)
+	assert.False(t, IsRetryable(err))
+
+	_, err = NewSQLiteRepo(context.Background(), ":memory:", WithCollection(""))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// countingRepository counts the lookups reaching the repository it wraps.
+type countingRepository struct {
+	UserRepository
+	lookups atomic.Int64
+}
+
+func (r *countingRepository) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	r.lookups.Add(1)
+	return r.UserRepository.GetUserByID(ctx, id, opts...)
+}
+
+func (r *countingRepository) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (*User, error) {
+	r.lookups.Add(1)
+	return r.UserRepository.GetUserByEmail(ctx, email, opts...)
+}
+
+// newCachedRepo returns an in-memory repository behind a cache on a
+// miniredis server, with the counter of the lookups reaching the repository.
+func newCachedRepo(t *testing.T, opts ...CacheOption) (*CachedUserRepository, *countingRepository, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	counting := &countingRepository{UserRepository: newInMemoryRepo(t)}
+
+	return NewCachedUserRepository(counting, client, opts...), counting, server
+}
+
+func TestCachedUserRepository(t *testing.T) {
+	ctx := context.Background()
+
+	repo, counting, server := newCachedRepo(t)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	first, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	second, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	// The lookup by ID cached the user under its email too.
+	byEmail, err := repo.GetUserByEmail(ctx, "John@Example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, int64(1), counting.lookups.Load())
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, repo.Stats())
+	assert.Equal(t, first, second)
+	assert.Equal(t, first, byEmail)
+	assert.Empty(t, second.Password)
+	assert.Equal(t, user.CreatedAt, second.CreatedAt)
+
+	cached, err := server.Get("user:id:" + user.ID.Hex())
+	if err != nil {
+		t.Fatalf("error getting cached user: %s", err)
+	}
+
+	assert.NotContains(t, cached, "password")
+	assert.NotContains(t, cached, user.Password)
+	assert.Equal(t, defaultCacheTTL, server.TTL("user:email:john@example.com"))
+
+	// Reads the cache can't answer go to the repository.
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user.Password, got.Password)
+	assert.Equal(t, int64(2), counting.lookups.Load())
+
+	_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	server.FastForward(defaultCacheTTL)
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, int64(4), counting.lookups.Load())
+}
+
+func TestCachedUserRepository_Tenants(t *testing.T) {
+	ctx := context.Background()
+
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	tenants, _ := NewTenantMockMongo(CollectionPerTenant("users"))
+	repo := NewCachedUserRepository(tenants, client)
+
+	acme, globex := WithTenant(ctx, "acme"), WithTenant(ctx, "globex")
+
+	acmeUser, err := repo.CreateUser(acme, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	globexUser, err := repo.CreateUser(globex, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	// Cache the user of acme first, for globex to miss it.
+	got, err := repo.GetUserByEmail(acme, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, acmeUser.ID, got.ID)
+
+	got, err = repo.GetUserByEmail(globex, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, globexUser.ID, got.ID)
+	assert.Equal(t, "Johnny", got.Name)
+
+	_, err = repo.GetUserByID(globex, acmeUser.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	got, err = repo.GetUserByEmail(acme, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, acmeUser.ID, got.ID)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3}, repo.Stats())
+	assert.True(t, server.Exists(`user:tenant:"acme":email:john@example.com`))
+	assert.True(t, server.Exists(`user:tenant:"globex":email:john@example.com`))
+	assert.False(t, server.Exists("user:email:john@example.com"))
+}
+
+func TestCachedUserRepository_Invalidation(t *testing.T) {
+	ctx := context.Background()
+
+	repo, counting, server := newCachedRepo(t, WithCacheKeyPrefix("blog:"))
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.True(t, server.Exists("blog:id:"+user.ID.Hex()))
+	assert.True(t, server.Exists("blog:email:john@example.com"))
+
+	user.Email = "johnny@example.com"
+
+	err = repo.UpdateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	assert.Empty(t, server.Keys())
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, "johnny@example.com", got.Email)
+	assert.Equal(t, int64(2), got.Version)
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	err = repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	assert.Empty(t, server.Keys())
+
+	_, err = repo.GetUserByEmail(ctx, "johnny@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	assert.Equal(t, int64(4), counting.lookups.Load())
+	assert.Zero(t, repo.Stats().Degraded)
+}
+
+func TestCachedUserRepository_ChangeUserEmail(t *testing.T) {
+	ctx := context.Background()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	mongoRepo := NewMockMongo()
+
+	err := mongoRepo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	repo := NewCachedUserRepository(mongoRepo, client)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	changed, err := repo.ChangeUserEmail(ctx, user.ID, "Johnny@example.com")
+	if err != nil {
+		t.Fatalf("error changing email: %s", err)
+	}
+
+	assert.Equal(t, "johnny@example.com", changed.Email)
+	assert.Empty(t, server.Keys())
+
+	got, err := repo.GetUserByEmail(ctx, "johnny@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, user.ID, got.ID)
+
+	_, err = NewCachedUserRepository(newInMemoryRepo(t), client).ChangeUserEmail(ctx, user.ID, "jack@example.com")
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestCachedUserRepository_Expiry(t *testing.T) {
+	ctx := context.Background()
+
+	repo, _, server := newCachedRepo(t)
+
+	expiresAt := time.Now().Add(time.Minute)
+
+	user, err := repo.CreateUser(ctx, &User{
+		Name: "John", Email: "john@example.com", Password: "password", ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	ttl := server.TTL("user:id:" + user.ID.Hex())
+	assert.Positive(t, ttl)
+	assert.LessOrEqual(t, ttl, time.Minute)
+}
+
+func TestCachedUserRepository_RedisDown(t *testing.T) {
+	ctx := context.Background()
+
+	repo, counting, server := newCachedRepo(t)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	server.Close()
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user with redis down: %s", err)
+	}
+
+	assert.Equal(t, user.ID, got.ID)
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user with redis down: %s", err)
+	}
+
+	stored, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	stored.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, stored)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(4), counting.lookups.Load())
+
+	// The failed lookups, the writes back of their results and the two
+	// calls of the update.
+	assert.Equal(t, CacheStats{Misses: 1, Degraded: 6}, repo.Stats())
+}
+
+func newFileRepo(t *testing.T, path string) *FileRepo {
+	t.Helper()
+
+	repo, err := NewFileRepo(path, WithBcryptCost(bcrypt.MinCost))
+	if err != nil {
+		t.Fatalf("error opening repo: %s", err)
+	}
+
+	return repo
+}
+
+func TestFileRepo_Reopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+
+	repo := newFileRepo(t, path)
+
+	john, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+
+	jane, err := repo.CreateUser(ctx, &User{
+		Name: "Jane", Email: "jane@example.com", Password: "password", ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	jack, err := repo.CreateUser(ctx, &User{Name: "Jack", Email: "jack@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	john.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, john)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, jack.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	reopened := newFileRepo(t, path)
+
+	users, err := reopened.ListUsers(ctx, 0, 0, WithPassword())
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Equal(t, []*User{john, jane}, users)
+
+	_, err = reopened.CreateUser(ctx, &User{Name: "John", Email: "John@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	// Only the file is left in the directory, no temporary one.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("error reading dir: %s", err)
+	}
+
+	assert.Len(t, entries, 1)
+}
+
+func TestFileRepo_Corrupt(t *testing.T) {
+	id := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		column  int
+	}{
+		{"Syntax", "{\n  \"users\": [\n    {\"id\": }\n  ]\n}\n", 3, 12},
+		{"Type", "{\"users\": {}}", 1, 11},
+		{"Truncated", "{\"users\": [", 1, 11},
+		{"ZeroID", `{"users": [{"email": "john@example.com"}]}`, 0, 0},
+		{
+			"DuplicateEmail",
+			`{"users": [{"id": "` + id + `", "email": "john@example.com"}, ` +
+				`{"id": "` + primitive.NewObjectID().Hex() + `", "email": "john@example.com"}]}`,
+			0, 0,
+		},
+		{
+			"DuplicateID",
+			`{"users": [{"id": "` + id + `", "email": "john@example.com"}, ` +
+				`{"id": "` + id + `", "email": "jane@example.com"}]}`,
+			0, 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+
+			err := os.WriteFile(path, []byte(test.content), 0o600)
+			if err != nil {
+				t.Fatalf("error writing file: %s", err)
+			}
+
+			_, err = NewFileRepo(path)
+			assert.ErrorIs(t, err, ErrCorruptStore)
+
+			var corrupt *CorruptStoreError
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("expected a *CorruptStoreError, got %T", err)
+			}
+
+			assert.Equal(t, path, corrupt.Path)
+			assert.Equal(t, test.line, corrupt.Line)
+			assert.Equal(t, test.column, corrupt.Column)
+			assert.Contains(t, err.Error(), path)
+		})
+	}
+}
+
+func TestFileRepo_WriteFailure(t *testing.T) {
+	ctx := context.Background()
+
+	// The directory of the file doesn't exist, so no write can succeed.
+	repo := newFileRepo(t, filepath.Join(t.TempDir(), "missing", "users.json"))
+
+	user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+	_, err := repo.CreateUser(ctx, user)
+	assert.ErrorIs(t, err, ErrInsertingUser)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Neither the repo nor the user kept the failed change.
+	assert.True(t, user.ID.IsZero())
+	assert.Equal(t, "password", user.Password)
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestFileRepo_ConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	repo := newFileRepo(t, path)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				_, err := repo.CreateUser(ctx, &User{
+					Name:     "John",
+					Email:    fmt.Sprintf("john%d.%d@example.com", i, j),
+					Password: "password",
+				})
+				if err != nil {
+					t.Errorf("error creating user: %s", err)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	users, err := newFileRepo(t, path).ListUsers(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Len(t, users, 40)
+}
+
+// newUserServiceClient serves a UserServer on repo over an in-process
+// listener and returns a client connected to it.
+func newUserServiceClient(t *testing.T, repo UserRepository) UserServiceClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+
+	server := grpc.NewServer()
+	RegisterUserServiceServer(server, NewUserServer(repo))
+
+	go func() {
+		_ = server.Serve(lis)
+	}()
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %s", err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return NewUserServiceClient(conn)
+}
+
+func TestUserServer(t *testing.T) {
+	ctx := context.Background()
+
+	repo := newInMemoryRepo(t)
+	client := newUserServiceClient(t, repo)
+
+	created, err := client.CreateUser(ctx, &CreateUserRequest{
+		Name: "John", Email: "John@example.com", Password: "password",
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.NotEmpty(t, created.GetUser().GetId())
+	assert.Equal(t, "John", created.GetUser().GetName())
+	assert.Equal(t, "john@example.com", created.GetUser().GetEmail())
+	assert.Equal(t, RoleMember, created.GetUser().GetRole())
+	assert.Equal(t, int64(1), created.GetUser().GetVersion())
+
+	got, err := client.GetUser(ctx, &GetUserRequest{Id: created.GetUser().GetId()})
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, created.GetUser().GetId(), got.GetUser().GetId())
+	assert.Equal(t, created.GetUser().GetEmail(), got.GetUser().GetEmail())
+
+	// The password reached the repository, hashed.
+	stored, err := repo.GetUserByEmail(ctx, "john@example.com", WithPassword())
+	if err != nil {
+		t.Fatalf("error getting stored user: %s", err)
+	}
+
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("password")))
+	assert.NotContains(t, created.String(), "password")
+	assert.NotContains(t, created.String(), stored.Password)
+
+	_, err = client.DeleteUser(ctx, &DeleteUserRequest{Id: created.GetUser().GetId()})
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	_, err = client.GetUser(ctx, &GetUserRequest{Id: created.GetUser().GetId()})
+	assert.Equal(t, grpccodes.NotFound, status.Code(err))
+}
+
+func TestUserServer_StatusCodes(t *testing.T) {
+	ctx := context.Background()
+
+	client := newUserServiceClient(t, newInMemoryRepo(t))
+
+	_, err := client.CreateUser(ctx, &CreateUserRequest{
+		Name: "John", Email: "john@example.com", Password: "password",
+	})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	missing := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name string
+		call func() error
+		code grpccodes.Code
+	}{
+		{"CreateDuplicate", func() error {
+			_, err := client.CreateUser(ctx, &CreateUserRequest{
+				Name: "Johnny", Email: "John@Example.com", Password: "password",
+			})
+			return err
+		}, grpccodes.AlreadyExists},
+		{"CreateInvalid", func() error {
+			_, err := client.CreateUser(ctx, &CreateUserRequest{Name: "Jane", Email: "jane@example.com"})
+			return err
+		}, grpccodes.InvalidArgument},
+		{"CreateInvalidRole", func() error {
+			_, err := client.CreateUser(ctx, &CreateUserRequest{
+				Name: "Jane", Email: "jane@example.com", Password: "password", Role: "root",
+			})
+			return err
+		}, grpccodes.InvalidArgument},
+		{"GetMissing", func() error {
+			_, err := client.GetUser(ctx, &GetUserRequest{Id: missing})
+			return err
+		}, grpccodes.NotFound},
+		{"GetInvalidID", func() error {
+			_, err := client.GetUser(ctx, &GetUserRequest{Id: "not-an-id"})
+			return err
+		}, grpccodes.InvalidArgument},
+		{"DeleteMissing", func() error {
+			_, err := client.DeleteUser(ctx, &DeleteUserRequest{Id: missing})
+			return err
+		}, grpccodes.NotFound},
+		{"DeleteInvalidID", func() error {
+			_, err := client.DeleteUser(ctx, &DeleteUserRequest{})
+			return err
+		}, grpccodes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			assert.Equal(t, test.code, status.Code(err), "error: %v", err)
+		})
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	err := grpcStatus(fmt.Errorf("%w: email john@example.com", ErrUserAlreadyExists))
+	assert.Equal(t, grpccodes.AlreadyExists, status.Code(err))
+	assert.NotContains(t, status.Convert(err).Message(), "john@example.com")
+
+	err = grpcStatus(driverError(ErrFindingUser, errors.New("connection reset by 10.0.0.1")))
+	assert.Equal(t, grpccodes.Internal, status.Code(err))
+	assert.NotContains(t, status.Convert(err).Message(), "10.0.0.1")
+
+	assert.Equal(t, grpccodes.DeadlineExceeded, status.Code(grpcStatus(driverError(ErrFindingUser, context.DeadlineExceeded))))
+	assert.Equal(t, grpccodes.Unavailable, status.Code(grpcStatus(ErrTemporarilyUnavailable)))
+}
+
+// serveUsers sends a request to a UserHandler on repo and returns the
+// response.
+func serveUsers(t *testing.T, repo UserRepository, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+
+	recorder := httptest.NewRecorder()
+	NewUserHandler(repo).ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestUserHandler(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo(WithUniqueEmail())
+	repo.bcryptCost = bcrypt.MinCost
+
+	recorder := serveUsers(t, repo, http.MethodPost, "/users",
+		`{"name": "John", "email": "John@example.com", "password": "password"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.NotContains(t, recorder.Body.String(), "password")
+
+	var created userResponse
+
+	err := json.Unmarshal(recorder.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+
+	assert.Equal(t, "/users/"+created.ID, recorder.Header().Get("Location"))
+	assert.Equal(t, "john@example.com", created.Email)
+	assert.Equal(t, RoleMember, created.Role)
+	assert.Equal(t, int64(1), created.Version)
+	assert.False(t, created.CreatedAt.IsZero())
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	recorder = serveUsers(t, repo, http.MethodGet, recorder.Header().Get("Location"), "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var got userResponse
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+
+	assert.Equal(t, created, got)
+
+	recorder = serveUsers(t, repo, http.MethodGet, "/users?email=JOHN@example.com", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+
+	assert.Equal(t, created, got)
+
+	var page listUsersResponse
+
+	recorder = serveUsers(t, repo, http.MethodGet, "/users?limit=1&offset=1", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+
+	if assert.Len(t, page.Users, 1) {
+		assert.Equal(t, "jane@example.com", page.Users[0].Email)
+	}
+
+	recorder = serveUsers(t, repo, http.MethodGet, "/users", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "password")
+
+	err = json.Unmarshal(recorder.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+
+	assert.Len(t, page.Users, 2)
+
+	recorder = serveUsers(t, repo, http.MethodDelete, "/users/"+created.ID, "")
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Empty(t, recorder.Body.String())
+
+	recorder = serveUsers(t, repo, http.MethodGet, "/users/"+created.ID, "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestUserHandler_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo(WithUniqueEmail())
+	repo.bcryptCost = bcrypt.MinCost
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	missing := "/users/" + primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"CreateDuplicate", http.MethodPost, "/users",
+			`{"name": "Johnny", "email": "JOHN@example.com", "password": "password"}`, http.StatusConflict, "already_exists"},
+		{"CreateInvalidUser", http.MethodPost, "/users",
+			`{"name": "Jane", "email": "jane@example.com", "password": "short"}`, http.StatusBadRequest, "invalid_user"},
+		{"CreateInvalidEmail", http.MethodPost, "/users",
+			`{"name": "Jane", "email": "jane", "password": "password"}`, http.StatusBadRequest, "invalid_user"},
+		{"CreateMalformed", http.MethodPost, "/users", `{"name": `, http.StatusBadRequest, "invalid_request"},
+		{"CreateUnknownField", http.MethodPost, "/users",
+			`{"name": "Jane", "email": "jane@example.com", "password": "password", "admin": true}`,
+			http.StatusBadRequest, "invalid_request"},
+		{"CreateTrailingData", http.MethodPost, "/users",
+			`{"name": "Jane", "email": "jane@example.com", "password": "password"} {}`,
+			http.StatusBadRequest, "invalid_request"},
+		{"CreateTooLarge", http.MethodPost, "/users",
+			`{"name": "` + strings.Repeat("a", maxRequestBodySize) + `"}`,
+			http.StatusRequestEntityTooLarge, "invalid_request"},
+		{"GetMissing", http.MethodGet, missing, "", http.StatusNotFound, "not_found"},
+		{"GetMalformedID", http.MethodGet, "/users/not-hex", "", http.StatusBadRequest, "invalid_id"},
+		{"GetByMissingEmail", http.MethodGet, "/users?email=jane@example.com", "", http.StatusNotFound, "not_found"},
+		{"GetByInvalidEmail", http.MethodGet, "/users?email=jane", "", http.StatusBadRequest, "invalid_user"},
+		{"ListInvalidLimit", http.MethodGet, "/users?limit=many", "", http.StatusBadRequest, "invalid_request"},
+		{"ListNegativeOffset", http.MethodGet, "/users?offset=-1", "", http.StatusBadRequest, "invalid_request"},
+		{"ListInvalidPageToken", http.MethodGet, "/users?page_token=garbage", "", http.StatusBadRequest,
+			"invalid_page_token"},
+		{"DeleteMissing", http.MethodDelete, missing, "", http.StatusNotFound, "not_found"},
+		{"DeleteMalformedID", http.MethodDelete, "/users/123", "", http.StatusBadRequest, "invalid_id"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := serveUsers(t, repo, test.method, test.target, test.body)
+			assert.Equal(t, test.status, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+			var response errorResponse
+
+			err := json.Unmarshal(recorder.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("error decoding response %q: %s", recorder.Body.String(), err)
+			}
+
+			assert.Equal(t, test.code, response.Error.Code)
+			assert.NotEmpty(t, response.Error.Message)
+			assert.NotContains(t, response.Error.Message, "@example.com")
+		})
+	}
+}
+
+func TestUserHandler_InternalError(t *testing.T) {
+	repo := NewMockMongo()
+	repo.mongoCaller.(*MockMongo).FailAlways("FindOne", errors.New("connection reset by 10.0.0.1"))
+
+	recorder := serveUsers(t, repo, http.MethodGet, "/users/"+primitive.NewObjectID().Hex(), "")
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.JSONEq(t, `{"error": {"code": "internal", "message": "internal error"}}`, recorder.Body.String())
+}
+
+// importFixture imports testdata/import_<name>.csv into repo.
+func importFixture(t *testing.T, repo *MongoRepo, name string, opts ImportOptions) (ImportReport, error) {
+	t.Helper()
+
+	file, err := os.Open(filepath.Join("testdata", "import_"+name+".csv"))
+	if err != nil {
+		t.Fatalf("error opening fixture: %s", err)
+	}
+	defer file.Close()
+
+	return repo.ImportUsersCSV(context.Background(), file, opts)
+}
+
+// newImportRepo returns a mock repo with unique emails and fast hashing.
+func newImportRepo() (*MongoRepo, *MockMongo) {
+	repo := NewMockMongo(WithUniqueEmail())
+	repo.bcryptCost = bcrypt.MinCost
+
+	return repo, repo.mongoCaller.(*MockMongo)
+}
+
+// importRowLines returns the lines of the row errors of report.
+func importRowLines(report ImportReport) []int {
+	lines := make([]int, 0, len(report.Errors))
+	for _, rowErr := range report.Errors {
+		lines = append(lines, rowErr.Line)
+	}
+
+	return lines
+}
+
+func TestMongoRepo_ImportUsersCSV(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("BOM", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		report, err := importFixture(t, repo, "bom", ImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, ImportReport{Created: 2}, report)
+		assert.Len(t, mock.Users(), 2)
+
+		user, err := repo.GetUserByEmail(ctx, "john@example.com", WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "John", user.Name)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("password")))
+	})
+
+	t.Run("Quoted", func(t *testing.T) {
+		repo, _ := newImportRepo()
+
+		report, err := importFixture(t, repo, "quoted", ImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, ImportReport{Created: 3}, report)
+
+		for email, name := range map[string]string{
+			"doe@example.com":  "Doe, John",
+			"jane@example.com": `Jane "JJ" Doe`,
+			"jack@example.com": "Jack",
+		} {
+			user, err := repo.GetUserByEmail(ctx, email, WithPassword())
+			if err != nil {
+				t.Fatalf("error getting user: %s", err)
+			}
+
+			assert.Equal(t, name, user.Name)
+
+			if email == "doe@example.com" {
+				assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("pass,word")))
+			}
+		}
+	})
+
+	t.Run("Duplicates", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "Taken", Email: "taken@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		report, err := importFixture(t, repo, "duplicates", ImportOptions{BatchSize: 10})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 3, report.Created)
+		assert.Equal(t, 2, report.SkippedDuplicates)
+		assert.Equal(t, 2, report.Invalid)
+		assert.Equal(t, []int{4, 5, 6, 7}, importRowLines(report))
+		assert.ErrorIs(t, report.Errors[0], ErrUserAlreadyExists)
+		assert.ErrorIs(t, report.Errors[1], ErrInvalidUser)
+		assert.ErrorIs(t, report.Errors[2], ErrInvalidUser)
+		assert.ErrorIs(t, report.Errors[3], ErrUserAlreadyExists)
+		assert.Contains(t, report.Errors[0].Error(), "line 4: ")
+
+		// The users after the stored duplicate were inserted too.
+		assert.Len(t, mock.Users(), 4)
+
+		_, err = repo.GetUserByEmail(ctx, "jim@example.com")
+		assert.NoError(t, err)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		report, err := importFixture(t, repo, "duplicates", ImportOptions{DryRun: true})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 4, report.Created)
+		assert.Equal(t, 1, report.SkippedDuplicates)
+		assert.Equal(t, 2, report.Invalid)
+		assert.Empty(t, mock.Users())
+		assert.Empty(t, mock.CallsTo("InsertMany"))
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		report, err := importFixture(t, repo, "malformed", ImportOptions{BatchSize: 1})
+		assert.ErrorIs(t, err, ErrMalformedCSV)
+
+		var rowErr *ImportRowError
+		if !errors.As(err, &rowErr) {
+			t.Fatalf("expected an *ImportRowError, got %T", err)
+		}
+
+		assert.Equal(t, 3, rowErr.Line)
+		assert.Contains(t, err.Error(), "line 3: ")
+
+		// The batch before the malformed row was inserted, not the rows after.
+		assert.Equal(t, ImportReport{Created: 1}, report)
+		assert.Len(t, mock.Users(), 1)
+	})
+
+	t.Run("BatchFailure", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		refused := errors.New("document failed validation")
+		mock.FailWhen(FailOnEmail("jack@example.com", refused))
+
+		input := "name,email,password\n"
+		for _, name := range []string{"john", "jane", "jill", "jack", "jim"} {
+			input += name + "," + name + "@example.com,password\n"
+		}
+
+		report, err := repo.ImportUsersCSV(ctx, strings.NewReader(input), ImportOptions{BatchSize: 2})
+		assert.ErrorIs(t, err, ErrInsertingUser)
+
+		var rowErr *ImportRowError
+		if !errors.As(err, &rowErr) {
+			t.Fatalf("expected an *ImportRowError, got %T", err)
+		}
+
+		// jack is on line 5, second of the second batch.
+		assert.Equal(t, 5, rowErr.Line)
+		assert.Equal(t, ImportReport{Created: 3}, report)
+		assert.Len(t, mock.Users(), 3)
+	})
+
+	t.Run("InvalidHeader", func(t *testing.T) {
+		repo, _ := newImportRepo()
+
+		for _, input := range []string{"", "name,email\nJohn,john@example.com\n", "name,email,password,Email\n"} {
+			_, err := repo.ImportUsersCSV(ctx, strings.NewReader(input), ImportOptions{})
+			assert.ErrorIs(t, err, ErrInvalidCSVHeader, "input %q", input)
+		}
+	})
+}
+
+// cancelingWriter cancels its context on the first write.
+type cancelingWriter struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return w.Buffer.Write(p)
+}
+
+func TestMongoRepo_ExportUsers(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		source, sourceMock := newImportRepo()
+		verified := SeedUsers(t, source, 7, WithSeedSoftDeleted(0.3))[1]
+		verified.EmailVerified = true
+
+		err := source.UpdateUser(ctx, verified)
+		if err != nil {
+			t.Fatalf("error verifying user: %s", err)
+		}
+
+		var buf bytes.Buffer
+
+		n, err := source.ExportUsers(ctx, &buf, ExportOptions{BatchSize: 3, IncludeSecrets: true})
+		if err != nil {
+			t.Fatalf("error exporting: %s", err)
+		}
+
+		assert.Equal(t, int64(7), n)
+		assert.Equal(t, 7, strings.Count(buf.String(), "\n"))
+		assert.Equal(t, 1, strings.Count(buf.String(), `"email_verified":true`))
+
+		// The users are streamed from a single cursor.
+		assert.Len(t, sourceMock.CallsTo("Find"), 1)
+
+		target, targetMock := newImportRepo()
+
+		report, err := target.ImportUsersJSON(ctx, &buf, JSONImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, ImportReport{Created: 7}, report)
+		assert.Equal(t, sourceMock.Users(), targetMock.Users())
+	})
+
+	t.Run("WithoutSecrets", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		SeedUsers(t, repo, 2)
+
+		var buf bytes.Buffer
+
+		n, err := repo.ExportUsers(ctx, &buf, ExportOptions{})
+		if err != nil {
+			t.Fatalf("error exporting: %s", err)
+		}
+
+		assert.Equal(t, int64(2), n)
+		assert.NotContains(t, buf.String(), "password")
+		assert.NotContains(t, buf.String(), "$2a$")
+
+		// Without their password the users can't be restored.
+		target, targetMock := newImportRepo()
+
+		report, err := target.ImportUsersJSON(ctx, &buf, JSONImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 2, report.Invalid)
+		assert.ErrorIs(t, report.Errors[0], ErrInvalidUser)
+		assert.Empty(t, targetMock.Users())
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		SeedUsers(t, repo, 5)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		w := &cancelingWriter{cancel: cancel}
+
+		n, err := repo.ExportUsers(ctx, w, ExportOptions{BatchSize: 2})
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+
+		// The user being written when ctx was canceled is done, not the next
+		// ones.
+		assert.Equal(t, int64(1), n)
+		assert.Equal(t, 1, strings.Count(w.String(), "\n"))
+	})
+}
+
+func TestMongoRepo_ImportUsersJSON(t *testing.T) {
+	ctx := context.Background()
+
+	// export returns the export of repo with the secrets.
+	export := func(t *testing.T, repo *MongoRepo) string {
+		t.Helper()
+
+		var buf strings.Builder
+
+		_, err := repo.ExportUsers(ctx, &buf, ExportOptions{IncludeSecrets: true})
+		if err != nil {
+			t.Fatalf("error exporting: %s", err)
+		}
+
+		return buf.String()
+	}
+
+	t.Run("Conflicts", func(t *testing.T) {
+		source, _ := newImportRepo()
+		users := SeedUsers(t, source, 3)
+
+		backup := export(t, source)
+
+		users[0].Name = "Renamed"
+
+		err := source.UpdateUser(ctx, users[0])
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		// Another user took the email of the last one in the backup.
+		err = source.DeleteUser(ctx, users[2].ID)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+
+		_, err = source.CreateUser(ctx, &User{Name: "Other", Email: users[2].Email, Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		report, err := source.ImportUsersJSON(ctx, strings.NewReader(backup), JSONImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 3, report.SkippedDuplicates)
+		assert.Equal(t, []int{1, 2, 3}, importRowLines(report))
+		assert.ErrorIs(t, report.Errors[2], ErrUserAlreadyExists)
+
+		user, err := source.GetUserByID(ctx, users[0].ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "Renamed", user.Name)
+
+		report, err = source.ImportUsersJSON(ctx, strings.NewReader(backup), JSONImportOptions{OnConflict: ConflictUpsert})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		// The user on the email of the third is another one, never replaced.
+		assert.Equal(t, 2, report.Updated)
+		assert.Equal(t, 1, report.SkippedDuplicates)
+		assert.Equal(t, []int{3}, importRowLines(report))
+
+		user, err = source.GetUserByID(ctx, users[0].ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "User 0001", user.Name)
+		assert.Equal(t, int64(1), user.Version)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		source, _ := newImportRepo()
+		SeedUsers(t, source, 2)
+
+		lines := strings.SplitAfter(export(t, source), "\n")
+		input := lines[0] + "\n{\"id\": \n" + lines[1]
+
+		repo, mock := newImportRepo()
+
+		report, err := repo.ImportUsersJSON(ctx, strings.NewReader(input), JSONImportOptions{})
+		assert.ErrorIs(t, err, ErrMalformedJSON)
+
+		var rowErr *ImportRowError
+		if !errors.As(err, &rowErr) {
+			t.Fatalf("expected an *ImportRowError, got %T", err)
+		}
+
+		// Blank lines are counted but skipped.
+		assert.Equal(t, 3, rowErr.Line)
+		assert.Equal(t, ImportReport{Created: 1}, report)
+		assert.Len(t, mock.Users(), 1)
+	})
+
+	t.Run("InvalidRecord", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		input := `{"name":"No ID","email":"noid@example.com","password":"` + strings.Repeat("x", 60) + `","role":"member"}` + "\n"
+
+		report, err := repo.ImportUsersJSON(ctx, strings.NewReader(input), JSONImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 1, report.Invalid)
+		assert.ErrorIs(t, report.Errors[0], ErrInvalidUserID)
+		assert.Empty(t, mock.Users())
+	})
+
+	t.Run("PlaintextPassword", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		input := `{"id":"` + primitive.NewObjectID().Hex() +
+			`","name":"John","email":"john@example.com","password":"password","role":"member"}` + "\n"
+
+		report, err := repo.ImportUsersJSON(ctx, strings.NewReader(input), JSONImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing: %s", err)
+		}
+
+		assert.Equal(t, 1, report.Invalid)
+		assert.ErrorIs(t, report.Errors[0], ErrInvalidUser)
+		assert.Contains(t, report.Errors[0].Error(), "bcrypt hash")
+		assert.Empty(t, mock.Users())
+	})
+
+	t.Run("WriteFailure", func(t *testing.T) {
+		source, _ := newImportRepo()
+		SeedUsers(t, source, 2)
+
+		repo, mock := newImportRepo()
+		mock.FailAlways("InsertOne", errors.New("connection reset"))
+
+		report, err := repo.ImportUsersJSON(ctx, strings.NewReader(export(t, source)), JSONImportOptions{})
+		assert.ErrorIs(t, err, ErrInsertingUser)
+		assert.Contains(t, err.Error(), "line 1: ")
+		assert.Equal(t, ImportReport{}, report)
+	})
+}
+
+// receivedEvents returns the events waiting on sink.
+func receivedEvents(sink *ChannelSink) []UserEvent {
+	var events []UserEvent
+
+	for {
+		select {
+		case event := <-sink.Events():
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// failingSink is an EventSink failing every Publish with err.
+type failingSink struct {
+	err error
+}
+
+func (s failingSink) Publish(context.Context, UserEvent) error {
+	return s.err
+}
+
+func TestMongoRepo_Events(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	repo, _ := newImportRepo()
+	repo.clock = NewFakeClock(now)
+
+	sink := NewChannelSink(16)
+	repo.events = sink
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "John@Example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	user.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	_, err = repo.ChangeUserEmail(ctx, user.ID, "johnny@example.com")
+	if err != nil {
+		t.Fatalf("error changing email: %s", err)
+	}
+
+	err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"role": RoleAdmin})
+	if err != nil {
+		t.Fatalf("error updating fields: %s", err)
+	}
+
+	err = repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	// Already soft-deleted, nothing happens.
+	err = repo.SoftDeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error soft-deleting user: %s", err)
+	}
+
+	err = repo.RestoreUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error restoring user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	// Failed mutations publish nothing.
+	assert.ErrorIs(t, repo.DeleteUser(ctx, user.ID), ErrUserNotFound)
+
+	_, err = repo.CreateUser(ctx, &User{Name: "John", Email: "not an email", Password: "password"})
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	users := []*User{
+		{Name: "Jane", Email: "jane@example.com", Password: "password"},
+		{Name: "Jack", Email: "jack@example.com", Password: "password"},
+	}
+
+	_, err = repo.CreateUsers(ctx, users)
+	if err != nil {
+		t.Fatalf("error creating users: %s", err)
+	}
+
+	event := func(eventType EventType, id primitive.ObjectID, email string) UserEvent {
+		return UserEvent{Type: eventType, UserID: id, Email: email, Timestamp: now}
+	}
+
+	assert.Equal(t, []UserEvent{
+		event(EventUserCreated, user.ID, "john@example.com"),
+		event(EventUserUpdated, user.ID, "john@example.com"),
+		event(EventUserUpdated, user.ID, "johnny@example.com"),
+		event(EventUserUpdated, user.ID, ""),
+		event(EventUserDeleted, user.ID, ""),
+		event(EventUserUpdated, user.ID, ""),
+		event(EventUserDeleted, user.ID, ""),
+		event(EventUserCreated, users[0].ID, "jane@example.com"),
+		event(EventUserCreated, users[1].ID, "jack@example.com"),
+	}, receivedEvents(sink))
+}
+
+func TestMongoRepo_EventDeliveryFailure(t *testing.T) {
+	ctx := context.Background()
+
+	unreachable := errors.New("broker unreachable")
+
+	t.Run("Ignored", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		repo.events = failingSink{err: unreachable}
+
+		handler := &recordingHandler{}
+		repo.logger = slog.New(handler)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Len(t, mock.Users(), 1)
+
+		var warned bool
+
+		for _, record := range handler.records {
+			if record.Message == "publishing user event failed" {
+				warned = true
+
+				assert.Equal(t, slog.LevelWarn, record.Level)
+				assert.Equal(t, map[string]string{
+					"type":    "created",
+					"user_id": user.ID.Hex(),
+					"error":   "broker unreachable",
+				}, attrs(record))
+			}
+		}
+
+		assert.True(t, warned, "the failure must be logged")
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		repo.events = failingSink{err: unreachable}
+		repo.requireDelivery = true
+
+		user := &User{Name: "John", Email: "john@example.com", Password: "password"}
+
+		_, err := repo.CreateUser(ctx, user)
+		assert.ErrorIs(t, err, ErrPublishingEvent)
+		assert.ErrorIs(t, err, unreachable)
+
+		// The user is stored all the same.
+		assert.Len(t, mock.Users(), 1)
+
+		err = repo.DeleteUser(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrPublishingEvent)
+		assert.Empty(t, mock.Users())
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		sink := NewChannelSink(1)
+
+		repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017",
+			(&fakeConnect{}).option(), WithSkipPing(), WithEventSink(sink), RequireEventDelivery())
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.Same(t, sink, repo.events)
+		assert.True(t, repo.requireDelivery)
+	})
+}
+
+// recordingInserter is an OutboxInserter keeping what it is given, or failing
+// with err.
+type recordingInserter struct {
+	documents []interface{}
+	err       error
+}
+
+func (r *recordingInserter) InsertOne(_ context.Context, document interface{}, _ ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	r.documents = append(r.documents, document)
+
+	return &mongo.InsertOneResult{}, nil
+}
+
+func TestOutboxSink(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	inserter := &recordingInserter{}
+
+	repo, _ := newImportRepo()
+	repo.clock = NewFakeClock(now)
+	repo.events = NewOutboxSinkFromCollection(inserter)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	err = repo.DeleteUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error deleting user: %s", err)
+	}
+
+	if len(inserter.documents) != 2 {
+		t.Fatalf("expected 2 events in the outbox, got %d", len(inserter.documents))
+	}
+
+	for i, expected := range []struct {
+		eventType EventType
+		email     string
+	}{
+		{EventUserCreated, "john@example.com"},
+		{EventUserDeleted, ""},
+	} {
+		stored, ok := inserter.documents[i].(*outboxEvent)
+		if !ok {
+			t.Fatalf("expected an *outboxEvent, got %T", inserter.documents[i])
+		}
+
+		assert.Equal(t, expected.eventType, stored.Type)
+		assert.Equal(t, user.ID, stored.UserID)
+		assert.Equal(t, expected.email, stored.Email)
+		assert.Equal(t, now, stored.Timestamp)
+		assert.Equal(t, now, stored.ID.Timestamp().UTC())
+	}
+
+	assert.NotEqual(t, inserter.documents[0].(*outboxEvent).ID, inserter.documents[1].(*outboxEvent).ID)
+
+	doc, err := bson.Marshal(inserter.documents[1])
+	if err != nil {
+		t.Fatalf("error marshaling event: %s", err)
+	}
+
+	assert.NotContains(t, bson.Raw(doc).String(), `"email"`)
+
+	inserter.err = errors.New("connection reset")
+	repo.requireDelivery = true
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrPublishingEvent)
+}
+
+// scriptedStream is a ChangeStream returning events, then failing with err,
+// or waiting for its context to be done when err is nil.
+type scriptedStream struct {
+	events []bson.Raw
+	err    error
+
+	current bson.Raw
+	ctxErr  error
+	closed  atomic.Bool
+}
+
+func (s *scriptedStream) Next(ctx context.Context) bool {
+	if len(s.events) > 0 {
+		s.current, s.events = s.events[0], s.events[1:]
+		return true
+	}
+
+	if s.err == nil {
+		<-ctx.Done()
+		s.ctxErr = ctx.Err()
+	}
+
+	return false
+}
+
+func (s *scriptedStream) Decode(val interface{}) error {
+	return bson.Unmarshal(s.current, val)
+}
+
+func (s *scriptedStream) Err() error {
+	if s.ctxErr != nil {
+		return s.ctxErr
+	}
+
+	return s.err
+}
+
+func (s *scriptedStream) Close(context.Context) error {
+	s.closed.Store(true)
+	return nil
+}
+
+// scriptedWatcher is a MongoCaller whose change stream is stream, or which
+// fails to open one with err.
+type scriptedWatcher struct {
+	*MockMongo
+
+	stream *scriptedStream
+	err    error
+	opts   *options.ChangeStreamOptions
+}
+
+func (w *scriptedWatcher) WatchChanges(
+	_ context.Context, _ interface{}, opts ...*options.ChangeStreamOptions,
+) (ChangeStream, error) {
+	w.opts = options.MergeChangeStreamOptions(opts...)
+
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	return w.stream, nil
+}
+
+// newWatchedRepo returns a repo on a scriptedWatcher.
+func newWatchedRepo(stream *scriptedStream) (*MongoRepo, *scriptedWatcher) {
+	watcher := &scriptedWatcher{MockMongo: NewMockMongo().mongoCaller.(*MockMongo), stream: stream}
+
+	return NewMongoRepoFromCollection(watcher), watcher
+}
+
+// changeDocument returns a change stream event.
+func changeDocument(t *testing.T, token int, operation string, id primitive.ObjectID, fullDocument interface{}) bson.Raw {
+	t.Helper()
+
+	event := bson.M{
+		"_id":           bson.M{"_data": fmt.Sprintf("%04d", token)},
+		"operationType": operation,
+		"documentKey":   bson.M{"_id": id},
+	}
+
+	if fullDocument != nil {
+		event["fullDocument"] = fullDocument
+	}
+
+	raw, err := bson.Marshal(event)
+	if err != nil {
+		t.Fatalf("error marshaling change: %s", err)
+	}
+
+	return raw
+}
+
+// receiveChanges returns the changes sent on changes until it is closed.
+func receiveChanges(t *testing.T, changes <-chan UserChange) []UserChange {
+	t.Helper()
+
+	var received []UserChange
+
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return received
+			}
+
+			received = append(received, change)
+		case <-time.After(time.Second):
+			t.Fatalf("changes not closed after %d changes", len(received))
+		}
+	}
+}
+
+func TestMongoRepo_WatchUsers(t *testing.T) {
+	ctx := context.Background()
+
+	createdAt := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := &User{
+		ID:        primitive.NewObjectID(),
+		Name:      "John",
+		Email:     "john@example.com",
+		Role:      RoleMember,
+		Version:   1,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+
+	renamed := *user
+	renamed.Name = "Johnny"
+	renamed.Version = 2
+
+	t.Run("Changes", func(t *testing.T) {
+		stream := &scriptedStream{
+			events: []bson.Raw{
+				changeDocument(t, 1, "insert", user.ID, toDocument(user)),
+				changeDocument(t, 2, "update", user.ID, toDocument(&renamed)),
+				// Deleted before the update was read.
+				changeDocument(t, 3, "update", user.ID, nil),
+				changeDocument(t, 4, "delete", user.ID, nil),
+				changeDocument(t, 5, "drop", primitive.NilObjectID, nil),
+			},
+			err: errors.New("connection reset"),
+		}
+
+		repo, watcher := newWatchedRepo(stream)
+
+		changes, err := repo.WatchUsers(ctx)
+		if err != nil {
+			t.Fatalf("error watching users: %s", err)
+		}
+
+		received := receiveChanges(t, changes)
+		if len(received) != 5 {
+			t.Fatalf("expected 5 changes, got %d", len(received))
+		}
+
+		token := func(n int) bson.Raw {
+			raw, err := bson.Marshal(bson.M{"_data": fmt.Sprintf("%04d", n)})
+			if err != nil {
+				t.Fatalf("error marshaling token: %s", err)
+			}
+
+			return raw
+		}
+
+		assert.Equal(t, []UserChange{
+			{Operation: ChangeInsert, UserID: user.ID, User: user, ResumeToken: token(1)},
+			{Operation: ChangeUpdate, UserID: user.ID, User: &renamed, ResumeToken: token(2)},
+			{Operation: ChangeUpdate, UserID: user.ID, ResumeToken: token(3)},
+			{Operation: ChangeDelete, UserID: user.ID, ResumeToken: token(4)},
+		}, received[:4])
+
+		// The drop is skipped, then the stream failure ends the watch.
+		assert.ErrorIs(t, received[4].Err, ErrWatchingUsers)
+		assert.Contains(t, received[4].Err.Error(), "connection reset")
+		assert.True(t, stream.closed.Load())
+
+		assert.Equal(t, options.UpdateLookup, *watcher.opts.FullDocument)
+		assert.Nil(t, watcher.opts.ResumeAfter)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		stream := &scriptedStream{events: []bson.Raw{changeDocument(t, 1, "delete", user.ID, nil)}}
+
+		repo, _ := newWatchedRepo(stream)
+
+		ctx, cancel := context.WithCancel(ctx)
+
+		changes, err := repo.WatchUsers(ctx)
+		if err != nil {
+			t.Fatalf("error watching users: %s", err)
+		}
+
+		change := <-changes
+		assert.Equal(t, ChangeDelete, change.Operation)
+
+		cancel()
+
+		// Closed without an error, the watch having been stopped.
+		assert.Empty(t, receiveChanges(t, changes))
+		assert.True(t, stream.closed.Load())
+	})
+
+	t.Run("From", func(t *testing.T) {
+		repo, watcher := newWatchedRepo(&scriptedStream{err: errors.New("connection reset")})
+
+		token := changeDocument(t, 1, "delete", user.ID, nil)
+
+		changes, err := repo.WatchUsersFrom(ctx, token)
+		if err != nil {
+			t.Fatalf("error watching users: %s", err)
+		}
+
+		received := receiveChanges(t, changes)
+		assert.Len(t, received, 1)
+		assert.Equal(t, token, watcher.opts.ResumeAfter)
+
+		_, err = repo.WatchUsersFrom(ctx, nil)
+		assert.ErrorIs(t, err, ErrWatchingUsers)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		repo, watcher := newWatchedRepo(nil)
+		watcher.err = errors.New("The $changeStream stage is only supported on replica sets")
+
+		_, err := repo.WatchUsers(ctx)
+		assert.ErrorIs(t, err, ErrWatchingUsers)
+
+		_, err = NewMockMongo().WatchUsers(ctx)
+		assert.ErrorIs(t, err, ErrWatchingUsers)
+
+		assert.NoError(t, repo.Close(ctx))
+
+		_, err = repo.WatchUsers(ctx)
+		assert.ErrorIs(t, err, ErrRepoClosed)
+	})
+}
+
+// fakeSession is a mongo.Session whose transactions roll back the users of
+// mock when aborted. It records what it is asked to do in calls.
+type fakeSession struct {
+	mongo.Session
+
+	mock *MockMongo
+	// err fails the transactions without running them.
+	err   error
+	calls []string
+
+	snapshot map[primitive.ObjectID]userDocument
+}
+
+func (s *fakeSession) WithTransaction(
+	ctx context.Context, fn func(ctx mongo.SessionContext) (interface{}, error), _ ...*options.TransactionOptions,
+) (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	s.calls = append(s.calls, "start")
+
+	s.mock.mu.Lock()
+	s.snapshot = maps.Clone(s.mock.users)
+	s.mock.mu.Unlock()
+
+	result, err := fn(mongo.NewSessionContext(ctx, s))
+	if err != nil {
+		_ = s.AbortTransaction(ctx)
+		return nil, err
+	}
+
+	s.calls = append(s.calls, "commit")
+
+	return result, nil
+}
+
+func (s *fakeSession) AbortTransaction(context.Context) error {
+	s.calls = append(s.calls, "abort")
+
+	s.mock.mu.Lock()
+	s.mock.users = s.snapshot
+	s.mock.mu.Unlock()
+
+	return nil
+}
+
+func (s *fakeSession) EndSession(context.Context) {
+	s.calls = append(s.calls, "end")
+}
+
+// sessionCaller is a MongoCaller starting fakeSessions, which records whether
+// its inserts were made in one.
+type sessionCaller struct {
+	*MockMongo
+
+	session *fakeSession
+	// inSession tells, for each insert, whether it was made in session.
+	inSession []bool
+}
+
+func (c *sessionCaller) StartSession(...*options.SessionOptions) (mongo.Session, error) {
+	return c.session, nil
+}
+
+func (c *sessionCaller) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	c.inSession = append(c.inSession, mongo.SessionFromContext(ctx) == c.session)
+
+	return c.MockMongo.InsertOne(ctx, document, opts...)
+}
+
+// newTransactionRepo returns a repo on a sessionCaller.
+func newTransactionRepo() (*MongoRepo, *sessionCaller) {
+	mock := NewMockMongo().mongoCaller.(*MockMongo)
+	caller := &sessionCaller{MockMongo: mock, session: &fakeSession{mock: mock}}
+
+	repo := NewMongoRepoFromCollection(caller)
+	repo.bcryptCost = bcrypt.MinCost
+
+	return repo, caller
+}
+
+func TestMongoRepo_WithTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	newUser := func(name string) *User {
+		return &User{Name: name, Email: strings.ToLower(name) + "@example.com", Password: "password"}
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		repo, caller := newTransactionRepo()
+
+		err := repo.WithTransaction(ctx, func(ctx context.Context) error {
+			_, err := repo.CreateUser(ctx, newUser("John"))
+			if err != nil {
+				return err
+			}
+
+			// Joins the transaction instead of starting another one.
+			return repo.WithTransaction(ctx, func(ctx context.Context) error {
+				_, err := repo.CreateUser(ctx, newUser("Jane"))
+				return err
+			})
+		})
+		if err != nil {
+			t.Fatalf("error running transaction: %s", err)
+		}
+
+		assert.Equal(t, []string{"start", "commit", "end"}, caller.session.calls)
+		assert.Equal(t, []bool{true, true}, caller.inSession)
+		assert.Len(t, caller.Users(), 2)
+
+		// Outside of the transaction, calls go without the session.
+		_, err = repo.CreateUser(ctx, newUser("Jack"))
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, []bool{true, true, false}, caller.inSession)
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		repo, caller := newTransactionRepo()
+
+		_, err := repo.CreateUser(ctx, newUser("John"))
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		errProfile := errors.New("error creating profile")
+
+		err = repo.WithTransaction(ctx, func(ctx context.Context) error {
+			_, err := repo.CreateUser(ctx, newUser("Jane"))
+			if err != nil {
+				return err
+			}
+
+			return errProfile
+		})
+		assert.ErrorIs(t, err, errProfile)
+
+		assert.Equal(t, []string{"start", "abort", "end"}, caller.session.calls)
+
+		users := caller.Users()
+		if len(users) != 1 {
+			t.Fatalf("expected 1 user, got %d", len(users))
+		}
+
+		assert.Equal(t, "John", users[0].Name)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		repo, caller := newTransactionRepo()
+
+		assert.PanicsWithValue(t, "boom", func() {
+			_ = repo.WithTransaction(ctx, func(ctx context.Context) error {
+				_, err := repo.CreateUser(ctx, newUser("John"))
+				if err != nil {
+					return err
+				}
+
+				panic("boom")
+			})
+		})
+
+		assert.Equal(t, []string{"start", "abort", "end"}, caller.session.calls)
+		assert.Empty(t, caller.Users())
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		repo, caller := newTransactionRepo()
+		caller.session.err = mongo.CommandError{
+			Code:    20,
+			Name:    "IllegalOperation",
+			Message: "Transaction numbers are only allowed on a replica set member or mongos",
+		}
+
+		err := repo.WithTransaction(ctx, func(context.Context) error { return nil })
+		assert.ErrorIs(t, err, ErrTransactionsUnsupported)
+
+		err = NewMockMongo().WithTransaction(ctx, func(context.Context) error {
+			t.Fatalf("fn must not run without transactions")
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrTransactionsUnsupported)
+
+		assert.NoError(t, repo.Close(ctx))
+		assert.ErrorIs(t, repo.WithTransaction(ctx, func(context.Context) error { return nil }), ErrRepoClosed)
+	})
+}
+
+func TestMongoRepo_CreateUserIdempotent(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("SameKey", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		first, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		second, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error retrying user creation: %s", err)
+		}
+
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, "John", second.Name)
+		assert.Equal(t, "john@example.com", second.Email)
+		assert.Empty(t, second.Password)
+		assert.Len(t, mock.CallsTo("InsertOne"), 1)
+
+		_, err = repo.GetUserByEmail(ctx, "jane@example.com")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("OtherKey", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		first, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		second, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-2")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Len(t, mock.CallsTo("InsertOne"), 2)
+	})
+
+	t.Run("ExpiredKey", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+		repo.clock = clock
+
+		first, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		clock.Advance(defaultIdempotencyKeyTTL - time.Second)
+
+		retried, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error retrying user creation: %s", err)
+		}
+
+		assert.Equal(t, first.ID, retried.ID)
+
+		clock.Advance(time.Second)
+
+		second, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Len(t, mock.CallsTo("InsertOne"), 2)
+
+		// The first user is kept, only its key is released.
+		stored, err := repo.GetUserByID(ctx, first.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Empty(t, stored.idempotencyKey)
+		assert.Nil(t, stored.idempotencyExpiresAt)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		repo.idempotencyKeyTTL = time.Minute
+		clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+		repo.clock = clock
+
+		first, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, clock.Now().Add(time.Minute), *first.idempotencyExpiresAt)
+
+		clock.Advance(time.Minute)
+
+		second, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.NotEqual(t, first.ID, second.ID)
+
+		withOption, err := NewMongoRepo(ctx, "mongodb://localhost:27017",
+			(&fakeConnect{}).option(), WithSkipPing(), WithIdempotencyKeyTTL(time.Minute))
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.Equal(t, time.Minute, withOption.idempotencyKeyTTL)
+	})
+
+	t.Run("ConcurrentCall", func(t *testing.T) {
+		mock := NewMockMongo().mongoCaller.(*MockMongo)
+		caller := &racingCaller{MockMongo: mock, key: "key-1"}
+		repo := NewMongoRepoFromCollection(caller)
+		repo.bcryptCost = bcrypt.MinCost
+
+		user, err := repo.CreateUserIdempotent(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"}, "key-1")
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, caller.winner, user.ID)
+		assert.Equal(t, "John", user.Name)
+		assert.Len(t, mock.Users(), 1)
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		_, err := repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, "")
+		assert.ErrorIs(t, err, ErrInvalidIdempotencyKey)
+
+		_, err = repo.CreateUserIdempotent(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"},
+			strings.Repeat("k", maxIdempotencyKeyLength+1))
+		assert.ErrorIs(t, err, ErrInvalidIdempotencyKey)
+		assert.Empty(t, mock.calls)
+	})
+
+	t.Run("NilUser", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		_, err := repo.CreateUserIdempotent(ctx, nil, "key")
+		assert.ErrorIs(t, err, ErrInvalidUser)
+		assert.Empty(t, mock.calls)
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		repo, _ := newImportRepo()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.CreateUserIdempotent(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"}, "key-1")
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+		assert.NotErrorIs(t, err, errIdempotencyKeyTaken)
+	})
+}
+
+// racingCaller stores a user with key right before the first insert, as a
+// concurrent CreateUserIdempotent would.
+type racingCaller struct {
+	*MockMongo
+
+	key    string
+	winner primitive.ObjectID
+}
+
+func (c *racingCaller) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	if c.winner.IsZero() {
+		c.winner = primitive.NewObjectID()
+
+		_, err := c.MockMongo.InsertOne(ctx, &userDocument{
+			ID: c.winner, Name: "John", Email: "john@example.com", Password: "hash", IdempotencyKey: c.key,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.MockMongo.InsertOne(ctx, document, opts...)
+}
+
+// newRateLimitedRepo returns a mock behind a RateLimitedRepo on a fake clock,
+// whose waits move the clock instead of sleeping, with the waits made.
+func newRateLimitedRepo(reads, writes *rate.Limiter) (*RateLimitedRepo, *MockMongo, *[]time.Duration) {
+	mongoRepo, mock := newImportRepo()
+
+	clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	waits := &[]time.Duration{}
+
+	repo := NewRateLimitedRepo(mongoRepo, reads, writes)
+	repo.clock = clock
+	repo.sleep = func(_ context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		clock.Advance(d)
+
+		return nil
+	}
+
+	return repo, mock, waits
+}
+
+func TestRateLimitedRepo(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Burst", func(t *testing.T) {
+		repo, mock, waits := newRateLimitedRepo(rate.NewLimiter(rate.Inf, 0), rate.NewLimiter(10, 2))
+
+		for i := 0; i < 5; i++ {
+			_, err := repo.CreateUser(ctx, &User{Name: "John", Email: fmt.Sprintf("john%d@example.com", i), Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+		}
+
+		// The burst goes through, then a call every 100ms.
+		ms := 100 * time.Millisecond
+		assert.Equal(t, []time.Duration{ms, ms, ms}, *waits)
+		assert.Len(t, mock.CallsTo("InsertOne"), 5)
+
+		stats := repo.Stats()
+		assert.Equal(t, int64(3), stats.WritesThrottled)
+		assert.Zero(t, stats.ReadsThrottled)
+		assert.InDelta(t, 0, stats.WriteTokens, 1e-9)
+	})
+
+	t.Run("ShortDeadline", func(t *testing.T) {
+		repo, mock, waits := newRateLimitedRepo(rate.NewLimiter(rate.Inf, 0), rate.NewLimiter(1, 1))
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err = repo.CreateUser(timeoutCtx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrOperationTimeout)
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+		assert.Empty(t, *waits)
+		assert.Len(t, mock.CallsTo("InsertOne"), 1)
+
+		// The token given back is there for the next call.
+		stats := repo.Stats()
+		assert.Equal(t, int64(1), stats.WritesThrottled)
+		assert.InDelta(t, 0, stats.WriteTokens, 1e-9)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		repo, mock, _ := newRateLimitedRepo(rate.NewLimiter(rate.Inf, 0), rate.NewLimiter(1, 1))
+		repo.sleep = func(context.Context, time.Duration) error {
+			return context.Canceled
+		}
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		err = repo.DeleteUser(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Empty(t, mock.CallsTo("DeleteOne"))
+
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err = repo.GetUserByEmail(canceledCtx, "john@example.com")
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.Empty(t, mock.CallsTo("FindOne"))
+	})
+
+	t.Run("ReadsAndWrites", func(t *testing.T) {
+		repo, mock, waits := newRateLimitedRepo(rate.NewLimiter(10, 1), rate.NewLimiter(1, 1))
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		// An exhausted write limit doesn't hold reads back.
+		_, err = repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Empty(t, *waits)
+
+		_, err = repo.ListUsers(ctx, 10, 0)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		_, _, err = repo.ListUsersAfter(ctx, primitive.NilObjectID, 10)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		user.Name = "Johnny"
+
+		err = repo.UpdateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		ms := 100 * time.Millisecond
+		assert.Equal(t, []time.Duration{ms, ms, time.Second - 2*ms}, *waits)
+		assert.Len(t, mock.CallsTo("Find"), 2)
+
+		stats := repo.Stats()
+		assert.Equal(t, int64(2), stats.ReadsThrottled)
+		assert.Equal(t, int64(1), stats.WritesThrottled)
+	})
+
+	t.Run("NoCall", func(t *testing.T) {
+		repo, mock, _ := newRateLimitedRepo(rate.NewLimiter(1, 0), rate.NewLimiter(rate.Inf, 0))
+
+		_, err := repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrOperationTimeout)
+		assert.ErrorIs(t, err, ErrRateLimited)
+		assert.Empty(t, mock.calls)
+	})
+
+	t.Run("Sleeps", func(t *testing.T) {
+		mongoRepo, _ := newImportRepo()
+		repo := NewRateLimitedRepo(mongoRepo, rate.NewLimiter(rate.Inf, 0), rate.NewLimiter(rate.Every(20*time.Millisecond), 1))
+
+		start := time.Now()
+
+		for i := 0; i < 2; i++ {
+			_, err := repo.CreateUser(ctx, &User{Name: "John", Email: fmt.Sprintf("john%d@example.com", i), Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+		}
+
+		assert.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+	})
+}
+
+// newCircuitBreakerRepo returns a mock behind a CircuitBreakerRepo on a fake
+// clock, with the transitions it made.
+func newCircuitBreakerRepo(opts ...CircuitBreakerOption) (
+	*CircuitBreakerRepo, *MockMongo, *FakeClock, *[]CircuitState,
+) {
+	mongoRepo, mock := newImportRepo()
+	clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+	transitions := &[]CircuitState{}
+
+	opts = append([]CircuitBreakerOption{
+		WithCircuitThreshold(3),
+		WithCircuitCooldown(time.Minute),
+		OnCircuitStateChange(func(_, to CircuitState) {
+			*transitions = append(*transitions, to)
+		}),
+	}, opts...)
+
+	repo := NewCircuitBreakerRepo(mongoRepo, opts...)
+	repo.clock = clock
+
+	return repo, mock, clock, transitions
+}
+
+func TestCircuitBreakerRepo(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Opens", func(t *testing.T) {
+		repo, mock, clock, transitions := newCircuitBreakerRepo()
+
+		for i := 0; i < 4; i++ {
+			mock.FailNext("FindOne", transientError)
+		}
+
+		for i := 0; i < 3; i++ {
+			_, err := repo.GetUserByID(ctx, primitive.NewObjectID())
+			assert.ErrorIs(t, err, ErrFindingUser)
+			assert.NotErrorIs(t, err, ErrCircuitOpen)
+		}
+
+		assert.Equal(t, CircuitOpen, repo.State())
+
+		// Calls fail right away until the cooldown ends.
+		clock.Advance(time.Minute - time.Second)
+
+		_, err := repo.GetUserByEmail(ctx, "john@example.com")
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+		assert.Equal(t, 3, mock.calls)
+
+		// The probe fails and the circuit opens for another cooldown.
+		clock.Advance(time.Second)
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+		assert.Equal(t, CircuitOpen, repo.State())
+		assert.Equal(t, 4, mock.calls)
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+
+		// The next probe gets an answer and closes the circuit.
+		clock.Advance(time.Minute)
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		assert.Equal(t, CircuitClosed, repo.State())
+
+		assert.Equal(t, []CircuitState{
+			CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed,
+		}, *transitions)
+	})
+
+	t.Run("Answers", func(t *testing.T) {
+		repo, _, _, transitions := newCircuitBreakerRepo(WithCircuitThreshold(1))
+
+		for i := 0; i < 3; i++ {
+			_, err := repo.GetUserByID(ctx, primitive.NewObjectID())
+			assert.ErrorIs(t, err, ErrUserNotFound)
+		}
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "not an email", Password: "password"})
+		assert.ErrorIs(t, err, ErrInvalidUser)
+
+		err = repo.DeleteUser(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		assert.Equal(t, CircuitClosed, repo.State())
+		assert.Empty(t, *transitions)
+	})
+
+	t.Run("ConsecutiveFailures", func(t *testing.T) {
+		repo, mock, _, _ := newCircuitBreakerRepo()
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			mock.FailNext("FindOne", transientError)
+			mock.FailNext("FindOne", transientError)
+
+			_, _ = repo.GetUserByID(ctx, user.ID)
+			_, _ = repo.GetUserByID(ctx, user.ID)
+
+			// An answer starts the count over.
+			_, err = repo.GetUserByID(ctx, user.ID)
+			assert.NoError(t, err)
+		}
+
+		assert.Equal(t, CircuitClosed, repo.State())
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		repo, mock, _, _ := newCircuitBreakerRepo(WithCircuitThreshold(1))
+		mock.FailNext("Find", context.DeadlineExceeded)
+
+		_, err := repo.ListUsers(ctx, 10, 0)
+		assert.ErrorIs(t, err, ErrOperationTimeout)
+		assert.Equal(t, CircuitOpen, repo.State())
+
+		_, _, err = repo.ListUsersAfter(ctx, primitive.NilObjectID, 10)
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+	})
+
+	t.Run("CallerGivesUp", func(t *testing.T) {
+		repo, mock, clock, transitions := newCircuitBreakerRepo(WithCircuitThreshold(1))
+
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := repo.GetUserByID(canceledCtx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.Equal(t, CircuitClosed, repo.State())
+
+		mock.FailNext("FindOne", transientError)
+
+		_, _ = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.Equal(t, CircuitOpen, repo.State())
+
+		// A probe abandoned by its caller is made by the next call.
+		clock.Advance(time.Minute)
+
+		_, _ = repo.GetUserByID(canceledCtx, primitive.NewObjectID())
+		assert.Equal(t, CircuitOpen, repo.State())
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		assert.Equal(t, CircuitClosed, repo.State())
+
+		assert.Equal(t, []CircuitState{
+			CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed,
+		}, *transitions)
+	})
+
+	t.Run("SingleProbe", func(t *testing.T) {
+		repo, mock, clock, _ := newCircuitBreakerRepo(WithCircuitThreshold(1))
+		mock.FailNext("FindOne", transientError)
+
+		_, _ = repo.GetUserByID(ctx, primitive.NewObjectID())
+		assert.Equal(t, CircuitOpen, repo.State())
+
+		blocking := &blockingRepository{
+			UserRepository: repo.repo,
+			entered:        make(chan struct{}),
+			release:        make(chan struct{}),
+		}
+		repo.repo = blocking
+
+		clock.Advance(time.Minute)
+
+		done := make(chan error)
+		go func() {
+			_, err := repo.GetUserByID(ctx, primitive.NewObjectID())
+			done <- err
+		}()
+
+		<-blocking.entered
+		assert.Equal(t, CircuitHalfOpen, repo.State())
+
+		_, err := repo.GetUserByEmail(ctx, "john@example.com")
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+
+		close(blocking.release)
+		assert.ErrorIs(t, <-done, ErrUserNotFound)
+		assert.Equal(t, CircuitClosed, repo.State())
+	})
+}
+
+// blockingRepository blocks GetUserByID until release is closed, after
+// telling entered.
+type blockingRepository struct {
+	UserRepository
+
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRepository) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	r.entered <- struct{}{}
+	<-r.release
+
+	return r.UserRepository.GetUserByID(ctx, id, opts...)
+}
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		// problems are the failed rules listed by the error, none when empty.
+		problems []string
+	}{
+		{name: "strong", policy: policy, password: "Correct7Horse"},
+		{name: "too short", policy: policy, password: "Short7Pw", problems: []string{"shorter than 10 characters"}},
+		{name: "characters not bytes", policy: PasswordPolicy{MinLength: 10}, password: "éééééééééé"},
+		{name: "no uppercase", policy: policy, password: "correct7horse", problems: []string{"no uppercase letter"}},
+		{name: "no lowercase", policy: policy, password: "CORRECT7HORSE", problems: []string{"no lowercase letter"}},
+		{name: "no digit", policy: policy, password: "CorrectHorse", problems: []string{"no digit"}},
+		{name: "no symbol", policy: PasswordPolicy{RequireSymbol: true}, password: "Correct7Horse", problems: []string{"no symbol"}},
+		{name: "symbol", policy: PasswordPolicy{RequireSymbol: true}, password: "Correct 7Horse"},
+		{name: "common", policy: policy, password: "Password123", problems: []string{"too common"}},
+		{name: "own deny list", policy: PasswordPolicy{DenyList: []string{"blog-tclaudel"}}, password: "Blog-Tclaudel", problems: []string{"too common"}},
+		{name: "max length", policy: PasswordPolicy{MaxLength: 12}, password: "Correct7Horses", problems: []string{"longer than 12 bytes"}},
+		{name: "72 bytes", policy: policy, password: "Aa1" + strings.Repeat("x", 69)},
+		{name: "73 bytes", policy: policy, password: "Aa1" + strings.Repeat("x", 70), problems: []string{"longer than 72 bytes"}},
+		{name: "multibyte over 72 bytes", policy: PasswordPolicy{}, password: strings.Repeat("é", 37), problems: []string{"longer than 72 bytes"}},
+		{
+			name: "several rules", policy: policy, password: "qwerty12",
+			problems: []string{"shorter than 10 characters", "no uppercase letter", "too common"},
+		},
+		{name: "disabled", policy: PasswordPolicy{}, password: "password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.password)
+			if len(tt.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrWeakPassword)
+			assert.Equal(t, len(tt.problems), strings.Count(err.Error(), "; ")+1)
+
+			for _, problem := range tt.problems {
+				assert.ErrorContains(t, err, problem)
+			}
+
+			assert.NotContains(t, err.Error(), tt.password)
+		})
+	}
+}
+
+func TestMongoRepo_PasswordPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	newPolicyRepo := func() (*MongoRepo, *MockMongo) {
+		repo, mock := newImportRepo()
+		policy := DefaultPasswordPolicy()
+		repo.passwordPolicy = &policy
+
+		return repo, mock
+	}
+
+	t.Run("CreateUser", func(t *testing.T) {
+		repo, mock := newPolicyRepo()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password123"})
+		assert.ErrorIs(t, err, ErrWeakPassword)
+		assert.ErrorIs(t, err, ErrInvalidUser)
+		assert.NotContains(t, err.Error(), "password123")
+
+		_, err = repo.CreateUsers(ctx, []*User{{Name: "John", Email: "john@example.com", Password: "password123"}})
+		assert.ErrorIs(t, err, ErrWeakPassword)
+
+		_, err = repo.UpsertUser(ctx, &User{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com", Password: "password123"})
+		assert.ErrorIs(t, err, ErrWeakPassword)
+		assert.Empty(t, mock.calls)
+
+		_, err = repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("ChangePassword", func(t *testing.T) {
+		repo, _ := newPolicyRepo()
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		err = repo.ChangePassword(ctx, user.ID, "Correct7Horse", "qwertyuiop")
+		assert.ErrorIs(t, err, ErrWeakPassword)
+
+		err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"password": "qwertyuiop"})
+		assert.ErrorIs(t, err, ErrWeakPassword)
+
+		err = repo.ChangePassword(ctx, user.ID, "Correct7Horse", "Battery9Staple")
+		if err != nil {
+			t.Fatalf("error changing password: %s", err)
+		}
+
+		ok, err := repo.VerifyPassword(ctx, "john@example.com", "Battery9Staple")
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.True(t, ok)
+
+		err = repo.ChangePassword(ctx, primitive.NewObjectID(), "Battery9Staple", "Battery9Staple")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("BcryptLimit", func(t *testing.T) {
+		// Without a policy as with one, bcrypt never gets to truncate a
+		// password.
+		withPolicy, _ := newPolicyRepo()
+
+		for _, repo := range []*MongoRepo{NewMockMongo(), withPolicy} {
+			tooLong := "Aa1" + strings.Repeat("x", 70)
+
+			_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: tooLong})
+			assert.ErrorIs(t, err, ErrInvalidUser)
+
+			user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: tooLong[:72]})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+
+			err = repo.ChangePassword(ctx, user.ID, tooLong[:72], tooLong)
+			assert.ErrorIs(t, err, ErrInvalidUser)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		repo, _ := newImportRepo()
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		err = repo.ChangePassword(ctx, user.ID, "password", "12345678")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		repo, _ := newPolicyRepo()
+
+		report, err := repo.ImportUsersCSV(ctx, strings.NewReader(
+			"name,email,password\nJohn,john@example.com,password123\nJane,jane@example.com,Correct7Horse\n",
+		), ImportOptions{})
+		if err != nil {
+			t.Fatalf("error importing users: %s", err)
+		}
+
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 1, report.Invalid)
+		assert.ErrorIs(t, report.Errors[0], ErrWeakPassword)
+	})
+
+	t.Run("Option", func(t *testing.T) {
+		repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017",
+			(&fakeConnect{}).option(), WithSkipPing(), WithPasswordPolicy(DefaultPasswordPolicy()))
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.Equal(t, DefaultPasswordPolicy(), *repo.passwordPolicy)
+	})
+}
+
+func TestMongoRepo_ChangePassword(t *testing.T) {
+	ctx := context.Background()
+
+	repo, _ := newImportRepo()
+	policy := DefaultPasswordPolicy()
+	repo.passwordPolicy = &policy
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	repo.clock = clock
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	clock.Advance(time.Hour)
+
+	err = repo.ChangePassword(ctx, user.ID, "Wrong7Horse", "Battery9Staple")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	assert.NotErrorIs(t, err, ErrWeakPassword)
+
+	err = repo.ChangePassword(ctx, user.ID, "Correct7Horse", "password123")
+	assert.ErrorIs(t, err, ErrWeakPassword)
+	assert.NotErrorIs(t, err, ErrInvalidCredentials)
+
+	err = repo.ChangePassword(ctx, primitive.NewObjectID(), "Correct7Horse", "Battery9Staple")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.NotErrorIs(t, err, ErrInvalidCredentials)
+
+	err = repo.ChangePassword(ctx, user.ID, "Correct7Horse", "Battery9Staple")
+	if err != nil {
+		t.Fatalf("error changing password: %s", err)
+	}
+
+	stored, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, now.Add(time.Hour), stored.UpdatedAt)
+	assert.Equal(t, user.Version+1, stored.Version)
+
+	for password, want := range map[string]bool{"Correct7Horse": false, "Battery9Staple": true} {
+		ok, err := repo.VerifyPassword(ctx, "john@example.com", password)
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.Equal(t, want, ok, password)
+	}
+
+	// The old password no longer changes it.
+	err = repo.ChangePassword(ctx, user.ID, "Correct7Horse", "Another5Horse")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestMongoRepo_VerifyPasswordRehash(t *testing.T) {
+	ctx := context.Background()
+
+	// storedHash returns the hash stored for the user and its cost.
+	storedHash := func(t *testing.T, repo *MongoRepo) (string, int) {
+		t.Helper()
+
+		user, err := repo.GetUserByEmail(ctx, "john@example.com", WithPassword())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		cost, err := bcrypt.Cost([]byte(user.Password))
+		if err != nil {
+			t.Fatalf("error reading cost: %s", err)
+		}
+
+		return user.Password, cost
+	}
+
+	newLowCostRepo := func(t *testing.T) (*MongoRepo, *MockMongo) {
+		t.Helper()
+
+		repo, mock := newImportRepo()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		repo.bcryptCost = bcrypt.MinCost + 1
+
+		return repo, mock
+	}
+
+	t.Run("Rehash", func(t *testing.T) {
+		repo, _ := newLowCostRepo(t)
+		oldHash, cost := storedHash(t, repo)
+		assert.Equal(t, bcrypt.MinCost, cost)
+
+		ok, err := repo.VerifyPassword(ctx, "john@example.com", "password")
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.True(t, ok)
+
+		newHash, cost := storedHash(t, repo)
+		assert.NotEqual(t, oldHash, newHash)
+		assert.Equal(t, bcrypt.MinCost+1, cost)
+
+		ok, err = repo.VerifyPassword(ctx, "john@example.com", "password")
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.True(t, ok)
+
+		// The hash is at the repo cost and kept from then on.
+		hash, _ := storedHash(t, repo)
+		assert.Equal(t, newHash, hash)
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		repo, mock := newLowCostRepo(t)
+		oldHash, _ := storedHash(t, repo)
+
+		ok, err := repo.VerifyPassword(ctx, "john@example.com", "wrong password")
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.False(t, ok)
+		assert.Empty(t, mock.CallsTo("UpdateOne"))
+
+		hash, _ := storedHash(t, repo)
+		assert.Equal(t, oldHash, hash)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		repo, mock := newLowCostRepo(t)
+		handler := &recordingHandler{}
+		repo.logger = slog.New(handler)
+		mock.FailAlways("UpdateOne", transientError)
+
+		ok, err := repo.VerifyPassword(ctx, "john@example.com", "password")
+		if err != nil {
+			t.Fatalf("error verifying password: %s", err)
+		}
+
+		assert.True(t, ok)
+
+		var messages []string
+		for _, record := range handler.records {
+			messages = append(messages, record.Message)
+		}
+
+		assert.Contains(t, messages, "rehashing password failed")
+	})
+}
+
+// newEncryptedRepo returns a repo on mock encrypting emails with key, able to
+// decrypt the ones of previousKeys, and hashing them with a key of its own.
+func newEncryptedRepo(t *testing.T, mock *MockMongo, key []byte, previousKeys ...[]byte) *MongoRepo {
+	t.Helper()
+
+	fields, err := newFieldEncryption(key, previousKeys, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("error creating field encryption: %s", err)
+	}
+
+	repo := NewMongoRepoFromCollection(mock)
+	repo.bcryptCost = bcrypt.MinCost
+	repo.fields = fields
+
+	return repo
+}
+
+func TestMongoRepo_FieldEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	keyA := []byte("0123456789abcdef0123456789abcdef")
+	keyB := []byte("fedcba9876543210fedcba9876543210")
+
+	t.Run("AtRest", func(t *testing.T) {
+		_, mock := newImportRepo()
+		repo := newEncryptedRepo(t, mock, keyA)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "Jane@Example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, "jane@example.com", user.Email)
+
+		inserts := mock.CallsTo("InsertOne")
+		if !assert.Len(t, inserts, 1) {
+			return
+		}
+
+		inserted := fmt.Sprint(inserts[0].Args[0])
+		assert.NotContains(t, strings.ToLower(inserted), "example.com")
+		assert.Contains(t, inserted, "email:"+encryptedPrefix+encryptionKeyID(keyA)+":")
+		assert.Contains(t, inserted, "email_hash:"+repo.fields.emailHash("jane@example.com"))
+
+		found, err := repo.GetUserByID(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "jane@example.com", found.Email)
+
+		found, err = repo.GetUserByEmail(ctx, " JANE@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, found.ID)
+
+		exists, err := repo.UserExistsByEmail(ctx, "jane@example.com")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		users, err := repo.ListUsers(ctx, 10, 0)
+		if assert.NoError(t, err) && assert.Len(t, users, 1) {
+			assert.Equal(t, "jane@example.com", users[0].Email)
+		}
+
+		users, err = repo.FindUsers(ctx, UserFilter{Email: "jane@example.com"})
+		if assert.NoError(t, err) && assert.Len(t, users, 1) {
+			assert.Equal(t, user.ID, users[0].ID)
+		}
+
+		emails, err := repo.DistinctEmails(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"jane@example.com"}, emails)
+	})
+
+	t.Run("RandomNonce", func(t *testing.T) {
+		fields, err := newFieldEncryption(keyA, nil, nil)
+		if err != nil {
+			t.Fatalf("error creating field encryption: %s", err)
+		}
+
+		assert.NotEqual(t, fields.encrypt("email", "jane@example.com"), fields.encrypt("email", "jane@example.com"))
+		assert.Equal(t, fields.emailHash("jane@example.com"), fields.emailHash(" Jane@Example.com"))
+	})
+
+	t.Run("UniqueEmail", func(t *testing.T) {
+		mock := NewMockMongo().mongoCaller.(*MockMongo)
+		repo := newEncryptedRepo(t, mock, keyA)
+
+		err := repo.EnsureIndexes(ctx)
+		if err != nil {
+			t.Fatalf("error ensuring indexes: %s", err)
+		}
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Janet", Email: "Jane@Example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+		assert.ErrorContains(t, err, "jane@example.com")
+	})
+
+	t.Run("ChangeEmail", func(t *testing.T) {
+		_, mock := newImportRepo()
+		repo := newEncryptedRepo(t, mock, keyA)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		changed, err := repo.ChangeUserEmail(ctx, user.ID, "janet@example.com")
+		if err != nil {
+			t.Fatalf("error changing email: %s", err)
+		}
+
+		assert.Equal(t, "janet@example.com", changed.Email)
+		assert.NotContains(t, mock.users[user.ID].Email, "janet")
+
+		_, err = repo.GetUserByEmail(ctx, "jane@example.com")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		found, err := repo.GetUserByEmail(ctx, "janet@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, found.ID)
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		_, mock := newImportRepo()
+
+		old, err := newEncryptedRepo(t, mock, keyA).CreateUser(ctx,
+			&User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		rotated := newEncryptedRepo(t, mock, keyB, keyA)
+
+		created, err := rotated.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		for _, user := range []*User{old, created} {
+			found, err := rotated.GetUserByEmail(ctx, user.Email)
+			assert.NoError(t, err)
+			assert.Equal(t, user.ID, found.ID)
+		}
+
+		emails, err := rotated.DistinctEmails(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"jane@example.com", "john@example.com"}, emails)
+
+		// The old key only decrypts what it encrypted.
+		_, err = newEncryptedRepo(t, mock, keyA).GetUserByID(ctx, created.ID)
+		assert.ErrorIs(t, err, ErrCorruptField)
+
+		// Rewritten, the old user no longer needs the old key.
+		old.Name = "Johnny"
+
+		err = rotated.UpdateUser(ctx, old)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		found, err := newEncryptedRepo(t, mock, keyB).GetUserByID(ctx, old.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "john@example.com", found.Email)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		_, mock := newImportRepo()
+		repo := newEncryptedRepo(t, mock, keyA)
+
+		user, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		stored := mock.users[user.ID]
+		encrypted := []byte(stored.Email)
+		// The last base64 character may only carry padding bits.
+		encrypted[len(encrypted)-8] ^= 1
+
+		for name, email := range map[string]string{
+			"tampered":    string(encrypted),
+			"unknown key": newEncryptedRepo(t, mock, keyB).fields.encrypt("email", "jane@example.com"),
+			"plain":       "jane@example.com",
+		} {
+			t.Run(name, func(t *testing.T) {
+				stored.Email = email
+				mock.users[user.ID] = stored
+
+				_, err := repo.GetUserByID(ctx, user.ID)
+				assert.ErrorIs(t, err, ErrCorruptField)
+				assert.ErrorContains(t, err, user.ID.Hex())
+
+				_, err = repo.ListUsers(ctx, 10, 0)
+				assert.ErrorIs(t, err, ErrCorruptField)
+			})
+		}
+	})
+
+	t.Run("Option", func(t *testing.T) {
+		repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017",
+			(&fakeConnect{}).option(), WithSkipPing(), WithFieldEncryption(keyB, keyA))
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.Equal(t, encryptionKeyID(keyB), repo.fields.currentID)
+		assert.Len(t, repo.fields.aeads, 2)
+	})
+}
+
+func TestUser_Redaction(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("Correct7Horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error hashing password: %s", err)
+	}
+
+	deletedAt := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	user := &User{
+		ID:        primitive.NewObjectID(),
+		Name:      "Jane",
+		Email:     "jane.doe@example.com",
+		Password:  string(hash),
+		Role:      RoleAdmin,
+		Version:   3,
+		CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		DeletedAt: &deletedAt,
+
+		EmailVerified: true,
+	}
+
+	// secrets are what none of the renderings may show.
+	secrets := []string{string(hash), "jane.doe"}
+
+	assertRedacted := func(t *testing.T, rendered string) {
+		t.Helper()
+
+		for _, secret := range secrets {
+			assert.NotContains(t, rendered, secret)
+		}
+	}
+
+	t.Run("Format", func(t *testing.T) {
+		for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+			for _, v := range []any{user, *user, []*User{user}} {
+				rendered := fmt.Sprintf(format, v)
+				assertRedacted(t, rendered)
+				assert.Contains(t, rendered, user.ID.Hex())
+			}
+		}
+
+		rendered := user.String()
+		assert.Contains(t, rendered, "Password:"+redactedPassword)
+		assert.Contains(t, rendered, "Email:j***@example.com")
+		assert.Contains(t, rendered, "DeletedAt:"+deletedAt.String())
+		assert.Contains(t, rendered, "EmailVerified:true")
+		assert.Contains(t, (&User{}).String(), "Password: ")
+
+		err := fmt.Errorf("storing %+v: %w", user, ErrInsertingUser)
+		assertRedacted(t, err.Error())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		for _, v := range []any{user, *user, map[string]*User{"user": user}} {
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("error marshaling user: %s", err)
+			}
+
+			assert.NotContains(t, string(data), string(hash))
+			assert.NotContains(t, string(data), "Password")
+		}
+
+		data, err := json.Marshal(user)
+		if err != nil {
+			t.Fatalf("error marshaling user: %s", err)
+		}
+
+		var fields map[string]any
+
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			t.Fatalf("error unmarshaling user: %s", err)
+		}
+
+		assert.Equal(t, user.Email, fields["Email"])
+		assert.Equal(t, user.ID.Hex(), fields["ID"])
+		assert.NotContains(t, fields, "idempotencyKey")
+	})
+
+	t.Run("Log", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		logger.Info("created", "user", user)
+		logger.Info("created", slog.Any("user", *user))
+
+		assertRedacted(t, buf.String())
+
+		var record struct {
+			User map[string]any `json:"user"`
+		}
+
+		err := json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &record)
+		if err != nil {
+			t.Fatalf("error decoding log record: %s", err)
+		}
+
+		assert.Equal(t, map[string]any{
+			"id":         user.ID.Hex(),
+			"name":       "Jane",
+			"email":      "j***@example.com",
+			"password":   redactedPassword,
+			"role":       RoleAdmin,
+			"version":    float64(3),
+			"created_at": "2023-01-01T00:00:00Z",
+			"deleted_at": "2023-02-01T00:00:00Z",
+
+			"email_verified": true,
+		}, record.User)
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		// The storage types keep the hash.
+		assert.Equal(t, string(hash), toDocument(user).Password)
+		assert.Equal(t, string(hash), newUserRecord(user).Password)
+	})
+}
+
+// newAuditedRepo returns a repo on a mock whose mutations are audited in the
+// returned log, both mock callers.
+func newAuditedRepo() (*MongoRepo, *MockMongo, *MockAuditLog) {
+	repo, mock := newImportRepo()
+	log := NewMockAuditLog()
+	repo.auditLog = log
+
+	return repo, mock, log
+}
+
+func TestMongoRepo_Auditing(t *testing.T) {
+	t.Run("Mutations", func(t *testing.T) {
+		repo, _, log := newAuditedRepo()
+		ctx := WithActor(context.Background(), "admin-1")
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		user.Name = "Johnny"
+
+		err = repo.UpdateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"role": RoleAdmin, "password": "Battery9Staple"})
+		if err != nil {
+			t.Fatalf("error updating fields: %s", err)
+		}
+
+		_, err = repo.ChangeUserEmail(WithActor(ctx, "john"), user.ID, "johnny@example.com")
+		if err != nil {
+			t.Fatalf("error changing email: %s", err)
+		}
+
+		err = repo.SoftDeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error soft-deleting user: %s", err)
+		}
+
+		err = repo.RestoreUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error restoring user: %s", err)
+		}
+
+		err = repo.DeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+
+		entries := log.Entries()
+		if len(entries) != 7 {
+			t.Fatalf("expected 7 audit entries, got %d", len(entries))
+		}
+
+		operations := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			operations = append(operations, entry.Operation)
+			assert.Equal(t, user.ID, entry.UserID)
+		}
+
+		assert.Equal(t, []string{
+			"CreateUser", "UpdateUser", "UpdateUserFields", "ChangeUserEmail", "SoftDeleteUser", "RestoreUser", "DeleteUser",
+		}, operations)
+
+		assert.Equal(t, "admin-1", entries[0].Actor)
+		assert.Equal(t, "john", entries[3].Actor)
+
+		assert.Equal(t, []FieldChange{
+			{Field: "name", New: "John"},
+			{Field: "email", New: "john@example.com"},
+			{Field: "password"},
+			{Field: "role", New: RoleMember},
+		}, entries[0].Changes)
+		assert.Equal(t, []FieldChange{{Field: "name", Old: "John", New: "Johnny"}}, entries[1].Changes)
+		assert.Equal(t, []FieldChange{
+			{Field: "password"},
+			{Field: "role", Old: RoleMember, New: RoleAdmin},
+		}, entries[2].Changes)
+		assert.Equal(t, []FieldChange{
+			{Field: "email", Old: "john@example.com", New: "johnny@example.com"},
+		}, entries[3].Changes)
+
+		if assert.Len(t, entries[4].Changes, 1) {
+			assert.Equal(t, "deleted_at", entries[4].Changes[0].Field)
+			assert.Empty(t, entries[4].Changes[0].Old)
+			assert.NotEmpty(t, entries[4].Changes[0].New)
+		}
+
+		assert.Equal(t, []FieldChange{{Field: "deleted_at", Old: entries[4].Changes[0].New}}, entries[5].Changes)
+		assert.Empty(t, entries[6].Changes)
+
+		for _, entry := range entries {
+			rendered := fmt.Sprintf("%+v", entry)
+			assert.NotContains(t, rendered, "Correct7Horse")
+			assert.NotContains(t, rendered, "Battery9Staple")
+			assert.NotContains(t, rendered, "$2a$")
+		}
+
+		listed, err := repo.ListAuditEntries(ctx, user.ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []AuditEntry{entries[6], entries[5]}, listed)
+
+		listed, err = repo.ListAuditEntries(ctx, primitive.NewObjectID(), 10)
+		assert.NoError(t, err)
+		assert.Empty(t, listed)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		repo, _, log := newAuditedRepo()
+		ctx := context.Background()
+
+		user := &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"}
+
+		_, err := repo.UpsertUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error upserting user: %s", err)
+		}
+
+		_, err = repo.UpsertUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "Correct7Horse"})
+		if err != nil {
+			t.Fatalf("error upserting user: %s", err)
+		}
+
+		entries := log.Entries()
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 audit entries, got %d", len(entries))
+		}
+
+		assert.Equal(t, user.ID, entries[1].UserID)
+		assert.Empty(t, entries[0].Actor)
+		assert.Equal(t, []FieldChange{
+			{Field: "name", Old: "John", New: "Johnny"},
+			{Field: "password"},
+		}, entries[1].Changes)
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		repo, _, log := newAuditedRepo()
+		repo.fields = newEncryptedRepo(t, NewMockMongo().mongoCaller.(*MockMongo), make([]byte, 32)).fields
+
+		_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		entries := log.Entries()
+		if assert.Len(t, entries, 1) {
+			assert.Contains(t, entries[0].Changes, FieldChange{Field: "email"})
+		}
+	})
+
+	t.Run("Tenants", func(t *testing.T) {
+		repo, _ := NewTenantMockMongo(CollectionPerTenant("users"))
+		log := NewMockAuditLog()
+		repo.auditLog = log
+
+		ctx := context.Background()
+		acme, globex := WithTenant(ctx, "acme"), WithTenant(ctx, "globex")
+
+		// The collections of the tenants may hold users of the same ID.
+		id := primitive.NewObjectID()
+
+		for _, tenantCtx := range []context.Context{acme, globex} {
+			_, err := repo.CreateUser(tenantCtx, &User{ID: id, Name: "John", Email: "john@example.com", Password: "password"})
+			if err != nil {
+				t.Fatalf("error creating user: %s", err)
+			}
+		}
+
+		err := repo.UpdateUserFields(globex, id, map[string]interface{}{"name": "Johnny"})
+		if err != nil {
+			t.Fatalf("error updating fields: %s", err)
+		}
+
+		listed, err := repo.ListAuditEntries(acme, id, 10)
+		assert.NoError(t, err)
+
+		if assert.Len(t, listed, 1) {
+			assert.Equal(t, "CreateUser", listed[0].Operation)
+			assert.Equal(t, "acme", listed[0].Tenant)
+		}
+
+		listed, err = repo.ListAuditEntries(globex, id, 10)
+		assert.NoError(t, err)
+		assert.Len(t, listed, 2)
+
+		listed, err = repo.ListAuditEntries(ctx, id, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, listed)
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		repo, mock, log := newAuditedRepo()
+		ctx := context.Background()
+
+		handler := &recordingHandler{}
+		repo.logger = slog.New(handler)
+
+		registry := prometheus.NewRegistry()
+
+		metrics, err := newRepoMetrics(registry)
+		if err != nil {
+			t.Fatalf("error creating metrics: %s", err)
+		}
+
+		repo.metrics = metrics
+
+		log.FailWith(errors.New("audit log down"))
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		mock.FailNext("FindOne", transientError)
+
+		err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"name": "Johnny"})
+		assert.NoError(t, err)
+
+		stored, err := repo.GetUserByID(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Johnny", stored.Name)
+		}
+
+		var warnings []map[string]string
+
+		for _, record := range handler.records {
+			if record.Message == "writing audit entry failed" {
+				warnings = append(warnings, attrs(record))
+			}
+		}
+
+		if assert.Len(t, warnings, 2) {
+			assert.Equal(t, "CreateUser", warnings[0]["op"])
+			assert.Equal(t, user.ID.Hex(), warnings[0]["user_id"])
+			assert.Contains(t, warnings[0]["error"], "audit log down")
+			assert.Equal(t, "UpdateUserFields", warnings[1]["op"])
+		}
+
+		series := scrapeMetrics(t, registry)
+		assert.Equal(t, float64(1), series[`user_repo_audit_failures_total{op="CreateUser"}`])
+		assert.Equal(t, float64(1), series[`user_repo_audit_failures_total{op="UpdateUserFields"}`])
+		assert.Empty(t, log.Entries())
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		repo, mock, log := newAuditedRepo()
+		repo.strictAudit = true
+		ctx := context.Background()
+
+		events := NewChannelSink(1)
+		repo.events = events
+
+		log.FailWith(errors.New("audit log down"))
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrAuditing)
+
+		// The user is stored and its event published all the same.
+		users := mock.Users()
+		if len(users) != 1 {
+			t.Fatalf("expected 1 user, got %d", len(users))
+		}
+
+		assert.Equal(t, EventUserCreated, (<-events.Events()).Type)
+
+		log.FailWith(nil)
+		mock.FailNext("FindOne", transientError)
+
+		err = repo.UpdateUserFields(ctx, users[0].ID, map[string]interface{}{"name": "Johnny"})
+		assert.ErrorIs(t, err, ErrAuditing)
+
+		// The user couldn't be read before, so it wasn't updated.
+		assert.Equal(t, "John", mock.Users()[0].Name)
+		assert.Empty(t, mock.CallsTo("UpdateOne"))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		ctx := context.Background()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Empty(t, mock.CallsTo("FindOne"))
+
+		_, err = repo.ListAuditEntries(ctx, primitive.NewObjectID(), 10)
+		assert.ErrorIs(t, err, ErrListingAuditTrail)
+	})
+
+	t.Run("Option", func(t *testing.T) {
+		ctx := context.Background()
+
+		repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017", (&fakeConnect{}).option(), WithSkipPing(), WithAuditing())
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		if collection, ok := repo.auditLog.(*mongo.Collection); assert.True(t, ok) {
+			assert.Equal(t, AuditCollection, collection.Name())
+		}
+
+		assert.False(t, repo.strictAudit)
+
+		repo, err = NewMongoRepo(ctx, "mongodb://localhost:27017", (&fakeConnect{}).option(), WithSkipPing(), StrictAuditing())
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.NotNil(t, repo.auditLog)
+		assert.True(t, repo.strictAudit)
+	})
+}
+
+func TestMongoRepo_CreateUserOptions(t *testing.T) {
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("Correct7Horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("error hashing password: %s", err)
+	}
+
+	t.Run("NilUser", func(t *testing.T) {
+		repo, mock := newImportRepo()
+
+		for _, opts := range [][]WriteOption{nil, {SkipValidation()}, {SkipValidation(), WithRawPassword()}} {
+			_, err := repo.CreateUser(ctx, nil, opts...)
+			assert.ErrorIs(t, err, ErrInvalidUser)
+		}
+
+		assert.Empty(t, mock.CallsTo("InsertOne"))
+	})
+
+	t.Run("SkipValidation", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		policy := DefaultPasswordPolicy()
+		repo.passwordPolicy = &policy
+
+		user, err := repo.CreateUser(ctx, &User{Email: " John@Example ", Password: "short", Role: "owner"}, SkipValidation())
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, "john@example", user.Email)
+		assert.Equal(t, "owner", mock.Users()[0].Role)
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: " ", Password: "password"}, SkipValidation())
+		assert.ErrorIs(t, err, ErrInvalidUser)
+
+		_, err = repo.CreateUser(ctx, &User{Email: "jane@example.com", Password: "short"})
+		assert.ErrorIs(t, err, ErrInvalidUser)
+		assert.Len(t, mock.CallsTo("InsertOne"), 1)
+	})
+
+	t.Run("RawPassword", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		policy := DefaultPasswordPolicy()
+		repo.passwordPolicy = &policy
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: string(hash)},
+			WithRawPassword())
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		inserts := mock.CallsTo("InsertOne")
+		if assert.Len(t, inserts, 1) {
+			assert.Equal(t, string(hash), inserts[0].Args[0].(bson.M)["password"])
+		}
+
+		assert.Equal(t, string(hash), mock.Users()[0].Password)
+
+		_, err = repo.VerifyPassword(ctx, user.Email, "Correct7Horse")
+		assert.NoError(t, err)
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "Correct7Horse"},
+			WithRawPassword())
+		assert.ErrorIs(t, err, ErrInvalidUser)
+		assert.ErrorContains(t, err, "not a bcrypt hash")
+		assert.Len(t, mock.CallsTo("InsertOne"), 1)
+	})
+
+	t.Run("SuppressEvents", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		events := NewChannelSink(2)
+		repo.events = events
+		repo.auditLog = NewMockAuditLog()
+
+		_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"}, SuppressEvents())
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		jane, err := repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Len(t, events.Events(), 1)
+		assert.Equal(t, jane.ID, (<-events.Events()).UserID)
+
+		// Auditing isn't an event.
+		assert.Len(t, repo.auditLog.(*MockAuditLog).Entries(), 2)
+	})
+
+	t.Run("Compose", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		events := NewChannelSink(1)
+		repo.events = events
+
+		wc := writeconcern.Majority()
+
+		_, err := repo.CreateUser(ctx, &User{Email: "john@example.com", Password: string(hash)},
+			SkipValidation(), WithRawPassword(), SuppressEvents(), UsingWriteConcern(wc))
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		stored := mock.Users()[0]
+		assert.Empty(t, stored.Name)
+		assert.Equal(t, string(hash), stored.Password)
+		assert.Equal(t, wc, mock.writeConcern)
+		assert.Empty(t, events.Events())
+	})
+}
+
+// post is a document unrelated to users, stored by the Repository tests.
+type post struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	Title  string             `bson:"title"`
+	Tags   []string           `bson:"tags,omitempty"`
+	Author primitive.ObjectID `bson:"author,omitempty"`
+}
+
+func (p *post) GetID() primitive.ObjectID { return p.ID }
+
+func (p *post) SetID(id primitive.ObjectID) { p.ID = id }
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("CRUD", func(t *testing.T) {
+		posts := NewRepositoryFromCollection[*post](NewMockCollection(), "posts")
+
+		p := &post{Title: "Testing with external dependencies", Tags: []string{"go", "mongo"}}
+
+		err := posts.Insert(ctx, p)
+		if err != nil {
+			t.Fatalf("error inserting post: %s", err)
+		}
+
+		assert.False(t, p.ID.IsZero(), "Insert should give the post an ID")
+
+		found, err := posts.FindByID(ctx, p.ID)
+		if err != nil {
+			t.Fatalf("error finding post: %s", err)
+		}
+
+		assert.Equal(t, p, found)
+
+		p.Title = "Testing with Mongo"
+
+		err = posts.Replace(ctx, p)
+		if err != nil {
+			t.Fatalf("error replacing post: %s", err)
+		}
+
+		found, err = posts.FindByID(ctx, p.ID)
+		if err != nil {
+			t.Fatalf("error finding post: %s", err)
+		}
+
+		assert.Equal(t, "Testing with Mongo", found.Title)
+
+		err = posts.Delete(ctx, p.ID)
+		if err != nil {
+			t.Fatalf("error deleting post: %s", err)
+		}
+
+		_, err = posts.FindByID(ctx, p.ID)
+		assert.ErrorIs(t, err, ErrDocumentNotFound)
+		assert.True(t, IsNotFound(err))
+
+		assert.ErrorIs(t, posts.Delete(ctx, p.ID), ErrDocumentNotFound)
+		assert.ErrorIs(t, posts.Replace(ctx, p), ErrDocumentNotFound)
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		posts := NewRepositoryFromCollection[*post](NewMockCollection(), "posts")
+
+		p := &post{ID: primitive.NewObjectID(), Title: "First"}
+
+		err := posts.Insert(ctx, p)
+		if err != nil {
+			t.Fatalf("error inserting post: %s", err)
+		}
+
+		err = posts.Insert(ctx, &post{ID: p.ID, Title: "Second"})
+		assert.ErrorIs(t, err, ErrDocumentAlreadyExists)
+		assert.True(t, IsConflict(err))
+		assert.Contains(t, err.Error(), "posts "+p.ID.Hex())
+	})
+
+	t.Run("List", func(t *testing.T) {
+		posts := NewRepositoryFromCollection[*post](NewMockCollection(), "posts")
+
+		var ids []primitive.ObjectID
+
+		for i := 0; i < 5; i++ {
+			p := &post{Title: fmt.Sprintf("Post %d", i)}
+
+			err := posts.Insert(ctx, p)
+			if err != nil {
+				t.Fatalf("error inserting post %d: %s", i, err)
+			}
+
+			ids = append(ids, p.ID)
+		}
+
+		page, err := posts.List(ctx, 2, 1)
+		if err != nil {
+			t.Fatalf("error listing posts: %s", err)
+		}
+
+		if len(page) != 2 {
+			t.Fatalf("expected 2 posts, got %d", len(page))
+		}
+
+		assert.Equal(t, ids[1], page[0].ID)
+		assert.Equal(t, ids[2], page[1].ID)
+
+		all, err := posts.List(ctx, 0, -1)
+		if err != nil {
+			t.Fatalf("error listing posts: %s", err)
+		}
+
+		assert.Len(t, all, 5)
+
+		empty, err := posts.List(ctx, 10, 5)
+		if err != nil {
+			t.Fatalf("error listing posts: %s", err)
+		}
+
+		assert.NotNil(t, empty)
+		assert.Empty(t, empty)
+	})
+
+	t.Run("DriverError", func(t *testing.T) {
+		collection := NewMockCollection()
+		posts := NewRepositoryFromCollection[*post](collection, "posts")
+
+		collection.FailWith(transientError)
+
+		err := posts.Insert(ctx, &post{Title: "Lost"})
+		assert.ErrorIs(t, err, ErrInsertingDocument)
+		assert.True(t, IsRetryable(err))
+
+		_, err = posts.FindByID(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrFindingDocument)
+
+		_, err = posts.List(ctx, 10, 0)
+		assert.ErrorIs(t, err, ErrListingDocuments)
+
+		assert.ErrorIs(t, posts.Replace(ctx, &post{ID: primitive.NewObjectID()}), ErrReplacingDocument)
+		assert.ErrorIs(t, posts.Delete(ctx, primitive.NewObjectID()), ErrDeletingDocument)
+		assert.Zero(t, collection.Len())
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		// MongoRepo stores its users through a Repository, so one built on the
+		// same collection sees them as documents.
+		repo := NewMockMongo()
+
+		user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "Correct7Horse"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		users := NewRepositoryFromCollection[*userDocument](repo.mongoCaller, defaultCollection)
+
+		doc, err := users.FindByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error finding user document: %s", err)
+		}
+
+		assert.Equal(t, "john@example.com", doc.Email)
+
+		doc.Name = "Johnny"
+
+		err = users.Replace(ctx, doc)
+		if err != nil {
+			t.Fatalf("error replacing user document: %s", err)
+		}
+
+		got, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, "Johnny", got.Name)
+
+		err = users.Delete(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error deleting user document: %s", err)
+		}
+
+		_, err = repo.GetUserByID(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+}
+
+func TestNewUser(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		user, err := NewUser("John", "  John@Example.com ", "Correct7Horse")
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		assert.Equal(t, "John", user.Name)
+		assert.Equal(t, "john@example.com", user.Email)
+		assert.Equal(t, "Correct7Horse", user.Password)
+		assert.Equal(t, RoleMember, user.Role)
+		assert.True(t, user.ID.IsZero())
+		assert.Zero(t, user.Version)
+		assert.True(t, user.CreatedAt.IsZero())
+		assert.True(t, user.UpdatedAt.IsZero())
+		assert.Nil(t, user.ExpiresAt)
+		assert.True(t, user.trusted())
+	})
+
+	t.Run("WithRole", func(t *testing.T) {
+		user, err := NewUser("John", "john@example.com", "Correct7Horse", WithRole(RoleAdmin))
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		assert.Equal(t, RoleAdmin, user.Role)
+	})
+
+	t.Run("Provisional", func(t *testing.T) {
+		before := time.Now()
+
+		user, err := NewUser("John", "john@example.com", "Correct7Horse", Provisional(time.Hour))
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		if user.ExpiresAt == nil {
+			t.Fatalf("expected the user to expire")
+		}
+
+		assert.WithinRange(t, *user.ExpiresAt, before.Add(time.Hour), time.Now().Add(time.Hour))
+	})
+
+	t.Run("WithExpiry", func(t *testing.T) {
+		expiresAt := time.Now().Add(24 * time.Hour)
+
+		user, err := NewUser("John", "john@example.com", "Correct7Horse", WithExpiry(expiresAt))
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		if user.ExpiresAt == nil {
+			t.Fatalf("expected the user to expire")
+		}
+
+		assert.Equal(t, expiresAt, *user.ExpiresAt)
+
+		// The last expiry option given wins.
+		user, err = NewUser("John", "john@example.com", "Correct7Horse", WithExpiry(expiresAt), Provisional(time.Minute))
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		assert.True(t, user.ExpiresAt.Before(expiresAt))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			user     [3]string
+			opts     []UserOption
+			problems []string
+		}{
+			{name: "empty name", user: [3]string{" ", "john@example.com", "Correct7Horse"}, problems: []string{"name is empty"}},
+			{name: "bad email", user: [3]string{"John", "john", "Correct7Horse"}, problems: []string{`email "john"`}},
+			{name: "short password", user: [3]string{"John", "john@example.com", "short"}, problems: []string{"password must be"}},
+			{
+				name:     "bad role",
+				user:     [3]string{"John", "john@example.com", "Correct7Horse"},
+				opts:     []UserOption{WithRole("root")},
+				problems: []string{`role "root"`},
+			},
+			{
+				name:     "non-positive ttl",
+				user:     [3]string{"John", "john@example.com", "Correct7Horse"},
+				opts:     []UserOption{Provisional(0)},
+				problems: []string{"ttl must be positive"},
+			},
+			{
+				name:     "past expiry",
+				user:     [3]string{"John", "john@example.com", "Correct7Horse"},
+				opts:     []UserOption{WithExpiry(time.Now().Add(-time.Minute))},
+				problems: []string{"not in the future"},
+			},
+			{
+				name:     "every problem",
+				user:     [3]string{"", "", ""},
+				opts:     []UserOption{WithRole("root"), Provisional(-time.Second)},
+				problems: []string{"name is empty", "email", "password must be", `role "root"`, "ttl must be positive"},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				user, err := NewUser(tt.user[0], tt.user[1], tt.user[2], tt.opts...)
+				assert.Nil(t, user)
+				assert.ErrorIs(t, err, ErrInvalidUser)
+
+				for _, problem := range tt.problems {
+					assert.ErrorContains(t, err, problem)
+				}
+			})
+		}
+	})
+
+	t.Run("CreateUser", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		ctx := context.Background()
+
+		user, err := NewUser("John", "John@Example.com", "Correct7Horse", WithRole(RoleGuest), Provisional(time.Hour))
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		created, err := repo.CreateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, "john@example.com", created.Email)
+		assert.Equal(t, RoleGuest, created.Role)
+		assert.NotNil(t, created.ExpiresAt)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(created.Password), []byte("Correct7Horse")))
+		assert.False(t, user.trusted(), "the hashed password should end the trust")
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		repo, _ := newImportRepo()
+
+		user, err := NewUser("John", "john@example.com", "Correct7Horse")
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		user.Email = "not an email"
+
+		_, err = repo.CreateUser(context.Background(), user)
+		assert.ErrorIs(t, err, ErrInvalidUser)
+	})
+
+	t.Run("PasswordPolicy", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		repo.passwordPolicy = &PasswordPolicy{MinLength: 12}
+
+		user, err := NewUser("John", "john@example.com", "Correct7Hrs")
+		if err != nil {
+			t.Fatalf("error building user: %s", err)
+		}
+
+		_, err = repo.CreateUser(context.Background(), user)
+		assert.ErrorIs(t, err, ErrWeakPassword)
+	})
+
+	t.Run("Literal", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		ctx := context.Background()
+
+		_, err := repo.CreateUser(ctx, &User{})
+		assert.ErrorIs(t, err, ErrInvalidUser)
+
+		created, err := repo.CreateUser(ctx, &User{Name: "John", Email: "John@Example.com", Password: "Correct7Horse"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		assert.Equal(t, "john@example.com", created.Email)
+		assert.Equal(t, RoleMember, created.Role)
+	})
+}
+
+func TestParseUserID(t *testing.T) {
+	want := MustParseUserID("65a1b2c3d4e5f60718293a4b")
+
+	tests := []struct {
+		name    string
+		input   string
+		problem string
+	}{
+		{name: "lowercase", input: "65a1b2c3d4e5f60718293a4b"},
+		{name: "uppercase", input: "65A1B2C3D4E5F60718293A4B"},
+		{name: "spaces", input: " 65a1b2c3d4e5f60718293a4b\n"},
+		{name: "empty", input: "", problem: "id is empty"},
+		{name: "blank", input: "   ", problem: "id is empty"},
+		{name: "short", input: "65a1b2c3", problem: `"65a1b2c3" is not 24 hex characters`},
+		{name: "long", input: "65a1b2c3d4e5f60718293a4b00", problem: "is not 24 hex characters"},
+		{name: "not hex", input: "65a1b2c3d4e5f60718293zzz", problem: `"65a1b2c3d4e5f60718293zzz" is not hex`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ParseUserID(tt.input)
+
+			if tt.problem == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, want, id)
+
+				return
+			}
+
+			assert.ErrorIs(t, err, ErrInvalidUserID)
+			assert.ErrorContains(t, err, tt.problem)
+			assert.Equal(t, primitive.NilObjectID, id)
+		})
+	}
+
+	assert.Panics(t, func() { MustParseUserID("nope") })
+}
+
+func TestMongoRepo_UserStats(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC)
+
+	t.Run("Empty", func(t *testing.T) {
+		repo := NewMockMongo()
+		repo.clock = NewFakeClock(now)
+
+		stats, err := repo.UserStats(ctx)
+		if err != nil {
+			t.Fatalf("error computing stats: %s", err)
+		}
+
+		assert.Zero(t, stats.Total)
+		assert.Zero(t, stats.SoftDeleted)
+		assert.Empty(t, stats.ByRole)
+
+		if len(stats.Signups) != 30 {
+			t.Fatalf("expected 30 days of signups, got %d", len(stats.Signups))
+		}
+
+		assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), stats.Signups[0].Day)
+		assert.Equal(t, time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), stats.Signups[29].Day)
+
+		for _, day := range stats.Signups {
+			assert.Zero(t, day.Count, day.Day)
+		}
+	})
+
+	t.Run("Distribution", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		clock := NewFakeClock(now)
+		repo.clock = clock
+
+		var ids []primitive.ObjectID
+
+		for i, seed := range []struct {
+			ago  time.Duration
+			role string
+		}{
+			{ago: 40 * 24 * time.Hour, role: RoleAdmin},
+			{ago: 29*24*time.Hour + 9*time.Hour, role: RoleMember},
+			{ago: 24 * time.Hour, role: RoleGuest},
+			{ago: time.Hour, role: RoleMember},
+			{ago: 0, role: RoleMember},
+		} {
+			clock.Set(now.Add(-seed.ago))
+
+			user, err := repo.CreateUser(ctx, &User{
+				Name:     fmt.Sprintf("User %d", i),
+				Email:    fmt.Sprintf("user%d@example.com", i),
+				Password: "Correct7Horse",
+				Role:     seed.role,
+			})
+			if err != nil {
+				t.Fatalf("error creating user %d: %s", i, err)
+			}
+
+			ids = append(ids, user.ID)
+		}
+
+		clock.Set(now)
+
+		err := repo.SoftDeleteUser(ctx, ids[2])
+		if err != nil {
+			t.Fatalf("error soft-deleting user: %s", err)
+		}
+
+		stats, err := repo.UserStats(ctx)
+		if err != nil {
+			t.Fatalf("error computing stats: %s", err)
+		}
+
+		assert.Equal(t, int64(5), stats.Total)
+		assert.Equal(t, int64(1), stats.SoftDeleted)
+		assert.Equal(t, map[string]int64{RoleAdmin: 1, RoleMember: 3, RoleGuest: 1}, stats.ByRole)
+
+		signups := make(map[string]int64)
+
+		var total int64
+
+		for _, day := range stats.Signups {
+			total += day.Count
+
+			if day.Count > 0 {
+				signups[day.Day.Format(time.DateOnly)] = day.Count
+			}
+		}
+
+		assert.Equal(t, map[string]int64{"2024-03-02": 1, "2024-03-30": 1, "2024-03-31": 2}, signups)
+		assert.Equal(t, int64(4), total, "the user created 40 days ago is out of the window")
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		repo := NewMockMongo()
+		mock := repo.mongoCaller.(*MockMongo)
+		mock.FailNext("Aggregate", transientError)
+
+		_, err := repo.UserStats(ctx)
+		assert.ErrorIs(t, err, ErrComputingStats)
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		repo := NewMockMongo()
+		assert.NoError(t, repo.Close(ctx))
+
+		_, err := repo.UserStats(ctx)
+		assert.ErrorIs(t, err, ErrRepoClosed)
+	})
+}
+
+func TestMongoRepo_IterateUsers(t *testing.T) {
+	ctx := context.Background()
+
+	// drain returns every user left in it, and the error which ended it.
+	drain := func(it UserIterator) ([]*User, error) {
+		var users []*User
+
+		for {
+			user, err := it.Next(ctx)
+			if err != nil {
+				return users, err
+			}
+
+			users = append(users, user)
+		}
+	}
+
+	t.Run("Full", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		seeded := SeedUsers(t, repo, 7)
+
+		it, err := repo.IterateUsers(ctx, UserFilter{}, WithBatchSize(2))
+		if err != nil {
+			t.Fatalf("error iterating users: %s", err)
+		}
+		defer it.Close()
+
+		users, err := drain(it)
+		assert.ErrorIs(t, err, io.EOF)
+		assert.NoError(t, it.Err())
+
+		if len(users) != len(seeded) {
+			t.Fatalf("expected %d users, got %d", len(seeded), len(users))
+		}
+
+		for i, user := range users {
+			assert.Equal(t, seeded[i].ID, user.ID)
+			assert.Empty(t, user.Password)
+		}
+
+		_, err = it.Next(ctx)
+		assert.ErrorIs(t, err, io.EOF, "Next should keep returning io.EOF")
+		assert.NoError(t, it.Close())
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		SeedUsers(t, repo, 6, WithSeedRole(RoleGuest))
+		SeedUsers(t, repo, 2, WithSeedEmailDomain("admins.example.com"), WithSeedRole(RoleAdmin))
+
+		it, err := repo.IterateUsers(ctx, UserFilter{Role: RoleAdmin}, SortBy("email", true), WithPassword())
+		if err != nil {
+			t.Fatalf("error iterating users: %s", err)
+		}
+		defer it.Close()
+
+		users, err := drain(it)
+		assert.ErrorIs(t, err, io.EOF)
+
+		if len(users) != 2 {
+			t.Fatalf("expected 2 users, got %d", len(users))
+		}
+
+		assert.Greater(t, users[0].Email, users[1].Email)
+		assert.NotEmpty(t, users[0].Password)
+	})
+
+	t.Run("Abandoned", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		SeedUsers(t, repo, 5)
+
+		it, err := repo.IterateUsers(ctx, UserFilter{})
+		if err != nil {
+			t.Fatalf("error iterating users: %s", err)
+		}
+
+		_, err = it.Next(ctx)
+		if err != nil {
+			t.Fatalf("error reading the first user: %s", err)
+		}
+
+		assert.NoError(t, it.Close())
+		assert.NoError(t, it.Close(), "Close should be idempotent")
+
+		_, err = it.Next(ctx)
+		assert.ErrorIs(t, err, ErrIteratorClosed)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		repo, _ := newImportRepo()
+		SeedUsers(t, repo, 5)
+
+		it, err := repo.IterateUsers(ctx, UserFilter{})
+		if err != nil {
+			t.Fatalf("error iterating users: %s", err)
+		}
+		defer it.Close()
+
+		ctx, cancel := context.WithCancel(ctx)
+
+		_, err = it.Next(ctx)
+		if err != nil {
+			t.Fatalf("error reading the first user: %s", err)
+		}
+
+		cancel()
+
+		_, err = it.Next(ctx)
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.ErrorIs(t, it.Err(), ErrOperationCanceled)
+
+		// The iteration is over even with a live context.
+		_, err = it.Next(context.Background())
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.NoError(t, it.Close())
+	})
+
+	t.Run("DecodeError", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		seeded := SeedUsers(t, repo, 4)
+		mock.CorruptUser(seeded[2].ID)
+
+		it, err := repo.IterateUsers(ctx, UserFilter{})
+		if err != nil {
+			t.Fatalf("error iterating users: %s", err)
+		}
+
+		users, err := drain(it)
+		assert.Len(t, users, 2, "the users before the corrupt one should be returned")
+		assert.ErrorIs(t, err, ErrListingUsers)
+		assert.Equal(t, err, it.Err())
+		assert.NoError(t, it.Close())
+	})
+
+	t.Run("FindError", func(t *testing.T) {
+		repo, mock := newImportRepo()
+		mock.FailNext("Find", transientError)
+
+		it, err := repo.IterateUsers(ctx, UserFilter{})
+		assert.Nil(t, it)
+		assert.ErrorIs(t, err, ErrListingUsers)
+		assert.True(t, IsRetryable(err))
+	})
+}
+
+func TestPageTokens(t *testing.T) {
+	tokens, err := NewPageTokens([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("error creating page tokens: %s", err)
+	}
+
+	id := primitive.NewObjectID()
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		cursor, err := tokens.DecodePageToken(tokens.EncodePageToken(id, idSort, nil), idSort)
+		if err != nil {
+			t.Fatalf("error decoding page token: %s", err)
+		}
+
+		assert.Equal(t, PageCursor{LastID: id, SortField: idSort}, cursor)
+
+		cursor, err = tokens.DecodePageToken(tokens.EncodePageToken(id, "name", "John"), "name")
+		if err != nil {
+			t.Fatalf("error decoding page token: %s", err)
+		}
+
+		assert.Equal(t, PageCursor{LastID: id, SortField: "name", LastValue: "John"}, cursor)
+
+		cursor, err = tokens.DecodePageToken(tokens.EncodePageToken(id, "created_at", created), "created_at")
+		if err != nil {
+			t.Fatalf("error decoding page token: %s", err)
+		}
+
+		assert.Equal(t, primitive.NewDateTimeFromTime(created), cursor.LastValue)
+	})
+
+	t.Run("URLSafe", func(t *testing.T) {
+		token := tokens.EncodePageToken(id, "name", strings.Repeat("?&/+=", 10))
+		assert.Equal(t, token, url.QueryEscape(token))
+	})
+
+	token := tokens.EncodePageToken(id, "name", "John")
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("error decoding page token: %s", err)
+	}
+
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)/2] ^= 0xff
+
+	wrongVersion := append([]byte(nil), raw...)
+	wrongVersion[0] = pageTokenVersion + 1
+
+	other, err := NewPageTokens([]byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("error creating page tokens: %s", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		sort  string
+	}{
+		{"Tampered", base64.RawURLEncoding.EncodeToString(tampered), "name"},
+		{"Truncated", token[:len(token)-4], "name"},
+		{"Empty", "", "name"},
+		{"WrongVersion", base64.RawURLEncoding.EncodeToString(wrongVersion), "name"},
+		{"NotBase64", "not a token!", "name"},
+		{"OtherSortOrder", token, "created_at"},
+		{"OtherKey", other.EncodePageToken(id, "name", "John"), "name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := tokens.DecodePageToken(test.token, test.sort)
+			assert.ErrorIs(t, err, ErrInvalidPageToken)
+		})
+	}
+
+	t.Run("ShortKey", func(t *testing.T) {
+		_, err := NewPageTokens([]byte("short"))
+		assert.ErrorIs(t, err, ErrInvalidOption)
+	})
+}
+
+func TestMongoRepo_ListUsersPage(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	want := SeedUsers(t, repo, 5)
+
+	var (
+		listed []*User
+		token  string
+		pages  int
+	)
+
+	for {
+		page, next, err := repo.ListUsersPage(ctx, token, 2, WithPassword())
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		listed = append(listed, page...)
+		pages++
+
+		if next == "" {
+			break
+		}
+
+		// The token doesn't give away the ID it resumes from.
+		assert.NotContains(t, next, page[len(page)-1].ID.Hex())
+
+		token = next
+	}
+
+	assert.Equal(t, want, listed)
+	assert.Equal(t, 3, pages)
+
+	_, _, err := NewMockMongo().ListUsersPage(ctx, token, 2)
+	assert.ErrorIs(t, err, ErrInvalidPageToken, "a token of another repo is rejected")
+}
+
+func TestUserHandler_PageToken(t *testing.T) {
+	repo := NewMockMongo()
+	want := SeedUsers(t, repo, 3)
+
+	var (
+		listed []string
+		token  string
+	)
+
+	for {
+		recorder := serveUsers(t, repo, http.MethodGet, "/users?limit=2&page_token="+token, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var page listUsersResponse
+
+		err := json.Unmarshal(recorder.Body.Bytes(), &page)
+		if err != nil {
+			t.Fatalf("error decoding response: %s", err)
+		}
+
+		for _, user := range page.Users {
+			listed = append(listed, user.ID)
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+
+		token = page.NextPageToken
+	}
+
+	wantIDs := make([]string, 0, len(want))
+	for _, user := range want {
+		wantIDs = append(wantIDs, user.ID.Hex())
+	}
+
+	assert.Equal(t, wantIDs, listed)
+
+	// The legacy offset pagination answers no token.
+	recorder := serveUsers(t, repo, http.MethodGet, "/users?limit=1&offset=1", "")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "next_page_token")
+}
+
+func TestMongoRepo_Tenants(t *testing.T) {
+	ctx := context.Background()
+
+	var resolved []string
+
+	resolver := func(tenantID string) (TenantNamespace, error) {
+		resolved = append(resolved, tenantID)
+		return CollectionPerTenant("users")(tenantID)
+	}
+
+	repo, mock := NewTenantMockMongo(resolver, WithUniqueEmail())
+
+	acme, globex := WithTenant(ctx, "acme"), WithTenant(ctx, "globex")
+
+	acmeUser, err := repo.CreateUser(acme, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	globexUser, err := repo.CreateUser(globex, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating the same email under another tenant: %s", err)
+	}
+
+	_, err = repo.CreateUser(acme, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	t.Run("ReadsStayWithinTheTenant", func(t *testing.T) {
+		got, err := repo.GetUserByEmail(acme, "john@example.com")
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, acmeUser.ID, got.ID)
+
+		got, err = repo.GetUserByEmail(globex, "john@example.com")
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, globexUser.ID, got.ID)
+
+		_, err = repo.GetUserByID(globex, acmeUser.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = repo.GetUserByID(WithTenant(ctx, "initech"), acmeUser.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		users, err := repo.ListUsers(acme, 10, 0)
+		if err != nil {
+			t.Fatalf("error listing users: %s", err)
+		}
+
+		if assert.Len(t, users, 1) {
+			assert.Equal(t, acmeUser.ID, users[0].ID)
+		}
+
+		got, err = repo.GetUserByID(acme, acmeUser.ID, UsingReadPreference(readpref.Secondary()))
+		if err != nil {
+			t.Fatalf("error getting user from a secondary: %s", err)
+		}
+
+		assert.Equal(t, acmeUser.ID, got.ID)
+	})
+
+	t.Run("WritesStayWithinTheTenant", func(t *testing.T) {
+		err := repo.DeleteUser(globex, acmeUser.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		assert.Len(t, mock.Namespace(TenantNamespace{Collection: "users_acme"}).Users(), 1)
+		assert.Len(t, mock.Namespace(TenantNamespace{Collection: "users_globex"}).Users(), 1)
+		assert.Empty(t, mock.Users(), "no user is stored outside of a tenant")
+	})
+
+	t.Run("MissingTenant", func(t *testing.T) {
+		_, err := repo.GetUserByID(ctx, acmeUser.ID)
+		assert.ErrorIs(t, err, ErrMissingTenant)
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Jane", Email: "jane@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrMissingTenant)
+
+		err = repo.EnsureIndexes(ctx)
+		assert.ErrorIs(t, err, ErrMissingTenant)
+	})
+
+	t.Run("InvalidTenant", func(t *testing.T) {
+		for _, tenantID := range []string{"acme.system", "$cmd", strings.Repeat("a", maxTenantIDLen+1)} {
+			_, err := repo.GetUserByID(WithTenant(ctx, tenantID), acmeUser.ID)
+			assert.ErrorIs(t, err, ErrInvalidTenant, tenantID)
+		}
+	})
+
+	// The tenants are resolved once, the rejected ones on each call.
+	assert.Equal(t, []string{"acme", "globex", "initech"}, resolved[:3])
+	assert.Len(t, resolved, 6)
+}
+
+func TestMongoRepo_EnsureTenantIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	repo, _ := NewTenantMockMongo(DatabasePerTenant("tenant"))
+
+	err := repo.EnsureTenantIndexes(ctx, "acme")
+	if err != nil {
+		t.Fatalf("error creating indexes: %s", err)
+	}
+
+	for _, tenantID := range []string{"acme", "globex"} {
+		tenant := WithTenant(ctx, tenantID)
+
+		_, err := repo.CreateUser(tenant, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		_, err = repo.CreateUser(tenant, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+		if tenantID == "acme" {
+			assert.ErrorIs(t, err, ErrUserAlreadyExists, "acme has the unique index on email")
+		} else {
+			assert.NoError(t, err, "globex has no index yet")
+		}
+	}
+}
+
+func TestTenantResolvers(t *testing.T) {
+	ns, err := CollectionPerTenant("users")("acme-1")
+	if err != nil {
+		t.Fatalf("error resolving tenant: %s", err)
+	}
+
+	assert.Equal(t, TenantNamespace{Collection: "users_acme-1"}, ns)
+
+	ns, err = DatabasePerTenant("tenant")("acme_1")
+	if err != nil {
+		t.Fatalf("error resolving tenant: %s", err)
+	}
+
+	assert.Equal(t, TenantNamespace{Database: "tenant_acme_1"}, ns)
+
+	for _, tenantID := range []string{"a.b", "a/b", "a b", "é", strings.Repeat("a", maxTenantIDLen+1)} {
+		_, err := CollectionPerTenant("users")(tenantID)
+		assert.Error(t, err, tenantID)
+	}
+}
+
+func TestMongoRepo_EmailCollation(t *testing.T) {
+	ctx := context.Background()
+
+	// newRepo returns a repo storing a user written before emails were
+	// normalized.
+	newRepo := func(t *testing.T, collation *options.Collation) (*MongoRepo, primitive.ObjectID) {
+		repo := NewMockMongo()
+		repo.collation = collation
+
+		legacy := &userDocument{ID: primitive.NewObjectID(), Name: "John", Email: "John@Example.com", Role: RoleMember}
+
+		_, err := repo.mongoCaller.InsertOne(ctx, legacy)
+		if err != nil {
+			t.Fatalf("error inserting user: %s", err)
+		}
+
+		err = repo.EnsureIndexes(ctx)
+		if err != nil {
+			t.Fatalf("error creating indexes: %s", err)
+		}
+
+		return repo, legacy.ID
+	}
+
+	t.Run("Lookup", func(t *testing.T) {
+		repo, id := newRepo(t, caseInsensitiveCollation)
+
+		user, err := repo.GetUserByEmail(ctx, "john@example.com")
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.Equal(t, id, user.ID)
+		assert.Equal(t, "John@Example.com", user.Email)
+
+		exists, err := repo.UserExistsByEmail(ctx, "JOHN@example.com")
+		if err != nil {
+			t.Fatalf("error checking user: %s", err)
+		}
+
+		assert.True(t, exists)
+
+		users, err := repo.FindUsers(ctx, UserFilter{Email: "john@example.com"})
+		if err != nil {
+			t.Fatalf("error finding users: %s", err)
+		}
+
+		assert.Len(t, users, 1)
+
+		count, err := repo.CountUsersMatching(ctx, UserFilter{Email: "john@example.com"})
+		if err != nil {
+			t.Fatalf("error counting users: %s", err)
+		}
+
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		repo, _ := newRepo(t, caseInsensitiveCollation)
+
+		_, err := repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+		assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+		created, err := repo.UpsertUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error upserting user: %s", err)
+		}
+
+		assert.False(t, created, "the legacy user is updated")
+		assert.Len(t, repo.mongoCaller.(*MockMongo).Users(), 1)
+	})
+
+	t.Run("WithoutCollation", func(t *testing.T) {
+		repo, _ := newRepo(t, nil)
+
+		_, err := repo.GetUserByEmail(ctx, "john@example.com")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+		assert.NoError(t, err, "emails differing by case only are distinct")
+	})
+
+	t.Run("Option", func(t *testing.T) {
+		fake := &fakeConnect{}
+
+		repo, err := NewMongoRepo(ctx, "mongodb://localhost:27017", fake.option(), WithSkipPing(), WithEmailCollation())
+		if err != nil {
+			t.Fatalf("error creating repo: %s", err)
+		}
+
+		assert.Equal(t, caseInsensitiveCollation, repo.emailCollation(true))
+		assert.Nil(t, repo.emailCollation(false))
+
+		repo.fields, err = newFieldEncryption(make([]byte, 32), nil, nil)
+		if err != nil {
+			t.Fatalf("error creating field encryption: %s", err)
+		}
+
+		assert.Nil(t, repo.emailCollation(true), "email hashes need no collation")
+	})
+}
+
+func TestMongoRepo_EmailVerification(t *testing.T) {
+	ctx := context.Background()
+
+	newRepo := func(t *testing.T) (*MongoRepo, *MockTokenStore, *FakeClock, *User) {
+		repo := NewMockMongo()
+		tokens := NewMockTokenStore()
+		repo.tokens = tokens
+		clock := NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+		repo.clock = clock
+
+		return repo, tokens, clock, SeedUsers(t, repo, 1)[0]
+	}
+
+	t.Run("Confirm", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		assert.NotEmpty(t, token)
+		assert.Equal(t, []string{hashToken(token)}, tokens.IDs())
+		assert.NotContains(t, tokens.IDs(), token)
+
+		_, err = repo.GetUserByEmail(ctx, user.Email, VerifiedOnly())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		assert.Zero(t, tokens.Len())
+
+		verified, err := repo.GetUserByEmail(ctx, user.Email, VerifiedOnly())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.True(t, verified.EmailVerified)
+		assert.Equal(t, user.Version+1, verified.Version)
+
+		_, err = repo.StartEmailVerification(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrEmailAlreadyVerified)
+	})
+
+	t.Run("Reuse", func(t *testing.T) {
+		repo, _, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+
+		err = repo.ConfirmEmailVerification(ctx, "")
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		first, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		second, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error restarting verification: %s", err)
+		}
+
+		assert.NotEqual(t, first, second)
+		assert.Equal(t, 1, tokens.Len())
+
+		err = repo.ConfirmEmailVerification(ctx, first)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+
+		err = repo.ConfirmEmailVerification(ctx, second)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		repo, _, clock, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		clock.Advance(defaultVerificationTokenTTL)
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrTokenExpired)
+
+		stored, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.False(t, stored.EmailVerified)
+	})
+
+	t.Run("FailedUpdate", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		repo.mongoCaller.(*MockMongo).FailNext("UpdateOne", errors.New("connection reset"))
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrVerifyingEmail)
+		assert.Equal(t, 1, tokens.Len(), "a failed confirm keeps the token")
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification again: %s", err)
+		}
+
+		assert.Zero(t, tokens.Len())
+
+		stored, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.True(t, stored.EmailVerified)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		repo, _, clock, user := newRepo(t)
+		repo.verificationTokenTTL = time.Hour
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		clock.Advance(time.Hour - time.Millisecond)
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("DeletedUser", func(t *testing.T) {
+		repo, _, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.SoftDeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error deleting user: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = repo.StartEmailVerification(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+
+		_, err = repo.StartEmailVerification(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("ChangedEmail", func(t *testing.T) {
+		repo, _, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		changed, err := repo.ChangeUserEmail(ctx, user.ID, "johnny@example.com")
+		if err != nil {
+			t.Fatalf("error changing email: %s", err)
+		}
+
+		assert.False(t, changed.EmailVerified)
+	})
+
+	t.Run("ChangedEmailRevokes", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		_, err = repo.ChangeUserEmail(ctx, user.ID, "johnny@example.com")
+		if err != nil {
+			t.Fatalf("error changing email: %s", err)
+		}
+
+		assert.Zero(t, tokens.Len())
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+	})
+
+	t.Run("UpdatedEmail", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		token, err = repo.StartEmailVerification(ctx, SeedUsers(t, repo, 1)[0].ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"email": "johnny@example.com"})
+		if err != nil {
+			t.Fatalf("error updating email: %s", err)
+		}
+
+		stored, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.False(t, stored.EmailVerified)
+		assert.Equal(t, 1, tokens.Len(), "the tokens of other users are kept")
+
+		other, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.UpdateUserFields(ctx, user.ID, map[string]interface{}{"email": "john.doe@example.com"})
+		if err != nil {
+			t.Fatalf("error updating email: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, other)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("BoundToEmail", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		// UpdateUser replaces the document, leaving the token in place.
+		user.Email = "johnny@example.com"
+
+		err = repo.UpdateUser(ctx, user)
+		if err != nil {
+			t.Fatalf("error updating user: %s", err)
+		}
+
+		assert.Equal(t, 1, tokens.Len())
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+
+		stored, err := repo.GetUserByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.False(t, stored.EmailVerified)
+	})
+
+	t.Run("EncryptedEmail", func(t *testing.T) {
+		repo := newEncryptedRepo(t, NewMockMongo().mongoCaller.(*MockMongo), make([]byte, 32))
+		tokens := NewMockTokenStore()
+		repo.tokens = tokens
+		user := SeedUsers(t, repo, 1)[0]
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		verified, err := repo.GetUserByEmail(ctx, user.Email, VerifiedOnly())
+		if err != nil {
+			t.Fatalf("error getting user: %s", err)
+		}
+
+		assert.True(t, verified.EmailVerified)
+	})
+
+	t.Run("Audited", func(t *testing.T) {
+		repo, _, _, user := newRepo(t)
+		log := NewMockAuditLog()
+		repo.auditLog = log
+
+		token, err := repo.StartEmailVerification(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		if err != nil {
+			t.Fatalf("error confirming verification: %s", err)
+		}
+
+		entries := log.Entries()
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 audit entry, got %d", len(entries))
+		}
+
+		assert.Equal(t, "ConfirmEmailVerification", entries[0].Operation)
+		assert.Equal(t, user.ID, entries[0].UserID)
+	})
+
+	t.Run("Tenants", func(t *testing.T) {
+		repo, _ := NewTenantMockMongo(CollectionPerTenant("users"))
+		tokens := NewMockTokenStore()
+		repo.tokens = tokens
+
+		acme, globex := WithTenant(ctx, "acme"), WithTenant(ctx, "globex")
+
+		user, err := repo.CreateUser(acme, &User{Name: "John", Email: "john@example.com", Password: "password"})
+		if err != nil {
+			t.Fatalf("error creating user: %s", err)
+		}
+
+		token, err := repo.StartEmailVerification(acme, user.ID)
+		if err != nil {
+			t.Fatalf("error starting verification: %s", err)
+		}
+
+		err = repo.ConfirmEmailVerification(globex, token)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+
+		err = repo.ConfirmEmailVerification(ctx, token)
+		assert.ErrorIs(t, err, ErrTokenInvalid)
+		assert.Equal(t, 1, tokens.Len())
+
+		err = repo.ConfirmEmailVerification(acme, token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Indexes", func(t *testing.T) {
+		repo := NewMockMongo()
+		tokens := NewMockTokenStore()
+		repo.tokens = tokens
+		repo.tokenIndexes = tokens
+
+		err := repo.EnsureIndexes(ctx)
+		if err != nil {
+			t.Fatalf("error creating indexes: %s", err)
+		}
+
+		assert.Equal(t, []string{"expires_at_1", "user_id_1"}, tokens.Indexes())
+		assert.Equal(t, int32(0), *tokenIndexModels()[0].Options.ExpireAfterSeconds)
+	})
+
+	t.Run("NoTokens", func(t *testing.T) {
+		repo := NewMockMongo()
+		user := SeedUsers(t, repo, 1)[0]
+
+		_, err := repo.StartEmailVerification(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrStartingVerification)
+
+		err = repo.ConfirmEmailVerification(ctx, "token")
+		assert.ErrorIs(t, err, ErrVerifyingEmail)
+	})
+
+	t.Run("TokenStoreError", func(t *testing.T) {
+		repo, tokens, _, user := newRepo(t)
+		tokens.FailWith(errors.New("connection reset"))
+
+		_, err := repo.StartEmailVerification(ctx, user.ID)
+		assert.ErrorIs(t, err, ErrStartingVerification)
+
+		err = repo.ConfirmEmailVerification(ctx, "token")
+		assert.ErrorIs(t, err, ErrVerifyingEmail)
+	})
+}
+
+func TestMongoRepo_CloseWithoutClient(t *testing.T) {
+	repo := &MongoRepo{}
+
+	err := repo.Close(context.Background())
+	assert.NoError(t, err)
+
+	_, err = repo.CountUsers(context.Background())
+	assert.ErrorIs(t, err, ErrRepoClosed)
+}
+
+func TestNewMongoRepoFromClient(t *testing.T) {
+	ctx := context.Background()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+
+	fake := &fakeConnect{}
+
+	owned, err := NewMongoRepo(ctx, "mongodb://localhost:27017", fake.option(), WithSkipPing(),
+		WithDatabase("app"), WithCollection("accounts"))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	injected, err := NewMongoRepoFromClient(client, WithDatabase("app"), WithCollection("accounts"))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	ownedCollection := owned.mongoCaller.(*reconnectingCaller).caller.(*mongo.Collection)
+	injectedCollection := injected.mongoCaller.(*reconnectingCaller).caller.(*mongo.Collection)
+	assert.Equal(t, ownedCollection.Database().Name(), injectedCollection.Database().Name())
+	assert.Equal(t, ownedCollection.Name(), injectedCollection.Name())
+	assert.Same(t, client, injectedCollection.Database().Client())
+
+	assert.NoError(t, owned.Close(ctx))
+	assert.ErrorIs(t, ownedCollection.Database().Client().Disconnect(ctx), mongo.ErrClientDisconnected)
+
+	assert.NoError(t, injected.Close(ctx))
+	assert.Equal(t, StatusClosed, injected.Status())
+	assert.NoError(t, client.Disconnect(ctx), "an injected client must be left connected")
+}
+
+func TestNewMongoRepoFromClient_InvalidOption(t *testing.T) {
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	_, err = NewMongoRepoFromClient(client, WithDatabase(""))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+
+	_, err = NewMongoRepoFromClient(client, WithClock(nil))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+
+	_, err = NewMongoRepoFromClient(client, WithIDGenerator(nil))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+func TestNewMongoRepoFromCollection(t *testing.T) {
+	ctx := context.Background()
+
+	// scenario runs the same calls on a repo and returns what they gave.
+	scenario := func(repo *MongoRepo) []interface{} {
+		var results []interface{}
+
+		_, err := repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "John", Email: "john@example.com",
+			Password: "password"})
+		results = append(results, err)
+
+		_, err = repo.CreateUser(ctx, &User{ID: primitive.NewObjectID(), Name: "Johnny", Email: "john@example.com",
+			Password: "password"})
+		results = append(results, errors.Is(err, ErrUserAlreadyExists))
+
+		user, err := repo.GetUserByEmail(ctx, "john@example.com")
+		results = append(results, err, user != nil && user.Name == "John")
+
+		count, err := repo.CountUsers(ctx)
+		results = append(results, count, err)
+
+		_, err = repo.GetUserByID(ctx, primitive.NewObjectID())
+		results = append(results, errors.Is(err, ErrUserNotFound))
+
+		return results
+	}
+
+	mock := &MockMongo{users: make(map[primitive.ObjectID]userDocument)}
+	repo := NewMongoRepoFromCollection(mock)
+	repo.bcryptCost = bcrypt.MinCost
+
+	assert.Equal(t, scenario(NewMockMongo()), scenario(repo))
+
+	assert.NoError(t, repo.Close(ctx))
+	assert.Zero(t, mock.disconnects, "Close must not disconnect an injected collection")
+}
+
+func TestNewMongoRepoFromCollection_WithoutIndexes(t *testing.T) {
+	repo := NewMongoRepoFromCollection(&retryingCaller{})
+
+	err := repo.EnsureIndexes(context.Background())
+	assert.ErrorIs(t, err, ErrCreatingIndexes)
+}
+
+// newRetryingMock returns a mock repo retrying up to maxAttempts times. The
+// delays it would have waited are recorded instead of slept.
+func newRetryingMock(maxAttempts int) (*MongoRepo, *MockMongo, *[]time.Duration) {
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	var delays []time.Duration
+
+	retrying := newRetryingCaller(mock, maxAttempts, 10*time.Millisecond)
+	retrying.jitter = func(d time.Duration) time.Duration { return d }
+	retrying.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return ctx.Err()
+	}
+
+	repo.mongoCaller = retrying
+
+	return repo, mock, &delays
+}
+
+func TestRetryingCaller_RecoversFromTransientErrors(t *testing.T) {
+	ctx := context.Background()
+
+	repo, mock, delays := newRetryingMock(3)
+	mock.transientFailures = 2
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Equal(t, 3, mock.calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, *delays)
+
+	mock.transientFailures = 1
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.NoError(t, err)
+}
+
+func TestRetryingCaller_GivesUp(t *testing.T) {
+	repo, mock, delays := newRetryingMock(3)
+	mock.transientFailures = 5
+
+	_, err := repo.CountUsers(context.Background())
+	assert.ErrorIs(t, err, ErrCountingUsers)
+	assert.Equal(t, 3, mock.calls)
+	assert.Len(t, *delays, 2)
+}
+
+func TestRetryingCaller_DoesNotRetryPermanentErrors(t *testing.T) {
+	ctx := context.Background()
+
+	repo, mock, delays := newRetryingMock(3)
+
+	err := repo.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("error ensuring indexes: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.CreateUser(ctx, &User{Name: "Johnny", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+	assert.Equal(t, 2, mock.calls)
+	assert.Empty(t, *delays)
+}
+
+func TestRetryingCaller_StopsOnCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo, mock, delays := newRetryingMock(3)
+	mock.transientFailures = 5
+
+	// The caller gives up while the first retry is waiting.
+	retrying := repo.mongoCaller.(*retryingCaller)
+	sleep := retrying.sleep
+	retrying.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return sleep(ctx, d)
+	}
+
+	_, err := repo.CountUsers(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, err, ErrOperationCanceled)
+	assert.ErrorContains(t, err, transientError.Message, "the last error is kept")
+	assert.Equal(t, 1, mock.calls)
+	assert.Len(t, *delays, 1)
+}
+
+func TestRetryingCaller_DoesNotRetryInTransactions(t *testing.T) {
+	repo, mock, delays := newRetryingMock(3)
+	mock.transientFailures = 1
+
+	ctx := mongo.NewSessionContext(context.Background(), &fakeSession{})
+
+	_, err := repo.CountUsers(ctx)
+	assert.ErrorIs(t, err, ErrCountingUsers)
+	assert.Equal(t, 1, mock.calls)
+	assert.Empty(t, *delays)
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+
+	err := sleepContext(ctx, time.Hour)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestIsRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "network", err: transientError, want: true},
+		{name: "host unreachable", err: mongo.CommandError{Code: 6, Name: "HostUnreachable"}, want: true},
+		{name: "host not found", err: mongo.CommandError{Code: 7, Name: "HostNotFound"}, want: true},
+		{name: "network timeout", err: mongo.CommandError{Code: 89, Name: "NetworkTimeout"}, want: true},
+		{name: "shutdown", err: mongo.CommandError{Code: 91, Name: "ShutdownInProgress"}, want: true},
+		{name: "stepped down", err: mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}, want: true},
+		{name: "not master", err: mongo.CommandError{Code: 10107, Message: "not master"}, want: true},
+		{name: "interrupted at shutdown", err: mongo.CommandError{Code: 11600}, want: true},
+		{name: "repl state change", err: mongo.CommandError{Code: 11602}, want: true},
+		{name: "not primary no secondary ok", err: mongo.CommandError{Code: 13435}, want: true},
+		{name: "not primary or secondary", err: mongo.CommandError{Code: 13436}, want: true},
+		{name: "retryable write label", err: mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}, want: true},
+		{
+			name: "not primary write error",
+			err:  mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 10107, Message: "not primary"}}},
+			want: true,
+		},
+		{name: "dial", err: dialErr, want: true},
+		{name: "wrapped dial", err: fmt.Errorf("connect: %w", dialErr), want: true},
+		{name: "server selection", err: topology.ServerSelectionError{Wrapped: topology.ErrServerSelectionTimeout}, want: true},
+		{name: "server selection timeout", err: fmt.Errorf("find: %w", topology.ErrServerSelectionTimeout), want: true},
+		{name: "unavailable", err: fmt.Errorf("%w: ping failed", ErrTemporarilyUnavailable), want: true},
+		{name: "repo network error", err: driverError(ErrFindingUser, transientError), want: true},
+		{name: "duplicate key", err: duplicateKeyError(0, "email_1"), want: false},
+		{name: "validation", err: mongo.CommandError{Code: 121, Message: "Document failed validation"}, want: false},
+		{name: "unauthorized", err: mongo.CommandError{Code: 13, Name: "Unauthorized"}, want: false},
+		{name: "invalid user", err: fmt.Errorf("%w: name is empty", ErrInvalidUser), want: false},
+		{
+			name: "already exists",
+			err:  alreadyExistsError(primitive.NewObjectID(), "john@example.com", duplicateKeyError(0, "email_1")),
+			want: false,
+		},
+		{name: "not found", err: fmt.Errorf("%w: john@example.com", ErrUserNotFound), want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "repo canceled", err: driverError(ErrFindingUser, context.Canceled), want: false},
+		{name: "deadline", err: fmt.Errorf("find: %w", context.DeadlineExceeded), want: false},
+		{name: "other", err: errors.New("boom"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRetryable(tt.err))
+		})
+	}
+}
+
+func TestNewMongoRepo_WithRetries(t *testing.T) {
+	fake := &fakeConnect{}
+
+	repo, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017",
+		fake.option(), WithSkipPing(), WithRetries(4, time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	retrying, ok := repo.mongoCaller.(*retryingCaller)
+	if assert.True(t, ok) {
+		assert.Equal(t, 4, retrying.maxAttempts)
+		assert.Equal(t, time.Millisecond, retrying.baseDelay)
+	}
+
+	_, err = NewMongoRepo(context.Background(), "mongodb://localhost:27017", fake.option(), WithRetries(-1, 0))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+func TestMongoRepo_OperationTimeout(t *testing.T) {
+	repo := NewMockMongo()
+	repo.operationTimeout = 20 * time.Millisecond
+	repo.mongoCaller.(*MockMongo).delay = time.Hour
+
+	start := time.Now()
+
+	_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrOperationTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, ErrInsertingUser)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestMongoRepo_CanceledContext(t *testing.T) {
+	user := func() *User { return &User{Name: "John", Email: "john@example.com", Password: "password"} }
+
+	t.Run("before the call", func(t *testing.T) {
+		repo := NewMockMongo()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := repo.CreateUser(ctx, user())
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NotErrorIs(t, err, ErrInsertingUser)
+
+		_, err = repo.GetUserByEmail(ctx, "john@example.com")
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.NotErrorIs(t, err, ErrFindingUser)
+	})
+
+	t.Run("during the call", func(t *testing.T) {
+		repo := NewMockMongo()
+		repo.mongoCaller.(*MockMongo).delay = time.Hour
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		_, err := repo.CreateUser(ctx, user())
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.NotErrorIs(t, err, ErrOperationTimeout)
+	})
+
+	t.Run("deadline before the call", func(t *testing.T) {
+		repo := NewMockMongo()
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		_, err := repo.CreateUser(ctx, user())
+		assert.ErrorIs(t, err, ErrOperationTimeout)
+		assert.NotErrorIs(t, err, ErrOperationCanceled)
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		repo, mock, _ := newRetryingMock(3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := repo.CountUsers(ctx)
+		assert.ErrorIs(t, err, ErrOperationCanceled)
+		assert.Equal(t, 1, mock.calls)
+	})
+}
+
+func TestMongoRepo_OperationTimeout_CallerDeadline(t *testing.T) {
+	t.Run("shorter than the default", func(t *testing.T) {
+		repo := NewMockMongo()
+		repo.operationTimeout = time.Hour
+		repo.mongoCaller.(*MockMongo).delay = time.Hour
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+
+		_, err := repo.CountUsers(ctx)
+		assert.ErrorIs(t, err, ErrOperationTimeout)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("longer than the default", func(t *testing.T) {
+		repo := NewMockMongo()
+		repo.operationTimeout = 10 * time.Millisecond
+		repo.mongoCaller.(*MockMongo).delay = 50 * time.Millisecond
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		_, err := repo.CountUsers(ctx)
+		assert.NoError(t, err)
+	})
+}
+
+func TestNewMongoRepo_WithOperationTimeout(t *testing.T) {
+	fake := &fakeConnect{}
+
+	repo, err := NewMongoRepo(context.Background(), "mongodb://localhost:27017",
+		fake.option(), WithSkipPing(), WithOperationTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("error creating repo: %s", err)
+	}
+
+	assert.Equal(t, time.Second, repo.operationTimeout)
+
+	_, err = NewMongoRepo(context.Background(), "mongodb://localhost:27017",
+		fake.option(), WithOperationTimeout(-time.Second))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+func TestRepoOptions_WriteConcern(t *testing.T) {
+	wc := writeconcern.Majority()
+
+	assert.Nil(t, newRepoOptions(nil).collectionOptions().WriteConcern)
+	assert.Equal(t, wc, newRepoOptions([]Option{WithWriteConcern(wc)}).collectionOptions().WriteConcern)
+}
+
+func TestMongoRepo_UsingWriteConcern(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Nil(t, mock.writeConcern)
+
+	wc := writeconcern.Unacknowledged()
+
+	user.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, user, UsingWriteConcern(wc))
+	if err != nil {
+		t.Fatalf("error updating user: %s", err)
+	}
+
+	assert.Equal(t, wc, mock.writeConcern)
+
+	// The override also goes through the retry decorator.
+	retrying := newRetryingCaller(mock, 2, time.Millisecond)
+	repo.mongoCaller = retrying
+
+	caller, err := repo.writeCaller([]WriteOption{UsingWriteConcern(writeconcern.Majority())})
+	if err != nil {
+		t.Fatalf("error getting caller: %s", err)
+	}
+
+	assert.Equal(t, mock, caller.(*retryingCaller).caller)
+	assert.Equal(t, writeconcern.Majority(), mock.writeConcern)
+}
+
+func TestRepoOptions_ReadPreference(t *testing.T) {
+	rp := readpref.SecondaryPreferred()
+
+	assert.Nil(t, newRepoOptions(nil).collectionOptions().ReadPreference)
+	assert.Equal(t, rp, newRepoOptions([]Option{WithReadPreference(rp)}).collectionOptions().ReadPreference)
+}
+
+func TestMongoRepo_UsingReadPreference(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.readPref = readpref.Secondary()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	// Without override the collection read preference applies.
+	assert.Nil(t, mock.readPreference)
+
+	_, err = repo.GetUserByID(ctx, user.ID, UsingReadPreference(readpref.Nearest()))
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, readpref.NearestMode, mock.readPreference.Mode())
+
+	_, err = repo.ListUsers(ctx, 10, 0, UsingReadPreference(readpref.SecondaryPreferred()))
+	if err != nil {
+		t.Fatalf("error listing users: %s", err)
+	}
+
+	assert.Equal(t, readpref.SecondaryPreferredMode, mock.readPreference.Mode())
+
+	_, err = repo.FindUsers(ctx, UserFilter{Name: "John"}, UsingReadPreference(readpref.PrimaryPreferred()))
+	if err != nil {
+		t.Fatalf("error finding users: %s", err)
+	}
+
+	assert.Equal(t, readpref.PrimaryPreferredMode, mock.readPreference.Mode())
+}
+
+func TestMongoRepo_GetUserByEmail_ReadsPrimary(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.readPref = readpref.Secondary()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com")
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, readpref.PrimaryMode, mock.readPreference.Mode())
+
+	_, err = repo.GetUserByEmail(ctx, "john@example.com", UsingReadPreference(readpref.Secondary()))
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, readpref.SecondaryMode, mock.readPreference.Mode())
+}
+
+func TestMongoRepo_UsingWriteConcern_Unsupported(t *testing.T) {
+	repo := NewMockMongo()
+	repo.mongoCaller = struct{ MongoCaller }{repo.mongoCaller}
+
+	_, err := repo.CreateUser(context.Background(), &User{Name: "John", Email: "john@example.com", Password: "password"},
+		UsingWriteConcern(writeconcern.Majority()))
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
+
+func TestMongoRepo_WriteConcernError(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+
+	user := &User{Name: "John", Email: emailWitchTriggersWriteConcernError, Password: "password"}
+
+	_, err := repo.CreateUser(ctx, user)
+	assert.ErrorIs(t, err, ErrWriteConcern)
+	assert.NotErrorIs(t, err, ErrInsertingUser)
+
+	// The write went through even though it wasn't acknowledged as asked.
+	got, err := repo.GetUserByID(ctx, user.ID, WithPassword())
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	got.Name = "Johnny"
+
+	err = repo.UpdateUser(ctx, got)
+	assert.ErrorIs(t, err, ErrWriteConcern)
+}
+
+func TestMongoRepo_Health(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	repo.address = "localhost:27017"
+
+	details, err := repo.HealthDetails(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:27017", details.Address)
+
+	repo.mongoCaller.(*MockMongo).pingErr = transientError
+
+	details, err = repo.HealthDetails(ctx)
+	assert.ErrorIs(t, err, ErrConnectingToMongoDatabase)
+	assert.Equal(t, "localhost:27017", details.Address)
+
+	err = repo.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing repo: %s", err)
+	}
+
+	err = repo.Health(ctx)
+	assert.ErrorIs(t, err, ErrRepoClosed)
+}
+
+func TestMongoRepo_HealthLatency(t *testing.T) {
+	repo := NewMockMongo()
+	repo.mongoCaller.(*MockMongo).delay = 20 * time.Millisecond
+
+	details, err := repo.HealthDetails(context.Background())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, details.Latency, 20*time.Millisecond)
+}
+
+func TestReadyzHandler(t *testing.T) {
+	repo := NewMockMongo()
+
+	recorder := httptest.NewRecorder()
+	ReadyzHandler(repo).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	repo.mongoCaller.(*MockMongo).pingErr = transientError
+
+	recorder = httptest.NewRecorder()
+	ReadyzHandler(repo).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestMongoRepo_Reconnect(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	connection := newConnectionState(mock, time.Minute)
+	connection.now = func() time.Time { return now }
+	repo.mongoCaller = &reconnectingCaller{caller: mock, state: connection}
+	repo.connection = connection
+
+	user, err := repo.CreateUser(ctx, &User{Name: "John", Email: "john@example.com", Password: "password"})
+	if err != nil {
+		t.Fatalf("error creating user: %s", err)
+	}
+
+	assert.Equal(t, StatusHealthy, repo.Status())
+
+	// The server goes away.
+	mock.transientFailures = 1
+	mock.pingErr = transientError
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrFindingUser)
+	assert.Equal(t, StatusDegraded, repo.Status())
+
+	// Calls fail fast during the cooldown.
+	calls := mock.calls
+
+	_, err = repo.GetUserByID(ctx, user.ID)
+	assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+	assert.ErrorIs(t, err, ErrFindingUser)
+
+	_, err = repo.CountUsers(ctx)
+	assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+	assert.Equal(t, calls, mock.calls)
+
+	// Once it is over, the server is pinged but still down.
+	now = now.Add(time.Minute)
+
+	_, err = repo.CountUsers(ctx)
+	assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+	assert.Equal(t, StatusDegraded, repo.Status())
+
+	// The server is back.
+	mock.pingErr = nil
+
+	_, err = repo.CountUsers(ctx)
+	assert.ErrorIs(t, err, ErrTemporarilyUnavailable)
+
+	now = now.Add(time.Minute)
+
+	got, err := repo.GetUserByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %s", err)
+	}
+
+	assert.Equal(t, "John", got.Name)
+	assert.Equal(t, StatusHealthy, repo.Status())
+}
+
+func TestMongoRepo_ReconnectIgnoresServerErrors(t *testing.T) {
+	ctx := context.Background()
+
+	repo := NewMockMongo()
+	mock := repo.mongoCaller.(*MockMongo)
+
+	connection := newConnectionState(mock, time.Minute)
+	repo.mongoCaller = &reconnectingCaller{caller: mock, state: connection}
+	repo.connection = connection
+	mock.FailWhen(FailOnEmail("broken@example.com", errors.New("boom")))
+
+	_, err := repo.CreateUser(ctx, &User{Name: "John", Email: "broken@example.com", Password: "password"})
+	assert.ErrorIs(t, err, ErrInsertingUser)
+	assert.Equal(t, StatusHealthy, repo.Status())
+}
+
+func TestMongoRepo_StatusClosed(t *testing.T) {
+	repo := NewMockMongo()
+
+	err := repo.Close(context.Background())
+	if err != nil {
+		t.Fatalf("error closing repo: %s", err)
+	}
+
+	assert.Equal(t, StatusClosed, repo.Status())
+}
+
+func TestIsConnectionFailure(t *testing.T) {
+	assert.True(t, isConnectionFailure(transientError))
+	assert.True(t, isConnectionFailure(fmt.Errorf("find: %w", topology.ServerSelectionError{Wrapped: context.DeadlineExceeded})))
+	assert.False(t, isConnectionFailure(duplicateKeyError(0, "email_1")))
+	assert.False(t, isConnectionFailure(nil))
+}
@@ -0,0 +1,500 @@
+package users
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// InMemoryUserRepository is a UserRepository keeping its users in memory, for
+// programs whose users don't need to outlive the process, such as demos, or
+// to test the code using a repository without a database. It follows the
+// rules of MongoRepo: emails are normalized and unique, passwords hashed,
+// versions checked and soft-deleted or expired users hidden.
+//
+// It is safe for concurrent use. The users given to it and returned by it are
+// copies, so callers can't change what it stores without calling it.
+type InMemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]*User
+	// emails maps every stored email to its user, including soft-deleted
+	// ones, as the unique index on Mongo does.
+	emails map[string]primitive.ObjectID
+
+	bcryptCost int
+	clock      Clock
+	ids        IDGenerator
+	pageSize   int64
+}
+
+var _ UserRepository = (*InMemoryUserRepository)(nil)
+
+// NewInMemoryUserRepository returns an empty repository. Of opts, only
+// WithBcryptCost, WithClock and WithIDGenerator apply, the others are about
+// the database and ignored.
+func NewInMemoryUserRepository(opts ...Option) (*InMemoryUserRepository, error) {
+	repoOpts := newRepoOptions(opts)
+
+	err := repoOpts.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &InMemoryUserRepository{
+		users:      make(map[primitive.ObjectID]*User),
+		emails:     make(map[string]primitive.ObjectID),
+		bcryptCost: repoOpts.bcryptCost,
+		clock:      repoOpts.clock,
+		ids:        repoOpts.ids,
+		pageSize:   defaultPageSize,
+	}, nil
+}
+
+// CreateUser stores a copy of user, hashing its password, like
+// MongoRepo.CreateUser does. user is updated in place with the fields set on
+// insert. Write options have no effect.
+func (r *InMemoryUserRepository) CreateUser(ctx context.Context, user *User, _ ...WriteOption) (*User, error) {
+	err := contextError(ctx, ErrInsertingUser)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashing is slow, so it is done before taking the lock.
+	hash, err := hashPassword(user.Password, r.bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.purgeExpired()
+
+	id := user.ID
+	if id.IsZero() {
+		id = r.ids.NewID()
+	}
+
+	if _, ok := r.users[id]; ok {
+		return nil, fmt.Errorf("%w: id %s", ErrUserAlreadyExists, id.Hex())
+	}
+
+	if _, ok := r.emails[email]; ok {
+		return nil, fmt.Errorf("%w: email %s", ErrUserAlreadyExists, email)
+	}
+
+	user.ID = id
+	user.Email = email
+	user.Password = hash
+	user.Version = 1
+	user.CreatedAt = r.timestamp()
+	user.UpdatedAt = user.CreatedAt
+
+	if user.Role == "" {
+		user.Role = RoleMember
+	}
+
+	r.users[id] = copyUser(user)
+	r.emails[email] = id
+
+	return user, nil
+}
+
+func (r *InMemoryUserRepository) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	err := contextError(ctx, ErrFindingUser)
+	if err != nil {
+		return nil, err
+	}
+
+	readOpts := newReadOptions(opts)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok || !r.visible(user, readOpts) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return readCopy(user, readOpts), nil
+}
+
+func (r *InMemoryUserRepository) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (
+	*User, error,
+) {
+	err := contextError(ctx, ErrFindingUser)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err = NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	readOpts := newReadOptions(opts)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.emails[email]
+	if !ok || !r.visible(r.users[id], readOpts) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	}
+
+	return readCopy(r.users[id], readOpts), nil
+}
+
+// UpdateUser replaces the stored user having user.ID with a copy of user, if
+// it still has user.Version, like MongoRepo.UpdateUser does. On success
+// user.Version holds the new version. Write options have no effect.
+func (r *InMemoryUserRepository) UpdateUser(ctx context.Context, user *User, _ ...WriteOption) error {
+	err := contextError(ctx, ErrUpdatingUser)
+	if err != nil {
+		return err
+	}
+
+	if user.ID.IsZero() {
+		return fmt.Errorf("%w: id is zero", ErrInvalidUserID)
+	}
+
+	err = user.Validate()
+	if err != nil {
+		return err
+	}
+
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.purgeExpired()
+
+	stored, ok := r.users[user.ID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, user.ID.Hex())
+	}
+
+	if stored.Version != user.Version {
+		return fmt.Errorf("%w: %s", ErrVersionConflict, user.ID.Hex())
+	}
+
+	if owner, ok := r.emails[email]; ok && owner != user.ID {
+		return fmt.Errorf("%w: email %s", ErrUserAlreadyExists, email)
+	}
+
+	user.Email = email
+	user.UpdatedAt = r.timestamp()
+	user.Version++
+
+	delete(r.emails, stored.Email)
+	r.users[user.ID] = copyUser(user)
+	r.emails[email] = user.ID
+
+	return nil
+}
+
+// DeleteUser removes the user for good, soft-deleted or not.
+func (r *InMemoryUserRepository) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	err := contextError(ctx, ErrDeletingUser)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.purgeExpired()
+
+	user, ok := r.users[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	delete(r.users, id)
+	delete(r.emails, user.Email)
+
+	return nil
+}
+
+// ListUsers returns a page of users ordered on their ID, or as set by SortBy,
+// like MongoRepo.ListUsers does.
+func (r *InMemoryUserRepository) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) (
+	[]*User, error,
+) {
+	err := contextError(ctx, ErrListingUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	readOpts := newReadOptions(opts)
+
+	less, err := userOrder(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	limit = r.pageLimit(limit)
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.sorted(readOpts, less)
+	if offset >= int64(len(users)) {
+		return []*User{}, nil
+	}
+
+	users = users[offset:]
+	if int64(len(users)) > limit {
+		users = users[:limit]
+	}
+
+	return readCopies(users, readOpts), nil
+}
+
+// ListUsersAfter returns the users whose ID comes after afterID, in ID order,
+// and the cursor of the next page, like MongoRepo.ListUsersAfter does.
+func (r *InMemoryUserRepository) ListUsersAfter(
+	ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption,
+) ([]*User, primitive.ObjectID, error) {
+	err := contextError(ctx, ErrListingUsers)
+	if err != nil {
+		return nil, primitive.NilObjectID, err
+	}
+
+	readOpts := newReadOptions(opts)
+	limit = r.pageLimit(limit)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.sorted(readOpts, lessID)
+
+	start := sort.Search(len(users), func(i int) bool {
+		return bytes.Compare(users[i].ID[:], afterID[:]) > 0
+	})
+	users = users[start:]
+
+	if int64(len(users)) <= limit {
+		return readCopies(users, readOpts), primitive.NilObjectID, nil
+	}
+
+	users = users[:limit]
+
+	return readCopies(users, readOpts), users[limit-1].ID, nil
+}
+
+func (r *InMemoryUserRepository) timestamp() time.Time {
+	return r.clock.Now().UTC().Truncate(time.Millisecond)
+}
+
+func (r *InMemoryUserRepository) pageLimit(limit int64) int64 {
+	if limit <= 0 {
+		limit = r.pageSize
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return limit
+}
+
+// visible reports whether a read made with readOpts returns user.
+func (r *InMemoryUserRepository) visible(user *User, readOpts readOptions) bool {
+	if user.DeletedAt != nil && !readOpts.includeDeleted {
+		return false
+	}
+
+	if readOpts.verifiedOnly && !user.EmailVerified {
+		return false
+	}
+
+	return !r.expired(user)
+}
+
+// expired reports whether user is provisional and past its expiry, which is
+// when the TTL index gets Mongo to purge it.
+func (r *InMemoryUserRepository) expired(user *User) bool {
+	return user.ExpiresAt != nil && !user.ExpiresAt.After(r.clock.Now())
+}
+
+// purgeExpired removes the expired users, so their emails can be taken
+// again. r.mu must be held for writing.
+func (r *InMemoryUserRepository) purgeExpired() {
+	for id, user := range r.users {
+		if r.expired(user) {
+			delete(r.users, id)
+			delete(r.emails, user.Email)
+		}
+	}
+}
+
+// sorted returns the users visible to readOpts ordered by less. r.mu must be
+// held.
+func (r *InMemoryUserRepository) sorted(readOpts readOptions, less func(a, b *User) bool) []*User {
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		if r.visible(user, readOpts) {
+			users = append(users, user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return less(users[i], users[j])
+	})
+
+	return users
+}
+
+// snapshot returns copies of every stored user, expired ones included, in ID
+// order.
+func (r *InMemoryUserRepository) snapshot() []*User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		users = append(users, copyUser(user))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return lessID(users[i], users[j])
+	})
+
+	return users
+}
+
+// replace stores users in place of the stored ones. Their IDs and emails must
+// be unique.
+func (r *InMemoryUserRepository) replace(users []*User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.users = make(map[primitive.ObjectID]*User, len(users))
+	r.emails = make(map[string]primitive.ObjectID, len(users))
+
+	for _, user := range users {
+		r.users[user.ID] = copyUser(user)
+		r.emails[user.Email] = user.ID
+	}
+}
+
+// userOrder returns the order SortBy asked for, ties broken by ID.
+func userOrder(readOpts readOptions) (func(a, b *User) bool, error) {
+	if readOpts.sortField == "" {
+		return lessID, nil
+	}
+
+	key, ok := sortableFields[readOpts.sortField]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSortField, readOpts.sortField)
+	}
+
+	compare := func(a, b *User) int {
+		switch key {
+		case "name":
+			return strings.Compare(a.Name, b.Name)
+		case "email":
+			return strings.Compare(a.Email, b.Email)
+		case "created_at":
+			return a.CreatedAt.Compare(b.CreatedAt)
+		default:
+			return bytes.Compare(a.ID[:], b.ID[:])
+		}
+	}
+
+	return func(a, b *User) bool {
+		c := compare(a, b)
+		if readOpts.sortDescending {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return lessID(a, b)
+	}, nil
+}
+
+func lessID(a, b *User) bool {
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// contextError returns the error a repo call made with ctx fails with once
+// ctx is done, nil before.
+func contextError(ctx context.Context, sentinel error) error {
+	err := ctx.Err()
+	if err != nil {
+		return driverError(sentinel, err)
+	}
+
+	return nil
+}
+
+// copyUser returns a copy of user sharing nothing with it.
+func copyUser(user *User) *User {
+	c := *user
+
+	if user.DeletedAt != nil {
+		deletedAt := *user.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+
+	if user.ExpiresAt != nil {
+		expiresAt := *user.ExpiresAt
+		c.ExpiresAt = &expiresAt
+	}
+
+	if user.idempotencyExpiresAt != nil {
+		expiresAt := *user.idempotencyExpiresAt
+		c.idempotencyExpiresAt = &expiresAt
+	}
+
+	return &c
+}
+
+// readCopy returns the copy of user a read made with readOpts gets.
+func readCopy(user *User, readOpts readOptions) *User {
+	c := copyUser(user)
+	if !readOpts.withPassword {
+		c.Password = ""
+	}
+
+	return c
+}
+
+func readCopies(users []*User, readOpts readOptions) []*User {
+	copies := make([]*User, 0, len(users))
+	for _, user := range users {
+		copies = append(copies, readCopy(user, readOpts))
+	}
+
+	return copies
+}
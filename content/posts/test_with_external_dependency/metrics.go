@@ -0,0 +1,112 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The statuses the operations counter labels the repo calls with.
+const (
+	statusOK       = "ok"
+	statusError    = "error"
+	statusNotFound = "not_found"
+	statusConflict = "conflict"
+)
+
+// repoMetrics counts and times the repo method calls. The repos given the
+// same registerer share it.
+type repoMetrics struct {
+	operations *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	slow       *prometheus.CounterVec
+	// auditFailures counts the mutations whose audit entry couldn't be
+	// written.
+	auditFailures *prometheus.CounterVec
+}
+
+// newRepoMetrics registers the repo collectors on registerer, or reuses the
+// ones a previous repo registered there.
+func newRepoMetrics(registerer prometheus.Registerer) (*repoMetrics, error) {
+	operations, err := registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repo_operations_total",
+		Help: "Number of user repository calls, by method and outcome.",
+	}, []string{"op", "status"}))
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := registerCollector(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_repo_operation_duration_seconds",
+		Help:    "How long the user repository calls took, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"}))
+	if err != nil {
+		return nil, err
+	}
+
+	slow, err := registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repo_slow_operations_total",
+		Help: "Number of user repository calls slower than the slow operation threshold, by method.",
+	}, []string{"op"}))
+	if err != nil {
+		return nil, err
+	}
+
+	auditFailures, err := registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repo_audit_failures_total",
+		Help: "Number of user repository mutations whose audit entry couldn't be written, by method.",
+	}, []string{"op"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &repoMetrics{operations: operations, duration: duration, slow: slow, auditFailures: auditFailures}, nil
+}
+
+// registerCollector registers collector on registerer and returns it, or the
+// identical collector already registered there.
+func registerCollector[C prometheus.Collector](registerer prometheus.Registerer, collector C) (C, error) {
+	err := registerer.Register(collector)
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		existing, ok := registered.ExistingCollector.(C)
+		if ok {
+			return existing, nil
+		}
+	}
+
+	if err != nil {
+		return collector, fmt.Errorf("%w: registering metrics: %s", ErrInvalidOption, err)
+	}
+
+	return collector, nil
+}
+
+// observe records the call to the method op which took took and returned err,
+// counting it as slow too if slow is set.
+func (r *repoMetrics) observe(op string, err error, took time.Duration, slow bool) {
+	r.operations.WithLabelValues(op, operationStatus(err)).Inc()
+	r.duration.WithLabelValues(op).Observe(took.Seconds())
+
+	if slow {
+		r.slow.WithLabelValues(op).Inc()
+	}
+}
+
+// operationStatus labels a call returning err.
+func operationStatus(err error) string {
+	switch {
+	case err == nil:
+		return statusOK
+	case IsNotFound(err):
+		return statusNotFound
+	case IsConflict(err):
+		return statusConflict
+	default:
+		return statusError
+	}
+}
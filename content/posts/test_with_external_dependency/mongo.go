@@ -1,59 +1,2104 @@
-package main
+package users
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultPageSize is used by ListUsers when MongoRepo.pageSize is unset.
+	defaultPageSize int64 = 50
+	// maxPageSize bounds every page so a caller can't pull the whole collection.
+	maxPageSize int64 = 500
+)
+
+// updatableFields lists the bson keys UpdateUserFields accepts.
+var updatableFields = map[string]struct{}{
+	"name":     {},
+	"email":    {},
+	"password": {},
+	"role":     {},
+}
+
+// Server error codes translateWriteError reports with their own sentinel.
+const (
+	codeUnauthorized              = 13
+	codeWriteConcernFailed        = 64
+	codeUnsatisfiableWriteConcern = 100
+	codeBSONObjectTooLarge        = 10334
+	codeDocumentTooLarge          = 17419
 )
 
 var (
 	ErrConnectingToMongoDatabase = errors.New("error connecting to mongo database")
+	ErrInvalidOption             = errors.New("invalid option")
+	ErrRepoClosed                = errors.New("repository is closed")
+	ErrOperationTimeout          = errors.New("operation timed out")
+	ErrOperationCanceled         = errors.New("operation canceled")
+	ErrWriteConcern              = errors.New("write concern not satisfied")
+	ErrDocumentTooLarge          = errors.New("document too large")
+	ErrUnauthorized              = errors.New("not authorized")
+	ErrTemporarilyUnavailable    = errors.New("database temporarily unavailable")
 	ErrInsertingUser             = errors.New("error inserting user")
+	ErrFindingUser               = errors.New("error finding user")
+	ErrUserNotFound              = errors.New("user not found")
+	ErrInvalidEmail              = errors.New("invalid email")
+	ErrMultipleUsersFound        = errors.New("multiple users found")
+	ErrInvalidUserID             = errors.New("invalid user id")
+	ErrUpdatingUser              = errors.New("error updating user")
+	ErrDeletingUser              = errors.New("error deleting user")
+	ErrRefusingFullDelete        = errors.New("refusing to delete every user")
+	ErrListingUsers              = errors.New("error listing users")
+	ErrCountingUsers             = errors.New("error counting users")
+	ErrInvalidUser               = errors.New("invalid user")
+	ErrInvalidRole               = errors.New("invalid role")
+	ErrInvalidField              = errors.New("invalid field")
+	ErrInvalidSortField          = errors.New("invalid sort field")
+	ErrEmailAlreadyTaken         = errors.New("email already taken")
+	ErrVersionConflict           = errors.New("user was modified concurrently")
+	ErrUserAlreadyExists         = errors.New("user already exists")
+	ErrCreatingIndexes           = errors.New("error creating indexes")
 )
 
-type User struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty"`
-	Name     string             `bson:"name,omitempty"`
-	Email    string             `bson:"email,omitempty"`
-	Password string             `bson:"password,omitempty"`
+// IsNotFound reports whether err means the user, or the document of a
+// Repository, looked up, updated or deleted doesn't exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrDocumentNotFound)
+}
+
+// IsConflict reports whether err means a write collided with another one: a
+// user or document already has the ID or email given, or the user changed
+// since it was read.
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrUserAlreadyExists) || errors.Is(err, ErrVersionConflict) ||
+		errors.Is(err, ErrDocumentAlreadyExists)
+}
+
+// BulkInsertError reports which users of a CreateUsers call the database
+// refused, and how many it stored. It matches ErrInsertingUser with errors.Is
+// and unwraps to Err, the error returned by the driver.
+type BulkInsertError struct {
+	Err error
+	// errs holds why each refused user was, by its position in the slice given
+	// to CreateUsers.
+	errs      map[int]error
+	succeeded int
+}
+
+func (e *BulkInsertError) Error() string {
+	return fmt.Sprintf("%s: users at indexes %v: %s", ErrInsertingUser, e.FailedIndexes(), e.Err)
+}
+
+// FailedIndexes returns the positions of the refused users in the slice given
+// to CreateUsers, in increasing order. An ordered insert refuses one user and
+// leaves out the ones after it, which aren't listed.
+func (e *BulkInsertError) FailedIndexes() []int {
+	failed := make([]int, 0, len(e.errs))
+	for i := range e.errs {
+		failed = append(failed, i)
+	}
+
+	sort.Ints(failed)
+
+	return failed
+}
+
+// Errors returns why each refused user was, by its position in the slice
+// given to CreateUsers. A duplicate ID or email matches ErrUserAlreadyExists.
+func (e *BulkInsertError) Errors() map[int]error {
+	return maps.Clone(e.errs)
+}
+
+// Succeeded returns how many users were stored. After an ordered insert they
+// are the users before the first failed index, after an unordered one all the
+// users but the failed ones.
+func (e *BulkInsertError) Succeeded() int {
+	return e.succeeded
+}
+
+func (e *BulkInsertError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BulkInsertError) Is(target error) bool {
+	return target == ErrInsertingUser
+}
+
+// newBulkInsertError returns the BulkInsertError of bulkErr, failing the
+// insert of users.
+func newBulkInsertError(users []*User, bulkErr mongo.BulkWriteException, ordered bool) *BulkInsertError {
+	insertErr := &BulkInsertError{errs: make(map[int]error, len(bulkErr.WriteErrors))}
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Index < 0 || writeErr.Index >= len(users) {
+			continue
+		}
+
+		user := users[writeErr.Index]
+
+		if mongo.IsDuplicateKeyError(mongo.WriteException{WriteErrors: mongo.WriteErrors{writeErr.WriteError}}) {
+			insertErr.errs[writeErr.Index] = alreadyExistsError(user.ID, user.Email, writeErr.WriteError)
+		} else {
+			insertErr.errs[writeErr.Index] = fmt.Errorf("%w: %s", ErrInsertingUser, writeErr.Message)
+		}
+	}
+
+	insertErr.succeeded = len(users) - len(insertErr.errs)
+
+	if ordered {
+		for i := range insertErr.errs {
+			insertErr.succeeded = min(insertErr.succeeded, i)
+		}
+	}
+
+	return insertErr
+}
+
+// OperationError is returned by the repo methods when the database fails
+// them. It matches the sentinel of the failure with errors.Is, such as
+// ErrInsertingUser, and unwraps to the error returned by the driver.
+type OperationError struct {
+	// Op is the MongoRepo method that failed, e.g. "CreateUser".
+	Op         string
+	Collection string
+	// Took is how long the method ran before failing.
+	Took time.Duration
+	Err  error
+
+	sentinel error
+}
+
+func (e *OperationError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("%s: %s", e.sentinel, e.Err)
+	}
+
+	return fmt.Sprintf("%s on %s after %s: %s: %s", e.Op, e.Collection, e.Took, e.sentinel, e.Err)
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *OperationError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+// driverError wraps err, returned by the driver, in an OperationError
+// matching sentinel. Deadlines and cancellations are reported as
+// ErrOperationTimeout and ErrOperationCanceled instead so callers can tell an
+// abandoned call apart from a failed operation.
+func driverError(sentinel, err error) error {
+	switch {
+	case errors.Is(err, ErrTemporarilyUnavailable):
+		// Already matched through err, sentinel still tells what failed.
+	case errors.Is(err, context.DeadlineExceeded):
+		sentinel = ErrOperationTimeout
+	case errors.Is(err, context.Canceled):
+		sentinel = ErrOperationCanceled
+	}
+
+	return &OperationError{Err: err, sentinel: sentinel}
+}
+
+// translateWriteError is driverError for the writes, reporting the failures
+// callers can act on with their own sentinel instead of the generic one of the
+// write. An unsatisfied write concern is ErrWriteConcern since such a write
+// may still have been applied.
+func translateWriteError(sentinel, err error) error {
+	var serverErr mongo.ServerError
+
+	switch {
+	case errors.Is(err, driver.ErrDocumentTooLarge):
+		sentinel = ErrDocumentTooLarge
+	case isWriteConcernError(err):
+		sentinel = ErrWriteConcern
+	case errors.As(err, &serverErr):
+		switch {
+		case serverErr.HasErrorCode(codeBSONObjectTooLarge), serverErr.HasErrorCode(codeDocumentTooLarge):
+			sentinel = ErrDocumentTooLarge
+		case serverErr.HasErrorCode(codeUnauthorized):
+			sentinel = ErrUnauthorized
+		case serverErr.HasErrorCode(codeWriteConcernFailed), serverErr.HasErrorCode(codeUnsatisfiableWriteConcern):
+			sentinel = ErrWriteConcern
+		}
+	}
+
+	return driverError(sentinel, err)
+}
+
+// operation is a call to a repo method, described in the OperationError it
+// may return, logged and traced.
+type operation struct {
+	name  string
+	start time.Time
+	// userID is the user the call is about, zero when it isn't about one.
+	userID primitive.ObjectID
+	// span is nil unless the repo has a tracer.
+	span trace.Span
+}
+
+// begin starts the operation name on the user id, which may be zero. The
+// returned context carries its span, if any.
+func (m *MongoRepo) begin(ctx context.Context, name string, id primitive.ObjectID) (context.Context, operation) {
+	call := operation{name: name, start: m.now(), userID: id}
+
+	if m.tracer != nil {
+		ctx, call.span = m.startSpan(ctx, name)
+	}
+
+	if m.logger != nil {
+		m.logger.LogAttrs(ctx, slog.LevelDebug, "mongo operation started", call.attrs()...)
+	}
+
+	return ctx, call
+}
+
+// end fills the OperationError *err may hold with call, if no method it made
+// did already, and logs and ends its span with how call went. It must be
+// deferred directly, to end the span of a call that panics.
+func (m *MongoRepo) end(ctx context.Context, call *operation, err *error) {
+	if call.span != nil {
+		defer call.span.End()
+
+		if r := recover(); r != nil {
+			call.span.SetStatus(codes.Error, fmt.Sprint(r))
+			panic(r)
+		}
+	}
+
+	took := m.now().Sub(call.start)
+
+	var opErr *OperationError
+	if errors.As(*err, &opErr) && opErr.Op == "" {
+		opErr.Op = call.name
+		opErr.Collection = m.collection
+		opErr.Took = took
+	}
+
+	if call.span != nil && *err != nil {
+		message := redact((*err).Error())
+		call.span.RecordError(errors.New(message))
+		call.span.SetStatus(codes.Error, message)
+	}
+
+	slow := m.slowThreshold > 0 && took > m.slowThreshold
+
+	if m.metrics != nil {
+		m.metrics.observe(call.name, *err, took, slow)
+	}
+
+	if m.logger == nil {
+		return
+	}
+
+	attrs := append(call.attrs(), slog.Duration("duration", took))
+
+	if slow {
+		m.logger.LogAttrs(ctx, slog.LevelWarn, "slow mongo operation",
+			append(attrs, slog.Bool("success", *err == nil))...)
+	}
+
+	if *err != nil {
+		attrs = append(attrs, slog.String("error", redact((*err).Error())))
+		m.logger.LogAttrs(ctx, slog.LevelError, "mongo operation failed", attrs...)
+
+		return
+	}
+
+	m.logger.LogAttrs(ctx, slog.LevelInfo, "mongo operation succeeded", attrs...)
+}
+
+func (call *operation) attrs() []slog.Attr {
+	attrs := make([]slog.Attr, 0, 4)
+	attrs = append(attrs, slog.String("op", call.name))
+
+	if !call.userID.IsZero() {
+		attrs = append(attrs, slog.String("user_id", call.userID.Hex()))
+	}
+
+	return attrs
+}
+
+// alreadyExistsError reports the duplicate key error err, hit writing the user
+// with this id and email, as ErrUserAlreadyExists naming the email, or the id
+// when that is the key which collided.
+func alreadyExistsError(id primitive.ObjectID, email string, err error) error {
+	if strings.Contains(err.Error(), "index: idempotency_key_1") {
+		return fmt.Errorf("%w: %w", ErrUserAlreadyExists, errIdempotencyKeyTaken)
+	}
+
+	if strings.Contains(err.Error(), "index: _id_") {
+		return fmt.Errorf("%w: id %s", ErrUserAlreadyExists, id.Hex())
+	}
+
+	return fmt.Errorf("%w: email %s", ErrUserAlreadyExists, email)
 }
 
 type MongoRepo struct {
 	mongoCaller MongoCaller
+	indexes     IndexCreator
+	// watcher is nil when the collection has no change streams.
+	watcher ChangeWatcher
+	// sessions is nil when the repo can't run transactions.
+	sessions SessionStarter
+	// client is pinged by Health and, if ownsClient, disconnected by Close.
+	client     MongoClient
+	ownsClient bool
+	// collection is the name reported in OperationError.
+	collection string
+	// connection is nil when the caller doesn't track the connection.
+	connection *connectionState
+	closed     atomic.Bool
+	pageSize   int64
+	// bcryptCost is the cost passwords are hashed with, bcrypt.DefaultCost
+	// when zero.
+	bcryptCost int
+	// clock is the system clock unless set with WithClock.
+	clock Clock
+	// ids makes the IDs of the users created without one.
+	ids IDGenerator
+	// logger is nil unless set with WithLogger, which disables logging.
+	logger *slog.Logger
+	// tracer is nil unless set with WithTracerProvider.
+	tracer trace.Tracer
+	// metrics is nil unless set with WithMetrics.
+	metrics *repoMetrics
+	// passwordPolicy is nil unless set with WithPasswordPolicy.
+	passwordPolicy *PasswordPolicy
+	// fields is nil unless set with WithFieldEncryption.
+	fields *fieldEncryption
+	// collation is nil unless set with WithEmailCollation.
+	collation  *options.Collation
+	pageTokens *PageTokens
+	// idempotencyKeyTTL is how long CreateUserIdempotent keys are held,
+	// defaultIdempotencyKeyTTL when zero.
+	idempotencyKeyTTL time.Duration
+	// tokens is nil when the repo can't store verification tokens, and
+	// tokenIndexes when EnsureIndexes can't index them.
+	// verificationTokenTTL is defaultVerificationTokenTTL when zero.
+	tokens               TokenCaller
+	tokenIndexes         IndexCreator
+	verificationTokenTTL time.Duration
+	// slowThreshold is how long an operation may take before being logged
+	// at warn level and counted as slow. Zero disables it.
+	slowThreshold time.Duration
+	// operationTimeout bounds the methods called without a deadline. Zero
+	// means no bound.
+	operationTimeout time.Duration
+	// readPref is the read preference set with WithReadPreference, nil when
+	// it comes from the URI.
+	readPref *readpref.ReadPref
+	// auditLog is nil unless set with WithAuditing. strictAudit makes a
+	// failure to audit fail the mutation.
+	auditLog    AuditCaller
+	strictAudit bool
+	// events is nil unless set with WithEventSink. requireDelivery makes a
+	// failure to publish fail the mutation.
+	events          EventSink
+	requireDelivery bool
+	// address lists the hosts of the URI, for HealthDetails.
+	address string
 }
 
+var (
+	_ MongoCaller  = (*mongo.Collection)(nil)
+	_ IndexCreator = mongo.IndexView{}
+	_ MongoClient  = (*mongo.Client)(nil)
+)
+
 type MongoCaller interface {
 	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
 		*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (
+		*mongo.InsertManyResult, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (
+		*mongo.UpdateResult, error)
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (
+		*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	Distinct(ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions) (
+		[]interface{}, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+}
+
+// MongoClient is the part of *mongo.Client used by Health and Close.
+type MongoClient interface {
+	Ping(ctx context.Context, rp *readpref.ReadPref) error
+	Disconnect(ctx context.Context) error
+}
+
+// IndexCreator is the part of mongo.IndexView used by EnsureIndexes.
+type IndexCreator interface {
+	CreateMany(ctx context.Context, models []mongo.IndexModel, opts ...*options.CreateIndexesOptions) ([]string, error)
 }
 
-func NewMongoRepo(ctx context.Context, mongoURI string) (*MongoRepo, error) {
-	const (
-		dbName         = "test"
-		collectionName = "users"
-	)
+// NewMongoRepo connects to mongoURI and works on the "users" collection of the
+// "test" database unless told otherwise with WithDatabase and WithCollection.
+// As the driver connects lazily, the server is pinged before returning so a
+// wrong URI fails here rather than on the first call; see WithSkipPing.
+func NewMongoRepo(ctx context.Context, mongoURI string, opts ...Option) (*MongoRepo, error) {
+	repoOpts := newRepoOptions(opts)
+
+	err := repoOpts.validate()
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	client, err := repoOpts.connect(ctx, repoOpts.clientOptions(mongoURI)...)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrConnectingToMongoDatabase, err)
 	}
 
-	collection := client.Database(dbName).Collection(collectionName)
+	if !repoOpts.skipPing {
+		err = ping(ctx, client, repoOpts.pingTimeout)
+		if err != nil {
+			_ = client.Disconnect(ctx)
+			return nil, fmt.Errorf("%w: %s", ErrConnectingToMongoDatabase, err)
+		}
+	}
+
+	repo, err := newMongoRepo(ctx, client, repoOpts)
+	if err != nil {
+		_ = client.Disconnect(ctx)
+		return nil, err
+	}
+
+	repo.ownsClient = true
+	repo.address = strings.Join(options.Client().ApplyURI(mongoURI).Hosts, ",")
+
+	return repo, nil
+}
+
+// NewMongoRepoFromClient works like NewMongoRepo on a client the caller
+// already connected, so several repos can share it. The client stays the
+// caller's: Close on the repo doesn't disconnect it, and the options about
+// connecting, such as WithClientOptions or WithPingTimeout, are ignored.
+func NewMongoRepoFromClient(client *mongo.Client, opts ...Option) (*MongoRepo, error) {
+	repoOpts := newRepoOptions(opts)
+
+	err := repoOpts.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return newMongoRepo(context.Background(), client, repoOpts)
+}
+
+// NewMongoRepoFromCollection returns a repo working directly on caller,
+// typically a *mongo.Collection, without retries nor reconnect handling. Close
+// doesn't disconnect anything.
+func NewMongoRepoFromCollection(caller MongoCaller) *MongoRepo {
+	repo := &MongoRepo{
+		mongoCaller: caller,
+		pageSize:    defaultPageSize,
+		clock:       systemClock{},
+		ids:         objectIDGenerator{},
+		pageTokens:  newRandomPageTokens(),
+	}
+
+	if collection, ok := caller.(*mongo.Collection); ok {
+		repo.collection = collection.Name()
+		repo.indexes = collection.Indexes()
+		repo.client = collection.Database().Client()
+		repo.watcher = collectionWatcher{collection: collection}
+		repo.sessions = collection.Database().Client()
+	}
+
+	if indexes, ok := caller.(IndexCreator); ok {
+		repo.indexes = indexes
+	}
+
+	if watcher, ok := caller.(ChangeWatcher); ok {
+		repo.watcher = watcher
+	}
+
+	if sessions, ok := caller.(SessionStarter); ok {
+		repo.sessions = sessions
+	}
+
+	if client, ok := caller.(MongoClient); ok {
+		repo.client = client
+	}
+
+	return repo
+}
+
+// userCollection is what a repo works on a collection of users with.
+type userCollection struct {
+	caller  MongoCaller
+	indexes IndexCreator
+	// watcher is nil when the collection has no change streams.
+	watcher ChangeWatcher
+}
+
+// openCollection returns the collection of client in ns, the one picked by
+// repoOpts for its empty fields, with the retries and reconnect handling of
+// repoOpts.
+func openCollection(
+	client *mongo.Client, connection *connectionState, repoOpts repoOptions, ns TenantNamespace,
+) userCollection {
+	database, name := repoOpts.database, repoOpts.collection
+	if ns.Database != "" {
+		database = ns.Database
+	}
+
+	if ns.Collection != "" {
+		name = ns.Collection
+	}
+
+	collection := client.Database(database).Collection(name, repoOpts.collectionOptions())
+
+	var caller MongoCaller = &reconnectingCaller{caller: collection, state: connection}
+	if repoOpts.maxAttempts > 1 {
+		caller = newRetryingCaller(caller, repoOpts.maxAttempts, repoOpts.retryDelay)
+	}
+
+	return userCollection{
+		caller:  caller,
+		indexes: collection.Indexes(),
+		watcher: collectionWatcher{collection: collection},
+	}
+}
+
+// newMongoRepo builds the repo on the collection of client picked by
+// repoOpts.
+func newMongoRepo(ctx context.Context, client *mongo.Client, repoOpts repoOptions) (*MongoRepo, error) {
+	connection := newConnectionState(client, repoOpts.reconnectCooldown)
+	connection.now = repoOpts.clock.Now
+
+	collection := openCollection(client, connection, repoOpts, TenantNamespace{})
+
+	repo := &MongoRepo{
+		mongoCaller: collection.caller,
+		indexes:     collection.indexes,
+		watcher:     collection.watcher,
+		sessions:    client,
+		client:      client,
+		connection:  connection,
+		pageSize:    defaultPageSize,
+		bcryptCost:  repoOpts.bcryptCost,
+		clock:       repoOpts.clock,
+		ids:         repoOpts.ids,
+		logger:      repoOpts.logger,
+		tracer:      repoOpts.tracer(),
+
+		slowThreshold:     repoOpts.slowThreshold,
+		idempotencyKeyTTL: repoOpts.idempotencyKeyTTL,
+		passwordPolicy:    repoOpts.passwordPolicy,
+
+		verificationTokenTTL: repoOpts.verificationTokenTTL,
+
+		operationTimeout: repoOpts.operationTimeout,
+		readPref:         repoOpts.readPreference,
+		collection:       repoOpts.collection,
+
+		events:          repoOpts.eventSink,
+		requireDelivery: repoOpts.requireEventDelivery,
+	}
+
+	if repoOpts.emailCollation {
+		repo.collation = caseInsensitiveCollation
+	}
+
+	fields, err := repoOpts.fieldEncryption()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.fields = fields
+
+	repo.pageTokens, err = repoOpts.pageTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	if repoOpts.tenantResolver != nil {
+		repo.useTenants(repoOpts.tenantResolver, func(ns TenantNamespace) userCollection {
+			return openCollection(client, connection, repoOpts, ns)
+		})
+	}
+
+	tokens := client.Database(repoOpts.database).Collection(TokenCollection)
+	repo.tokens = tokens
+	repo.tokenIndexes = tokens.Indexes()
+
+	if repoOpts.auditing {
+		repo.auditLog = client.Database(repoOpts.database).Collection(AuditCollection)
+		repo.strictAudit = repoOpts.strictAudit
+	}
+
+	if repoOpts.metricsRegisterer != nil {
+		metrics, err := newRepoMetrics(repoOpts.metricsRegisterer)
+		if err != nil {
+			return nil, err
+		}
+
+		repo.metrics = metrics
+	}
+
+	if repoOpts.createIndexes {
+		err := repo.EnsureIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return repo, nil
+}
+
+// Close disconnects from the server when the repo connected itself. Every call
+// made on the repo afterwards returns ErrRepoClosed, except Close itself which
+// does nothing.
+func (m *MongoRepo) Close(ctx context.Context) error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 
-	return &MongoRepo{
-		mongoCaller: collection,
-	}, nil
+	if m.client == nil || !m.ownsClient {
+		return nil
+	}
+
+	err := m.client.Disconnect(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRepoClosed, err)
+	}
+
+	return nil
+}
+
+// Status tells whether the repo can currently reach the server.
+func (m *MongoRepo) Status() Status {
+	switch {
+	case m.closed.Load():
+		return StatusClosed
+	case m.connection == nil:
+		return StatusHealthy
+	default:
+		return m.connection.status()
+	}
+}
+
+func ping(ctx context.Context, client MongoClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return client.Ping(ctx, readpref.Primary())
 }
 
-func (m *MongoRepo) CreateUser(ctx context.Context, user *User) error {
-	_, err := m.mongoCaller.InsertOne(ctx, user)
+// EnsureIndexes creates the unique index on email, the index on name used by
+// SearchUsersByName and the TTL index purging provisional users once their
+// expires_at is past, as well as the TTL index purging the verification
+// tokens left unconfirmed. Creating an index that already exists is a no-op, so it
+// is safe to call on every start.
+func (m *MongoRepo) EnsureIndexes(ctx context.Context) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "EnsureIndexes", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	if m.indexes == nil {
+		return fmt.Errorf("%w: no index view to create them with", ErrCreatingIndexes)
+	}
+
+	emailIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetName("email_1").SetUnique(true).SetCollation(m.emailCollation(true)),
+	}
+
+	// Encrypted emails all differ, their hashes are what must be unique.
+	if m.fields != nil {
+		emailIndex = mongo.IndexModel{
+			Keys:    bson.D{{Key: "email_hash", Value: 1}},
+			Options: options.Index().SetName("email_hash_1").SetUnique(true),
+		}
+	}
+
+	models := []mongo.IndexModel{
+		emailIndex,
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}},
+			Options: options.Index().SetName("name_1"),
+		},
+		{
+			// Only documents with an expires_at date are purged.
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_1").SetExpireAfterSeconds(0),
+		},
+		{
+			// Only the users created with CreateUserIdempotent have a key.
+			Keys: bson.D{{Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetName("idempotency_key_1").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$exists": true}}),
+		},
+	}
+
+	_, err = m.indexes.CreateMany(ctx, models)
 	if err != nil {
-		return fmt.Errorf("%w: %s", ErrInsertingUser, err)
+		return driverError(ErrCreatingIndexes, err)
+	}
+
+	if m.tokenIndexes != nil {
+		_, err = m.tokenIndexes.CreateMany(ctx, tokenIndexModels())
+		if err != nil {
+			return driverError(ErrCreatingIndexes, err)
+		}
 	}
 
 	return nil
 }
+
+// CreateUser inserts user after replacing its password with a bcrypt hash and
+// returns the stored user. User gets an ID from the repo IDGenerator when it
+// has none, and is updated in place with it and the other fields set on
+// insert. A user whose ID or email is already taken is rejected with
+// ErrUserAlreadyExists. opts can override the write concern of this insert,
+// and skip its validation, hashing or event with SkipValidation,
+// WithRawPassword and SuppressEvents. A user built by NewUser isn't validated
+// again, unless changed since.
+func (m *MongoRepo) CreateUser(ctx context.Context, user *User, opts ...WriteOption) (_ *User, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "CreateUser", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	if user == nil {
+		return nil, fmt.Errorf("%w: user is nil", ErrInvalidUser)
+	}
+
+	writeOpts := newWriteOptions(opts)
+
+	err = m.validateNewUser(user, writeOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := user.Password
+	if !writeOpts.rawPassword {
+		hash, err = m.hashPassword(user.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if user.ID.IsZero() {
+		user.ID = m.newID()
+	}
+
+	call.userID = user.ID
+	user.Password = hash
+	user.Version = 1
+	user.CreatedAt = m.timestamp()
+	user.UpdatedAt = user.CreatedAt
+
+	if user.Role == "" {
+		user.Role = RoleMember
+	}
+
+	caller, err := m.writeCaller(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := toDocument(user)
+
+	err = m.documents(caller).insert(ctx, m.encrypted(doc))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, alreadyExistsError(doc.ID, doc.Email, err)
+	}
+
+	if err != nil {
+		return nil, translateWriteError(ErrInsertingUser, err)
+	}
+
+	err = m.writeAudit(ctx, "CreateUser", nil, fromDocument(doc))
+	if !writeOpts.suppressEvents {
+		err = m.publishAudited(ctx, err, EventUserCreated, doc.ID, doc.Email)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fromDocument(doc), nil
+}
+
+// validateNewUser checks user can be created given writeOpts, and normalizes
+// its email.
+func (m *MongoRepo) validateNewUser(user *User, writeOpts writeOptions) error {
+	if writeOpts.rawPassword {
+		if !isPasswordHash(user.Password) {
+			return fmt.Errorf("%w: password is not a bcrypt hash", ErrInvalidUser)
+		}
+	}
+
+	if writeOpts.skipValidation {
+		user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+		if user.Email == "" {
+			return fmt.Errorf("%w: email is empty", ErrInvalidUser)
+		}
+
+		return nil
+	}
+
+	// A user from NewUser is already validated and its email normalized.
+	trusted := user.trusted()
+
+	if !trusted {
+		err := user.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The policy is about the passwords users choose, not their hashes.
+	if !writeOpts.rawPassword {
+		err := m.checkPassword(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	if trusted {
+		return nil
+	}
+
+	var err error
+	user.Email, err = NormalizeEmail(user.Email)
+
+	return err
+}
+
+// BulkOptions tunes a CreateUsers call.
+type BulkOptions struct {
+	// Ordered stops the insert at the first user refused, leaving out the
+	// users after it. Otherwise every user is tried. CreateUsers called
+	// without BulkOptions makes an ordered insert.
+	Ordered bool
+}
+
+// CreateUsers inserts users in a single round trip and returns their IDs in
+// input order. Users without an ID get one from the repo IDGenerator, and
+// passwords are replaced with their bcrypt hash like in CreateUser. Every user
+// is validated before any is inserted, and only the stored users are updated
+// with their ID, hash, version and timestamps, so a failed batch can be fixed
+// and retried as is.
+//
+// The insert is ordered unless opts, of which only the first is used, says
+// otherwise. Users refused by the database make it fail with a
+// *BulkInsertError telling which ones, and how many were stored.
+func (m *MongoRepo) CreateUsers(ctx context.Context, users []*User, opts ...BulkOptions) (
+	_ []primitive.ObjectID, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "CreateUsers", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	if len(users) == 0 {
+		return []primitive.ObjectID{}, nil
+	}
+
+	emails := make([]string, len(users))
+
+	for i, user := range users {
+		if user == nil {
+			return nil, fmt.Errorf("%w: user at index %d is nil", ErrInvalidUser, i)
+		}
+
+		err := user.Validate()
+		if err == nil {
+			err = m.checkPassword(user.Password)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("user at index %d: %w", i, err)
+		}
+
+		emails[i], err = NormalizeEmail(user.Email)
+		if err != nil {
+			return nil, fmt.Errorf("user at index %d: %w", i, err)
+		}
+	}
+
+	// created are the users as stored, copied back into users once they are.
+	created := make([]*User, len(users))
+	documents := make([]interface{}, 0, len(users))
+	now := m.timestamp()
+
+	for i, user := range users {
+		hash, err := m.hashPassword(user.Password)
+		if err != nil {
+			return nil, fmt.Errorf("user at index %d: %w", i, err)
+		}
+
+		stored := *user
+		stored.Email = emails[i]
+		stored.Password = hash
+		stored.Version = 1
+		stored.CreatedAt = now
+		stored.UpdatedAt = now
+
+		if stored.Role == "" {
+			stored.Role = RoleMember
+		}
+
+		if stored.ID.IsZero() {
+			stored.ID = m.newID()
+		}
+
+		created[i] = &stored
+		documents = append(documents, m.encrypted(toDocument(&stored)))
+	}
+
+	ordered := len(opts) == 0 || opts[0].Ordered
+
+	result, err := m.mongoCaller.InsertMany(ctx, documents, options.InsertMany().SetOrdered(ordered))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		insertErr := newBulkInsertError(created, bulkErr, ordered)
+		insertErr.Err = err
+
+		for i, user := range created {
+			_, failed := insertErr.errs[i]
+			if failed || (ordered && i >= insertErr.succeeded) {
+				continue
+			}
+
+			*users[i] = *user
+
+			err = m.publishAudited(ctx, m.writeAudit(ctx, "CreateUsers", nil, user), EventUserCreated, user.ID, user.Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, insertErr
+	}
+
+	if err != nil {
+		return nil, translateWriteError(ErrInsertingUser, err)
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(result.InsertedIDs))
+
+	for i, insertedID := range result.InsertedIDs {
+		id, ok := insertedID.(primitive.ObjectID)
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected id type %T", ErrInsertingUser, insertedID)
+		}
+
+		created[i].ID = id
+		ids = append(ids, id)
+	}
+
+	for i, user := range created {
+		*users[i] = *user
+
+		err = m.publishAudited(ctx, m.writeAudit(ctx, "CreateUsers", nil, user), EventUserCreated, user.ID, user.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ids, nil
+}
+
+func (m *MongoRepo) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (_ *User, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "GetUserByID", id)
+	defer m.end(ctx, &call, &err)
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := m.documents(caller).findOne(ctx, readOpts.apply(bson.M{"_id": id}), readOpts.findOneOptions())
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	return m.decode(doc)
+}
+
+// GetUsersByIDs fetches the users with the given IDs in a single query. IDs
+// that don't match a user are absent from the returned map.
+func (m *MongoRepo) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID, opts ...ReadOption) (
+	_ map[primitive.ObjectID]*User, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "GetUsersByIDs", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	users := make(map[primitive.ObjectID]*User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	seen := make(map[primitive.ObjectID]struct{}, len(ids))
+	unique := make([]primitive.ObjectID, 0, len(ids))
+
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := caller.Find(ctx, readOpts.apply(bson.M{"_id": bson.M{"$in": unique}}), readOpts.findOptions())
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	found, err := m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	for _, user := range found {
+		users[user.ID] = user
+	}
+
+	return users, nil
+}
+
+// GetUserByEmail looks a user up by email. Emails are expected to be unique, so
+// more than one match is reported as ErrMultipleUsersFound instead of returning
+// an arbitrary document.
+func (m *MongoRepo) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (_ *User, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "GetUserByEmail", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	email, err = NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	readOpts := newReadOptions(opts)
+
+	// Logins must see the latest password, so unless told otherwise the
+	// primary is read whatever the repo read preference.
+	if readOpts.readPreference == nil {
+		readOpts.readPreference = readpref.Primary()
+	}
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := caller.Find(ctx, readOpts.apply(m.emailFilter(email)), readOpts.findOptions().
+		SetLimit(2).
+		SetCollation(m.emailCollation(true)))
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	users, err := m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, driverError(ErrFindingUser, err)
+	}
+
+	switch len(users) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	case 1:
+		return users[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrMultipleUsersFound, email)
+	}
+}
+
+// UpdateUser replaces the stored document matching user.ID with user and
+// bumps its UpdatedAt. As the whole document is written, user should come from
+// a read made WithPassword so the password hash and CreatedAt are kept. A
+// password which isn't a hash is a new one, checked against the password
+// policy and hashed like CreateUser does.
+//
+// The replace only applies if the stored document still has user.Version,
+// otherwise ErrVersionConflict is returned and the caller should read the user
+// again and retry. On success user.Version holds the new version. opts can
+// override the write concern of this update.
+func (m *MongoRepo) UpdateUser(ctx context.Context, user *User, opts ...WriteOption) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	if user == nil {
+		return fmt.Errorf("%w: user is nil", ErrInvalidUser)
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "UpdateUser", user.ID)
+	defer m.end(ctx, &call, &err)
+
+	if user.ID.IsZero() {
+		return fmt.Errorf("%w: id is zero", ErrInvalidUserID)
+	}
+
+	err = user.Validate()
+	if err != nil {
+		return err
+	}
+
+	user.Email, err = NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+
+	if !isPasswordHash(user.Password) {
+		err = m.checkPassword(user.Password)
+		if err != nil {
+			return err
+		}
+
+		user.Password, err = m.hashPassword(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	user.UpdatedAt = m.timestamp()
+
+	caller, err := m.writeCaller(opts)
+	if err != nil {
+		return err
+	}
+
+	before, err := m.snapshot(ctx, "UpdateUser", bson.M{"_id": user.ID})
+	if err != nil {
+		return err
+	}
+
+	replacement := *user
+	replacement.Version = user.Version + 1
+
+	matched, err := m.documents(caller).replace(ctx, versionFilter(user.ID, user.Version),
+		m.encrypted(toDocument(&replacement)))
+	if mongo.IsDuplicateKeyError(err) {
+		return alreadyExistsError(user.ID, user.Email, err)
+	}
+
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	if !matched {
+		return m.missOrConflict(ctx, user.ID)
+	}
+
+	user.Version = replacement.Version
+
+	return m.publishAudited(ctx, m.audit(ctx, "UpdateUser", bson.M{"_id": user.ID}, before),
+		EventUserUpdated, user.ID, user.Email)
+}
+
+func (m *MongoRepo) DeleteUser(ctx context.Context, id primitive.ObjectID) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "DeleteUser", id)
+	defer m.end(ctx, &call, &err)
+
+	before, err := m.snapshot(ctx, "DeleteUser", bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+
+	deleted, err := m.documents(m.mongoCaller).delete(ctx, bson.M{"_id": id})
+	if err != nil {
+		return translateWriteError(ErrDeletingUser, err)
+	}
+
+	if !deleted {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return m.publishAudited(ctx, m.audit(ctx, "DeleteUser", bson.M{"_id": id}, before), EventUserDeleted, id, "")
+}
+
+// DeleteUsersMatching removes every user matching filter and returns how many
+// were deleted. An empty filter is refused unless filter.AllowAll is set. As
+// the deleted users aren't read, no event is published for them.
+func (m *MongoRepo) DeleteUsersMatching(ctx context.Context, filter UserFilter) (deleted int64, err error) {
+	if m.closed.Load() {
+		return 0, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "DeleteUsersMatching", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	query := m.userFilter(filter)
+	if len(query) == 0 && !filter.AllowAll {
+		return 0, ErrRefusingFullDelete
+	}
+
+	result, err := m.mongoCaller.DeleteMany(ctx, query,
+		options.Delete().SetCollation(m.emailCollation(filter.Email != "")))
+	if err != nil {
+		return 0, translateWriteError(ErrDeletingUser, err)
+	}
+
+	return result.DeletedCount, nil
+}
+
+// ListUsers returns a page of users ordered by ID unless SortBy says otherwise.
+// A limit lower than one falls back to the repo page size and is capped at
+// maxPageSize.
+func (m *MongoRepo) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) ([]*User, error) {
+	return m.listUsers(ctx, "ListUsers", bson.M{}, limit, offset, opts)
+}
+
+// ListUsersByRole is ListUsers restricted to users with the given role.
+func (m *MongoRepo) ListUsersByRole(ctx context.Context, role string, limit, offset int64, opts ...ReadOption) (
+	[]*User, error,
+) {
+	if !validRole(role) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+
+	return m.listUsers(ctx, "ListUsersByRole", bson.M{"role": role}, limit, offset, opts)
+}
+
+// listUsers runs the listing of the method op.
+func (m *MongoRepo) listUsers(ctx context.Context, op string, filter bson.M, limit, offset int64, opts []ReadOption) (
+	_ []*User, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, op, primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	limit = m.pageLimit(limit)
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, err := readOpts.sort()
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := readOpts.findOptions().
+		SetSort(sort).
+		SetLimit(limit).
+		SetSkip(offset)
+
+	docs, err := m.documents(caller).find(ctx, readOpts.apply(filter), findOptions)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	users, err := m.decodeAll(docs)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	return users, nil
+}
+
+func (m *MongoRepo) CountUsers(ctx context.Context) (_ int64, err error) {
+	if m.closed.Load() {
+		return 0, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "CountUsers", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return 0, driverError(ErrCountingUsers, err)
+	}
+
+	return count, nil
+}
+
+func (m *MongoRepo) CountUsersMatching(ctx context.Context, filter UserFilter) (_ int64, err error) {
+	if m.closed.Load() {
+		return 0, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "CountUsersMatching", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	count, err := m.mongoCaller.CountDocuments(ctx, m.userFilter(filter),
+		options.Count().SetCollation(m.emailCollation(filter.Email != "")))
+	if err != nil {
+		return 0, driverError(ErrCountingUsers, err)
+	}
+
+	return count, nil
+}
+
+// FindUsers returns every user matching filter, ordered by ID unless SortBy
+// says otherwise.
+func (m *MongoRepo) FindUsers(ctx context.Context, filter UserFilter, opts ...ReadOption) (_ []*User, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "FindUsers", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, err := readOpts.sort()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := caller.Find(ctx, readOpts.apply(m.userFilter(filter)), readOpts.findOptions().
+		SetSort(sort).
+		SetCollation(m.emailCollation(filter.Email != "")))
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	users, err := m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	return users, nil
+}
+
+// UpsertUser creates the user or updates the one sharing its email. created
+// reports whether a new document was inserted, in which case user.ID holds its
+// ID.
+func (m *MongoRepo) UpsertUser(ctx context.Context, user *User) (created bool, err error) {
+	if m.closed.Load() {
+		return false, ErrRepoClosed
+	}
+
+	if user == nil {
+		return false, fmt.Errorf("%w: user is nil", ErrInvalidUser)
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "UpsertUser", user.ID)
+	defer m.end(ctx, &call, &err)
+
+	err = user.Validate()
+	if err != nil {
+		return false, err
+	}
+
+	err = m.checkPassword(user.Password)
+	if err != nil {
+		return false, err
+	}
+
+	user.Email, err = NormalizeEmail(user.Email)
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := m.hashPassword(user.Password)
+	if err != nil {
+		return false, err
+	}
+
+	now := m.timestamp()
+
+	set := bson.M{
+		"name":       user.Name,
+		"password":   hash,
+		"updated_at": now,
+	}
+
+	setOnInsert := bson.M{"created_at": now}
+	if !user.ID.IsZero() {
+		setOnInsert["_id"] = user.ID
+	}
+
+	// The email is only inserted along the filter when it is stored as is.
+	if m.fields != nil {
+		setOnInsert["email"] = m.fields.encrypt("email", user.Email)
+	}
+
+	// An upsert without a role keeps the current one, or defaults a new user
+	// to RoleMember.
+	if user.Role != "" {
+		set["role"] = user.Role
+	} else {
+		setOnInsert["role"] = RoleMember
+	}
+
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": setOnInsert,
+		// An upserted document starts at version 1.
+		"$inc": bson.M{"version": 1},
+	}
+
+	before, err := m.snapshot(ctx, "UpsertUser", m.emailFilter(user.Email))
+	if err != nil {
+		return false, err
+	}
+
+	result, err := m.mongoCaller.UpdateOne(ctx, m.emailFilter(user.Email), update, options.Update().
+		SetUpsert(true).
+		SetCollation(m.emailCollation(true)))
+	if mongo.IsDuplicateKeyError(err) {
+		// Another upsert inserted the email first, or user.ID belongs to a
+		// user with another email.
+		return false, alreadyExistsError(user.ID, user.Email, err)
+	}
+
+	if err != nil {
+		return false, translateWriteError(ErrUpdatingUser, err)
+	}
+
+	auditErr := m.audit(ctx, "UpsertUser", m.emailFilter(user.Email), before)
+
+	if result.UpsertedID == nil {
+		return false, m.publishAudited(ctx, auditErr, EventUserUpdated, user.ID, user.Email)
+	}
+
+	if id, ok := result.UpsertedID.(primitive.ObjectID); ok {
+		user.ID = id
+	}
+
+	return true, m.publishAudited(ctx, auditErr, EventUserCreated, user.ID, user.Email)
+}
+
+// UpdateUserFields sets the given bson fields on the user with this id,
+// whatever its version. Only keys listed in updatableFields are accepted so a
+// typo can't create a new key. Setting the email unverifies it, as
+// ChangeUserEmail does.
+func (m *MongoRepo) UpdateUserFields(ctx context.Context, id primitive.ObjectID, fields map[string]interface{}) error {
+	return m.updateUserFields(ctx, "UpdateUserFields", bson.M{"_id": id}, id, fields)
+}
+
+// UpdateUserFieldsAtVersion is UpdateUserFields applied only if the user is
+// still at version expected. It returns ErrVersionConflict otherwise.
+func (m *MongoRepo) UpdateUserFieldsAtVersion(
+	ctx context.Context, id primitive.ObjectID, expected int64, fields map[string]interface{},
+) error {
+	return m.updateUserFields(ctx, "UpdateUserFieldsAtVersion", versionFilter(id, expected), id, fields)
+}
+
+// updateUserFields runs the update of the method op.
+func (m *MongoRepo) updateUserFields(
+	ctx context.Context, op string, filter bson.M, id primitive.ObjectID, fields map[string]interface{},
+) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, op, id)
+	defer m.end(ctx, &call, &err)
+
+	if id.IsZero() {
+		return fmt.Errorf("%w: id is zero", ErrInvalidUserID)
+	}
+
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: no fields to update", ErrInvalidField)
+	}
+
+	set := bson.M{}
+	// email is the new email, normalized, when it is set.
+	var email string
+
+	for key, value := range fields {
+		if key == "_id" {
+			return fmt.Errorf("%w: _id can't be updated", ErrInvalidField)
+		}
+
+		if _, ok := updatableFields[key]; !ok {
+			return fmt.Errorf("%w: %s", ErrInvalidField, key)
+		}
+
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s must be a string", ErrInvalidField, key)
+		}
+
+		if problem := validateField(key, text); problem != "" {
+			return fmt.Errorf("%w: %s", ErrInvalidUser, problem)
+		}
+
+		if key == "email" {
+			email, _ = NormalizeEmail(text)
+			maps.Copy(set, m.emailFields(email))
+
+			continue
+		}
+
+		if key == "password" {
+			err := m.checkPassword(text)
+			if err != nil {
+				return err
+			}
+
+			hash, err := m.hashPassword(text)
+			if err != nil {
+				return err
+			}
+
+			value = hash
+		}
+
+		set[key] = value
+	}
+
+	set["updated_at"] = m.timestamp()
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+
+	if _, ok := fields["email"]; ok {
+		// A new email is unverified, whatever the tokens issued for the old one.
+		update["$unset"] = bson.M{"email_verified": ""}
+
+		err = m.revokeVerificationTokens(ctx, id)
+		if err != nil {
+			return driverError(ErrUpdatingUser, err)
+		}
+	}
+
+	before, err := m.snapshot(ctx, op, filter)
+	if err != nil {
+		return err
+	}
+
+	result, err := m.mongoCaller.UpdateOne(ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return alreadyExistsError(id, email, err)
+	}
+
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	if result.MatchedCount == 0 {
+		return m.missOrConflict(ctx, id)
+	}
+
+	return m.publishAudited(ctx, m.audit(ctx, op, bson.M{"_id": id}, before), EventUserUpdated, id, email)
+}
+
+// versionFilter matches the user with this id at version expected. Version 0
+// stands for documents written before versioning, which have no version field.
+func versionFilter(id primitive.ObjectID, expected int64) bson.M {
+	if expected == 0 {
+		return bson.M{"_id": id, "version": bson.M{"$exists": false}}
+	}
+
+	return bson.M{"_id": id, "version": expected}
+}
+
+// missOrConflict explains why a versioned write matched nothing: either the
+// user doesn't exist or it is at another version.
+func (m *MongoRepo) missOrConflict(ctx context.Context, id primitive.ObjectID) error {
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return driverError(ErrUpdatingUser, err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return fmt.Errorf("%w: %s", ErrVersionConflict, id.Hex())
+}
+
+// SoftDeleteUser hides the user from reads without removing the document, and
+// moves it to the next version. Soft-deleting an already soft-deleted user
+// keeps its original DeletedAt.
+func (m *MongoRepo) SoftDeleteUser(ctx context.Context, id primitive.ObjectID) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "SoftDeleteUser", id)
+	defer m.end(ctx, &call, &err)
+
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+
+	before, err := m.snapshot(ctx, "SoftDeleteUser", filter)
+	if err != nil {
+		return err
+	}
+
+	now := m.timestamp()
+
+	result, err := m.mongoCaller.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{"deleted_at": now, "updated_at": now},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return translateWriteError(ErrDeletingUser, err)
+	}
+
+	if result.MatchedCount > 0 {
+		return m.publishAudited(ctx, m.audit(ctx, "SoftDeleteUser", bson.M{"_id": id}, before), EventUserDeleted, id, "")
+	}
+
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return driverError(ErrDeletingUser, err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return nil
+}
+
+// RestoreUser makes a soft-deleted user visible again, and moves it to the
+// next version. Restoring a user which isn't soft-deleted does nothing.
+func (m *MongoRepo) RestoreUser(ctx context.Context, id primitive.ObjectID) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "RestoreUser", id)
+	defer m.end(ctx, &call, &err)
+
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}}
+
+	before, err := m.snapshot(ctx, "RestoreUser", filter)
+	if err != nil {
+		return err
+	}
+
+	result, err := m.mongoCaller.UpdateOne(ctx, filter, bson.M{
+		"$set":   bson.M{"updated_at": m.timestamp()},
+		"$unset": bson.M{"deleted_at": ""},
+		"$inc":   bson.M{"version": 1},
+	})
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	if result.MatchedCount > 0 {
+		return m.publishAudited(ctx, m.audit(ctx, "RestoreUser", bson.M{"_id": id}, before), EventUserUpdated, id, "")
+	}
+
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return driverError(ErrUpdatingUser, err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return nil
+}
+
+// UserExistsByEmail reports whether a user, soft-deleted or not, already uses
+// email. It only counts documents so no user data leaves the database.
+func (m *MongoRepo) UserExistsByEmail(ctx context.Context, email string) (_ bool, err error) {
+	if m.closed.Load() {
+		return false, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "UserExistsByEmail", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	email, err = NormalizeEmail(email)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := m.mongoCaller.CountDocuments(ctx, m.emailFilter(email), options.Count().
+		SetLimit(1).
+		SetCollation(m.emailCollation(true)))
+	if err != nil {
+		return false, driverError(ErrCountingUsers, err)
+	}
+
+	return count > 0, nil
+}
+
+// ListUsersAfter returns up to limit users whose ID is greater than afterID,
+// ordered by ID. next is the afterID of the following page, or the zero
+// ObjectID once every user has been returned. A zero afterID starts from the
+// beginning.
+//
+// Deprecated: use ListUsersPage, whose tokens clients can't forge nor read
+// IDs from. ListUsersAfter stays as the UserRepository method the tokens are
+// built on.
+func (m *MongoRepo) ListUsersAfter(ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption) (
+	users []*User, next primitive.ObjectID, err error,
+) {
+	if m.closed.Load() {
+		return nil, primitive.NilObjectID, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "ListUsersAfter", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	limit = m.pageLimit(limit)
+
+	filter := bson.M{}
+	if !afterID.IsZero() {
+		filter["_id"] = bson.M{"$gt": afterID}
+	}
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, primitive.NilObjectID, err
+	}
+
+	// One extra document tells whether another page exists.
+	findOptions := readOpts.findOptions().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit + 1)
+
+	cursor, err := caller.Find(ctx, readOpts.apply(filter), findOptions)
+	if err != nil {
+		return nil, primitive.NilObjectID, driverError(ErrListingUsers, err)
+	}
+
+	users, err = m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, primitive.NilObjectID, driverError(ErrListingUsers, err)
+	}
+
+	if int64(len(users)) <= limit {
+		return users, primitive.NilObjectID, nil
+	}
+
+	users = users[:limit]
+
+	return users, users[limit-1].ID, nil
+}
+
+// SearchUsersByName returns up to limit users whose name starts with prefix,
+// ordered by name. The prefix is matched literally.
+func (m *MongoRepo) SearchUsersByName(ctx context.Context, prefix string, limit int64, opts ...ReadOption) (
+	_ []*User, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "SearchUsersByName", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	readOpts := newReadOptions(opts)
+
+	caller, err := m.readCaller(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := readOpts.apply(bson.M{
+		"name": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix)},
+	})
+
+	findOptions := readOpts.findOptions().
+		SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(m.pageLimit(limit))
+
+	cursor, err := caller.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	users, err := m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	return users, nil
+}
+
+// pageLimit applies the repo page size to a non-positive limit and caps it at
+// maxPageSize.
+func (m *MongoRepo) pageLimit(limit int64) int64 {
+	if limit <= 0 {
+		limit = m.pageSize
+	}
+
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return limit
+}
+
+// ChangeUserEmail atomically sets the email of the user with this id and
+// returns the updated user. The new email is unverified, the tokens of
+// StartEmailVerification being revoked.
+func (m *MongoRepo) ChangeUserEmail(ctx context.Context, id primitive.ObjectID, newEmail string) (_ *User, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "ChangeUserEmail", id)
+	defer m.end(ctx, &call, &err)
+
+	email, err := NormalizeEmail(newEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	findOneAndUpdateOptions := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"password": 0})
+
+	set := m.emailFields(email)
+	set["updated_at"] = m.timestamp()
+
+	err = m.revokeVerificationTokens(ctx, id)
+	if err != nil {
+		return nil, driverError(ErrUpdatingUser, err)
+	}
+
+	before, err := m.snapshot(ctx, "ChangeUserEmail", bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc userDocument
+
+	err = m.mongoCaller.FindOneAndUpdate(
+		ctx, bson.M{"_id": id}, bson.M{
+			"$set":   set,
+			"$unset": bson.M{"email_verified": ""},
+			"$inc":   bson.M{"version": 1},
+		}, findOneAndUpdateOptions,
+	).Decode(&doc)
+
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	case mongo.IsDuplicateKeyError(err):
+		return nil, fmt.Errorf("%w: %w", ErrEmailAlreadyTaken, alreadyExistsError(id, email, err))
+	case err != nil:
+		return nil, translateWriteError(ErrUpdatingUser, err)
+	}
+
+	err = m.publishAudited(ctx, m.audit(ctx, "ChangeUserEmail", bson.M{"_id": id}, before),
+		EventUserUpdated, doc.ID, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.decode(&doc)
+}
+
+// DistinctEmails returns every email in use, sorted. Documents without an
+// email are ignored.
+func (m *MongoRepo) DistinctEmails(ctx context.Context) (_ []string, err error) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "DistinctEmails", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	if m.fields != nil {
+		return m.decryptedEmails(ctx)
+	}
+
+	values, err := m.mongoCaller.Distinct(ctx, "email", bson.M{})
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	emails := make([]string, 0, len(values))
+
+	for _, value := range values {
+		email, ok := value.(string)
+		if !ok || email == "" {
+			continue
+		}
+
+		emails = append(emails, email)
+	}
+
+	sort.Strings(emails)
+
+	return emails, nil
+}
+
+// decryptedEmails is DistinctEmails for encrypted emails, which the server
+// can't tell apart: each has to be read and decrypted.
+func (m *MongoRepo) decryptedEmails(ctx context.Context) ([]string, error) {
+	cursor, err := m.mongoCaller.Find(ctx, bson.M{"email": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"email": 1}))
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	users, err := m.decodeUsers(ctx, cursor)
+	if err != nil {
+		return nil, driverError(ErrListingUsers, err)
+	}
+
+	emails := make([]string, 0, len(users))
+	for _, user := range users {
+		emails = append(emails, user.Email)
+	}
+
+	sort.Strings(emails)
+
+	return slices.Compact(emails), nil
+}
+
+// withTimeout applies operationTimeout to ctx unless the caller already set a
+// deadline.
+func (m *MongoRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.operationTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, m.operationTimeout)
+}
+
+// newID falls back to primitive.NewObjectID for a repo built as a struct
+// literal.
+func (m *MongoRepo) newID() primitive.ObjectID {
+	if m.ids == nil {
+		return primitive.NewObjectID()
+	}
+
+	return m.ids.NewID()
+}
+
+// now reads the repo clock, falling back to the system one for a repo built
+// as a struct literal.
+func (m *MongoRepo) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+
+	return m.clock.Now()
+}
+
+// timestamp returns the current time of the repo clock, in UTC and truncated to
+// the millisecond precision of BSON dates so stored values compare equal.
+func (m *MongoRepo) timestamp() time.Time {
+	return m.now().UTC().Truncate(time.Millisecond)
+}
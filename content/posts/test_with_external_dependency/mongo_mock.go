@@ -1,39 +1,2576 @@
-package main
+package users
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
+	// emailWitchTriggersError makes the writes of a user with this email fail.
+	//
+	// Deprecated: use FailWhen with FailOnEmail, which works with any email.
 	emailWitchTriggersError = "error@error.com"
+	// emailWitchTriggersWriteConcernError is written by InsertOne and
+	// ReplaceOne, which then report the write concern as not satisfied.
+	emailWitchTriggersWriteConcernError = "write-concern@error.com"
 )
 
-var _ MongoCaller = (*MockMongo)(nil)
+var (
+	// idWitchTriggersDecodeError is served by FindOne as a document that cannot
+	// be decoded into a userDocument.
+	idWitchTriggersDecodeError = primitive.ObjectID{0xde, 0xc0, 0xde}
+	// idWitchTriggersError makes DeleteOne fail as if the driver errored.
+	idWitchTriggersError = primitive.ObjectID{0xe7, 0x7e}
+)
+
+var (
+	_ MongoCaller  = (*MockMongo)(nil)
+	_ IndexCreator = (*MockMongo)(nil)
+)
+
+// MockMongo is safe for concurrent use: reads of the recorded state take mu
+// for reading, and the MongoCaller methods, which count and record calls, for
+// writing.
+type MockMongo struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]userDocument
+	// uniqueEmail makes inserts behave as if a unique index on email existed.
+	// It is turned on by creating that index or by WithUniqueEmail.
+	uniqueEmail bool
+	// caselessEmail makes that index ignore case, as when it is created with a
+	// collation of strength 1 or 2.
+	caselessEmail bool
+	// expiring is set once a TTL index on expires_at exists. Reads then skip
+	// users whose expires_at is past according to now.
+	expiring bool
+	now      func() time.Time
+	// disconnects counts the calls to Disconnect.
+	disconnects int
+	// transientFailures makes that many calls fail with a network error
+	// before the mock behaves again, to exercise retries.
+	transientFailures int
+	// calls counts the MongoCaller calls made, failed ones included.
+	calls int
+	// writeConcern and readPreference are the last ones set through Clone.
+	writeConcern   *writeconcern.WriteConcern
+	readPreference *readpref.ReadPref
+	pingErr        error
+	// delay makes every call wait that long first, or until its context is
+	// done, to simulate a wedged server. latencies, set by SetLatency, and
+	// latencyFunc, set by SetLatencyFunc, override it.
+	delay       time.Duration
+	latencies   map[string]time.Duration
+	latencyFunc func(method string) time.Duration
+	// writeErr, when set, is returned by every write, such as a
+	// mongo.WriteException with the code under test.
+	writeErr error
+	// failures are the rules set by FailNext, FailAlways and FailAfterN, by
+	// method, in the order they apply.
+	failures map[string][]*failureRule
+	// predicates are the ones given to FailWhen.
+	predicates []func(method string, doc interface{}) error
+	// recorded are the MongoCaller calls made, in order.
+	recorded []Call
+	// corrupted are the users set by CorruptUser.
+	corrupted map[primitive.ObjectID]struct{}
+	// namespaces are the mocks of the tenant namespaces, see Namespace.
+	namespaces map[TenantNamespace]*MockMongo
+	// legacyTriggers enables the emailWitchTriggers and idWitchTriggers
+	// values. NewMockMongo turns it on for the tests written before FailNext
+	// and friends.
+	legacyTriggers bool
+}
+
+// Call is a MongoCaller call recorded by MockMongo.
+type Call struct {
+	Method string
+	// Args are the arguments after the context, such as the filter and the
+	// update. Documents are copied as bson.M so that later changes made by
+	// the caller don't show.
+	Args []interface{}
+	// Deadline is the deadline of the context of the call, zero if none.
+	Deadline time.Time
+	At       time.Time
+}
+
+// testReporter is the part of *testing.T used by AssertCalledWith.
+type testReporter interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// failureRule makes a method fail with err once skip calls went through, for
+// times calls or forever if times is negative.
+type failureRule struct {
+	err   error
+	skip  int
+	times int
+}
+
+// MockOption configures the mock built by NewMockMongo.
+type MockOption func(*MockMongo)
+
+// WithUniqueEmail makes the mock enforce the unique index on email from the
+// start, as if EnsureIndexes had run. Emails are compared as stored, so
+// differences of case only collide once the repo normalized them.
+func WithUniqueEmail() MockOption {
+	return func(m *MockMongo) {
+		m.uniqueEmail = true
+	}
+}
+
+func NewMockMongo(opts ...MockOption) *MongoRepo {
+	mock := &MockMongo{
+		users:          make(map[primitive.ObjectID]userDocument),
+		legacyTriggers: true,
+	}
+
+	for _, opt := range opts {
+		opt(mock)
+	}
+
+	repo := NewMongoRepoFromCollection(mock)
+	repo.bcryptCost = bcrypt.MinCost
+	repo.collection = defaultCollection
+	// Tests check the mock gets disconnected.
+	repo.ownsClient = true
+
+	// Expiry follows the repo clock so tests moving it see users expire.
+	mock.now = repo.now
+
+	return repo
+}
+
+// NewTenantMockMongo returns a repo given WithTenantResolver(resolver) on a
+// MockMongo, and the mock. The users of each namespace resolver returns are
+// stored by a mock of their own, see Namespace, so that tenants share none.
+func NewTenantMockMongo(resolver TenantResolver, opts ...MockOption) (*MongoRepo, *MockMongo) {
+	repo := NewMockMongo(opts...)
+	mock := repo.mongoCaller.(*MockMongo)
+
+	repo.useTenants(resolver, func(ns TenantNamespace) userCollection {
+		tenant := mock.Namespace(ns)
+		return userCollection{caller: tenant, indexes: tenant}
+	})
+
+	return repo, mock
+}
+
+// Namespace returns the mock storing the users of the tenant namespace ns,
+// for tests to inspect or fail the calls made on behalf of a tenant. It starts
+// empty, with the options and indexes m has then.
+func (m *MockMongo) Namespace(ns TenantNamespace) *MockMongo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tenant, ok := m.namespaces[ns]
+	if ok {
+		return tenant
+	}
+
+	tenant = &MockMongo{
+		users:          make(map[primitive.ObjectID]userDocument),
+		uniqueEmail:    m.uniqueEmail,
+		caselessEmail:  m.caselessEmail,
+		expiring:       m.expiring,
+		now:            m.now,
+		legacyTriggers: m.legacyTriggers,
+	}
+
+	if m.namespaces == nil {
+		m.namespaces = make(map[TenantNamespace]*MockMongo)
+	}
+
+	m.namespaces[ns] = tenant
+
+	return tenant
+}
+
+func (m *MockMongo) Disconnect(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.disconnects++
+
+	return nil
+}
+
+// Users returns a copy of every stored user ordered by ID, soft-deleted and
+// expired ones included, for tests to inspect what the repo wrote.
+func (m *MockMongo) Users() []*User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stored := m.sortedUsers()
+
+	users := make([]*User, 0, len(stored))
+	for i := range stored {
+		users = append(users, fromDocument(&stored[i]))
+	}
+
+	return users
+}
+
+// Reset empties the mock so subtests can share it. The users, counters and
+// injected failures are cleared while the indexes created through CreateMany
+// are kept, as after deleting every document of a collection. The mocks of
+// the namespaces are reset too.
+func (m *MockMongo) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tenant := range m.namespaces {
+		tenant.Reset()
+	}
+
+	m.users = make(map[primitive.ObjectID]userDocument)
+	m.disconnects = 0
+	m.transientFailures = 0
+	m.calls = 0
+	m.writeConcern = nil
+	m.readPreference = nil
+	m.pingErr = nil
+	m.delay = 0
+	m.latencies = nil
+	m.latencyFunc = nil
+	m.writeErr = nil
+	m.failures = nil
+	m.predicates = nil
+	m.recorded = nil
+	m.corrupted = nil
+}
+
+// CorruptUser makes Find serve the stored user with this id as a document
+// which can't be decoded into a userDocument, to fail a listing midway.
+func (m *MockMongo) CorruptUser(id primitive.ObjectID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.corrupted == nil {
+		m.corrupted = make(map[primitive.ObjectID]struct{})
+	}
+
+	m.corrupted[id] = struct{}{}
+}
+
+// Calls returns the MongoCaller calls made so far, in order.
+func (m *MockMongo) Calls() []Call {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Call(nil), m.recorded...)
+}
+
+// CallsTo returns the calls made to method, such as "InsertOne", in order.
+func (m *MockMongo) CallsTo(method string) []Call {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var calls []Call
+
+	for _, call := range m.recorded {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// AssertCalledWith reports an error on t unless one of the calls made to
+// method satisfies matcher.
+func (m *MockMongo) AssertCalledWith(t testReporter, method string, matcher func(Call) bool) bool {
+	t.Helper()
+
+	calls := m.CallsTo(method)
+
+	for _, call := range calls {
+		if matcher(call) {
+			return true
+		}
+	}
+
+	t.Errorf("no matching call to %s among the %d made", method, len(calls))
+
+	return false
+}
+
+// record appends a call to method with args to the recorded ones.
+func (m *MockMongo) record(ctx context.Context, method string, args []interface{}) {
+	call := Call{Method: method, At: time.Now()}
+	call.Deadline, _ = ctx.Deadline()
+
+	for _, arg := range args {
+		call.Args = append(call.Args, copyArg(arg))
+	}
+
+	m.recorded = append(m.recorded, call)
+}
+
+// copyArg returns a copy of arg as a bson.M when it is a document or a list
+// of documents, and arg itself otherwise. The documents the repo passes are
+// copied by hand: going through BSON would cost more than the call recorded.
+func copyArg(arg interface{}) interface{} {
+	switch arg := arg.(type) {
+	case []interface{}:
+		copied := make(bson.A, 0, len(arg))
+		for _, item := range arg {
+			copied = append(copied, copyArg(item))
+		}
+
+		return copied
+	case *userDocument:
+		return documentFields(*arg)
+	case bson.M:
+		return copyValue(arg)
+	}
+
+	doc, err := bsonDocument(arg)
+	if err != nil {
+		return arg
+	}
+
+	return doc
+}
+
+// copyValue deep copies the documents and arrays of v, the other values being
+// immutable or copied as is.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		copied := make(bson.M, len(v))
+		for key, value := range v {
+			copied[key] = copyValue(value)
+		}
+
+		return copied
+	case bson.D:
+		copied := make(bson.D, 0, len(v))
+		for _, e := range v {
+			copied = append(copied, bson.E{Key: e.Key, Value: copyValue(e.Value)})
+		}
+
+		return copied
+	case bson.A:
+		copied := make(bson.A, 0, len(v))
+		for _, item := range v {
+			copied = append(copied, copyValue(item))
+		}
+
+		return copied
+	case []interface{}:
+		copied := make(bson.A, 0, len(v))
+		for _, item := range v {
+			copied = append(copied, copyValue(item))
+		}
+
+		return copied
+	case []primitive.ObjectID:
+		return append([]primitive.ObjectID(nil), v...)
+	case []string:
+		return append([]string(nil), v...)
+	case *time.Time:
+		return copyTime(v)
+	default:
+		return v
+	}
+}
+
+// FailWhen makes every call for which predicate returns an error fail with
+// it. doc is the document written by InsertOne, ReplaceOne and, one document
+// at a time, InsertMany, and the filter for the other methods. InsertMany
+// stops at the first failing document and reports it as the server does, as
+// a write error at its index.
+func (m *MockMongo) FailWhen(predicate func(method string, doc interface{}) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.predicates = append(m.predicates, predicate)
+}
+
+// FailOnEmail returns a FailWhen predicate failing with err the calls writing
+// a user with email or filtering on it.
+func FailOnEmail(email string, err error) func(method string, doc interface{}) error {
+	return func(method string, doc interface{}) error {
+		switch doc := doc.(type) {
+		case *userDocument:
+			if doc.Email == email {
+				return err
+			}
+		case bson.M:
+			if doc["email"] == email {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// predicateFailure returns the error of the first FailWhen predicate failing
+// the call to method on doc.
+func (m *MockMongo) predicateFailure(method string, doc interface{}) error {
+	for _, predicate := range m.predicates {
+		if err := predicate(method, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetLatency makes every call to method take d, or until its context is done.
+func (m *MockMongo) SetLatency(method string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.latencies == nil {
+		m.latencies = make(map[string]time.Duration)
+	}
+
+	m.latencies[method] = d
+}
+
+// SetLatencyFunc makes every call take the duration latency returns for its
+// method, taking precedence over SetLatency.
+func (m *MockMongo) SetLatencyFunc(latency func(method string) time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.latencyFunc = latency
+}
+
+// latency is how long a call to method waits before running, unless
+// SetLatencyFunc overrides it.
+func (m *MockMongo) latency(method string) time.Duration {
+	if d, ok := m.latencies[method]; ok {
+		return d
+	}
+
+	return m.delay
+}
+
+// wait waits the latency of a call to method, or until ctx is done. It is
+// called with m.mu held and releases it meanwhile, for concurrent calls to
+// wait at the same time and the latency func to be free to use the mock.
+func (m *MockMongo) wait(ctx context.Context, method string) error {
+	latencyFunc, d := m.latencyFunc, m.latency(method)
+	if latencyFunc == nil && d <= 0 {
+		return nil
+	}
+
+	m.mu.Unlock()
+	defer m.mu.Lock()
+
+	if latencyFunc != nil {
+		d = latencyFunc(method)
+	}
+
+	if d <= 0 {
+		return nil
+	}
+
+	return sleepContext(ctx, d)
+}
+
+// FailNext makes the next call to method, a MongoCaller method name such as
+// "InsertOne", fail with err. Calling it twice fails the next two calls.
+func (m *MockMongo) FailNext(method string, err error) {
+	m.addFailure(method, &failureRule{err: err, times: 1})
+}
+
+// FailAlways makes every call to method fail with err until Reset.
+func (m *MockMongo) FailAlways(method string, err error) {
+	m.addFailure(method, &failureRule{err: err, times: -1})
+}
 
-type MockMongo struct{}
+// FailAfterN lets n calls to method through, then fails every following call
+// with err until Reset.
+func (m *MockMongo) FailAfterN(method string, n int, err error) {
+	m.addFailure(method, &failureRule{err: err, skip: n, times: -1})
+}
+
+func (m *MockMongo) addFailure(method string, rule *failureRule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failures == nil {
+		m.failures = make(map[string][]*failureRule)
+	}
+
+	m.failures[method] = append(m.failures[method], rule)
+}
+
+// ruleFailure returns the error the rules of method give for this call, if
+// any, consuming them.
+func (m *MockMongo) ruleFailure(method string) error {
+	rules := m.failures[method]
+	if len(rules) == 0 {
+		return nil
+	}
 
-func NewMockMongo() *MongoRepo {
-	return &MongoRepo{
-		mongoCaller: MockMongo{},
+	rule := rules[0]
+
+	if rule.skip > 0 {
+		rule.skip--
+		return nil
+	}
+
+	if rule.times > 0 {
+		rule.times--
+
+		if rule.times == 0 {
+			m.failures[method] = rules[1:]
+		}
 	}
+
+	return rule.err
 }
 
-func (m MockMongo) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+func (m *MockMongo) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
 	*mongo.InsertOneResult, error,
 ) {
-	doc, ok := document.(*User)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "InsertOne", document); err != nil {
+		return nil, err
+	}
+
+	doc, ok := document.(*userDocument)
 	if !ok {
 		return nil, ErrInsertingUser
 	}
 
-	if doc.Email == emailWitchTriggersError {
+	if m.legacyTriggers && doc.Email == emailWitchTriggersError {
 		return nil, ErrInsertingUser
 	}
 
+	if _, ok := m.users[doc.ID]; ok {
+		return nil, duplicateKeyError(0, "_id_")
+	}
+
+	if m.emailTaken(doc.ID, doc.Email, doc.EmailHash) {
+		return nil, duplicateKeyError(0, "email_1")
+	}
+
+	if m.idempotencyKeyTaken(doc.IdempotencyKey) {
+		return nil, duplicateKeyError(0, "idempotency_key_1")
+	}
+
+	m.users[doc.ID] = copyDocument(doc)
+
+	if m.legacyTriggers && doc.Email == emailWitchTriggersWriteConcernError {
+		return nil, writeConcernError()
+	}
+
 	return &mongo.InsertOneResult{
 		InsertedID: doc.ID,
 	}, nil
 }
+
+// Ping fails with pingErr when set, to simulate an unreachable server.
+func (m *MockMongo) Ping(ctx context.Context, rp *readpref.ReadPref) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.wait(ctx, "Ping")
+	if err != nil {
+		return err
+	}
+
+	return m.pingErr
+}
+
+// Clone records the write concern and read preference of opts and returns the
+// mock itself, so the operations that follow share its state.
+func (m *MockMongo) Clone(opts ...*options.CollectionOptions) (MongoCaller, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, opt := range opts {
+		if opt.WriteConcern != nil {
+			m.writeConcern = opt.WriteConcern
+		}
+
+		if opt.ReadPreference != nil {
+			m.readPreference = opt.ReadPreference
+		}
+	}
+
+	return m, nil
+}
+
+func (m *MockMongo) CreateMany(
+	ctx context.Context, models []mongo.IndexModel, opts ...*options.CreateIndexesOptions,
+) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(models))
+
+	for _, model := range models {
+		keys, ok := model.Keys.(bson.D)
+		if !ok || len(keys) == 0 {
+			return nil, fmt.Errorf("mock: unsupported index keys %T", model.Keys)
+		}
+
+		name := fmt.Sprintf("%s_%v", keys[0].Key, keys[0].Value)
+
+		if model.Options != nil {
+			if model.Options.Name != nil {
+				name = *model.Options.Name
+			}
+
+			if model.Options.Unique != nil && *model.Options.Unique && len(keys) == 1 &&
+				(keys[0].Key == "email" || keys[0].Key == "email_hash") {
+				m.uniqueEmail = true
+				m.caselessEmail = ignoresCase(model.Options.Collation)
+			}
+
+			if model.Options.ExpireAfterSeconds != nil && len(keys) == 1 && keys[0].Key == "expires_at" {
+				m.expiring = true
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// InsertMany inserts documents in order and, like an ordered bulk write, stops
+// at the first user carrying emailWitchTriggersError.
+func (m *MockMongo) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (
+	*mongo.InsertManyResult, error,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "InsertMany", documents); err != nil {
+		return nil, err
+	}
+
+	insertOpts := options.MergeInsertManyOptions(opts...)
+	ordered := insertOpts.Ordered == nil || *insertOpts.Ordered
+
+	result := &mongo.InsertManyResult{}
+
+	var writeErrs []mongo.WriteError
+
+	for i, document := range documents {
+		doc, ok := document.(*userDocument)
+		if !ok {
+			return nil, ErrInsertingUser
+		}
+
+		user := copyDocument(doc)
+		if user.ID.IsZero() {
+			user.ID = primitive.NewObjectID()
+		}
+
+		result.InsertedIDs = append(result.InsertedIDs, user.ID)
+
+		writeErr := m.insertManyFailure(i, &user)
+		if writeErr == nil {
+			m.users[user.ID] = user
+			continue
+		}
+
+		writeErrs = append(writeErrs, *writeErr)
+
+		// An ordered insert stops at its first failure, an unordered one
+		// tries every document.
+		if ordered {
+			break
+		}
+	}
+
+	if len(writeErrs) > 0 {
+		return result, bulkWriteException(writeErrs...)
+	}
+
+	return result, nil
+}
+
+// insertManyFailure returns why the document at index i of an InsertMany,
+// user, is refused, or nil.
+func (m *MockMongo) insertManyFailure(i int, user *userDocument) *mongo.WriteError {
+	if m.legacyTriggers && user.Email == emailWitchTriggersError {
+		return &mongo.WriteError{Index: i, Code: 121, Message: "Document failed validation"}
+	}
+
+	if err := m.predicateFailure("InsertMany", user); err != nil {
+		return &mongo.WriteError{Index: i, Code: 121, Message: err.Error()}
+	}
+
+	if _, ok := m.users[user.ID]; ok {
+		return &duplicateKeyError(i, "_id_").WriteErrors[0]
+	}
+
+	if m.emailTaken(user.ID, user.Email, user.EmailHash) {
+		return &duplicateKeyError(i, "email_1").WriteErrors[0]
+	}
+
+	return nil
+}
+
+func (m *MockMongo) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedFailure(ctx, "FindOne", filter); err != nil {
+		return singleResultError(err)
+	}
+
+	m.purgeExpired()
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	id, _ := f["_id"].(primitive.ObjectID)
+	if m.legacyTriggers && id == idWitchTriggersDecodeError {
+		return mongo.NewSingleResultFromDocument(bson.M{"_id": id, "name": 42}, nil, nil)
+	}
+
+	findOneOptions := options.MergeFindOneOptions(opts...)
+
+	// _id is unique: no need to scan the store in order.
+	if _, byID := f["_id"].(primitive.ObjectID); byID {
+		user, ok := m.users[id]
+		if !ok || !matchesCollated(f, user, findOneOptions.Collation) {
+			return singleResultError(mongo.ErrNoDocuments)
+		}
+
+		doc, err := project(user, findOneOptions.Projection)
+		if err != nil {
+			return singleResultError(err)
+		}
+
+		return mongo.NewSingleResultFromDocument(doc, nil, nil)
+	}
+
+	for _, user := range m.sortedUsers() {
+		if matchesCollated(f, user, findOneOptions.Collation) {
+			doc, err := project(user, findOneOptions.Projection)
+			if err != nil {
+				return singleResultError(err)
+			}
+
+			return mongo.NewSingleResultFromDocument(doc, nil, nil)
+		}
+	}
+
+	return singleResultError(mongo.ErrNoDocuments)
+}
+
+func (m *MockMongo) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedFailure(ctx, "Find", filter); err != nil {
+		return nil, err
+	}
+
+	m.purgeExpired()
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.MergeFindOptions(opts...)
+
+	var matched []userDocument
+
+	for _, user := range m.sortedUsers() {
+		if matchesCollated(f, user, findOptions.Collation) {
+			matched = append(matched, user)
+		}
+	}
+
+	if findOptions.Sort != nil {
+		err := sortUsers(matched, findOptions.Sort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if findOptions.Skip != nil {
+		if *findOptions.Skip >= int64(len(matched)) {
+			matched = nil
+		} else {
+			matched = matched[*findOptions.Skip:]
+		}
+	}
+
+	if findOptions.Limit != nil && *findOptions.Limit > 0 && *findOptions.Limit < int64(len(matched)) {
+		matched = matched[:*findOptions.Limit]
+	}
+
+	docs := make([]interface{}, 0, len(matched))
+
+	for _, user := range matched {
+		if _, ok := m.corrupted[user.ID]; ok {
+			docs = append(docs, bson.M{"_id": user.ID, "name": 42})
+			continue
+		}
+
+		doc, err := project(user, findOptions.Projection)
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+// UpdateOne answers a write colliding on _id, or on email once uniqueness is
+// enforced, with the duplicate key error the server would return.
+func (m *MockMongo) UpdateOne(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions,
+) (*mongo.UpdateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "UpdateOne", filter, update); err != nil {
+		return nil, err
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	u, ok := update.(bson.M)
+	if !ok {
+		return nil, ErrUpdatingUser
+	}
+
+	if m.legacyTriggers && f["email"] == emailWitchTriggersError {
+		return nil, ErrUpdatingUser
+	}
+
+	updateOptions := options.MergeUpdateOptions(opts...)
+
+	for _, user := range m.sortedUsers() {
+		if !matchesCollated(f, user, updateOptions.Collation) {
+			continue
+		}
+
+		updated, err := applyUpdate(user, u, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.emailTaken(updated.ID, updated.Email, updated.EmailHash) {
+			return nil, duplicateKeyError(0, "email_1")
+		}
+
+		m.users[updated.ID] = updated
+
+		return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+	}
+
+	if updateOptions.Upsert == nil || !*updateOptions.Upsert {
+		return &mongo.UpdateResult{}, nil
+	}
+
+	// Like Mongo, an upsert seeds the new document with the equality fields of
+	// the filter before applying the update.
+	var seed userDocument
+
+	raw, err := bson.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bson.Unmarshal(raw, &seed)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := applyUpdate(seed, u, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if inserted.ID.IsZero() {
+		inserted.ID = primitive.NewObjectID()
+	}
+
+	if _, ok := m.users[inserted.ID]; ok {
+		return nil, duplicateKeyError(0, "_id_")
+	}
+
+	if m.emailTaken(inserted.ID, inserted.Email, inserted.EmailHash) {
+		return nil, duplicateKeyError(0, "email_1")
+	}
+
+	m.users[inserted.ID] = inserted
+
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: inserted.ID}, nil
+}
+
+// FindOneAndUpdate treats email as uniquely indexed, answering a collision
+// with the duplicate key error the server would return.
+func (m *MockMongo) FindOneAndUpdate(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions,
+) *mongo.SingleResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "FindOneAndUpdate", filter, update); err != nil {
+		return singleResultError(err)
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	u, ok := update.(bson.M)
+	if !ok {
+		return singleResultError(ErrUpdatingUser)
+	}
+
+	findOneAndUpdateOptions := options.MergeFindOneAndUpdateOptions(opts...)
+
+	for _, user := range m.sortedUsers() {
+		if !matches(f, user) {
+			continue
+		}
+
+		updated, err := applyUpdate(user, u, false)
+		if err != nil {
+			return singleResultError(err)
+		}
+
+		if m.emailTaken(updated.ID, updated.Email, updated.EmailHash) {
+			return singleResultError(duplicateKeyError(0, "email_1"))
+		}
+
+		m.users[updated.ID] = updated
+
+		returned := user
+		if findOneAndUpdateOptions.ReturnDocument != nil && *findOneAndUpdateOptions.ReturnDocument == options.After {
+			returned = updated
+		}
+
+		doc, err := project(returned, findOneAndUpdateOptions.Projection)
+		if err != nil {
+			return singleResultError(err)
+		}
+
+		return mongo.NewSingleResultFromDocument(doc, nil, nil)
+	}
+
+	return singleResultError(mongo.ErrNoDocuments)
+}
+
+func (m *MockMongo) ReplaceOne(
+	ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions,
+) (*mongo.UpdateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "ReplaceOne", filter, replacement); err != nil {
+		return nil, err
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := replacement.(*userDocument)
+	if !ok {
+		return nil, ErrUpdatingUser
+	}
+
+	if m.legacyTriggers && doc.Email == emailWitchTriggersError {
+		return nil, ErrUpdatingUser
+	}
+
+	for id, user := range m.users {
+		if matches(f, user) {
+			if m.emailTaken(id, doc.Email, doc.EmailHash) {
+				return nil, duplicateKeyError(0, "email_1")
+			}
+
+			m.users[id] = copyDocument(doc)
+
+			if m.legacyTriggers && doc.Email == emailWitchTriggersWriteConcernError {
+				return nil, writeConcernError()
+			}
+
+			return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+		}
+	}
+
+	return &mongo.UpdateResult{}, nil
+}
+
+func (m *MockMongo) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "DeleteOne", filter); err != nil {
+		return nil, err
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.legacyTriggers && f["_id"] == idWitchTriggersError {
+		return nil, ErrDeletingUser
+	}
+
+	for id, user := range m.users {
+		if matches(f, user) {
+			delete(m.users, id)
+
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+	}
+
+	return &mongo.DeleteResult{}, nil
+}
+
+func (m *MockMongo) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedWriteFailure(ctx, "DeleteMany", filter); err != nil {
+		return nil, err
+	}
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteOptions := options.MergeDeleteOptions(opts...)
+
+	var deleted int64
+
+	for id, user := range m.users {
+		if matchesCollated(f, user, deleteOptions.Collation) {
+			delete(m.users, id)
+			deleted++
+		}
+	}
+
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+func (m *MockMongo) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (
+	int64, error,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedFailure(ctx, "CountDocuments", filter); err != nil {
+		return 0, err
+	}
+
+	m.purgeExpired()
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	countOptions := options.MergeCountOptions(opts...)
+
+	var count int64
+
+	for _, user := range m.users {
+		if countOptions.Limit != nil && *countOptions.Limit > 0 && count == *countOptions.Limit {
+			break
+		}
+
+		if matchesCollated(f, user, countOptions.Collation) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *MockMongo) Distinct(
+	ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions,
+) ([]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedFailure(ctx, "Distinct", fieldName, filter); err != nil {
+		return nil, err
+	}
+
+	m.purgeExpired()
+
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+
+	for _, user := range m.sortedUsers() {
+		if !matches(f, user) {
+			continue
+		}
+
+		value, ok := documentFields(user)[fieldName]
+		if !ok {
+			continue
+		}
+
+		duplicate := false
+
+		for _, seen := range values {
+			if equal(seen, value) {
+				duplicate = true
+
+				break
+			}
+		}
+
+		if !duplicate {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+// Aggregate evaluates the pipeline of UserStats on the stored users: a single
+// $facet stage whose pipelines start with an optional $match, followed by a
+// $count or by a $group summing 1 by field or by day with $dateToString.
+// Other pipelines fail with errUnsupportedPipeline.
+func (m *MockMongo) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (
+	*mongo.Cursor, error,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.injectedFailure(ctx, "Aggregate", pipeline); err != nil {
+		return nil, err
+	}
+
+	m.purgeExpired()
+
+	wrapped, err := bsonDocument(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return nil, err
+	}
+
+	stages, _ := wrapped["pipeline"].(bson.A)
+	if len(stages) != 1 {
+		return nil, fmt.Errorf("%w: %d stages instead of a single $facet", errUnsupportedPipeline, len(stages))
+	}
+
+	stage, _ := stages[0].(bson.M)
+
+	facets, ok := stage["$facet"].(bson.M)
+	if !ok || len(stage) != 1 {
+		return nil, fmt.Errorf("%w: %v instead of $facet", errUnsupportedPipeline, stage)
+	}
+
+	users := m.sortedUsers()
+	result := make(bson.M, len(facets))
+
+	for name, facet := range facets {
+		facetStages, ok := facet.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("%w: facet %s is not a pipeline", errUnsupportedPipeline, name)
+		}
+
+		result[name], err = aggregateFacet(users, facetStages)
+		if err != nil {
+			return nil, fmt.Errorf("facet %s: %w", name, err)
+		}
+	}
+
+	return mongo.NewCursorFromDocuments([]interface{}{result}, nil, nil)
+}
+
+// errUnsupportedPipeline is returned for the aggregations the mock can't
+// evaluate, like errUnsupportedFilter for filters.
+var errUnsupportedPipeline = errors.New("mock: unsupported pipeline")
+
+// aggregateFacet runs the pipeline of a $facet on users.
+func aggregateFacet(users []userDocument, stages bson.A) (bson.A, error) {
+	var output bson.A
+
+	grouped := false
+
+	for i, s := range stages {
+		stage, _ := s.(bson.M)
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("%w: stage %v", errUnsupportedPipeline, s)
+		}
+
+		switch {
+		case i == 0 && stage["$match"] != nil:
+			filter, err := parseFilter(stage["$match"])
+			if err != nil {
+				return nil, err
+			}
+
+			var matched []userDocument
+
+			for _, user := range users {
+				if matches(filter, user) {
+					matched = append(matched, user)
+				}
+			}
+
+			users = matched
+		case stage["$count"] != nil && !grouped:
+			field, _ := stage["$count"].(string)
+
+			// Like the server, counting nothing outputs no document.
+			output = bson.A{}
+			if len(users) > 0 {
+				output = bson.A{bson.M{field: int32(len(users))}}
+			}
+
+			grouped = true
+		case stage["$group"] != nil && !grouped:
+			spec, _ := stage["$group"].(bson.M)
+
+			var err error
+
+			output, err = groupUsers(users, spec)
+			if err != nil {
+				return nil, err
+			}
+
+			grouped = true
+		default:
+			return nil, fmt.Errorf("%w: stage %v", errUnsupportedPipeline, stage)
+		}
+	}
+
+	if !grouped {
+		return nil, fmt.Errorf("%w: facet neither counts nor groups", errUnsupportedPipeline)
+	}
+
+	return output, nil
+}
+
+// groupUsers evaluates a $group on users whose _id is a field path, such as
+// "$role", or the $dateToString of one with the format "%Y-%m-%d", and whose
+// accumulators are {$sum: 1}. Groups are output in the order of their first
+// user.
+func groupUsers(users []userDocument, spec bson.M) (bson.A, error) {
+	key, err := groupKey(spec["_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var accumulators []string
+
+	for field, accumulator := range spec {
+		if field == "_id" {
+			continue
+		}
+
+		sum, _ := accumulator.(bson.M)
+		if len(sum) != 1 || sum["$sum"] != int32(1) {
+			return nil, fmt.Errorf("%w: accumulator %s: %v", errUnsupportedPipeline, field, accumulator)
+		}
+
+		accumulators = append(accumulators, field)
+	}
+
+	var output bson.A
+
+	groups := make(map[interface{}]bson.M)
+
+	for _, user := range users {
+		value := key(user)
+
+		group, ok := groups[value]
+		if !ok {
+			group = bson.M{"_id": value}
+			for _, field := range accumulators {
+				group[field] = int32(0)
+			}
+
+			groups[value] = group
+			output = append(output, group)
+		}
+
+		for _, field := range accumulators {
+			group[field] = group[field].(int32) + 1
+		}
+	}
+
+	return output, nil
+}
+
+// groupKey returns the function giving the group of a user for the _id of a
+// $group.
+func groupKey(id interface{}) (func(userDocument) interface{}, error) {
+	if path, ok := id.(string); ok && strings.HasPrefix(path, "$") {
+		return func(user userDocument) interface{} {
+			value, _ := documentField(user, path[1:])
+			return value
+		}, nil
+	}
+
+	expression, _ := id.(bson.M)
+	dateToString, _ := expression["$dateToString"].(bson.M)
+	path, _ := dateToString["date"].(string)
+
+	if len(expression) != 1 || dateToString["format"] != "%Y-%m-%d" || !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%w: group _id %v", errUnsupportedPipeline, id)
+	}
+
+	return func(user userDocument) interface{} {
+		value, _ := documentField(user, path[1:])
+
+		date, ok := value.(primitive.DateTime)
+		if !ok {
+			return nil
+		}
+
+		return date.Time().UTC().Format(time.DateOnly)
+	}, nil
+}
+
+// emailTaken reports whether uniqueness is enforced and a user other than id
+// already has email, or emailHash when the emails are encrypted: their
+// ciphertexts all differ.
+func (m *MockMongo) emailTaken(id primitive.ObjectID, email, emailHash string) bool {
+	if !m.uniqueEmail {
+		return false
+	}
+
+	for otherID, other := range m.users {
+		if otherID == id {
+			continue
+		}
+
+		if emailHash != "" && other.EmailHash == emailHash {
+			return true
+		}
+
+		if emailHash == "" && (other.Email == email || m.caselessEmail && strings.EqualFold(other.Email, email)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// idempotencyKeyTaken reports whether a stored user has key. Unlike emails,
+// keys are always unique: only the users created with one have the field the
+// unique index of EnsureIndexes is on.
+func (m *MockMongo) idempotencyKeyTaken(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for _, other := range m.users {
+		if other.IdempotencyKey == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// duplicateKeyError is the write error the server returns when a write
+// breaks the unique index with this name.
+func duplicateKeyError(index int, name string) mongo.WriteException {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{
+			Index:   index,
+			Code:    11000,
+			Message: "E11000 duplicate key error collection: test.users index: " + name,
+		}},
+	}
+}
+
+// bulkWriteException is what InsertMany returns when writeErrs refused
+// documents, one for an ordered insert which stopped there.
+func bulkWriteException(writeErrs ...mongo.WriteError) mongo.BulkWriteException {
+	bulkErr := mongo.BulkWriteException{WriteErrors: make([]mongo.BulkWriteError, 0, len(writeErrs))}
+	for _, writeErr := range writeErrs {
+		bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{WriteError: writeErr})
+	}
+
+	return bulkErr
+}
+
+// writeConcernError is what the server returns when a write isn't replicated
+// in time.
+func writeConcernError() mongo.WriteException {
+	return mongo.WriteException{
+		WriteConcernError: &mongo.WriteConcernError{Code: 64, Name: "WriteConcernFailed", Message: "waiting for replication timed out"},
+	}
+}
+
+// applyUpdate returns a copy of user with the $set, $unset, $inc and, when
+// inserting, $setOnInsert operators of update applied.
+func applyUpdate(user userDocument, update bson.M, inserting bool) (userDocument, error) {
+	doc := documentFields(user)
+
+	normalized, err := bsonDocument(update)
+	if err != nil {
+		return userDocument{}, err
+	}
+
+	for operator, fields := range normalized {
+		values, ok := fields.(bson.M)
+		if !ok {
+			return userDocument{}, fmt.Errorf("mock: malformed %s operand", operator)
+		}
+
+		switch operator {
+		case "$set":
+		case "$inc":
+			for key, delta := range values {
+				sum, err := increment(doc[key], delta)
+				if err != nil {
+					return userDocument{}, err
+				}
+
+				doc[key] = sum
+			}
+
+			continue
+		case "$unset":
+			for key := range values {
+				delete(doc, key)
+			}
+
+			continue
+		case "$setOnInsert":
+			if !inserting {
+				continue
+			}
+		default:
+			return userDocument{}, fmt.Errorf("mock: unsupported update operator %s", operator)
+		}
+
+		for key, value := range values {
+			doc[key] = value
+		}
+	}
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return userDocument{}, err
+	}
+
+	var updated userDocument
+
+	err = bson.Unmarshal(raw, &updated)
+	if err != nil {
+		return userDocument{}, err
+	}
+
+	return updated, nil
+}
+
+// increment adds delta to value, a missing value counting as zero like in
+// Mongo.
+func increment(value, delta interface{}) (int64, error) {
+	toInt64 := func(v interface{}) (int64, error) {
+		switch v := v.(type) {
+		case nil:
+			return 0, nil
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		default:
+			return 0, fmt.Errorf("mock: can't $inc %T", v)
+		}
+	}
+
+	a, err := toInt64(value)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := toInt64(delta)
+	if err != nil {
+		return 0, err
+	}
+
+	return a + b, nil
+}
+
+// transientError is what the driver returns when the connection drops.
+var transientError = mongo.CommandError{Message: "connection reset by peer", Labels: []string{"NetworkError"}}
+
+// injectedFailure counts and records a call to method, waits its latency and then
+// returns the error of its failure rules, if any, or transientError while
+// transientFailures isn't exhausted. Like the driver, it fails calls made
+// with a done context right away. The lock of the mock is released while
+// waiting, the store must be read after it returns.
+func (m *MockMongo) injectedFailure(ctx context.Context, method string, args ...interface{}) error {
+	m.calls++
+	m.record(ctx, method, args)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := m.wait(ctx, method); err != nil {
+		return err
+	}
+
+	if err := m.ruleFailure(method); err != nil {
+		return err
+	}
+
+	// InsertMany checks its documents one by one.
+	if method != "InsertMany" {
+		if err := m.predicateFailure(method, predicateSubject(method, args)); err != nil {
+			return err
+		}
+	}
+
+	if m.transientFailures == 0 {
+		return nil
+	}
+
+	m.transientFailures--
+
+	return transientError
+}
+
+// injectedWriteFailure is injectedFailure for writes, which also fail with
+// writeErr when set.
+func (m *MockMongo) injectedWriteFailure(ctx context.Context, method string, args ...interface{}) error {
+	if err := m.injectedFailure(ctx, method, args...); err != nil {
+		return err
+	}
+
+	return m.writeErr
+}
+
+// predicateSubject is the doc given to the FailWhen predicates for a call to
+// method with args.
+func predicateSubject(method string, args []interface{}) interface{} {
+	switch method {
+	case "ReplaceOne", "Distinct":
+		return args[1]
+	default:
+		return args[0]
+	}
+}
+
+// purgeExpired deletes the users a TTL index would have removed by now.
+func (m *MockMongo) purgeExpired() {
+	if !m.expiring {
+		return
+	}
+
+	now := m.now()
+
+	for id, user := range m.users {
+		if user.ExpiresAt != nil && !user.ExpiresAt.After(now) {
+			delete(m.users, id)
+		}
+	}
+}
+
+// copyDocument returns a copy of doc sharing no memory with it, so a caller
+// changing its document afterwards doesn't alter the store.
+func copyDocument(doc *userDocument) userDocument {
+	copied := *doc
+	copied.DeletedAt = copyTime(doc.DeletedAt)
+	copied.ExpiresAt = copyTime(doc.ExpiresAt)
+	copied.IdempotencyExpiresAt = copyTime(doc.IdempotencyExpiresAt)
+
+	return copied
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	copied := *t
+
+	return &copied
+}
+
+// sortedUsers returns the stored users ordered by ID, like a Mongo scan sorted
+// on _id.
+func (m *MockMongo) sortedUsers() []userDocument {
+	// Sorting the IDs moves less memory around than sorting the documents.
+	ids := make([]primitive.ObjectID, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	users := make([]userDocument, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, m.users[id])
+	}
+
+	return users
+}
+
+// project removes the fields excluded by an exclusion projection such as
+// {password: 0} from the document served for user, or keeps only the _id and
+// the fields of an inclusion projection such as {email: 1}.
+func project(user userDocument, projection interface{}) (bson.M, error) {
+	doc := documentFields(user)
+
+	if projection == nil {
+		return doc, nil
+	}
+
+	fields, ok := projection.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("mock: unsupported projection %T", projection)
+	}
+
+	included := bson.M{"_id": doc["_id"]}
+
+	for key, include := range fields {
+		if include == 0 {
+			delete(doc, key)
+			continue
+		}
+
+		if value, ok := doc[key]; ok {
+			included[key] = value
+		}
+	}
+
+	if len(included) == 1 {
+		return doc, nil
+	}
+
+	if len(doc) < len(documentFields(user)) {
+		return nil, errors.New("mock: projection mixes inclusions and exclusions")
+	}
+
+	return included, nil
+}
+
+// sortUsers orders users in place following a bson.D sort specification.
+func sortUsers(users []userDocument, spec interface{}) error {
+	keys, ok := spec.(bson.D)
+	if !ok {
+		return fmt.Errorf("mock: unsupported sort %T", spec)
+	}
+
+	sort.SliceStable(users, func(i, j int) bool {
+		for _, key := range keys {
+			a, _ := documentField(users[i], key.Key)
+			b, _ := documentField(users[j], key.Key)
+
+			c, _ := compare(a, b)
+			if c == 0 {
+				continue
+			}
+
+			if key.Value == -1 {
+				return c > 0
+			}
+
+			return c < 0
+		}
+
+		return false
+	})
+
+	return nil
+}
+
+// errUnsupportedFilter is returned for the filters the mock can't evaluate,
+// so a new query shape fails loudly instead of silently matching nothing.
+var errUnsupportedFilter = errors.New("mock: unsupported filter")
+
+// filterOperators are the operators matches implements.
+var filterOperators = map[string]struct{}{
+	"$exists": {},
+	"$in":     {},
+	"$gt":     {},
+	"$gte":    {},
+	"$lt":     {},
+	"$lte":    {},
+}
+
+// parseFilter returns filter as decoded from BSON, which is what matches
+// expects, after checking the mock supports it: a bson.M of fields compared
+// for equality, to a prefix regex or with the operators in filterOperators.
+func parseFilter(filter interface{}) (bson.M, error) {
+	if _, ok := filter.(bson.M); !ok {
+		return nil, fmt.Errorf("%w: %T instead of bson.M", errUnsupportedFilter, filter)
+	}
+
+	f, err := bsonDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, condition := range f {
+		if strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("%w: top level operator %s", errUnsupportedFilter, key)
+		}
+
+		operators, ok := condition.(bson.M)
+		if !ok {
+			continue
+		}
+
+		for operator, operand := range operators {
+			if _, ok := filterOperators[operator]; !ok {
+				return nil, fmt.Errorf("%w: operator %s on %s", errUnsupportedFilter, operator, key)
+			}
+
+			if _, ok := operand.(bson.A); operator == "$in" && !ok {
+				return nil, fmt.Errorf("%w: $in on %s takes an array, got %T", errUnsupportedFilter, key, operand)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// matches reports whether user satisfies filter, as returned by parseFilter.
+// It understands the subset of the query language the repo emits: field
+// equality, anchored prefix regexes, $exists, $in and the comparison
+// operators $gt, $gte, $lt and $lte.
+func matches(filter bson.M, user userDocument) bool {
+	return matchesCollated(filter, user, nil)
+}
+
+// matchesCollated is matches comparing the strings of the equalities of
+// filter as collation does, nil being the default, binary, comparison. Only
+// the strengths ignoring case are implemented, ignoring diacritics too at
+// strength 1 isn't.
+func matchesCollated(filter bson.M, user userDocument, collation *options.Collation) bool {
+	for key, condition := range filter {
+		value, exists := documentField(user, key)
+
+		if regex, ok := condition.(primitive.Regex); ok {
+			if !exists || !matchPrefix(value, regex) {
+				return false
+			}
+
+			continue
+		}
+
+		operators, ok := condition.(bson.M)
+		if !ok {
+			if !exists || !equalCollated(value, condition, collation) {
+				return false
+			}
+
+			continue
+		}
+
+		for operator, operand := range operators {
+			if operator == "$exists" {
+				if exists != (operand == true) {
+					return false
+				}
+
+				continue
+			}
+
+			if !exists || !matchOperator(operator, value, operand) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchPrefix implements the only regex shape the repo builds: "^" followed by
+// a regexp.QuoteMeta escaped prefix. A pattern with an unescaped
+// metacharacter never matches, so forgetting to escape user input shows up in
+// tests.
+func matchPrefix(value interface{}, regex primitive.Regex) bool {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(regex.Pattern, "^") {
+		return false
+	}
+
+	var prefix strings.Builder
+
+	pattern := regex.Pattern[1:]
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			prefix.WriteByte(pattern[i])
+		case strings.IndexByte(`\.+*?()|[]{}^$`, c) >= 0:
+			return false
+		default:
+			prefix.WriteByte(c)
+		}
+	}
+
+	return strings.HasPrefix(s, prefix.String())
+}
+
+func matchOperator(operator string, value, operand interface{}) bool {
+	if operator == "$in" {
+		candidates, ok := operand.(bson.A)
+		if !ok {
+			return false
+		}
+
+		for _, candidate := range candidates {
+			if equal(value, candidate) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	c, ok := compare(value, operand)
+	if !ok {
+		return false
+	}
+
+	switch operator {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	case "$lte":
+		return c <= 0
+	default:
+		return false
+	}
+}
+
+func equal(a, b interface{}) bool {
+	c, ok := compare(a, b)
+
+	return ok && c == 0
+}
+
+// equalCollated is equal comparing strings ignoring case when collation does.
+func equalCollated(a, b interface{}, collation *options.Collation) bool {
+	s, isString := a.(string)
+	if !isString || !ignoresCase(collation) {
+		return equal(a, b)
+	}
+
+	t, ok := b.(string)
+
+	return ok && strings.EqualFold(s, t)
+}
+
+// ignoresCase reports whether collation compares strings ignoring case.
+func ignoresCase(collation *options.Collation) bool {
+	return collation != nil && (collation.Strength == 1 || collation.Strength == 2)
+}
+
+// compare orders two values decoded from BSON. ok is false when the values are
+// of different or unsupported types and therefore can't be ordered.
+func compare(a, b interface{}) (c int, ok bool) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case primitive.ObjectID:
+		if b, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(a[:], b[:]), true
+		}
+	case primitive.DateTime:
+		if b, ok := b.(primitive.DateTime); ok {
+			return cmpInt64(int64(a), int64(b)), true
+		}
+	case int32:
+		if b, ok := b.(int32); ok {
+			return cmpInt64(int64(a), int64(b)), true
+		}
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmpInt64(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmpBool(a, b), true
+		}
+	}
+
+	return 0, false
+}
+
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// documentKeys are the bson keys of userDocument.
+var documentKeys = []string{
+	"_id", "name", "email", "email_hash", "password", "role", "version", "created_at", "updated_at", "deleted_at",
+	"expires_at", "email_verified", "idempotency_key", "idempotency_expires_at",
+}
+
+// documentField returns the value under key of doc as bson.Unmarshal decodes
+// it, and whether doc has it, without marshaling doc: the mock looks at every
+// stored user on most calls. It must follow the bson tags of userDocument.
+func documentField(doc userDocument, key string) (interface{}, bool) {
+	switch key {
+	case "_id":
+		return doc.ID, !doc.ID.IsZero()
+	case "name":
+		return doc.Name, doc.Name != ""
+	case "email":
+		return doc.Email, doc.Email != ""
+	case "email_hash":
+		return doc.EmailHash, doc.EmailHash != ""
+	case "password":
+		return doc.Password, doc.Password != ""
+	case "role":
+		return doc.Role, doc.Role != ""
+	case "version":
+		return doc.Version, doc.Version != 0
+	case "created_at":
+		return primitive.NewDateTimeFromTime(doc.CreatedAt), !doc.CreatedAt.IsZero()
+	case "updated_at":
+		return primitive.NewDateTimeFromTime(doc.UpdatedAt), !doc.UpdatedAt.IsZero()
+	case "deleted_at":
+		return dateTimePtr(doc.DeletedAt)
+	case "expires_at":
+		return dateTimePtr(doc.ExpiresAt)
+	case "email_verified":
+		return doc.EmailVerified, doc.EmailVerified
+	case "idempotency_key":
+		return doc.IdempotencyKey, doc.IdempotencyKey != ""
+	case "idempotency_expires_at":
+		return dateTimePtr(doc.IdempotencyExpiresAt)
+	default:
+		return nil, false
+	}
+}
+
+// dateTimePtr follows omitempty, which drops a pointer to the zero time too.
+func dateTimePtr(t *time.Time) (interface{}, bool) {
+	if t == nil || t.IsZero() {
+		return nil, false
+	}
+
+	return primitive.NewDateTimeFromTime(*t), true
+}
+
+// documentFields returns doc as bson.Unmarshal decodes it into a bson.M.
+func documentFields(doc userDocument) bson.M {
+	fields := make(bson.M, len(documentKeys))
+
+	for _, key := range documentKeys {
+		if value, ok := documentField(doc, key); ok {
+			fields[key] = value
+		}
+	}
+
+	return fields
+}
+
+// bsonDocument round-trips v through BSON so filters and stored users are
+// compared using the same value types.
+func bsonDocument(v interface{}) (bson.M, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+
+	err = bson.Unmarshal(raw, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// singleResultError builds a SingleResult whose Decode returns err.
+func singleResultError(err error) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+}
+
+// MockAuditLog is an in-memory AuditCaller, given to a repo in place of the
+// AuditCollection of WithAuditing. It is safe for concurrent use.
+type MockAuditLog struct {
+	mu      sync.Mutex
+	entries []auditDocument
+	err     error
+}
+
+var _ AuditCaller = (*MockAuditLog)(nil)
+
+func NewMockAuditLog() *MockAuditLog {
+	return &MockAuditLog{}
+}
+
+// FailWith makes every call fail with err, or succeed again when err is nil.
+func (l *MockAuditLog) FailWith(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.err = err
+}
+
+// Entries returns the entries inserted so far, in order.
+func (l *MockAuditLog) Entries() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]AuditEntry, 0, len(l.entries))
+	for _, doc := range l.entries {
+		entries = append(entries, auditEntry(doc))
+	}
+
+	return entries
+}
+
+func (l *MockAuditLog) InsertOne(_ context.Context, document interface{}, _ ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	doc, ok := document.(*auditDocument)
+	if !ok {
+		return nil, fmt.Errorf("mock: unsupported audit document %T", document)
+	}
+
+	copied := *doc
+	copied.Changes = append([]auditChange(nil), doc.Changes...)
+	l.entries = append(l.entries, copied)
+
+	return &mongo.InsertOneResult{InsertedID: doc.ID}, nil
+}
+
+// Find supports the filters on user_id and tenant, and the sort of
+// ListAuditEntries: given a sort, the entries are served newest first.
+func (l *MockAuditLog) Find(_ context.Context, filter interface{}, opts ...*options.FindOptions) (
+	*mongo.Cursor, error,
+) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	f, ok := filter.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("mock: unsupported audit filter %T", filter)
+	}
+
+	userID, filtered := f["user_id"]
+
+	var found []auditDocument
+
+	for _, doc := range l.entries {
+		if (!filtered || doc.UserID == userID) && tenantMatches(doc.Tenant, f) {
+			found = append(found, doc)
+		}
+	}
+
+	findOptions := options.MergeFindOptions(opts...)
+	if findOptions.Sort != nil {
+		sort.SliceStable(found, func(i, j int) bool {
+			if !found[i].Timestamp.Equal(found[j].Timestamp) {
+				return found[i].Timestamp.After(found[j].Timestamp)
+			}
+
+			return bytes.Compare(found[i].ID[:], found[j].ID[:]) > 0
+		})
+	}
+
+	if findOptions.Limit != nil && *findOptions.Limit > 0 && int64(len(found)) > *findOptions.Limit {
+		found = found[:*findOptions.Limit]
+	}
+
+	docs := make([]interface{}, 0, len(found))
+	for i := range found {
+		docs = append(docs, &found[i])
+	}
+
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+// MockTokenStore is an in-memory TokenCaller, given to a repo in place of the
+// token collection. It is also the IndexCreator of that collection, recording
+// the names of the indexes created.
+type MockTokenStore struct {
+	mu      sync.Mutex
+	tokens  map[string]tokenDocument
+	indexes []string
+	err     error
+}
+
+var (
+	_ TokenCaller  = (*MockTokenStore)(nil)
+	_ IndexCreator = (*MockTokenStore)(nil)
+)
+
+func NewMockTokenStore() *MockTokenStore {
+	return &MockTokenStore{tokens: make(map[string]tokenDocument)}
+}
+
+// FailWith makes every call fail with err, or succeed again when err is nil.
+func (s *MockTokenStore) FailWith(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// Len returns the number of tokens stored.
+func (s *MockTokenStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.tokens)
+}
+
+// IDs returns the _id of the tokens stored, their hashes.
+func (s *MockTokenStore) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.tokens))
+	for id := range s.tokens {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func (s *MockTokenStore) InsertOne(_ context.Context, document interface{}, _ ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	doc, ok := document.(*tokenDocument)
+	if !ok {
+		return nil, fmt.Errorf("mock: unsupported token document %T", document)
+	}
+
+	if _, ok := s.tokens[doc.ID]; ok {
+		return nil, duplicateKeyError(0, "_id_")
+	}
+
+	s.tokens[doc.ID] = *doc
+
+	return &mongo.InsertOneResult{InsertedID: doc.ID}, nil
+}
+
+// FindOne supports the filters on _id, purpose and tenant.
+func (s *MockTokenStore) FindOne(_ context.Context, filter interface{}, _ ...*options.FindOneOptions) *mongo.SingleResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.find(filter)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	return mongo.NewSingleResultFromDocument(&doc, nil, nil)
+}
+
+// FindOneAndDelete supports the filters on _id, purpose and tenant.
+func (s *MockTokenStore) FindOneAndDelete(
+	_ context.Context, filter interface{}, _ ...*options.FindOneAndDeleteOptions,
+) *mongo.SingleResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.find(filter)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	delete(s.tokens, doc.ID)
+
+	return mongo.NewSingleResultFromDocument(&doc, nil, nil)
+}
+
+// find returns the token matching filter, s.mu being held.
+func (s *MockTokenStore) find(filter interface{}) (tokenDocument, error) {
+	if s.err != nil {
+		return tokenDocument{}, s.err
+	}
+
+	f, ok := filter.(bson.M)
+	if !ok {
+		return tokenDocument{}, fmt.Errorf("mock: unsupported token filter %T", filter)
+	}
+
+	id, _ := f["_id"].(string)
+
+	doc, ok := s.tokens[id]
+	if !ok || !tokenMatches(doc, f) {
+		return tokenDocument{}, mongo.ErrNoDocuments
+	}
+
+	return doc, nil
+}
+
+// DeleteMany supports the filters on user_id, purpose and tenant.
+func (s *MockTokenStore) DeleteMany(_ context.Context, filter interface{}, _ ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	f, ok := filter.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("mock: unsupported token filter %T", filter)
+	}
+
+	var deleted int64
+
+	for id, doc := range s.tokens {
+		if doc.UserID == f["user_id"] && tokenMatches(doc, f) {
+			delete(s.tokens, id)
+			deleted++
+		}
+	}
+
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+func (s *MockTokenStore) CreateMany(
+	_ context.Context, models []mongo.IndexModel, _ ...*options.CreateIndexesOptions,
+) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	names := make([]string, 0, len(models))
+	for _, model := range models {
+		names = append(names, *model.Options.Name)
+	}
+
+	s.indexes = append(s.indexes, names...)
+
+	return names, nil
+}
+
+// Indexes returns the names of the indexes created so far, in order.
+func (s *MockTokenStore) Indexes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.indexes...)
+}
+
+// tokenMatches reports whether doc has the purpose and the tenant of filter,
+// the tenant being either a string or {"$exists": false}.
+func tokenMatches(doc tokenDocument, filter bson.M) bool {
+	return doc.Purpose == filter["purpose"] && tenantMatches(doc.Tenant, filter)
+}
+
+// tenantMatches reports whether tenant is the one of filter, as built by
+// tenantFilter. A filter without tenant matches every document.
+func tenantMatches(tenant string, filter bson.M) bool {
+	switch condition := filter["tenant"].(type) {
+	case string:
+		return tenant == condition
+	case nil:
+		return true
+	default:
+		return tenant == ""
+	}
+}
+
+// MockCollection is an in-memory DocumentCaller storing documents of any
+// type, for the tests of a Repository of other documents than users. It knows
+// no index but the one on _id, and its filters can only match every document
+// or a single _id. It is safe for concurrent use.
+type MockCollection struct {
+	mu   sync.Mutex
+	docs map[primitive.ObjectID]bson.Raw
+	err  error
+}
+
+var _ DocumentCaller = (*MockCollection)(nil)
+
+func NewMockCollection() *MockCollection {
+	return &MockCollection{docs: make(map[primitive.ObjectID]bson.Raw)}
+}
+
+// FailWith makes every call fail with err, or succeed again when err is nil.
+func (c *MockCollection) FailWith(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.err = err
+}
+
+// Len returns the number of documents stored.
+func (c *MockCollection) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.docs)
+}
+
+func (c *MockCollection) InsertOne(_ context.Context, document interface{}, _ ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	raw, id, err := collectionDocument(document)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.docs[id]; ok {
+		return nil, duplicateKeyError(0, "_id_")
+	}
+
+	c.docs[id] = raw
+
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+func (c *MockCollection) FindOne(_ context.Context, filter interface{}, _ ...*options.FindOneOptions) *mongo.SingleResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return singleResultError(c.err)
+	}
+
+	ids, err := c.matching(filter)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	if len(ids) == 0 {
+		return singleResultError(mongo.ErrNoDocuments)
+	}
+
+	return mongo.NewSingleResultFromDocument(c.docs[ids[0]], nil, nil)
+}
+
+func (c *MockCollection) Find(_ context.Context, filter interface{}, opts ...*options.FindOptions) (
+	*mongo.Cursor, error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	ids, err := c.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.MergeFindOptions(opts...)
+
+	if findOptions.Skip != nil {
+		if *findOptions.Skip >= int64(len(ids)) {
+			ids = nil
+		} else {
+			ids = ids[*findOptions.Skip:]
+		}
+	}
+
+	if findOptions.Limit != nil && *findOptions.Limit > 0 && *findOptions.Limit < int64(len(ids)) {
+		ids = ids[:*findOptions.Limit]
+	}
+
+	docs := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		docs = append(docs, c.docs[id])
+	}
+
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (c *MockCollection) ReplaceOne(
+	_ context.Context, filter interface{}, replacement interface{}, _ ...*options.ReplaceOptions,
+) (*mongo.UpdateResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	ids, err := c.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return &mongo.UpdateResult{}, nil
+	}
+
+	raw, id, err := collectionDocument(replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != ids[0] {
+		return nil, errors.New("mock: replacement changes _id")
+	}
+
+	c.docs[id] = raw
+
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (c *MockCollection) DeleteOne(_ context.Context, filter interface{}, _ ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	ids, err := c.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return &mongo.DeleteResult{}, nil
+	}
+
+	delete(c.docs, ids[0])
+
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+// matching returns the IDs of the documents matching filter, in increasing
+// order.
+func (c *MockCollection) matching(filter interface{}) ([]primitive.ObjectID, error) {
+	f, ok := filter.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T instead of bson.M", errUnsupportedFilter, filter)
+	}
+
+	if len(f) == 0 {
+		ids := make([]primitive.ObjectID, 0, len(c.docs))
+		for id := range c.docs {
+			ids = append(ids, id)
+		}
+
+		sort.Slice(ids, func(i, j int) bool {
+			return bytes.Compare(ids[i][:], ids[j][:]) < 0
+		})
+
+		return ids, nil
+	}
+
+	id, ok := f["_id"].(primitive.ObjectID)
+	if !ok || len(f) > 1 {
+		return nil, fmt.Errorf("%w: only _id can be matched, got %v", errUnsupportedFilter, f)
+	}
+
+	if _, ok := c.docs[id]; !ok {
+		return nil, nil
+	}
+
+	return []primitive.ObjectID{id}, nil
+}
+
+// collectionDocument returns document as stored, and its _id.
+func collectionDocument(document interface{}) (bson.Raw, primitive.ObjectID, error) {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, primitive.NilObjectID, err
+	}
+
+	id, ok := bson.Raw(raw).Lookup("_id").ObjectIDOK()
+	if !ok {
+		return nil, primitive.NilObjectID, fmt.Errorf("mock: document %T has no ObjectID _id", document)
+	}
+
+	return raw, id, nil
+}
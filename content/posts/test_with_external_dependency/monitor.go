@@ -0,0 +1,42 @@
+package users
+
+import (
+	"context"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// NewLoggingCommandMonitor returns a driver command monitor logging to logger
+// each command sent to the server: its start and success at debug level, its
+// failure at warn level, with the command name and how long it took. The
+// command and reply documents, which hold user data, are never logged.
+func NewLoggingCommandMonitor(logger *slog.Logger) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			logger.LogAttrs(ctx, slog.LevelDebug, "mongo command started",
+				slog.String("command", evt.CommandName),
+				slog.String("database", evt.DatabaseName),
+				slog.Int64("request_id", evt.RequestID),
+				slog.String("connection_id", evt.ConnectionID),
+			)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			logger.LogAttrs(ctx, slog.LevelDebug, "mongo command succeeded", finishedAttrs(evt.CommandFinishedEvent)...)
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			attrs := append(finishedAttrs(evt.CommandFinishedEvent), slog.String("error", redact(evt.Failure)))
+			logger.LogAttrs(ctx, slog.LevelWarn, "mongo command failed", attrs...)
+		},
+	}
+}
+
+func finishedAttrs(evt event.CommandFinishedEvent) []slog.Attr {
+	return []slog.Attr{
+		slog.String("command", evt.CommandName),
+		slog.String("database", evt.DatabaseName),
+		slog.Int64("request_id", evt.RequestID),
+		slog.String("connection_id", evt.ConnectionID),
+		slog.Duration("duration", evt.Duration),
+	}
+}
@@ -0,0 +1,727 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultDatabase    = "test"
+	defaultCollection  = "users"
+	defaultPingTimeout = 5 * time.Second
+)
+
+// sortableFields maps the fields accepted by SortBy to their bson key.
+var sortableFields = map[string]string{
+	"_id":        "_id",
+	"name":       "name",
+	"email":      "email",
+	"created_at": "created_at",
+}
+
+type repoOptions struct {
+	createIndexes bool
+	bcryptCost    int
+	database      string
+	collection    string
+	// connectTimeout is left to the driver default when zero.
+	connectTimeout    time.Duration
+	client            *options.ClientOptions
+	commandMonitor    *event.CommandMonitor
+	poolMonitor       *event.PoolMonitor
+	skipPing          bool
+	pingTimeout       time.Duration
+	operationTimeout  time.Duration
+	writeConcern      *writeconcern.WriteConcern
+	readPreference    *readpref.ReadPref
+	reconnectCooldown time.Duration
+	// maxAttempts above 1 enables retrying transient errors.
+	maxAttempts int
+	retryDelay  time.Duration
+	clock       Clock
+	ids         IDGenerator
+	logger      *slog.Logger
+	// tracerProvider is nil when tracing is off.
+	tracerProvider trace.TracerProvider
+	// metricsRegisterer is nil when metrics are off.
+	metricsRegisterer prometheus.Registerer
+	// slowThreshold is zero when slow operations aren't reported.
+	slowThreshold time.Duration
+	// idempotencyKeyTTL is left to defaultIdempotencyKeyTTL when zero.
+	idempotencyKeyTTL time.Duration
+	// verificationTokenTTL is left to defaultVerificationTokenTTL when zero.
+	verificationTokenTTL time.Duration
+	// passwordPolicy is nil when passwords only need to pass Validate.
+	passwordPolicy *PasswordPolicy
+	// encryptionKey is nil when emails are stored in plain.
+	encryptionKey          []byte
+	previousEncryptionKeys [][]byte
+	emailHashKey           []byte
+	// pageTokenKey is nil when the page tokens are signed with a random key.
+	pageTokenKey []byte
+	// tenantResolver is nil unless set with WithTenantResolver.
+	tenantResolver TenantResolver
+	emailCollation bool
+	// auditing writes the audit trail to AuditCollection.
+	auditing    bool
+	strictAudit bool
+	// eventSink is nil when no events are published.
+	eventSink            EventSink
+	requireEventDelivery bool
+	// connect is mongo.Connect outside of tests.
+	connect func(ctx context.Context, opts ...*options.ClientOptions) (*mongo.Client, error)
+}
+
+// Option configures NewMongoRepo.
+type Option func(*repoOptions)
+
+// WithIndexCreation makes NewMongoRepo call EnsureIndexes before returning.
+func WithIndexCreation() Option {
+	return func(o *repoOptions) {
+		o.createIndexes = true
+	}
+}
+
+// WithBcryptCost sets the bcrypt cost passwords are hashed with.
+func WithBcryptCost(cost int) Option {
+	return func(o *repoOptions) {
+		o.bcryptCost = cost
+	}
+}
+
+// WithDatabase sets the database holding the users collection.
+func WithDatabase(name string) Option {
+	return func(o *repoOptions) {
+		o.database = name
+	}
+}
+
+// WithCollection sets the collection users are stored in.
+func WithCollection(name string) Option {
+	return func(o *repoOptions) {
+		o.collection = name
+	}
+}
+
+// WithConnectTimeout bounds how long establishing a connection may take.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(o *repoOptions) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithClientOptions passes driver options, such as TLS or pool settings, to
+// the client. The URI given to NewMongoRepo and WithConnectTimeout take
+// precedence over what they set.
+func WithClientOptions(clientOpts *options.ClientOptions) Option {
+	return func(o *repoOptions) {
+		o.client = clientOpts
+	}
+}
+
+// WithCommandMonitor makes the client report every command it sends to
+// monitor, for instance one made by NewLoggingCommandMonitor. It replaces the
+// monitor set with WithClientOptions.
+func WithCommandMonitor(monitor *event.CommandMonitor) Option {
+	return func(o *repoOptions) {
+		o.commandMonitor = monitor
+	}
+}
+
+// WithPoolMonitor makes the client report the events of its connection pool,
+// such as connections being opened and closed, to monitor. It replaces the
+// monitor set with WithClientOptions.
+func WithPoolMonitor(monitor *event.PoolMonitor) Option {
+	return func(o *repoOptions) {
+		o.poolMonitor = monitor
+	}
+}
+
+// WithSkipPing makes NewMongoRepo return without checking the server is
+// reachable, for callers that start before the database does.
+func WithSkipPing() Option {
+	return func(o *repoOptions) {
+		o.skipPing = true
+	}
+}
+
+// WithPingTimeout sets how long NewMongoRepo waits for the server to answer
+// its ping. It defaults to 5 seconds.
+func WithPingTimeout(timeout time.Duration) Option {
+	return func(o *repoOptions) {
+		o.pingTimeout = timeout
+	}
+}
+
+// WithOperationTimeout bounds every call made with a context that has no
+// deadline to timeout. A timed out call returns ErrOperationTimeout.
+func WithOperationTimeout(timeout time.Duration) Option {
+	return func(o *repoOptions) {
+		o.operationTimeout = timeout
+	}
+}
+
+// WithWriteConcern sets the write concern every write is made with, instead of
+// the one from the URI.
+func WithWriteConcern(wc *writeconcern.WriteConcern) Option {
+	return func(o *repoOptions) {
+		o.writeConcern = wc
+	}
+}
+
+// WithReadPreference sets which members of the replica set reads go to.
+// GetUserByEmail still reads from the primary unless told otherwise.
+func WithReadPreference(rp *readpref.ReadPref) Option {
+	return func(o *repoOptions) {
+		o.readPreference = rp
+	}
+}
+
+// WithRetries makes the repo try an operation failing with a transient error,
+// such as a network error or an election in progress, up to maxAttempts times.
+// The delay between attempts starts around baseDelay and doubles each time.
+func WithRetries(maxAttempts int, baseDelay time.Duration) Option {
+	return func(o *repoOptions) {
+		o.maxAttempts = maxAttempts
+		o.retryDelay = baseDelay
+	}
+}
+
+// WithReconnectCooldown sets how long the repo waits between two pings once
+// it lost the connection to the server. It defaults to 5 seconds.
+func WithReconnectCooldown(cooldown time.Duration) Option {
+	return func(o *repoOptions) {
+		o.reconnectCooldown = cooldown
+	}
+}
+
+// WithClock sets the clock the repo reads the time from, for timestamps,
+// expiry and the time operations took. Tests pass a FakeClock.
+func WithClock(clock Clock) Option {
+	return func(o *repoOptions) {
+		o.clock = clock
+	}
+}
+
+// WithIDGenerator sets how the IDs of the users created without one are made,
+// for instance a SequentialIDGenerator in tests.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(o *repoOptions) {
+		o.ids = ids
+	}
+}
+
+// WithLogger makes the repo log each method call to logger: its start at
+// debug level, then its outcome and duration. Logs name the user by ID, never
+// by email, and leave passwords out.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *repoOptions) {
+		o.logger = logger
+	}
+}
+
+// WithTracerProvider makes every repo method record a client span on a
+// tracer of provider, as a child of the span of its context.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(o *repoOptions) {
+		o.tracerProvider = provider
+	}
+}
+
+// WithMetrics makes the repo count its method calls by outcome, as ok, error,
+// not_found or conflict, and time them, in collectors registered on
+// registerer. Repos given the same registerer share the collectors.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(o *repoOptions) {
+		o.metricsRegisterer = registerer
+	}
+}
+
+// WithSlowOperationThreshold makes the repo report the method calls taking
+// longer than d, as measured by its clock: they are logged at warn level with
+// WithLogger and counted in user_repo_slow_operations_total with WithMetrics.
+// Zero, the default, reports none.
+func WithSlowOperationThreshold(d time.Duration) Option {
+	return func(o *repoOptions) {
+		o.slowThreshold = d
+	}
+}
+
+// WithIdempotencyKeyTTL sets how long the key given to CreateUserIdempotent
+// identifies the user it created, 24 hours by default: a retry made later
+// creates another user.
+func WithIdempotencyKeyTTL(ttl time.Duration) Option {
+	return func(o *repoOptions) {
+		o.idempotencyKeyTTL = ttl
+	}
+}
+
+// WithVerificationTokenTTL sets how long the tokens of StartEmailVerification
+// can be confirmed, 24 hours by default.
+func WithVerificationTokenTTL(ttl time.Duration) Option {
+	return func(o *repoOptions) {
+		o.verificationTokenTTL = ttl
+	}
+}
+
+// WithPasswordPolicy makes CreateUser, CreateUsers, UpsertUser and the
+// updates of passwords, ChangePassword included, reject the passwords breaking
+// policy with ErrWeakPassword. Without it passwords are only checked by
+// Validate; DefaultPasswordPolicy is a sensible policy to start from.
+func WithPasswordPolicy(policy PasswordPolicy) Option {
+	return func(o *repoOptions) {
+		o.passwordPolicy = &policy
+	}
+}
+
+// WithFieldEncryption makes the repo store the emails encrypted with AES-GCM
+// under key, of 16, 24 or 32 bytes, and decrypt the ones encrypted under
+// previousKeys too: to rotate keys, pass the new key and the old one as a
+// previous key, then drop it once every user was rewritten. Reading an email
+// none of the keys decrypts fails with ErrCorruptField.
+//
+// The emails are looked up and kept unique by their email_hash, an HMAC the
+// same for every encryption of an email, so EnsureIndexes must be called again
+// once encryption is enabled. Sorting by email sorts the ciphertexts.
+//
+// The hash is keyed by a key derived from key unless set with
+// WithEmailHashKey, which must be set before keys are rotated: the users
+// stored before the rotation would not be found otherwise.
+func WithFieldEncryption(key []byte, previousKeys ...[]byte) Option {
+	return func(o *repoOptions) {
+		o.encryptionKey = key
+		o.previousEncryptionKeys = previousKeys
+	}
+}
+
+// WithEmailHashKey sets the key of the email_hash kept by WithFieldEncryption,
+// of at least 16 bytes. It must not change once users are stored.
+func WithEmailHashKey(key []byte) Option {
+	return func(o *repoOptions) {
+		o.emailHashKey = key
+	}
+}
+
+// WithPageTokenKey sets the key, of at least 16 bytes, signing the page
+// tokens of ListUsersPage. Without it a random key is drawn, and the tokens
+// of a process can't be used with another.
+func WithPageTokenKey(key []byte) Option {
+	return func(o *repoOptions) {
+		o.pageTokenKey = key
+	}
+}
+
+// WithEmailCollation makes the repo compare emails ignoring case on the
+// server: the email queries and the unique index of EnsureIndexes get a
+// collation of strength 2. The users written before emails were normalized,
+// or by other services, are then found and collide whatever the case of their
+// email. An email_1 index created without the collation must be dropped for
+// EnsureIndexes to create it again. It has no effect with WithFieldEncryption,
+// whose email hashes are of the normalized emails.
+func WithEmailCollation() Option {
+	return func(o *repoOptions) {
+		o.emailCollation = true
+	}
+}
+
+// WithTenantResolver makes the repo store the users of each tenant apart, in
+// the namespace resolver derives from the tenant given to the context of the
+// call with WithTenant. Calls without a tenant fail with ErrMissingTenant.
+// Indexes are created per tenant with EnsureTenantIndexes, WithIndexCreation
+// is rejected. The audit trail stays shared across tenants.
+func WithTenantResolver(resolver TenantResolver) Option {
+	return func(o *repoOptions) {
+		o.tenantResolver = resolver
+	}
+}
+
+// WithEventSink makes the repo publish a UserEvent to sink after each user it
+// creates, updates or deletes, DeleteUsersMatching aside. A failure to publish
+// is logged and doesn't fail the mutation, see RequireEventDelivery.
+func WithEventSink(sink EventSink) Option {
+	return func(o *repoOptions) {
+		o.eventSink = sink
+	}
+}
+
+// RequireEventDelivery makes the mutations whose event can't be published
+// fail with ErrPublishingEvent. The mutation is still applied, so a caller
+// retrying it must expect it to have been.
+func RequireEventDelivery() Option {
+	return func(o *repoOptions) {
+		o.requireEventDelivery = true
+	}
+}
+
+// WithAuditing makes the repo record each mutation of a user it makes, such as
+// a create or an update, in the AuditCollection of its database, with the
+// actor set on the context with WithActor and the fields it changed;
+// ListAuditEntries reads them back. DeleteUsersMatching isn't recorded.
+//
+// Telling what changed takes reading the user before and after the mutation.
+// A failure to read it or to write the entry is logged, counted in
+// user_repo_audit_failures_total with WithMetrics, and doesn't fail the
+// mutation, see StrictAuditing.
+func WithAuditing() Option {
+	return func(o *repoOptions) {
+		o.auditing = true
+	}
+}
+
+// StrictAuditing makes the mutations which can't be audited fail with
+// ErrAuditing. A mutation whose user can't be read beforehand isn't made, one
+// whose entry can't be written is still applied, so a caller retrying it must
+// expect it to have been.
+func StrictAuditing() Option {
+	return func(o *repoOptions) {
+		o.auditing = true
+		o.strictAudit = true
+	}
+}
+
+func newRepoOptions(opts []Option) repoOptions {
+	o := repoOptions{
+		database:          defaultDatabase,
+		collection:        defaultCollection,
+		pingTimeout:       defaultPingTimeout,
+		reconnectCooldown: defaultReconnectCooldown,
+		clock:             systemClock{},
+		ids:               objectIDGenerator{},
+		connect:           mongo.Connect,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+func (o repoOptions) validate() error {
+	switch {
+	case o.database == "":
+		return fmt.Errorf("%w: database name is empty", ErrInvalidOption)
+	case o.collection == "":
+		return fmt.Errorf("%w: collection name is empty", ErrInvalidOption)
+	case o.connectTimeout < 0:
+		return fmt.Errorf("%w: connect timeout %s is negative", ErrInvalidOption, o.connectTimeout)
+	case o.pingTimeout <= 0:
+		return fmt.Errorf("%w: ping timeout %s is not positive", ErrInvalidOption, o.pingTimeout)
+	case o.operationTimeout < 0:
+		return fmt.Errorf("%w: operation timeout %s is negative", ErrInvalidOption, o.operationTimeout)
+	case o.reconnectCooldown < 0:
+		return fmt.Errorf("%w: reconnect cooldown %s is negative", ErrInvalidOption, o.reconnectCooldown)
+	case o.maxAttempts < 0:
+		return fmt.Errorf("%w: %d attempts", ErrInvalidOption, o.maxAttempts)
+	case o.retryDelay < 0:
+		return fmt.Errorf("%w: retry delay %s is negative", ErrInvalidOption, o.retryDelay)
+	case o.slowThreshold < 0:
+		return fmt.Errorf("%w: slow operation threshold %s is negative", ErrInvalidOption, o.slowThreshold)
+	case o.idempotencyKeyTTL < 0:
+		return fmt.Errorf("%w: idempotency key ttl %s is negative", ErrInvalidOption, o.idempotencyKeyTTL)
+	case o.verificationTokenTTL < 0:
+		return fmt.Errorf("%w: verification token ttl %s is negative", ErrInvalidOption, o.verificationTokenTTL)
+	case o.clock == nil:
+		return fmt.Errorf("%w: clock is nil", ErrInvalidOption)
+	case o.ids == nil:
+		return fmt.Errorf("%w: ID generator is nil", ErrInvalidOption)
+	case o.tenantResolver != nil && o.createIndexes:
+		return fmt.Errorf("%w: indexes are created per tenant with EnsureTenantIndexes", ErrInvalidOption)
+	}
+
+	if o.passwordPolicy != nil {
+		err := o.passwordPolicy.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := o.fieldEncryption()
+	if err != nil {
+		return err
+	}
+
+	_, err = o.pageTokens()
+
+	return err
+}
+
+// pageTokens returns the page tokens signed with the key of WithPageTokenKey,
+// or a random key.
+func (o repoOptions) pageTokens() (*PageTokens, error) {
+	if o.pageTokenKey == nil {
+		return newRandomPageTokens(), nil
+	}
+
+	return NewPageTokens(o.pageTokenKey)
+}
+
+// fieldEncryption returns nil when emails are stored in plain.
+func (o repoOptions) fieldEncryption() (*fieldEncryption, error) {
+	if o.encryptionKey == nil {
+		if o.emailHashKey != nil || o.previousEncryptionKeys != nil {
+			return nil, fmt.Errorf("%w: encryption keys without WithFieldEncryption", ErrInvalidOption)
+		}
+
+		return nil, nil
+	}
+
+	return newFieldEncryption(o.encryptionKey, o.previousEncryptionKeys, o.emailHashKey)
+}
+
+// tracer returns nil when tracing is off.
+func (o repoOptions) tracer() trace.Tracer {
+	if o.tracerProvider == nil {
+		return nil
+	}
+
+	return o.tracerProvider.Tracer(tracerName)
+}
+
+func (o repoOptions) collectionOptions() *options.CollectionOptions {
+	collectionOpts := options.Collection()
+
+	if o.writeConcern != nil {
+		collectionOpts.SetWriteConcern(o.writeConcern)
+	}
+
+	if o.readPreference != nil {
+		collectionOpts.SetReadPreference(o.readPreference)
+	}
+
+	return collectionOpts
+}
+
+// clientOptions returns the options to connect with. The driver merges them in
+// order, later ones winning.
+func (o repoOptions) clientOptions(mongoURI string) []*options.ClientOptions {
+	clientOpts := make([]*options.ClientOptions, 0, 5)
+
+	if o.client != nil {
+		clientOpts = append(clientOpts, o.client)
+	}
+
+	clientOpts = append(clientOpts, options.Client().ApplyURI(mongoURI))
+
+	if o.connectTimeout > 0 {
+		clientOpts = append(clientOpts, options.Client().SetConnectTimeout(o.connectTimeout))
+	}
+
+	if o.commandMonitor != nil {
+		clientOpts = append(clientOpts, options.Client().SetMonitor(o.commandMonitor))
+	}
+
+	if o.poolMonitor != nil {
+		clientOpts = append(clientOpts, options.Client().SetPoolMonitor(o.poolMonitor))
+	}
+
+	return clientOpts
+}
+
+type writeOptions struct {
+	writeConcern   *writeconcern.WriteConcern
+	skipValidation bool
+	rawPassword    bool
+	suppressEvents bool
+}
+
+// WriteOption tunes a single write method call. Those other than
+// UsingWriteConcern are only honored by MongoRepo.CreateUser, and ignored by
+// the other writes.
+type WriteOption func(*writeOptions)
+
+// UsingWriteConcern makes a single write use wc instead of the repo write
+// concern, for instance writeconcern.Unacknowledged() on a path that doesn't
+// need to wait for the server.
+func UsingWriteConcern(wc *writeconcern.WriteConcern) WriteOption {
+	return func(o *writeOptions) {
+		o.writeConcern = wc
+	}
+}
+
+// SkipValidation makes CreateUser store a user failing Validate or the
+// password policy, such as one migrated from a system with other rules. The
+// user must still have an email, which is trimmed and lowercased.
+func SkipValidation() WriteOption {
+	return func(o *writeOptions) {
+		o.skipValidation = true
+	}
+}
+
+// WithRawPassword makes CreateUser store the password as given instead of
+// hashing it, to migrate users whose password is already a bcrypt hash. A
+// password which isn't one is rejected with ErrInvalidUser.
+func WithRawPassword() WriteOption {
+	return func(o *writeOptions) {
+		o.rawPassword = true
+	}
+}
+
+// SuppressEvents makes CreateUser publish no event to the sink of
+// WithEventSink, for instance while the users of another system are migrated.
+// The creation is still audited.
+func SuppressEvents() WriteOption {
+	return func(o *writeOptions) {
+		o.suppressEvents = true
+	}
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+type readOptions struct {
+	includeDeleted bool
+	withPassword   bool
+	sortField      string
+	sortDescending bool
+	readPreference *readpref.ReadPref
+	batchSize      int32
+	verifiedOnly   bool
+}
+
+// ReadOption tunes a single read method call.
+type ReadOption func(*readOptions)
+
+// UsingReadPreference makes a single read go to the members selected by rp
+// instead of following the repo read preference.
+func UsingReadPreference(rp *readpref.ReadPref) ReadOption {
+	return func(o *readOptions) {
+		o.readPreference = rp
+	}
+}
+
+// VerifiedOnly makes a read return only the users whose email was verified
+// with ConfirmEmailVerification, so that GetUserByEmail doesn't find the ones
+// who didn't prove it is theirs.
+func VerifiedOnly() ReadOption {
+	return func(o *readOptions) {
+		o.verifiedOnly = true
+	}
+}
+
+// IncludeDeleted makes a read return soft-deleted users too.
+func IncludeDeleted() ReadOption {
+	return func(o *readOptions) {
+		o.includeDeleted = true
+	}
+}
+
+// WithPassword makes a read return the password hash, which is left out of
+// every read by default. Only the login path should need it.
+func WithPassword() ReadOption {
+	return func(o *readOptions) {
+		o.withPassword = true
+	}
+}
+
+// SortBy orders the results of ListUsers and FindUsers on field, one of _id,
+// name, email or created_at. Ties are broken by _id.
+func SortBy(field string, descending bool) ReadOption {
+	return func(o *readOptions) {
+		o.sortField = field
+		o.sortDescending = descending
+	}
+}
+
+// WithBatchSize makes the cursor of a read fetch n users per round trip
+// instead of the server default. It matters for IterateUsers, whose batch is
+// all it holds in memory.
+func WithBatchSize(n int32) ReadOption {
+	return func(o *readOptions) {
+		o.batchSize = n
+	}
+}
+
+func newReadOptions(opts []ReadOption) readOptions {
+	var o readOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// apply adds the conditions implied by the options to filter.
+func (o readOptions) apply(filter bson.M) bson.M {
+	if !o.includeDeleted {
+		filter["deleted_at"] = bson.M{"$exists": false}
+	}
+
+	if o.verifiedOnly {
+		filter["email_verified"] = true
+	}
+
+	return filter
+}
+
+// sort returns the sort specification for the options, defaulting to _id.
+func (o readOptions) sort() (bson.D, error) {
+	if o.sortField == "" {
+		return bson.D{{Key: "_id", Value: 1}}, nil
+	}
+
+	key, ok := sortableFields[o.sortField]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSortField, o.sortField)
+	}
+
+	direction := 1
+	if o.sortDescending {
+		direction = -1
+	}
+
+	sort := bson.D{{Key: key, Value: direction}}
+	if key != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: 1})
+	}
+
+	return sort, nil
+}
+
+// projection returns the fields to leave out of read documents, or nil when
+// the whole document is wanted.
+func (o readOptions) projection() bson.M {
+	if o.withPassword {
+		return nil
+	}
+
+	return bson.M{"password": 0}
+}
+
+func (o readOptions) findOptions() *options.FindOptions {
+	findOptions := options.Find()
+	if projection := o.projection(); projection != nil {
+		findOptions.SetProjection(projection)
+	}
+
+	if o.batchSize > 0 {
+		findOptions.SetBatchSize(o.batchSize)
+	}
+
+	return findOptions
+}
+
+func (o readOptions) findOneOptions() *options.FindOneOptions {
+	findOneOptions := options.FindOne()
+	if projection := o.projection(); projection != nil {
+		findOneOptions.SetProjection(projection)
+	}
+
+	return findOneOptions
+}
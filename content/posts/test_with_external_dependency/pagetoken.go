@@ -0,0 +1,175 @@
+package users
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// pageTokenVersion starts every page token, for the format to evolve
+	// without mistaking old tokens for new ones.
+	pageTokenVersion byte = 1
+	// pageTokenMACSize is the length the HMAC of a token is truncated to.
+	pageTokenMACSize   = 16
+	minPageTokenKeyLen = 16
+	// idSort is the sort field of the pages ordered by ID.
+	idSort = "_id"
+)
+
+// ErrInvalidPageToken is returned for a page token which wasn't issued by
+// the repo, was altered or truncated, is of another version, or was issued
+// for another sort order.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// PageTokens issues and reads the opaque page tokens handed to clients in
+// place of the ID of the last user of a page. A token is the URL-safe base64
+// of a version byte, the BSON of its cursor and their HMAC-SHA256, so clients
+// can't forge or alter one, nor rely on what it holds.
+type PageTokens struct {
+	key []byte
+}
+
+// PageCursor is what a page token holds: where the page it follows ended.
+type PageCursor struct {
+	LastID primitive.ObjectID
+	// SortField is the field the pages are ordered on, "_id" when by ID.
+	SortField string
+	// LastValue is the value of SortField of the last user, as decoded from
+	// BSON: a time comes back as a primitive.DateTime. It is nil for the
+	// pages ordered by ID.
+	LastValue interface{}
+}
+
+type pageTokenPayload struct {
+	LastID    primitive.ObjectID `bson:"id"`
+	SortField string             `bson:"sort"`
+	LastValue interface{}        `bson:"value,omitempty"`
+}
+
+// NewPageTokens returns the page tokens signed with key, of at least 16
+// bytes. The instances of an application must share it for a token issued by
+// one to be read by another.
+func NewPageTokens(key []byte) (*PageTokens, error) {
+	if len(key) < minPageTokenKeyLen {
+		return nil, fmt.Errorf("%w: page token key is shorter than %d bytes", ErrInvalidOption, minPageTokenKeyLen)
+	}
+
+	return &PageTokens{key: append([]byte(nil), key...)}, nil
+}
+
+// newRandomPageTokens returns page tokens signed with a random key, which
+// only the process issuing them can read.
+func newRandomPageTokens() *PageTokens {
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key)
+
+	return &PageTokens{key: key}
+}
+
+// EncodePageToken returns the token of the page following the user lastID,
+// whose sortField was lastValue. Values BSON can't encode make it panic.
+func (p *PageTokens) EncodePageToken(lastID primitive.ObjectID, sortField string, lastValue interface{}) string {
+	payload, err := bson.Marshal(pageTokenPayload{LastID: lastID, SortField: sortField, LastValue: lastValue})
+	if err != nil {
+		panic(fmt.Sprintf("encoding page token: %s", err))
+	}
+
+	token := append([]byte{pageTokenVersion}, payload...)
+	token = append(token, p.mac(token)...)
+
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// DecodePageToken returns the cursor in token, which must have been issued
+// for the pages ordered on sortField. It fails with ErrInvalidPageToken
+// otherwise.
+func (p *PageTokens) DecodePageToken(token, sortField string) (PageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return PageCursor{}, fmt.Errorf("%w: not base64", ErrInvalidPageToken)
+	}
+
+	if len(raw) < 1+pageTokenMACSize {
+		return PageCursor{}, fmt.Errorf("%w: truncated", ErrInvalidPageToken)
+	}
+
+	if raw[0] != pageTokenVersion {
+		return PageCursor{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidPageToken, raw[0])
+	}
+
+	signed, mac := raw[:len(raw)-pageTokenMACSize], raw[len(raw)-pageTokenMACSize:]
+	if !hmac.Equal(mac, p.mac(signed)) {
+		return PageCursor{}, fmt.Errorf("%w: signature mismatch", ErrInvalidPageToken)
+	}
+
+	var payload pageTokenPayload
+
+	err = bson.Unmarshal(signed[1:], &payload)
+	if err != nil {
+		return PageCursor{}, fmt.Errorf("%w: malformed: %s", ErrInvalidPageToken, err)
+	}
+
+	if payload.SortField != sortField {
+		return PageCursor{}, fmt.Errorf("%w: issued for the order on %q, not %q",
+			ErrInvalidPageToken, payload.SortField, sortField)
+	}
+
+	return PageCursor(payload), nil
+}
+
+func (p *PageTokens) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(data)
+
+	return mac.Sum(nil)[:pageTokenMACSize]
+}
+
+// PageTokens returns the page tokens of the repo, signed with the key set by
+// WithPageTokenKey.
+func (m *MongoRepo) PageTokens() *PageTokens {
+	return m.pageTokens
+}
+
+// ListUsersPage is ListUsersAfter taking and returning page tokens instead
+// of IDs. An empty pageToken starts from the beginning, and next is empty
+// once every user has been returned.
+func (m *MongoRepo) ListUsersPage(ctx context.Context, pageToken string, limit int64, opts ...ReadOption) (
+	users []*User, next string, err error,
+) {
+	return listUsersPage(ctx, m, m.pageTokens, pageToken, limit, opts)
+}
+
+// listUsersPage runs ListUsersPage on any repository with tokens.
+func listUsersPage(
+	ctx context.Context, repo UserRepository, tokens *PageTokens, pageToken string, limit int64, opts []ReadOption,
+) ([]*User, string, error) {
+	afterID := primitive.NilObjectID
+
+	if pageToken != "" {
+		cursor, err := tokens.DecodePageToken(pageToken, idSort)
+		if err != nil {
+			return nil, "", err
+		}
+
+		afterID = cursor.LastID
+	}
+
+	users, nextID, err := repo.ListUsersAfter(ctx, afterID, limit, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if nextID.IsZero() {
+		return users, "", nil
+	}
+
+	return users, tokens.EncodePageToken(nextID, idSort, nil), nil
+}
@@ -0,0 +1,274 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrHashingPassword = errors.New("error hashing password")
+	// ErrInvalidCredentials is returned by ChangePassword when the current
+	// password given is wrong.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrWeakPassword is matched, along with ErrInvalidUser, when a password
+	// breaks the policy set with WithPasswordPolicy.
+	ErrWeakPassword = errors.New("weak password")
+)
+
+// commonPasswords are among the most used passwords long enough to pass the
+// length rules, lowercased.
+var commonPasswords = []string{
+	"00000000", "11111111", "11223344", "12341234", "12345678", "123456789", "1234567890", "1234qwer",
+	"1q2w3e4r", "1q2w3e4r5t", "1qaz2wsx", "87654321", "88888888", "987654321", "a1b2c3d4", "abc12345",
+	"abcd1234", "admin123", "asdfghjk", "asdfghjkl", "baseball", "changeme", "computer", "dragon123",
+	"football", "football1", "iloveyou", "iloveyou1", "letmein1", "letmein123", "master123", "michelle",
+	"monkey123", "p@ssw0rd", "p@ssword1", "passw0rd", "password", "password!", "password1", "password1!",
+	"password12", "password123", "princess", "q1w2e3r4", "qazwsxedc", "qwerty12", "qwerty123", "qwertyuiop",
+	"shadow123", "starwars", "sunshine", "superman", "trustno1", "welcome1", "welcome123", "whatever",
+	"zaq12wsx",
+}
+
+// PasswordPolicy is what the passwords given to a repo set WithPasswordPolicy
+// must satisfy, on top of the length bounds Validate checks. The zero policy
+// allows any password Validate accepts.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// MaxLength is the most bytes a password may have, the 72 bcrypt hashes
+	// when zero. Longer passwords are rejected: bcrypt would ignore the end.
+	MaxLength int
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol require a
+	// character of the class. Symbols are the characters neither letters nor
+	// digits.
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DenyList has the passwords refused whatever the other rules. They are
+	// compared ignoring case.
+	DenyList []string
+}
+
+// DefaultPasswordPolicy returns a policy requiring 10 characters mixing
+// lowercase, uppercase and digits, and refusing the most common passwords.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:    10,
+		RequireUpper: true,
+		RequireLower: true,
+		RequireDigit: true,
+		DenyList:     slices.Clone(commonPasswords),
+	}
+}
+
+// Check returns an error matching ErrWeakPassword, listing the rules password
+// breaks, or nil when it follows the policy. The error never includes the
+// password.
+func (p PasswordPolicy) Check(password string) error {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("password is shorter than %d characters", p.MinLength))
+	}
+
+	if maxLength := p.maxLength(); len(password) > maxLength {
+		problems = append(problems, fmt.Sprintf("password is longer than %d bytes", maxLength))
+	}
+
+	for _, class := range []struct {
+		required bool
+		name     string
+		is       func(rune) bool
+	}{
+		{p.RequireUpper, "uppercase letter", unicode.IsUpper},
+		{p.RequireLower, "lowercase letter", unicode.IsLower},
+		{p.RequireDigit, "digit", unicode.IsDigit},
+		{p.RequireSymbol, "symbol", isSymbol},
+	} {
+		if class.required && strings.IndexFunc(password, class.is) < 0 {
+			problems = append(problems, "password has no "+class.name)
+		}
+	}
+
+	if slices.ContainsFunc(p.DenyList, func(denied string) bool { return strings.EqualFold(denied, password) }) {
+		problems = append(problems, "password is too common")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrWeakPassword, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (p PasswordPolicy) maxLength() int {
+	if p.MaxLength == 0 {
+		return maxPasswordLength
+	}
+
+	return p.MaxLength
+}
+
+func (p PasswordPolicy) validate() error {
+	switch {
+	case p.MinLength < 0:
+		return fmt.Errorf("%w: password policy min length %d is negative", ErrInvalidOption, p.MinLength)
+	case p.MaxLength < 0 || p.MaxLength > maxPasswordLength:
+		return fmt.Errorf("%w: password policy max length %d is not between 0 and the %d bytes bcrypt hashes",
+			ErrInvalidOption, p.MaxLength, maxPasswordLength)
+	case p.MinLength > p.maxLength():
+		return fmt.Errorf("%w: password policy min length %d is over its max length %d",
+			ErrInvalidOption, p.MinLength, p.maxLength())
+	}
+
+	return nil
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// checkPassword returns an error matching ErrInvalidUser and ErrWeakPassword
+// when password breaks the policy of the repo.
+func (m *MongoRepo) checkPassword(password string) error {
+	if m.passwordPolicy == nil {
+		return nil
+	}
+
+	err := m.passwordPolicy.Check(password)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidUser, err)
+	}
+
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of password using the repo cost.
+func (m *MongoRepo) hashPassword(password string) (string, error) {
+	return hashPassword(password, m.bcryptCost)
+}
+
+// cost returns the bcrypt cost of the hashes the repo makes.
+func (m *MongoRepo) cost() int {
+	if m.bcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+
+	return m.bcryptCost
+}
+
+// hashPassword returns the bcrypt hash of password with cost, or the default
+// cost when zero.
+func hashPassword(password string, cost int) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("%w: password is empty", ErrInvalidUser)
+	}
+
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrHashingPassword, err)
+	}
+
+	return string(hash), nil
+}
+
+// VerifyPassword reports whether candidate is the password of the user with
+// this email. When it is and the stored hash has a lower cost than the repo
+// hashes with, the hash is replaced by one at the repo cost, so that users
+// move to stronger hashes as they log in.
+func (m *MongoRepo) VerifyPassword(ctx context.Context, email, candidate string) (bool, error) {
+	user, err := m.GetUserByEmail(ctx, email, WithPassword())
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := checkPasswordHash(user.Password, candidate)
+	if !ok || err != nil {
+		return false, err
+	}
+
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err == nil && cost < m.cost() {
+		m.rehashPassword(ctx, user.ID, user.Password, candidate)
+	}
+
+	return true, nil
+}
+
+// isPasswordHash reports whether password is a bcrypt hash, as stored.
+func isPasswordHash(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// checkPasswordHash reports whether password is the one hashed into hash.
+func checkPasswordHash(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrHashingPassword, err)
+	}
+
+	return true, nil
+}
+
+// rehashPassword replaces oldHash, the hash of password stored for the user
+// with this id, by a hash at the repo cost, unless the password was changed in
+// the meantime. A failure is only logged since the password was verified all
+// the same, and the next verification tries again.
+func (m *MongoRepo) rehashPassword(ctx context.Context, id primitive.ObjectID, oldHash, password string) {
+	hash, err := m.hashPassword(password)
+	if err == nil {
+		_, err = m.mongoCaller.UpdateOne(ctx,
+			bson.M{"_id": id, "password": oldHash},
+			bson.M{"$set": bson.M{"password": hash}},
+		)
+	}
+
+	if err != nil && m.logger != nil {
+		m.logger.LogAttrs(ctx, slog.LevelWarn, "rehashing password failed",
+			slog.String("user_id", id.Hex()),
+			slog.String("error", redact(err.Error())))
+	}
+}
+
+// ChangePassword replaces the password of the user with this id by the hash
+// of newPassword, provided currentPassword is its password. It fails with
+// ErrUserNotFound when there is no such user, ErrInvalidCredentials when
+// currentPassword is wrong and ErrWeakPassword when newPassword breaks the
+// policy set with WithPasswordPolicy. A user updated between the check and
+// the write is left alone with ErrVersionConflict.
+func (m *MongoRepo) ChangePassword(ctx context.Context, id primitive.ObjectID, currentPassword, newPassword string) error {
+	user, err := m.GetUserByID(ctx, id, WithPassword())
+	if err != nil {
+		return err
+	}
+
+	ok, err := checkPasswordHash(user.Password, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: wrong current password for user %s", ErrInvalidCredentials, id.Hex())
+	}
+
+	return m.updateUserFields(ctx, "ChangePassword", versionFilter(id, user.Version), id,
+		map[string]interface{}{"password": newPassword})
+}
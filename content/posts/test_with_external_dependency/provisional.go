@@ -0,0 +1,74 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateProvisionalUser creates user like CreateUser but with an ExpiresAt ttl
+// from now. Unless PromoteUser is called before, the TTL index created by
+// EnsureIndexes purges it once expired.
+func (m *MongoRepo) CreateProvisionalUser(ctx context.Context, user *User, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: ttl must be positive, got %s", ErrInvalidUser, ttl)
+	}
+
+	expiresAt := m.timestamp().Add(ttl)
+	user.ExpiresAt = &expiresAt
+
+	_, err := m.CreateUser(ctx, user)
+
+	return err
+}
+
+// PromoteUser makes the provisional user with this id permanent by clearing
+// its ExpiresAt. Promoting a user that isn't provisional is a no-op, while an
+// expired user is reported as not found even if not purged yet.
+func (m *MongoRepo) PromoteUser(ctx context.Context, id primitive.ObjectID) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "PromoteUser", id)
+	defer m.end(ctx, &call, &err)
+
+	now := m.timestamp()
+	filter := bson.M{"_id": id, "expires_at": bson.M{"$gt": now}}
+
+	before, err := m.snapshot(ctx, "PromoteUser", filter)
+	if err != nil {
+		return err
+	}
+
+	result, err := m.mongoCaller.UpdateOne(ctx, filter,
+		bson.M{
+			"$unset": bson.M{"expires_at": ""},
+			"$set":   bson.M{"updated_at": now},
+			"$inc":   bson.M{"version": 1},
+		},
+	)
+	if err != nil {
+		return translateWriteError(ErrUpdatingUser, err)
+	}
+
+	if result.MatchedCount > 0 {
+		return m.publishAudited(ctx, m.audit(ctx, "PromoteUser", bson.M{"_id": id}, before), EventUserUpdated, id, "")
+	}
+
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{"_id": id, "expires_at": bson.M{"$exists": false}})
+	if err != nil {
+		return driverError(ErrUpdatingUser, err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is matched, along with ErrOperationTimeout, by the calls
+// RateLimitedRepo gave up on before they reached the wrapped repository.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitedRepo is a UserRepository spacing out the calls made to the
+// repository it wraps, so that a busy caller such as an import job can't
+// saturate the database. Reads (the Get and List methods) and writes take
+// their tokens from two limiters.
+//
+// A call waits for its token. When its context expires first, or would expire
+// before the token is available, the call fails right away with
+// ErrOperationTimeout and the wrapped repository isn't called.
+type RateLimitedRepo struct {
+	repo   UserRepository
+	reads  *rate.Limiter
+	writes *rate.Limiter
+
+	// clock and sleep are swapped by tests to wait without sleeping.
+	clock Clock
+	sleep func(ctx context.Context, d time.Duration) error
+
+	readsThrottled  atomic.Int64
+	writesThrottled atomic.Int64
+}
+
+var _ UserRepository = (*RateLimitedRepo)(nil)
+
+// NewRateLimitedRepo returns repo limited to the rates of reads and writes,
+// such as rate.NewLimiter(100, 10) for 100 calls per second in bursts of up
+// to 10. A limiter of rate.Inf leaves its calls unlimited.
+func NewRateLimitedRepo(repo UserRepository, reads, writes *rate.Limiter) *RateLimitedRepo {
+	return &RateLimitedRepo{
+		repo:   repo,
+		reads:  reads,
+		writes: writes,
+		clock:  systemClock{},
+		sleep:  sleepContext,
+	}
+}
+
+// RateLimitStats tells how RateLimitedRepo is throttling its calls.
+type RateLimitStats struct {
+	// ReadTokens and WriteTokens are the calls which can be made right away,
+	// negative while calls wait for their token.
+	ReadTokens  float64
+	WriteTokens float64
+	// ReadsThrottled and WritesThrottled count the calls which had to wait for
+	// their token, including the ones which gave up.
+	ReadsThrottled  int64
+	WritesThrottled int64
+}
+
+// Stats returns the tokens available now and the calls throttled so far.
+func (r *RateLimitedRepo) Stats() RateLimitStats {
+	now := r.clock.Now()
+
+	return RateLimitStats{
+		ReadTokens:      r.reads.TokensAt(now),
+		WriteTokens:     r.writes.TokensAt(now),
+		ReadsThrottled:  r.readsThrottled.Load(),
+		WritesThrottled: r.writesThrottled.Load(),
+	}
+}
+
+func (r *RateLimitedRepo) CreateUser(ctx context.Context, user *User, opts ...WriteOption) (*User, error) {
+	err := r.waitWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.repo.CreateUser(ctx, user, opts...)
+}
+
+func (r *RateLimitedRepo) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (
+	*User, error,
+) {
+	err := r.waitRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.repo.GetUserByID(ctx, id, opts...)
+}
+
+func (r *RateLimitedRepo) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (
+	*User, error,
+) {
+	err := r.waitRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.repo.GetUserByEmail(ctx, email, opts...)
+}
+
+func (r *RateLimitedRepo) UpdateUser(ctx context.Context, user *User, opts ...WriteOption) error {
+	err := r.waitWrite(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.repo.UpdateUser(ctx, user, opts...)
+}
+
+func (r *RateLimitedRepo) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	err := r.waitWrite(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.repo.DeleteUser(ctx, id)
+}
+
+func (r *RateLimitedRepo) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) (
+	[]*User, error,
+) {
+	err := r.waitRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.repo.ListUsers(ctx, limit, offset, opts...)
+}
+
+func (r *RateLimitedRepo) ListUsersAfter(
+	ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption,
+) ([]*User, primitive.ObjectID, error) {
+	err := r.waitRead(ctx)
+	if err != nil {
+		return nil, primitive.NilObjectID, err
+	}
+
+	return r.repo.ListUsersAfter(ctx, afterID, limit, opts...)
+}
+
+func (r *RateLimitedRepo) waitRead(ctx context.Context) error {
+	return r.wait(ctx, r.reads, &r.readsThrottled, "read")
+}
+
+func (r *RateLimitedRepo) waitWrite(ctx context.Context) error {
+	return r.wait(ctx, r.writes, &r.writesThrottled, "write")
+}
+
+// wait takes a token from limiter, waiting for it if need be, or gives up and
+// gives the token back when ctx doesn't leave time to wait. Like
+// rate.Limiter.Wait, it doesn't wait for a token it knows it won't get.
+func (r *RateLimitedRepo) wait(ctx context.Context, limiter *rate.Limiter, throttled *atomic.Int64, kind string) error {
+	err := ctx.Err()
+	if err != nil {
+		return rateLimitError(kind, err)
+	}
+
+	now := r.clock.Now()
+
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		throttled.Add(1)
+		return fmt.Errorf("%w: %w: %s limit allows no call", ErrOperationTimeout, ErrRateLimited, kind)
+	}
+
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+
+	throttled.Add(1)
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		reservation.CancelAt(now)
+		return rateLimitError(kind, context.DeadlineExceeded)
+	}
+
+	err = r.sleep(ctx, delay)
+	if err != nil {
+		reservation.CancelAt(r.clock.Now())
+		return rateLimitError(kind, err)
+	}
+
+	return nil
+}
+
+// rateLimitError returns the error of a call which gave up waiting for its
+// kind of token as ctx ended with err.
+func rateLimitError(kind string, err error) error {
+	sentinel := ErrOperationTimeout
+	if errors.Is(err, context.Canceled) {
+		sentinel = ErrOperationCanceled
+	}
+
+	return fmt.Errorf("%w: %w: waiting for a %s token: %w", sentinel, ErrRateLimited, kind, err)
+}
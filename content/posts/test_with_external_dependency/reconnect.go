@@ -0,0 +1,278 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	// defaultReconnectCooldown is how long a degraded repo waits between two
+	// pings to the server.
+	defaultReconnectCooldown = 5 * time.Second
+	// reconnectPingTimeout bounds each of those pings.
+	reconnectPingTimeout = 2 * time.Second
+)
+
+// Status is the state of the connection of a MongoRepo.
+type Status string
+
+const (
+	// StatusHealthy means calls go to the server.
+	StatusHealthy Status = "healthy"
+	// StatusDegraded means the connection was lost. Calls fail with
+	// ErrTemporarilyUnavailable until a ping succeeds again.
+	StatusDegraded Status = "degraded"
+	// StatusClosed means Close was called.
+	StatusClosed Status = "closed"
+)
+
+// isConnectionFailure reports whether err means the server couldn't be
+// reached, as opposed to an operation the server rejected.
+func isConnectionFailure(err error) bool {
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+
+	var selectionErr topology.ServerSelectionError
+
+	return errors.As(err, &selectionErr)
+}
+
+// connectionState tracks whether the server is reachable. Once degraded, it
+// pings the server at most once per cooldown and fails the calls made in
+// between fast with ErrTemporarilyUnavailable.
+type connectionState struct {
+	client   MongoClient
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	degraded bool
+	// lastProbe is when the connection was lost or last pinged without
+	// success.
+	lastProbe time.Time
+}
+
+func newConnectionState(client MongoClient, cooldown time.Duration) *connectionState {
+	return &connectionState{
+		client:   client,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+func (c *connectionState) status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.degraded {
+		return StatusDegraded
+	}
+
+	return StatusHealthy
+}
+
+// available returns nil when a call can go to the server, pinging it first if
+// the connection was lost and the cooldown is over.
+func (c *connectionState) available(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.degraded {
+		return nil
+	}
+
+	if c.now().Sub(c.lastProbe) < c.cooldown {
+		return ErrTemporarilyUnavailable
+	}
+
+	err := ping(ctx, c.client, reconnectPingTimeout)
+	if err != nil {
+		c.lastProbe = c.now()
+		return fmt.Errorf("%w: %s", ErrTemporarilyUnavailable, err)
+	}
+
+	c.degraded = false
+
+	return nil
+}
+
+// observe marks the connection degraded when err is a connection failure.
+func (c *connectionState) observe(err error) {
+	if !isConnectionFailure(err) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.degraded = true
+	c.lastProbe = c.now()
+}
+
+// reconnectingCaller stops sending calls to a server it lost the connection
+// to, as tracked by state, until it answers again.
+type reconnectingCaller struct {
+	caller MongoCaller
+	state  *connectionState
+}
+
+var _ MongoCaller = (*reconnectingCaller)(nil)
+
+func (r *reconnectingCaller) do(ctx context.Context, op func() error) error {
+	err := r.state.available(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = op()
+	r.state.observe(err)
+
+	return err
+}
+
+func (r *reconnectingCaller) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+	result *mongo.InsertOneResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.InsertOne(ctx, document, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) InsertMany(
+	ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions,
+) (result *mongo.InsertManyResult, err error) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.InsertMany(ctx, documents, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (
+	result *mongo.SingleResult,
+) {
+	err := r.do(ctx, func() error {
+		result = r.caller.FindOne(ctx, filter, opts...)
+		return result.Err()
+	})
+	if result == nil {
+		result = mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+
+	return result
+}
+
+func (r *reconnectingCaller) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (
+	cursor *mongo.Cursor, err error,
+) {
+	err = r.do(ctx, func() error {
+		cursor, err = r.caller.Find(ctx, filter, opts...)
+		return err
+	})
+
+	return cursor, err
+}
+
+func (r *reconnectingCaller) UpdateOne(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions,
+) (result *mongo.UpdateResult, err error) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) FindOneAndUpdate(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions,
+) (result *mongo.SingleResult) {
+	err := r.do(ctx, func() error {
+		result = r.caller.FindOneAndUpdate(ctx, filter, update, opts...)
+		return result.Err()
+	})
+	if result == nil {
+		result = mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+
+	return result
+}
+
+func (r *reconnectingCaller) ReplaceOne(
+	ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions,
+) (result *mongo.UpdateResult, err error) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.ReplaceOne(ctx, filter, replacement, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	result *mongo.DeleteResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	result *mongo.DeleteResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.DeleteMany(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *reconnectingCaller) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (
+	count int64, err error,
+) {
+	err = r.do(ctx, func() error {
+		count, err = r.caller.CountDocuments(ctx, filter, opts...)
+		return err
+	})
+
+	return count, err
+}
+
+func (r *reconnectingCaller) Distinct(
+	ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions,
+) (values []interface{}, err error) {
+	err = r.do(ctx, func() error {
+		values, err = r.caller.Distinct(ctx, fieldName, filter, opts...)
+		return err
+	})
+
+	return values, err
+}
+
+func (r *reconnectingCaller) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (
+	cursor *mongo.Cursor, err error,
+) {
+	err = r.do(ctx, func() error {
+		cursor, err = r.caller.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
+
+	return cursor, err
+}
@@ -0,0 +1,28 @@
+// Package users is the user store of the post on testing code with an
+// external dependency: UserRepository, and MongoRepo implementing it on
+// MongoDB. The cmd directory holds the example program and usersctl.
+package users
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserRepository is what the rest of the code needs to store users. MongoRepo
+// implements it, on a server or on MockMongo, as does InMemoryUserRepository,
+// and RunRepositoryContractTests checks an implementation behaves like these
+// do.
+type UserRepository interface {
+	CreateUser(ctx context.Context, user *User, opts ...WriteOption) (*User, error)
+	GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (*User, error)
+	GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (*User, error)
+	UpdateUser(ctx context.Context, user *User, opts ...WriteOption) error
+	DeleteUser(ctx context.Context, id primitive.ObjectID) error
+	ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) ([]*User, error)
+	ListUsersAfter(ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption) (
+		[]*User, primitive.ObjectID, error,
+	)
+}
+
+var _ UserRepository = (*MongoRepo)(nil)
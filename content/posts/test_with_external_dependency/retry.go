@@ -0,0 +1,278 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// transientCodes are server error codes returned while a replica set elects a
+// new primary or a node shuts down.
+var transientCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary, formerly "not master"
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsRetryable reports whether the operation that failed with err may succeed
+// if tried again, such as after a network error, while no server could be
+// selected or while a replica set has no primary. Duplicate keys, validation
+// failures, missing users and a done context never do. err may be wrapped.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if mongo.IsDuplicateKeyError(err) {
+		return false
+	}
+
+	if errors.Is(err, ErrTemporarilyUnavailable) {
+		return true
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) || errors.Is(err, topology.ErrServerSelectionTimeout) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, code := range transientCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+
+		return serverErr.HasErrorLabel("RetryableWriteError")
+	}
+
+	return false
+}
+
+// retryingCaller retries the calls of the wrapped MongoCaller failing with a
+// transient error, waiting an exponentially growing delay between attempts.
+// A write may have been applied before its connection dropped, so a retried
+// insert can come back as a duplicate key. Calls made in a transaction aren't
+// retried, the transaction being retried as a whole.
+type retryingCaller struct {
+	caller      MongoCaller
+	maxAttempts int
+	baseDelay   time.Duration
+	// sleep waits d or until ctx is done. Tests replace it to skip waiting.
+	sleep func(ctx context.Context, d time.Duration) error
+	// jitter spreads the retries of concurrent callers.
+	jitter func(d time.Duration) time.Duration
+}
+
+var _ MongoCaller = (*retryingCaller)(nil)
+
+func newRetryingCaller(caller MongoCaller, maxAttempts int, baseDelay time.Duration) *retryingCaller {
+	return &retryingCaller{
+		caller:      caller,
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		sleep:       sleepContext,
+		jitter:      halfJitter,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// halfJitter returns a random delay between d/2 and d.
+func halfJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do calls op until it succeeds, fails with an error that isn't transient or
+// maxAttempts is reached. The last error is returned, joined to ctx's if ctx
+// is done while waiting, for the call to fail as canceled or timed out.
+func (r *retryingCaller) do(ctx context.Context, op func() error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return op()
+	}
+
+	delay := r.baseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if attempt >= r.maxAttempts || !IsRetryable(err) {
+			return err
+		}
+
+		sleepErr := r.sleep(ctx, r.jitter(delay))
+		if sleepErr != nil {
+			return errors.Join(sleepErr, err)
+		}
+
+		delay *= 2
+	}
+}
+
+func (r *retryingCaller) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+	result *mongo.InsertOneResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.InsertOne(ctx, document, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (
+	result *mongo.InsertManyResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.InsertMany(ctx, documents, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (
+	result *mongo.SingleResult,
+) {
+	_ = r.do(ctx, func() error {
+		result = r.caller.FindOne(ctx, filter, opts...)
+		return result.Err()
+	})
+
+	return result
+}
+
+func (r *retryingCaller) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (
+	cursor *mongo.Cursor, err error,
+) {
+	err = r.do(ctx, func() error {
+		cursor, err = r.caller.Find(ctx, filter, opts...)
+		return err
+	})
+
+	return cursor, err
+}
+
+func (r *retryingCaller) UpdateOne(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions,
+) (result *mongo.UpdateResult, err error) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) FindOneAndUpdate(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions,
+) (result *mongo.SingleResult) {
+	_ = r.do(ctx, func() error {
+		result = r.caller.FindOneAndUpdate(ctx, filter, update, opts...)
+		return result.Err()
+	})
+
+	return result
+}
+
+func (r *retryingCaller) ReplaceOne(
+	ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions,
+) (result *mongo.UpdateResult, err error) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.ReplaceOne(ctx, filter, replacement, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	result *mongo.DeleteResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	result *mongo.DeleteResult, err error,
+) {
+	err = r.do(ctx, func() error {
+		result, err = r.caller.DeleteMany(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (r *retryingCaller) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (
+	count int64, err error,
+) {
+	err = r.do(ctx, func() error {
+		count, err = r.caller.CountDocuments(ctx, filter, opts...)
+		return err
+	})
+
+	return count, err
+}
+
+func (r *retryingCaller) Distinct(
+	ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions,
+) (values []interface{}, err error) {
+	err = r.do(ctx, func() error {
+		values, err = r.caller.Distinct(ctx, fieldName, filter, opts...)
+		return err
+	})
+
+	return values, err
+}
+
+func (r *retryingCaller) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (
+	cursor *mongo.Cursor, err error,
+) {
+	err = r.do(ctx, func() error {
+		cursor, err = r.caller.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
+
+	return cursor, err
+}
@@ -0,0 +1,96 @@
+package users
+
+import (
+	"context"
+	"fmt"
+)
+
+const defaultSeedEmailDomain = "example.test"
+
+// seedReporter is the part of *testing.T used by SeedUsers, taken instead of
+// *testing.T for the testing package to stay out of the binary.
+type seedReporter interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+type seedOptions struct {
+	role         string
+	deletedShare float64
+	emailDomain  string
+}
+
+// SeedOption tunes the users made by SeedUsers.
+type SeedOption func(*seedOptions)
+
+// WithSeedRole gives every seeded user role instead of the default one.
+func WithSeedRole(role string) SeedOption {
+	return func(o *seedOptions) {
+		o.role = role
+	}
+}
+
+// WithSeedSoftDeleted soft-deletes that share of the seeded users, between 0
+// and 1, spread evenly over them.
+func WithSeedSoftDeleted(share float64) SeedOption {
+	return func(o *seedOptions) {
+		o.deletedShare = share
+	}
+}
+
+// WithSeedEmailDomain sets the domain of the seeded emails, example.test by
+// default.
+func WithSeedEmailDomain(domain string) SeedOption {
+	return func(o *seedOptions) {
+		o.emailDomain = domain
+	}
+}
+
+// SeedUsers creates n users named "User 0001", "User 0002" and so on, with
+// the emails user0001@example.test and so on, in a single CreateUsers call.
+// It returns them as stored, ordered as created, and fails t on any error.
+func SeedUsers(t seedReporter, repo *MongoRepo, n int, opts ...SeedOption) []*User {
+	t.Helper()
+
+	o := seedOptions{emailDomain: defaultSeedEmailDomain}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ctx := context.Background()
+
+	users := make([]*User, 0, n)
+	for i := 1; i <= n; i++ {
+		users = append(users, &User{
+			Name:     fmt.Sprintf("User %04d", i),
+			Email:    fmt.Sprintf("user%04d@%s", i, o.emailDomain),
+			Password: "password",
+			Role:     o.role,
+		})
+	}
+
+	_, err := repo.CreateUsers(ctx, users)
+	if err != nil {
+		t.Fatalf("error seeding users: %s", err)
+	}
+
+	for i, user := range users {
+		if int(float64(i+1)*o.deletedShare) == int(float64(i)*o.deletedShare) {
+			continue
+		}
+
+		err = repo.SoftDeleteUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error soft-deleting seeded user: %s", err)
+		}
+
+		deleted, err := repo.GetUserByID(ctx, user.ID, IncludeDeleted(), WithPassword())
+		if err != nil {
+			t.Fatalf("error reading seeded user: %s", err)
+		}
+
+		users[i] = deleted
+	}
+
+	return users
+}
@@ -0,0 +1,542 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	// Registers the "sqlite" database/sql driver, written in Go so no C
+	// toolchain is needed.
+	_ "modernc.org/sqlite"
+)
+
+var ErrOpeningSQLiteDatabase = errors.New("error opening sqlite database")
+
+// SQLite result codes the repo translates. Extended codes carry their
+// primary code in their lowest byte.
+const (
+	sqliteBusy                 = 5
+	sqliteLocked               = 6
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+// sqliteBusyTimeout is how long SQLite waits for a lock held by another
+// connection before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5 * time.Second
+
+// sqliteCodeError is implemented by the errors of the SQLite driver, such as
+// *sqlite.Error, carrying the extended result code of the failure.
+type sqliteCodeError interface {
+	Code() int
+}
+
+// SQLiteRepo is a UserRepository storing users in a SQLite database, in a
+// file or in memory, so the example runs without any server. IDs are
+// ObjectIDs stored as their hex string and times as Unix milliseconds. The
+// other rules are those of MongoRepo.
+type SQLiteRepo struct {
+	db *sql.DB
+	// table is the quoted name of the users table.
+	table      string
+	bcryptCost int
+	clock      Clock
+	ids        IDGenerator
+	pageSize   int64
+	closed     atomic.Bool
+}
+
+var _ UserRepository = (*SQLiteRepo)(nil)
+
+// NewSQLiteRepo opens the database in the file at path, created if needed, or
+// a private in-memory one when path is ":memory:", and creates the users
+// table, named by WithCollection, if it doesn't exist. File databases use
+// write-ahead logging so reads don't wait for writes. WithBcryptCost,
+// WithClock and WithIDGenerator apply too, the other options are Mongo's and
+// ignored.
+func NewSQLiteRepo(ctx context.Context, path string, opts ...Option) (*SQLiteRepo, error) {
+	repoOpts := newRepoOptions(opts)
+
+	err := repoOpts.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	memory := path == ":memory:"
+
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+
+	if !memory {
+		pragmas.Add("_pragma", "journal_mode(WAL)")
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+pragmas.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrOpeningSQLiteDatabase, err)
+	}
+
+	// Every connection to :memory: opens a database of its own, so a single
+	// one is kept.
+	if memory {
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxIdleTime(0)
+		db.SetConnMaxLifetime(0)
+	}
+
+	repo := &SQLiteRepo{
+		db:         db,
+		table:      quoteIdentifier(repoOpts.collection),
+		bcryptCost: repoOpts.bcryptCost,
+		clock:      repoOpts.clock,
+		ids:        repoOpts.ids,
+		pageSize:   defaultPageSize,
+	}
+
+	err = repo.migrate(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+func (r *SQLiteRepo) migrate(ctx context.Context) error {
+	index := quoteIdentifier(strings.Trim(r.table, `"`) + "_email_key")
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + r.table + ` (
+			id         TEXT PRIMARY KEY NOT NULL,
+			name       TEXT NOT NULL,
+			email      TEXT NOT NULL,
+			password   TEXT NOT NULL,
+			role       TEXT NOT NULL,
+			version    INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			deleted_at INTEGER,
+			expires_at INTEGER
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS ` + index + ` ON ` + r.table + ` (email)`,
+	}
+
+	for _, statement := range statements {
+		_, err := r.db.ExecContext(ctx, statement)
+		if err != nil {
+			return r.translate(ErrMigratingSchema, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the database. Every call made on the repo afterwards returns
+// ErrRepoClosed, except Close itself which does nothing. An in-memory
+// database is gone once closed.
+func (r *SQLiteRepo) Close(context.Context) error {
+	if !r.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	err := r.db.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRepoClosed, err)
+	}
+
+	return nil
+}
+
+// CreateUser inserts user after replacing its password with a bcrypt hash,
+// like MongoRepo.CreateUser does. A user whose ID or email is already taken
+// is rejected with ErrUserAlreadyExists. Write options have no effect.
+func (r *SQLiteRepo) CreateUser(ctx context.Context, user *User, _ ...WriteOption) (*User, error) {
+	if r.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	err := user.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	user.Email, err = NormalizeEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(user.Password, r.bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID.IsZero() {
+		user.ID = r.ids.NewID()
+	}
+
+	user.Password = hash
+	user.Version = 1
+	user.CreatedAt = r.timestamp()
+	user.UpdatedAt = user.CreatedAt
+
+	if user.Role == "" {
+		user.Role = RoleMember
+	}
+
+	// SQLite has no TTL index: an expired provisional user is purged when its
+	// email is taken again.
+	_, err = r.db.ExecContext(ctx, `DELETE FROM `+r.table+` WHERE email = ? AND expires_at <= ?`,
+		user.Email, r.clock.Now().UnixMilli())
+	if err != nil {
+		return nil, r.translate(ErrInsertingUser, err)
+	}
+
+	_, err = r.db.ExecContext(ctx,
+		`INSERT INTO `+r.table+` (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID.Hex(), user.Name, user.Email, user.Password, user.Role, user.Version,
+		user.CreatedAt.UnixMilli(), user.UpdatedAt.UnixMilli(), nullMillis(user.DeletedAt), nullMillis(user.ExpiresAt),
+	)
+	if err != nil {
+		return nil, r.writeError(ErrInsertingUser, user.ID, user.Email, err)
+	}
+
+	return user, nil
+}
+
+func (r *SQLiteRepo) GetUserByID(ctx context.Context, id primitive.ObjectID, opts ...ReadOption) (*User, error) {
+	if r.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	readOpts := newReadOptions(opts)
+
+	row := r.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM `+r.table+` WHERE id = ? AND `+sqliteVisible(readOpts),
+		id.Hex(), r.clock.Now().UnixMilli())
+
+	user, err := scanSQLiteUser(row, readOpts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	if err != nil {
+		return nil, r.translate(ErrFindingUser, err)
+	}
+
+	return user, nil
+}
+
+func (r *SQLiteRepo) GetUserByEmail(ctx context.Context, email string, opts ...ReadOption) (*User, error) {
+	if r.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	readOpts := newReadOptions(opts)
+
+	row := r.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM `+r.table+` WHERE email = ? AND `+sqliteVisible(readOpts),
+		email, r.clock.Now().UnixMilli())
+
+	user, err := scanSQLiteUser(row, readOpts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	}
+
+	if err != nil {
+		return nil, r.translate(ErrFindingUser, err)
+	}
+
+	return user, nil
+}
+
+// UpdateUser replaces the row of user.ID with user if it still has
+// user.Version, like MongoRepo.UpdateUser does. On success user.Version holds
+// the new version. Write options have no effect.
+func (r *SQLiteRepo) UpdateUser(ctx context.Context, user *User, _ ...WriteOption) error {
+	if r.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	if user.ID.IsZero() {
+		return fmt.Errorf("%w: id is zero", ErrInvalidUserID)
+	}
+
+	err := user.Validate()
+	if err != nil {
+		return err
+	}
+
+	user.Email, err = NormalizeEmail(user.Email)
+	if err != nil {
+		return err
+	}
+
+	user.UpdatedAt = r.timestamp()
+
+	result, err := r.db.ExecContext(ctx,
+		`UPDATE `+r.table+` SET name = ?, email = ?, password = ?, role = ?, version = version + 1,
+			updated_at = ?, deleted_at = ?, expires_at = ?
+		WHERE id = ? AND version = ?`,
+		user.Name, user.Email, user.Password, user.Role,
+		user.UpdatedAt.UnixMilli(), nullMillis(user.DeletedAt), nullMillis(user.ExpiresAt),
+		user.ID.Hex(), user.Version,
+	)
+	if err != nil {
+		return r.writeError(ErrUpdatingUser, user.ID, user.Email, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return r.translate(ErrUpdatingUser, err)
+	}
+
+	if updated == 0 {
+		return r.missOrConflict(ctx, user.ID)
+	}
+
+	user.Version++
+
+	return nil
+}
+
+func (r *SQLiteRepo) missOrConflict(ctx context.Context, id primitive.ObjectID) error {
+	var exists bool
+
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+r.table+` WHERE id = ?)`, id.Hex()).Scan(&exists)
+	if err != nil {
+		return r.translate(ErrUpdatingUser, err)
+	}
+
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return fmt.Errorf("%w: %s", ErrVersionConflict, id.Hex())
+}
+
+// DeleteUser removes the row of the user for good, soft-deleted or not.
+func (r *SQLiteRepo) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	if r.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM `+r.table+` WHERE id = ?`, id.Hex())
+	if err != nil {
+		return r.translate(ErrDeletingUser, err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return r.translate(ErrDeletingUser, err)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return nil
+}
+
+// ListUsers returns a page of users ordered on their ID, or as set by SortBy,
+// like MongoRepo.ListUsers does.
+func (r *SQLiteRepo) ListUsers(ctx context.Context, limit, offset int64, opts ...ReadOption) ([]*User, error) {
+	if r.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	readOpts := newReadOptions(opts)
+
+	order, err := sqlOrder(readOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+userColumns+` FROM `+r.table+` WHERE `+sqliteVisible(readOpts)+
+			` ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		r.clock.Now().UnixMilli(), r.pageLimit(limit), offset)
+	if err != nil {
+		return nil, r.translate(ErrListingUsers, err)
+	}
+
+	users, err := scanSQLiteUsers(rows, readOpts)
+	if err != nil {
+		return nil, r.translate(ErrListingUsers, err)
+	}
+
+	return users, nil
+}
+
+// ListUsersAfter returns the users whose ID comes after afterID, in ID order,
+// and the cursor of the next page, like MongoRepo.ListUsersAfter does.
+func (r *SQLiteRepo) ListUsersAfter(ctx context.Context, afterID primitive.ObjectID, limit int64, opts ...ReadOption) (
+	[]*User, primitive.ObjectID, error,
+) {
+	if r.closed.Load() {
+		return nil, primitive.NilObjectID, ErrRepoClosed
+	}
+
+	readOpts := newReadOptions(opts)
+	limit = r.pageLimit(limit)
+
+	// One extra row tells whether another page exists.
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+userColumns+` FROM `+r.table+` WHERE id > ? AND `+sqliteVisible(readOpts)+
+			` ORDER BY id LIMIT ?`,
+		afterID.Hex(), r.clock.Now().UnixMilli(), limit+1)
+	if err != nil {
+		return nil, primitive.NilObjectID, r.translate(ErrListingUsers, err)
+	}
+
+	users, err := scanSQLiteUsers(rows, readOpts)
+	if err != nil {
+		return nil, primitive.NilObjectID, r.translate(ErrListingUsers, err)
+	}
+
+	if int64(len(users)) <= limit {
+		return users, primitive.NilObjectID, nil
+	}
+
+	users = users[:limit]
+
+	return users, users[limit-1].ID, nil
+}
+
+func (r *SQLiteRepo) timestamp() time.Time {
+	return r.clock.Now().UTC().Truncate(time.Millisecond)
+}
+
+func (r *SQLiteRepo) pageLimit(limit int64) int64 {
+	if limit <= 0 {
+		limit = r.pageSize
+	}
+
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return limit
+}
+
+// sqliteVisible returns the condition matching the rows a read made with
+// readOpts returns, given the current time as the next parameter.
+func sqliteVisible(readOpts readOptions) string {
+	condition := "(expires_at IS NULL OR expires_at > ?)"
+	if !readOpts.includeDeleted {
+		condition += " AND deleted_at IS NULL"
+	}
+
+	return condition
+}
+
+// translate translates err, failing the operation of sentinel. A database still
+// locked by another connection once the busy timeout is over is reported as
+// ErrTemporarilyUnavailable.
+func (r *SQLiteRepo) translate(sentinel, err error) error {
+	var codeErr sqliteCodeError
+	if errors.As(err, &codeErr) {
+		switch codeErr.Code() & 0xff {
+		case sqliteBusy, sqliteLocked:
+			return driverError(sentinel, fmt.Errorf("%w: %s", ErrTemporarilyUnavailable, err))
+		}
+	}
+
+	return driverError(sentinel, err)
+}
+
+// writeError translates the error of an insert or update of the user with
+// this id and email.
+func (r *SQLiteRepo) writeError(sentinel error, id primitive.ObjectID, email string, err error) error {
+	var codeErr sqliteCodeError
+	if errors.As(err, &codeErr) {
+		switch codeErr.Code() {
+		case sqliteConstraintPrimaryKey:
+			return fmt.Errorf("%w: id %s", ErrUserAlreadyExists, id.Hex())
+		case sqliteConstraintUnique:
+			return fmt.Errorf("%w: email %s", ErrUserAlreadyExists, email)
+		}
+	}
+
+	return r.translate(sentinel, err)
+}
+
+func scanSQLiteUser(row rowScanner, readOpts readOptions) (*User, error) {
+	var (
+		user                 User
+		id                   string
+		createdAt, updatedAt int64
+		deletedAt, expiresAt sql.NullInt64
+	)
+
+	err := row.Scan(&id, &user.Name, &user.Email, &user.Password, &user.Role, &user.Version,
+		&createdAt, &updatedAt, &deletedAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	user.ID, err = primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUserID, id)
+	}
+
+	user.CreatedAt = time.UnixMilli(createdAt).UTC()
+	user.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	user.DeletedAt = millisPtr(deletedAt)
+	user.ExpiresAt = millisPtr(expiresAt)
+
+	if !readOpts.withPassword {
+		user.Password = ""
+	}
+
+	return &user, nil
+}
+
+func scanSQLiteUsers(rows *sql.Rows, readOpts readOptions) ([]*User, error) {
+	defer rows.Close()
+
+	users := make([]*User, 0)
+
+	for rows.Next() {
+		user, err := scanSQLiteUser(rows, readOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func nullMillis(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
+
+func millisPtr(ms sql.NullInt64) *time.Time {
+	if !ms.Valid {
+		return nil
+	}
+
+	t := time.UnixMilli(ms.Int64).UTC()
+
+	return &t
+}
@@ -0,0 +1,147 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// signupDays is the number of days UserStats counts the signups of, today
+// included.
+const signupDays = 30
+
+var ErrComputingStats = errors.New("error computing user stats")
+
+// Stats tells how many users a repo stores, as computed by UserStats.
+type Stats struct {
+	// Total counts every stored user, soft-deleted ones included.
+	Total int64
+	// ByRole counts the users of Total by role. Roles no user has are absent.
+	ByRole map[string]int64
+	// SoftDeleted counts the users of Total which are soft-deleted.
+	SoftDeleted int64
+	// Signups has the users created on each of the last 30 days, in UTC, the
+	// oldest first and today last. Days without signups count zero.
+	Signups []DailySignups
+}
+
+// DailySignups is the number of users created on Day, midnight UTC.
+type DailySignups struct {
+	Day   time.Time
+	Count int64
+}
+
+// statsDocument is the single document the pipeline of UserStats returns.
+// A facet matching no user is empty, $count having nothing to count.
+type statsDocument struct {
+	Total   []statsCount `bson:"total"`
+	Roles   []statsGroup `bson:"roles"`
+	Deleted []statsCount `bson:"deleted"`
+	Signups []statsGroup `bson:"signups"`
+}
+
+type statsCount struct {
+	Count int64 `bson:"count"`
+}
+
+type statsGroup struct {
+	Key   string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+// UserStats computes the number of users, by role, soft-deleted and created
+// on each of the last 30 days, in a single aggregation run by the server. An
+// empty collection gives zeroed stats.
+func (m *MongoRepo) UserStats(ctx context.Context) (_ Stats, err error) {
+	if m.closed.Load() {
+		return Stats{}, ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "UserStats", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	now := m.timestamp()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	since := today.AddDate(0, 0, 1-signupDays)
+
+	cursor, err := m.mongoCaller.Aggregate(ctx, statsPipeline(since))
+	if err != nil {
+		return Stats{}, driverError(ErrComputingStats, err)
+	}
+
+	var docs []statsDocument
+
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return Stats{}, driverError(ErrComputingStats, err)
+	}
+
+	stats := Stats{ByRole: make(map[string]int64), Signups: make([]DailySignups, 0, signupDays)}
+
+	// $facet always returns a document, but no document is no user too.
+	var doc statsDocument
+	if len(docs) > 0 {
+		doc = docs[0]
+	}
+
+	if len(doc.Total) > 0 {
+		stats.Total = doc.Total[0].Count
+	}
+
+	if len(doc.Deleted) > 0 {
+		stats.SoftDeleted = doc.Deleted[0].Count
+	}
+
+	for _, group := range doc.Roles {
+		stats.ByRole[group.Key] = group.Count
+	}
+
+	signups := make(map[string]int64, len(doc.Signups))
+	for _, group := range doc.Signups {
+		signups[group.Key] = group.Count
+	}
+
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		stats.Signups = append(stats.Signups, DailySignups{Day: day, Count: signups[day.Format(time.DateOnly)]})
+	}
+
+	return stats, nil
+}
+
+// statsPipeline computes the statsDocument of the users, with the signups
+// made since then.
+func statsPipeline(since time.Time) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{
+				bson.D{{Key: "$count", Value: "count"}},
+			}},
+			{Key: "roles", Value: bson.A{
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: "$role"},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+			}},
+			{Key: "deleted", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+				bson.D{{Key: "$count", Value: "count"}},
+			}},
+			{Key: "signups", Value: bson.A{
+				bson.D{{Key: "$match", Value: bson.D{{Key: "created_at", Value: bson.D{{Key: "$gte", Value: since}}}}}},
+				bson.D{{Key: "$group", Value: bson.D{
+					{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+						{Key: "format", Value: "%Y-%m-%d"},
+						{Key: "date", Value: "$created_at"},
+					}}}},
+					{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				}}},
+			}},
+		}}},
+	}
+}
@@ -0,0 +1,357 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxTenantIDLen bounds the tenant IDs accepted by the resolvers of this
+// file, for the names derived from them to stay within the limits of the
+// server.
+const maxTenantIDLen = 64
+
+var (
+	// ErrMissingTenant is returned by the calls made without WithTenant on a
+	// repo given WithTenantResolver.
+	ErrMissingTenant = errors.New("missing tenant")
+	// ErrInvalidTenant is returned for a tenant the TenantResolver rejected.
+	ErrInvalidTenant = errors.New("invalid tenant")
+)
+
+type tenantKey struct{}
+
+// WithTenant returns ctx telling that the calls made with it are on behalf of
+// tenantID. A repo given WithTenantResolver works on the users of that tenant
+// only.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant set with WithTenant, or an empty
+// string.
+func TenantFromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantKey{}).(string)
+	return tenantID
+}
+
+// TenantNamespace is where the users of a tenant are stored. An empty
+// Database or Collection is the one the repo was given.
+type TenantNamespace struct {
+	Database   string
+	Collection string
+}
+
+// TenantResolver returns the namespace of the users of tenantID. Its error is
+// returned wrapping ErrInvalidTenant. It is called once per tenant, the
+// collections of the tenants being kept open afterwards.
+type TenantResolver func(tenantID string) (TenantNamespace, error)
+
+// CollectionPerTenant stores the users of each tenant in the collection
+// prefix_<tenant ID> of the repo database. Tenant IDs are limited to 64
+// letters, digits, '-' and '_'.
+func CollectionPerTenant(prefix string) TenantResolver {
+	return func(tenantID string) (TenantNamespace, error) {
+		err := checkTenantID(tenantID)
+		if err != nil {
+			return TenantNamespace{}, err
+		}
+
+		return TenantNamespace{Collection: prefix + "_" + tenantID}, nil
+	}
+}
+
+// DatabasePerTenant stores the users of each tenant in the repo collection of
+// the database prefix_<tenant ID>. Tenant IDs are limited as in
+// CollectionPerTenant.
+func DatabasePerTenant(prefix string) TenantResolver {
+	return func(tenantID string) (TenantNamespace, error) {
+		err := checkTenantID(tenantID)
+		if err != nil {
+			return TenantNamespace{}, err
+		}
+
+		return TenantNamespace{Database: prefix + "_" + tenantID}, nil
+	}
+}
+
+// checkTenantID rejects the IDs which could name another namespace than the
+// tenant one, such as "x.system" or "$cmd".
+func checkTenantID(tenantID string) error {
+	if len(tenantID) > maxTenantIDLen {
+		return fmt.Errorf("longer than %d characters", maxTenantIDLen)
+	}
+
+	for _, r := range tenantID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("%q is not a letter, a digit, '-' nor '_'", r)
+		}
+	}
+
+	return nil
+}
+
+// EnsureTenantIndexes is EnsureIndexes on the collection of tenantID, to call
+// when provisioning a tenant since WithIndexCreation can't be combined with
+// WithTenantResolver. On a repo without tenants, it is EnsureIndexes.
+func (m *MongoRepo) EnsureTenantIndexes(ctx context.Context, tenantID string) error {
+	return m.EnsureIndexes(WithTenant(ctx, tenantID))
+}
+
+// useTenants makes the repo work on the collection of the tenant of each
+// call, as opened by open for its namespace.
+func (m *MongoRepo) useTenants(resolver TenantResolver, open func(ns TenantNamespace) userCollection) {
+	tenants := &tenantCollections{tenantCache: &tenantCache{
+		resolver: resolver,
+		open:     open,
+		opened:   make(map[string]userCollection),
+	}}
+
+	m.mongoCaller = tenants
+	m.indexes = tenants
+	m.watcher = tenants
+}
+
+// tenantCollections is the MongoCaller, IndexCreator and ChangeWatcher of a
+// repo given WithTenantResolver: each call goes to the collection of the
+// tenant of its context.
+type tenantCollections struct {
+	*tenantCache
+	// opts are the collection options set through Clone, applied to the
+	// collection of the tenant on each call.
+	opts []*options.CollectionOptions
+}
+
+var (
+	_ MongoCaller   = (*tenantCollections)(nil)
+	_ IndexCreator  = (*tenantCollections)(nil)
+	_ ChangeWatcher = (*tenantCollections)(nil)
+	_ callerCloner  = (*tenantCollections)(nil)
+)
+
+// tenantCache holds the collections of the tenants seen so far, for the
+// resolver to run and the handles to be made once per tenant. It is shared by
+// the clones of a tenantCollections.
+type tenantCache struct {
+	resolver TenantResolver
+	open     func(ns TenantNamespace) userCollection
+
+	mu     sync.Mutex
+	opened map[string]userCollection
+}
+
+// collection returns the collection of the tenant of ctx.
+func (t *tenantCache) collection(ctx context.Context) (userCollection, error) {
+	tenantID := TenantFromContext(ctx)
+	if tenantID == "" {
+		return userCollection{}, ErrMissingTenant
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if collection, ok := t.opened[tenantID]; ok {
+		return collection, nil
+	}
+
+	ns, err := t.resolver(tenantID)
+	if err != nil {
+		return userCollection{}, fmt.Errorf("%w %q: %w", ErrInvalidTenant, tenantID, err)
+	}
+
+	collection := t.open(ns)
+	t.opened[tenantID] = collection
+
+	return collection, nil
+}
+
+// caller returns the caller of the tenant of ctx, with the options of the
+// clone applied.
+func (t *tenantCollections) caller(ctx context.Context) (MongoCaller, error) {
+	collection, err := t.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	caller := collection.caller
+
+	for _, opts := range t.opts {
+		caller, err = cloneCaller(caller, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return caller, nil
+}
+
+func (t *tenantCollections) Clone(opts ...*options.CollectionOptions) (MongoCaller, error) {
+	return &tenantCollections{tenantCache: t.tenantCache, opts: append(slices.Clone(t.opts), opts...)}, nil
+}
+
+func (t *tenantCollections) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+	*mongo.InsertOneResult, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.InsertOne(ctx, document, opts...)
+}
+
+func (t *tenantCollections) InsertMany(
+	ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions,
+) (*mongo.InsertManyResult, error) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.InsertMany(ctx, documents, opts...)
+}
+
+func (t *tenantCollections) FindOne(
+	ctx context.Context, filter interface{}, opts ...*options.FindOneOptions,
+) *mongo.SingleResult {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	return caller.FindOne(ctx, filter, opts...)
+}
+
+func (t *tenantCollections) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (
+	*mongo.Cursor, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.Find(ctx, filter, opts...)
+}
+
+func (t *tenantCollections) UpdateOne(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions,
+) (*mongo.UpdateResult, error) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.UpdateOne(ctx, filter, update, opts...)
+}
+
+func (t *tenantCollections) FindOneAndUpdate(
+	ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions,
+) *mongo.SingleResult {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return singleResultError(err)
+	}
+
+	return caller.FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+func (t *tenantCollections) ReplaceOne(
+	ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions,
+) (*mongo.UpdateResult, error) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (t *tenantCollections) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.DeleteOne(ctx, filter, opts...)
+}
+
+func (t *tenantCollections) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (
+	*mongo.DeleteResult, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.DeleteMany(ctx, filter, opts...)
+}
+
+func (t *tenantCollections) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (
+	int64, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return caller.CountDocuments(ctx, filter, opts...)
+}
+
+func (t *tenantCollections) Distinct(
+	ctx context.Context, fieldName string, filter interface{}, opts ...*options.DistinctOptions,
+) ([]interface{}, error) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.Distinct(ctx, fieldName, filter, opts...)
+}
+
+func (t *tenantCollections) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (
+	*mongo.Cursor, error,
+) {
+	caller, err := t.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return caller.Aggregate(ctx, pipeline, opts...)
+}
+
+func (t *tenantCollections) CreateMany(
+	ctx context.Context, models []mongo.IndexModel, opts ...*options.CreateIndexesOptions,
+) ([]string, error) {
+	collection, err := t.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if collection.indexes == nil {
+		return nil, errors.New("no index view to create them with")
+	}
+
+	return collection.indexes.CreateMany(ctx, models, opts...)
+}
+
+func (t *tenantCollections) WatchChanges(
+	ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions,
+) (ChangeStream, error) {
+	collection, err := t.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if collection.watcher == nil {
+		return nil, errors.New("the collection has no change streams")
+	}
+
+	return collection.watcher.WatchChanges(ctx, pipeline, opts...)
+}
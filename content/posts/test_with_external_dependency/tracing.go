@@ -0,0 +1,64 @@
+package users
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the repo spans.
+const tracerName = "github.com/tclaudel/blog-tclaudel/userrepo"
+
+// spanOperations maps the repo methods to the database operation they make,
+// which names their span.
+var spanOperations = map[string]string{
+	"EnsureIndexes":             "createIndexes",
+	"CreateUser":                "insert",
+	"CreateUsers":               "insert",
+	"GetUserByID":               "find",
+	"GetUsersByIDs":             "find",
+	"GetUserByEmail":            "find",
+	"UpdateUser":                "update",
+	"DeleteUser":                "delete",
+	"DeleteUsersMatching":       "delete",
+	"ListUsers":                 "find",
+	"ListUsersByRole":           "find",
+	"CountUsers":                "count",
+	"CountUsersMatching":        "count",
+	"FindUsers":                 "find",
+	"IterateUsers":              "find",
+	"UpsertUser":                "update",
+	"UpdateUserFields":          "update",
+	"UpdateUserFieldsAtVersion": "update",
+	"SoftDeleteUser":            "update",
+	"RestoreUser":               "update",
+	"UserExistsByEmail":         "count",
+	"ListUsersAfter":            "find",
+	"SearchUsersByName":         "find",
+	"ChangeUserEmail":           "update",
+	"DistinctEmails":            "distinct",
+	"PromoteUser":               "update",
+	"UserStats":                 "aggregate",
+	"StartEmailVerification":    "find",
+	"ConfirmEmailVerification":  "update",
+}
+
+// startSpan starts the client span of the repo method op, named like
+// mongo.users.insert.
+func (m *MongoRepo) startSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	operation, ok := spanOperations[op]
+	if !ok {
+		operation = op
+	}
+
+	return m.tracer.Start(ctx, "mongo."+m.collection+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.mongodb.collection", m.collection),
+			attribute.String("code.function", op),
+		),
+	)
+}
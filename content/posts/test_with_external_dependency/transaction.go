@@ -0,0 +1,88 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// codeIllegalOperation is the server error code of a transaction started on
+// a standalone server.
+const codeIllegalOperation = 20
+
+var ErrTransactionsUnsupported = errors.New("transactions not supported")
+
+// SessionStarter starts the sessions WithTransaction runs in. *mongo.Client
+// implements it, as does the MongoCaller of a repo built with
+// NewMongoRepoFromCollection when it can run transactions.
+type SessionStarter interface {
+	StartSession(opts ...*options.SessionOptions) (mongo.Session, error)
+}
+
+var _ SessionStarter = (*mongo.Client)(nil)
+
+// WithTransaction runs fn in a transaction, committed if fn returns nil and
+// aborted if it fails or panics, the panic going on once aborted. The repo
+// calls fn makes with the context it is given, on this repo or another one
+// sharing the client, are part of the transaction; they aren't retried one by
+// one, the driver running fn again instead on a transient error, so fn must be
+// safe to run again.
+//
+// Called with the context of a transaction, WithTransaction just runs fn in
+// it. Transactions need a replica set or a sharded cluster: on a standalone
+// server, or a repo without a client, it fails with
+// ErrTransactionsUnsupported.
+func (m *MongoRepo) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	if m.sessions == nil {
+		return fmt.Errorf("%w: the repo has no client", ErrTransactionsUnsupported)
+	}
+
+	ctx, call := m.begin(ctx, "WithTransaction", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	session, err := m.sessions.StartSession()
+	if err != nil {
+		return driverError(ErrTransactionsUnsupported, err)
+	}
+
+	defer session.EndSession(context.Background())
+
+	defer func() {
+		if r := recover(); r != nil {
+			// The driver only aborts when fn returns an error.
+			_ = session.AbortTransaction(context.Background())
+			panic(r)
+		}
+	}()
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	if isStandaloneError(err) {
+		return fmt.Errorf("%w: %w", ErrTransactionsUnsupported, err)
+	}
+
+	return err
+}
+
+// isStandaloneError reports whether err is the failure of a transaction run on
+// a standalone server.
+func isStandaloneError(err error) bool {
+	var serverErr mongo.ServerError
+
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(codeIllegalOperation) &&
+		strings.Contains(err.Error(), "Transaction numbers")
+}
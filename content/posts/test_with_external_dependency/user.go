@@ -0,0 +1,331 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	minPasswordLength = 8
+	// maxPasswordLength is the most bcrypt hashes.
+	maxPasswordLength = 72
+	maxNameLength     = 256
+)
+
+// Roles a user can have. CreateUser defaults to RoleMember.
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+)
+
+// redactedPassword stands for the password of a user when it is printed.
+const redactedPassword = "[REDACTED]"
+
+// User is the domain user. How it is stored is up to the repository, see
+// userDocument for Mongo.
+//
+// Printed, logged or marshaled to JSON, a user never shows its password and
+// only the first character of its email, so that one dropped into a log line
+// or an error message doesn't leak them. The repositories store users through
+// their own types, userDocument and userRecord, which keep the hash.
+type User struct {
+	ID   primitive.ObjectID
+	Name string
+	// Email is lowercased before being stored.
+	Email string
+	// Password is the plain password when creating or updating a user and its
+	// bcrypt hash once stored. Reads leave it empty unless made WithPassword.
+	Password string
+	Role     string
+	// Version is incremented on every update and used to detect concurrent
+	// modifications. New users start at 1.
+	Version int64
+	// CreatedAt and UpdatedAt are managed by MongoRepo. Users written before
+	// they existed have zero values.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt is set once the user has been soft-deleted.
+	DeletedAt *time.Time
+	// ExpiresAt is set on provisional users, which are purged once it is past
+	// unless promoted first.
+	ExpiresAt *time.Time
+	// EmailVerified is set by ConfirmEmailVerification, and cleared when
+	// ChangeUserEmail gives the user another email.
+	EmailVerified bool
+
+	// idempotencyKey is the key of the CreateUserIdempotent call which created
+	// the user, held until idempotencyExpiresAt. They are kept on the User so
+	// that UpdateUser writes them back.
+	idempotencyKey       string
+	idempotencyExpiresAt *time.Time
+
+	// checked holds the fields as NewUser validated them, nil for a user built
+	// otherwise. CreateUser only trusts them while they are unchanged.
+	checked *checkedFields
+}
+
+type checkedFields struct {
+	name, email, password, role string
+}
+
+// UserOption configures the user built by NewUser.
+type UserOption func(*userOptions)
+
+type userOptions struct {
+	role      string
+	ttl       *time.Duration
+	expiresAt *time.Time
+}
+
+// WithRole gives the user role instead of RoleMember.
+func WithRole(role string) UserOption {
+	return func(o *userOptions) {
+		o.role = role
+	}
+}
+
+// Provisional makes the user provisional, expiring ttl after NewUser is
+// called. See CreateProvisionalUser.
+func Provisional(ttl time.Duration) UserOption {
+	return func(o *userOptions) {
+		o.ttl = &ttl
+		o.expiresAt = nil
+	}
+}
+
+// WithExpiry makes the user provisional, expiring at expiresAt.
+func WithExpiry(expiresAt time.Time) UserOption {
+	return func(o *userOptions) {
+		o.expiresAt = &expiresAt
+		o.ttl = nil
+	}
+}
+
+// NewUser returns a user ready for CreateUser, which doesn't check it again:
+// its fields are validated as Validate does, its email normalized and its role
+// RoleMember unless opts say otherwise. The ID, version and timestamps are left
+// for the repository to set. Every problem found is listed in the returned
+// error, which wraps ErrInvalidUser.
+//
+// The password policy of the repository, if any, is still applied by
+// CreateUser, as are the checks of the fields changed after NewUser returned.
+func NewUser(name, email, password string, opts ...UserOption) (*User, error) {
+	var userOpts userOptions
+	for _, opt := range opts {
+		opt(&userOpts)
+	}
+
+	user := &User{Name: name, Email: email, Password: password, Role: userOpts.role}
+	problems := user.problems()
+
+	now := time.Now()
+
+	switch {
+	case userOpts.ttl != nil && *userOpts.ttl <= 0:
+		problems = append(problems, fmt.Sprintf("ttl must be positive, got %s", *userOpts.ttl))
+	case userOpts.ttl != nil:
+		expiresAt := now.Add(*userOpts.ttl)
+		user.ExpiresAt = &expiresAt
+	case userOpts.expiresAt != nil && !userOpts.expiresAt.After(now):
+		problems = append(problems, fmt.Sprintf("expiry %s is not in the future", userOpts.expiresAt))
+	case userOpts.expiresAt != nil:
+		expiresAt := *userOpts.expiresAt
+		user.ExpiresAt = &expiresAt
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUser, strings.Join(problems, "; "))
+	}
+
+	// Validated above, the email can't fail to normalize.
+	user.Email, _ = NormalizeEmail(user.Email)
+
+	if user.Role == "" {
+		user.Role = RoleMember
+	}
+
+	user.checked = &checkedFields{name: user.Name, email: user.Email, password: user.Password, role: user.Role}
+
+	return user, nil
+}
+
+// trusted tells whether the user was built by NewUser and its checked fields
+// haven't changed since.
+func (u *User) trusted() bool {
+	return u.checked != nil &&
+		*u.checked == checkedFields{name: u.Name, email: u.Email, password: u.Password, role: u.Role}
+}
+
+// String renders every field of the user like %+v would, with the password
+// redacted and the email masked.
+func (u User) String() string {
+	var password string
+	if u.Password != "" {
+		password = redactedPassword
+	}
+
+	return fmt.Sprintf("{ID:%s Name:%s Email:%s Password:%s Role:%s Version:%d CreatedAt:%s UpdatedAt:%s "+
+		"DeletedAt:%s ExpiresAt:%s EmailVerified:%t}",
+		u.ID.Hex(), u.Name, maskEmail(u.Email), password, u.Role, u.Version, u.CreatedAt, u.UpdatedAt,
+		optionalTime(u.DeletedAt), optionalTime(u.ExpiresAt), u.EmailVerified)
+}
+
+// GoString makes %#v print what String does.
+func (u User) GoString() string {
+	return "User" + u.String()
+}
+
+// LogValue logs the user as a group with the password redacted and the email
+// masked. The unset optional fields are left out.
+func (u User) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("id", u.ID.Hex()),
+		slog.String("name", u.Name),
+		slog.String("email", maskEmail(u.Email)),
+	}
+
+	if u.Password != "" {
+		attrs = append(attrs, slog.String("password", redactedPassword))
+	}
+
+	attrs = append(attrs, slog.String("role", u.Role), slog.Int64("version", u.Version))
+
+	for _, t := range []struct {
+		key  string
+		time *time.Time
+	}{
+		{"created_at", &u.CreatedAt},
+		{"updated_at", &u.UpdatedAt},
+		{"deleted_at", u.DeletedAt},
+		{"expires_at", u.ExpiresAt},
+	} {
+		if t.time != nil && !t.time.IsZero() {
+			attrs = append(attrs, slog.Time(t.key, *t.time))
+		}
+	}
+
+	if u.EmailVerified {
+		attrs = append(attrs, slog.Bool("email_verified", true))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// MarshalJSON marshals the user without its password, the other fields
+// keeping their names as json.Marshal would give them.
+func (u User) MarshalJSON() ([]byte, error) {
+	// user has the fields of User without its methods, of which MarshalJSON
+	// would recurse. The empty Password shadows the one of user.
+	type user User
+
+	return json.Marshal(struct {
+		user
+		Password string `json:",omitempty"`
+	}{user: user(u)})
+}
+
+// maskEmail keeps the first character of the local part of email and its
+// domain, such as j***@example.com.
+func maskEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+
+	first, _ := utf8.DecodeRuneInString(local)
+
+	return string(first) + "***@" + domain
+}
+
+// optionalTime renders t as %v would print a *time.Time, but with its value.
+func optionalTime(t *time.Time) string {
+	if t == nil {
+		return "<nil>"
+	}
+
+	return t.String()
+}
+
+// Validate checks the user can be stored. The returned error wraps
+// ErrInvalidUser and lists every problem found, not only the first one.
+func (u *User) Validate() error {
+	problems := u.problems()
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidUser, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// problems lists what Validate finds wrong with the user.
+func (u *User) problems() []string {
+	var problems []string
+
+	for _, field := range []struct{ key, value string }{
+		{"name", u.Name},
+		{"email", u.Email},
+		{"password", u.Password},
+		{"role", u.Role},
+	} {
+		if problem := validateField(field.key, field.value); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// validateField returns what is wrong with value for the bson key, or an empty
+// string when it is valid.
+func validateField(key, value string) string {
+	switch key {
+	case "name":
+		switch {
+		case strings.TrimSpace(value) == "":
+			return "name is empty"
+		case len(value) > maxNameLength:
+			return fmt.Sprintf("name is longer than %d bytes", maxNameLength)
+		case !utf8.ValidString(value) || strings.IndexFunc(value, unicode.IsControl) >= 0:
+			return "name has invalid characters"
+		}
+	case "email":
+		if _, err := NormalizeEmail(value); err != nil {
+			return fmt.Sprintf("email %q is not valid", value)
+		}
+	case "password":
+		switch {
+		case len(value) < minPasswordLength:
+			return fmt.Sprintf("password must be at least %d characters", minPasswordLength)
+		case len(value) > maxPasswordLength:
+			return fmt.Sprintf("password must be at most %d bytes", maxPasswordLength)
+		}
+	case "role":
+		// An empty role is filled in with the default.
+		if value != "" && !validRole(value) {
+			return fmt.Sprintf("role %q is not valid", value)
+		}
+	}
+
+	return ""
+}
+
+func validRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleMember, RoleGuest:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,291 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TokenCollection is the collection of the users database the verification
+// tokens are stored in.
+const TokenCollection = "user_tokens"
+
+const (
+	defaultVerificationTokenTTL = 24 * time.Hour
+	// verificationTokenSize is the number of random bytes of a token.
+	verificationTokenSize = 32
+	// emailVerificationPurpose tells the tokens of StartEmailVerification
+	// apart from the ones other workflows would store in TokenCollection.
+	emailVerificationPurpose = "email_verification"
+)
+
+var (
+	ErrStartingVerification = errors.New("error starting email verification")
+	ErrVerifyingEmail       = errors.New("error verifying email")
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+	// ErrTokenInvalid is returned for a token which wasn't issued, was already
+	// used or was replaced by a newer one.
+	ErrTokenInvalid = errors.New("invalid token")
+	// ErrTokenExpired is returned for a token used after its expiry.
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// TokenCaller is the part of *mongo.Collection the verification tokens are
+// stored with.
+type TokenCaller interface {
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+		*mongo.InsertOneResult, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndDelete(ctx context.Context, filter interface{}, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+}
+
+var _ TokenCaller = (*mongo.Collection)(nil)
+
+// tokenDocument is how a token is stored: under its SHA-256, so that reading
+// the collection gives no token away. The collection is shared by the tenants,
+// Tenant being the one the token was issued under, if any. Email, or EmailHash
+// with WithFieldEncryption, is the email of the user the token confirms, for
+// it not to verify an email set since.
+type tokenDocument struct {
+	ID        string             `bson:"_id"`
+	Purpose   string             `bson:"purpose"`
+	Tenant    string             `bson:"tenant,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Email     string             `bson:"email,omitempty"`
+	EmailHash string             `bson:"email_hash,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// tokenIndexModels are the indexes EnsureIndexes creates on TokenCollection.
+func tokenIndexModels() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			// The server purges the tokens nobody confirmed once expired.
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_1").SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("user_id_1"),
+		},
+	}
+}
+
+// tenantFilter returns filter restricted to the documents of the tenant of
+// ctx, in the collections the tenants share: for a token issued under a tenant
+// not to be used, nor burnt, under another, and for an audit entry not to be
+// listed under another.
+func tenantFilter(ctx context.Context, filter bson.M) bson.M {
+	tenantID := TenantFromContext(ctx)
+	if tenantID == "" {
+		filter["tenant"] = bson.M{"$exists": false}
+	} else {
+		filter["tenant"] = tenantID
+	}
+
+	return filter
+}
+
+// revokeVerificationTokens deletes the email verification tokens of the user
+// with this id, the email they confirm being about to change.
+func (m *MongoRepo) revokeVerificationTokens(ctx context.Context, id primitive.ObjectID) error {
+	if m.tokens == nil {
+		return nil
+	}
+
+	_, err := m.tokens.DeleteMany(ctx, tenantFilter(ctx, bson.M{"user_id": id, "purpose": emailVerificationPurpose}))
+
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartEmailVerification issues the token confirming the email of the user
+// with this id, to send to that email. The token is only ever returned here,
+// the repo keeping its hash, and expires after the TTL set with
+// WithVerificationTokenTTL. Starting again replaces the previous token, and so
+// does changing the email with ChangeUserEmail or UpdateUserFields. It fails
+// with ErrUserNotFound for a missing or soft-deleted user and with
+// ErrEmailAlreadyVerified once the email is verified.
+func (m *MongoRepo) StartEmailVerification(ctx context.Context, id primitive.ObjectID) (_ string, err error) {
+	if m.closed.Load() {
+		return "", ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "StartEmailVerification", id)
+	defer m.end(ctx, &call, &err)
+
+	if m.tokens == nil {
+		return "", fmt.Errorf("%w: the repo has no token collection", ErrStartingVerification)
+	}
+
+	var doc userDocument
+
+	err = m.mongoCaller.FindOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}},
+		options.FindOne().SetProjection(bson.M{"email": 1, "email_hash": 1, "email_verified": 1})).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	if err != nil {
+		return "", driverError(ErrStartingVerification, err)
+	}
+
+	if doc.EmailVerified {
+		return "", fmt.Errorf("%w: %s", ErrEmailAlreadyVerified, id.Hex())
+	}
+
+	raw := make([]byte, verificationTokenSize)
+
+	_, err = rand.Read(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrStartingVerification, err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	err = m.revokeVerificationTokens(ctx, id)
+	if err != nil {
+		return "", driverError(ErrStartingVerification, err)
+	}
+
+	ttl := m.verificationTokenTTL
+	if ttl == 0 {
+		ttl = defaultVerificationTokenTTL
+	}
+
+	now := m.timestamp()
+	issued := &tokenDocument{
+		ID:        hashToken(token),
+		Purpose:   emailVerificationPurpose,
+		Tenant:    TenantFromContext(ctx),
+		UserID:    id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	// The encrypted email changes with every write, its hash doesn't.
+	if m.fields != nil {
+		issued.EmailHash = doc.EmailHash
+	} else {
+		issued.Email = doc.Email
+	}
+
+	_, err = m.tokens.InsertOne(ctx, issued)
+	if err != nil {
+		return "", driverError(ErrStartingVerification, err)
+	}
+
+	return token, nil
+}
+
+// ConfirmEmailVerification marks verified the email of the user token was
+// issued for by StartEmailVerification. The token is deleted once the email is
+// verified, so it confirms once while a confirm which failed can be retried:
+// using it again, or under another tenant than the one it was issued under,
+// fails with ErrTokenInvalid, as does a token of a user whose
+// email changed since. A token past its expiry, by the repo clock, fails with
+// ErrTokenExpired, and one of a user deleted since with ErrUserNotFound.
+func (m *MongoRepo) ConfirmEmailVerification(ctx context.Context, token string) (err error) {
+	if m.closed.Load() {
+		return ErrRepoClosed
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	ctx, call := m.begin(ctx, "ConfirmEmailVerification", primitive.NilObjectID)
+	defer m.end(ctx, &call, &err)
+
+	if m.tokens == nil {
+		return fmt.Errorf("%w: the repo has no token collection", ErrVerifyingEmail)
+	}
+
+	if token == "" {
+		return fmt.Errorf("%w: token is empty", ErrTokenInvalid)
+	}
+
+	var doc tokenDocument
+
+	byHash := tenantFilter(ctx, bson.M{"_id": hashToken(token), "purpose": emailVerificationPurpose})
+
+	err = m.tokens.FindOne(ctx, byHash).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrTokenInvalid
+	}
+
+	if err != nil {
+		return driverError(ErrVerifyingEmail, err)
+	}
+
+	call.userID = doc.UserID
+
+	if !m.timestamp().Before(doc.ExpiresAt) {
+		return fmt.Errorf("%w: at %s", ErrTokenExpired, doc.ExpiresAt.Format(time.RFC3339))
+	}
+
+	filter := bson.M{"_id": doc.UserID, "deleted_at": bson.M{"$exists": false}}
+	if doc.EmailHash != "" {
+		filter["email_hash"] = doc.EmailHash
+	} else {
+		filter["email"] = doc.Email
+	}
+
+	before, err := m.snapshot(ctx, "ConfirmEmailVerification", filter)
+	if err != nil {
+		return err
+	}
+
+	result, err := m.mongoCaller.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{"email_verified": true, "updated_at": m.timestamp()},
+		"$inc": bson.M{"version": 1},
+	})
+	if err != nil {
+		return translateWriteError(ErrVerifyingEmail, err)
+	}
+
+	if result.MatchedCount == 0 {
+		return m.unverifiable(ctx, doc.UserID)
+	}
+
+	// Deleted only now, for a failed update not to burn the token. A confirm
+	// racing this one finds it gone, and verifies the email again, harmlessly.
+	err = m.tokens.FindOneAndDelete(ctx, byHash).Err()
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return driverError(ErrVerifyingEmail, err)
+	}
+
+	return m.publishAudited(ctx, m.audit(ctx, "ConfirmEmailVerification", bson.M{"_id": doc.UserID}, before),
+		EventUserUpdated, doc.UserID, "")
+}
+
+// unverifiable explains why the user a token was issued for matched nothing:
+// either the user is gone or its email isn't the one the token confirms.
+func (m *MongoRepo) unverifiable(ctx context.Context, id primitive.ObjectID) error {
+	count, err := m.mongoCaller.CountDocuments(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}})
+	if err != nil {
+		return driverError(ErrVerifyingEmail, err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id.Hex())
+	}
+
+	return fmt.Errorf("%w: the email of %s changed", ErrTokenInvalid, id.Hex())
+}
@@ -0,0 +1,211 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrWatchingUsers = errors.New("error watching users")
+
+// ChangeOperation is the kind of write a UserChange reports.
+type ChangeOperation string
+
+const (
+	ChangeInsert  ChangeOperation = "insert"
+	ChangeUpdate  ChangeOperation = "update"
+	ChangeReplace ChangeOperation = "replace"
+	ChangeDelete  ChangeOperation = "delete"
+)
+
+// UserChange is a write to the users collection seen by WatchUsers, or the
+// failure ending the watch when Err is set, in which case it is the last
+// value received.
+type UserChange struct {
+	Operation ChangeOperation
+	// UserID is the ID of the user written.
+	UserID primitive.ObjectID
+	// User is the user as stored after the write, without its password. It is
+	// nil for deletes, and for updates when the user was deleted before the
+	// change was read.
+	User *User
+	// ResumeToken is what WatchUsersFrom takes to resume the watch after this
+	// change.
+	ResumeToken bson.Raw
+	Err         error
+}
+
+// ChangeStream is the part of *mongo.ChangeStream read by WatchUsers.
+type ChangeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// ChangeWatcher opens the change streams of the users collection. A
+// MongoCaller implementing it, like a test fake, is what the repo of
+// NewMongoRepoFromCollection watches.
+type ChangeWatcher interface {
+	WatchChanges(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (
+		ChangeStream, error)
+}
+
+// collectionWatcher is the ChangeWatcher of a *mongo.Collection.
+type collectionWatcher struct {
+	collection *mongo.Collection
+}
+
+func (w collectionWatcher) WatchChanges(
+	ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions,
+) (ChangeStream, error) {
+	stream, err := w.collection.Watch(ctx, pipeline, opts...)
+	if err != nil {
+		// A nil *mongo.ChangeStream would make a non-nil ChangeStream.
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// changeEvent is the part of a change stream event read by WatchUsers.
+type changeEvent struct {
+	// ID is the resume token of the event.
+	ID            bson.Raw      `bson:"_id"`
+	OperationType string        `bson:"operationType"`
+	FullDocument  *userDocument `bson:"fullDocument"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// watchPipeline keeps the writes to users and leaves the password hashes on
+// the server.
+var watchPipeline = mongo.Pipeline{
+	{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{
+		string(ChangeInsert), string(ChangeUpdate), string(ChangeReplace), string(ChangeDelete),
+	}}}}},
+	{{Key: "$project", Value: bson.M{"fullDocument.password": 0}}},
+}
+
+// WatchUsers returns the writes made to the users from now on, read from a
+// change stream of the collection, which needs a replica set. The channel is
+// closed once ctx is done, or after a last UserChange carrying the error which
+// ended the stream; a watch can then go on from the ResumeToken of the last
+// change received with WatchUsersFrom.
+func (m *MongoRepo) WatchUsers(ctx context.Context) (<-chan UserChange, error) {
+	return m.watchUsers(ctx, "WatchUsers", options.ChangeStream())
+}
+
+// WatchUsersFrom is WatchUsers starting after the change whose ResumeToken is
+// token, provided the oplog still holds it.
+func (m *MongoRepo) WatchUsersFrom(ctx context.Context, token bson.Raw) (<-chan UserChange, error) {
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%w: empty resume token", ErrWatchingUsers)
+	}
+
+	return m.watchUsers(ctx, "WatchUsersFrom", options.ChangeStream().SetResumeAfter(token))
+}
+
+// watchUsers opens the stream of the method op with opts and reads it into
+// the returned channel until ctx is done or the stream fails.
+func (m *MongoRepo) watchUsers(ctx context.Context, op string, opts *options.ChangeStreamOptions) (
+	_ <-chan UserChange, err error,
+) {
+	if m.closed.Load() {
+		return nil, ErrRepoClosed
+	}
+
+	if m.watcher == nil {
+		return nil, fmt.Errorf("%w: the collection has no change streams", ErrWatchingUsers)
+	}
+
+	openCtx, call := m.begin(ctx, op, primitive.NilObjectID)
+	defer m.end(openCtx, &call, &err)
+
+	opts.SetFullDocument(options.UpdateLookup)
+
+	stream, err := m.watcher.WatchChanges(openCtx, watchPipeline, opts)
+	if err != nil {
+		return nil, driverError(ErrWatchingUsers, err)
+	}
+
+	changes := make(chan UserChange)
+
+	go func() {
+		defer close(changes)
+		defer stream.Close(context.Background())
+
+		for {
+			change, err := m.nextChange(ctx, stream)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				change = UserChange{Err: err}
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// nextChange waits for the next write to users on stream. A user whose email
+// can't be decrypted ends the watch with ErrCorruptField, as the ones after it
+// can't be either.
+func (m *MongoRepo) nextChange(ctx context.Context, stream ChangeStream) (UserChange, error) {
+	for stream.Next(ctx) {
+		var event changeEvent
+
+		err := stream.Decode(&event)
+		if err != nil {
+			return UserChange{}, driverError(ErrWatchingUsers, err)
+		}
+
+		change := UserChange{
+			Operation:   ChangeOperation(event.OperationType),
+			UserID:      event.DocumentKey.ID,
+			ResumeToken: event.ID,
+		}
+
+		switch change.Operation {
+		case ChangeInsert, ChangeUpdate, ChangeReplace:
+			if event.FullDocument != nil {
+				change.User, err = m.decode(event.FullDocument)
+				if err != nil {
+					return UserChange{}, fmt.Errorf("%w: %w", ErrWatchingUsers, err)
+				}
+			}
+		case ChangeDelete:
+		default:
+			// The collection was dropped or renamed, which invalidates the
+			// stream after this event.
+			continue
+		}
+
+		return change, nil
+	}
+
+	err := stream.Err()
+	if err == nil {
+		err = errors.New("change stream closed")
+	}
+
+	return UserChange{}, driverError(ErrWatchingUsers, err)
+}